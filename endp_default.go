@@ -10,6 +10,8 @@ type DefaultEndPointData struct {
 	data                  interface{}
 	hasDestinationSession bool
 	destinationSession    int
+	// passed to the data processors as the options of context
+	options map[string]interface{}
 }
 
 // NewEndPointData ...
@@ -67,6 +69,39 @@ func (epd *DefaultEndPointData) ClearDestinationSession() EndPointData {
 	return epd
 }
 
+// newEndPointDataWithOptions returns the endpoint data carrying options
+func newEndPointDataWithOptions(options map[string]interface{}) EndPointData {
+	epd := NewEndPointData().(*DefaultEndPointData)
+	epd.options = options
+	return epd
+}
+
+// endPointDataOption returns the option of epd, nil if epd does not
+// carry options
+func endPointDataOption(epd EndPointData, name string) interface{} {
+	if o, ok := epd.(EndPointDataOptions); ok {
+		return o.GetOption(name)
+	}
+	return nil
+}
+
+// SetOption ...
+func (epd *DefaultEndPointData) SetOption(name string, value interface{}) EndPointData {
+	if epd.options == nil {
+		epd.options = make(map[string]interface{})
+	}
+	epd.options[name] = value
+	return epd
+}
+
+// GetOption ...
+func (epd *DefaultEndPointData) GetOption(name string) interface{} {
+	if value, ok := epd.options[name]; ok {
+		return value
+	}
+	return nil
+}
+
 // DefaultEndPoint ...
 type DefaultEndPoint struct {
 	name          string
@@ -154,6 +189,13 @@ func (ep *DefaultEndPoint) GetRxChannel() chan EndPointData {
 
 // OnEvent ...
 func (ep *DefaultEndPoint) OnEvent(event Event) {
+	// only the errors of the data sent by itself
+	if perr, ok := event.Data.(*ProcessingError); ok {
+		if perr.EndPoint != nil && perr.EndPoint != EndPoint(ep) {
+			return
+		}
+	}
+
 	if ep.eventListener != nil {
 		ep.eventListener(ep, event)
 	}
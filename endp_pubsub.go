@@ -0,0 +1,148 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"sync"
+)
+
+// TopicHandler handles a message published to topic
+type TopicHandler func(connection TransportConnection, topic string, message interface{})
+
+// PubSubEndPoint subscribes and publishes the topics on the connection
+// to a Broker, the stack should have a PubSub below the codec. The rx
+// channel must not be read by others. It is closed by the stack when it
+// is deleted or the stack is stopped.
+type PubSubEndPoint struct {
+	EndPoint
+	sync.Mutex
+	handlers map[string]TopicHandler
+	quit     chan struct{}
+	once     sync.Once
+}
+
+// NewPubSubEndPoint ...
+func NewPubSubEndPoint(name string, session int) *PubSubEndPoint {
+	p := &PubSubEndPoint{
+		EndPoint: NewEndPoint(name, session),
+		handlers: make(map[string]TopicHandler),
+		quit:     make(chan struct{}),
+	}
+
+	go p.dispatch()
+
+	return p
+}
+
+// SetName ...
+func (p *PubSubEndPoint) SetName(name string) EndPoint {
+	p.EndPoint.SetName(name)
+	return p
+}
+
+// SetSession ...
+func (p *PubSubEndPoint) SetSession(session int) EndPoint {
+	p.EndPoint.SetSession(session)
+	return p
+}
+
+// send ...
+func (p *PubSubEndPoint) send(epd EndPointData) error {
+	select {
+	case p.GetTxChannel() <- epd:
+		return nil
+	case <-p.quit:
+		return ErrEndPointClosed
+	}
+}
+
+// Subscribe asks the broker for the messages of pattern, handler is
+// called with the matched messages in order. The handler of the same
+// pattern is replaced.
+func (p *PubSubEndPoint) Subscribe(connection TransportConnection, pattern string, handler TopicHandler) error {
+	if connection == nil {
+		return ErrNoConnection
+	}
+	if err := ValidatePattern(pattern); err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.handlers[pattern] = handler
+	p.Unlock()
+
+	return p.send(newEndPointDataWithOptions(map[string]interface{}{
+		"pubsubKind": PubSubKindSubscribe,
+		"topic":      pattern,
+		"noPayload":  true,
+	}).SetConnection(connection))
+}
+
+// Unsubscribe ...
+func (p *PubSubEndPoint) Unsubscribe(connection TransportConnection, pattern string) error {
+	if connection == nil {
+		return ErrNoConnection
+	}
+
+	p.Lock()
+	delete(p.handlers, pattern)
+	p.Unlock()
+
+	return p.send(newEndPointDataWithOptions(map[string]interface{}{
+		"pubsubKind": PubSubKindUnsubscribe,
+		"topic":      pattern,
+		"noPayload":  true,
+	}).SetConnection(connection))
+}
+
+// Publish sends message to the subscribers of topic through the broker
+func (p *PubSubEndPoint) Publish(connection TransportConnection, topic string, message interface{}) error {
+	if connection == nil {
+		return ErrNoConnection
+	}
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	return p.send(newEndPointDataWithOptions(map[string]interface{}{
+		"pubsubKind": PubSubKindPublish,
+		"topic":      topic,
+	}).
+		SetConnection(connection).
+		SetData(message))
+}
+
+// dispatch reads the rx channel until the endpoint is closed
+func (p *PubSubEndPoint) dispatch() {
+	rx := p.GetRxChannel()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case epd := <-rx:
+			topic, _ := OptionParseString(endPointDataOption(epd, "topic"), "")
+
+			var handlers []TopicHandler
+			p.Lock()
+			for pattern, handler := range p.handlers {
+				if TopicMatch(pattern, topic) {
+					handlers = append(handlers, handler)
+				}
+			}
+			p.Unlock()
+
+			for _, handler := range handlers {
+				handler(epd.GetConnection(), topic, epd.GetData())
+			}
+		}
+	}
+}
+
+// Close stops dispatching, it is called by the stack
+func (p *PubSubEndPoint) Close() {
+	p.once.Do(func() {
+		close(p.quit)
+	})
+}
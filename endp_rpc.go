@@ -0,0 +1,404 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the errors of RPCEndPoint calls
+var (
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrEndPointClosed   = errors.New("endpoint closed")
+	ErrNoHandler        = errors.New("no handler")
+	ErrServerBusy       = errors.New("server busy")
+)
+
+// RPCDefaultMaxConcurrency is the requests served at the same time by
+// default
+const RPCDefaultMaxConcurrency int = 64
+
+// RPCError is the error returned by the handler of the remote side
+type RPCError struct {
+	Message string
+}
+
+// Error ...
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCHandler serves a request, the reply is sent back to the caller, or
+// the error as *RPCError if it is not nil
+type RPCHandler func(connection TransportConnection, request interface{}) (reply interface{}, err error)
+
+// rpcResult ...
+type rpcResult struct {
+	reply interface{}
+	err   error
+}
+
+// rpcCall is an in-flight call
+type rpcCall struct {
+	connection TransportConnection
+	result     chan rpcResult
+}
+
+// RPCEndPoint is an endpoint with request/response calls, the stack
+// should have a Correlator below the codec. The messages which are not
+// calls are passed to the data listener, the rx channel must not be
+// read by others. It is closed by the stack when it is deleted or the
+// stack is stopped.
+type RPCEndPoint struct {
+	EndPoint
+	sync.Mutex
+	nextID        uint64
+	calls         map[uint64]*rpcCall
+	handler       RPCHandler
+	timeout       time.Duration
+	dataListener  func(EndPoint, EndPointData)
+	eventListener func(EndPoint, Event)
+	quit          chan struct{}
+	once          sync.Once
+	latency       *Histogram
+	// the slots of the requests being served
+	slots chan struct{}
+}
+
+// NewRPCEndPoint ...
+func NewRPCEndPoint(name string, session int) *RPCEndPoint {
+	r := &RPCEndPoint{
+		EndPoint: NewEndPoint(name, session),
+		calls:    make(map[uint64]*rpcCall),
+		quit:     make(chan struct{}),
+		slots:    make(chan struct{}, RPCDefaultMaxConcurrency),
+	}
+
+	go r.dispatch()
+
+	return r
+}
+
+// SetName ...
+func (r *RPCEndPoint) SetName(name string) EndPoint {
+	r.EndPoint.SetName(name)
+	return r
+}
+
+// SetSession ...
+func (r *RPCEndPoint) SetSession(session int) EndPoint {
+	r.EndPoint.SetSession(session)
+	return r
+}
+
+// SetDataListener sets the listener of the messages which are not calls
+func (r *RPCEndPoint) SetDataListener(listener func(EndPoint, EndPointData)) EndPoint {
+	r.Lock()
+	r.dataListener = listener
+	r.Unlock()
+	return r
+}
+
+// SetEventListener ...
+func (r *RPCEndPoint) SetEventListener(listener func(EndPoint, Event)) EndPoint {
+	r.Lock()
+	r.eventListener = listener
+	r.Unlock()
+	return r
+}
+
+// SetHandler sets the handler of requests, each request is served in
+// its own goroutine, up to the max concurrency at the same time
+func (r *RPCEndPoint) SetHandler(handler RPCHandler) *RPCEndPoint {
+	r.Lock()
+	r.handler = handler
+	r.Unlock()
+	return r
+}
+
+// SetMaxConcurrency sets the requests served at the same time, more
+// requests are replied with ErrServerBusy, RPCDefaultMaxConcurrency by
+// default
+func (r *RPCEndPoint) SetMaxConcurrency(n int) *RPCEndPoint {
+	if n <= 0 {
+		n = RPCDefaultMaxConcurrency
+	}
+
+	r.Lock()
+	r.slots = make(chan struct{}, n)
+	r.Unlock()
+	return r
+}
+
+// SetTimeout sets the timeout of the calls whose ctx has no deadline,
+// 0 means no timeout
+func (r *RPCEndPoint) SetTimeout(timeout time.Duration) *RPCEndPoint {
+	r.Lock()
+	r.timeout = timeout
+	r.Unlock()
+	return r
+}
+
+// RegisterMetrics exposes the latency of calls and the calls in flight
+func (r *RPCEndPoint) RegisterMetrics(registry *MetricsRegistry) {
+	latency := registry.Histogram("ustack_rpc_call_duration_seconds", "The latency of RPC calls.",
+		Labels{"endpoint": r.GetName()}, nil)
+
+	registry.GaugeFunc("ustack_rpc_calls_in_flight", "The number of RPC calls waiting for the reply.",
+		Labels{"endpoint": r.GetName()},
+		func() float64 {
+			r.Lock()
+			defer r.Unlock()
+			return float64(len(r.calls))
+		})
+
+	r.Lock()
+	r.latency = latency
+	r.Unlock()
+}
+
+// UnregisterMetrics ...
+func (r *RPCEndPoint) UnregisterMetrics(registry *MetricsRegistry) {
+	r.Lock()
+	r.latency = nil
+	r.Unlock()
+
+	registry.Unregister("ustack_rpc_call_duration_seconds", Labels{"endpoint": r.GetName()})
+	registry.Unregister("ustack_rpc_calls_in_flight", Labels{"endpoint": r.GetName()})
+}
+
+// Call sends message to the connection and waits for the reply, it
+// fails if ctx is done, the connection is closed or the remote handler
+// returns an error
+func (r *RPCEndPoint) Call(ctx context.Context, connection TransportConnection, message interface{}) (interface{}, error) {
+	if connection == nil {
+		return nil, ErrNoConnection
+	}
+
+	r.Lock()
+	timeout := r.timeout
+	latency := r.latency
+	r.Unlock()
+
+	if latency != nil {
+		defer func(start time.Time) {
+			latency.ObserveDuration(time.Since(start))
+		}(time.Now())
+	}
+
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	id := atomic.AddUint64(&r.nextID, 1)
+	call := &rpcCall{
+		connection: connection,
+		result:     make(chan rpcResult, 1),
+	}
+
+	r.Lock()
+	r.calls[id] = call
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		delete(r.calls, id)
+		r.Unlock()
+	}()
+
+	// the close event may have been published before it is registered
+	if connection.Closed() {
+		return nil, ErrConnectionClosed
+	}
+
+	epd := newEndPointDataWithOptions(map[string]interface{}{
+		"rpcKind": RPCKindRequest,
+		"rpcID":   id,
+	}).
+		SetConnection(connection).
+		SetData(message)
+
+	select {
+	case r.GetTxChannel() <- epd:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.quit:
+		return nil, ErrEndPointClosed
+	}
+
+	select {
+	case result := <-call.result:
+		return result.reply, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.quit:
+		return nil, ErrEndPointClosed
+	}
+}
+
+// finish completes the call with the result
+func (r *RPCEndPoint) finish(connection TransportConnection, id uint64, reply interface{}, err error) {
+	r.Lock()
+	call, ok := r.calls[id]
+	if ok && call.connection == connection {
+		delete(r.calls, id)
+	} else {
+		ok = false
+	}
+	r.Unlock()
+
+	if ok {
+		call.result <- rpcResult{reply: reply, err: err}
+	}
+}
+
+// failCalls fails all the in-flight calls of the connection
+func (r *RPCEndPoint) failCalls(connection TransportConnection) {
+	r.Lock()
+	defer r.Unlock()
+
+	for id, call := range r.calls {
+		if call.connection == connection {
+			delete(r.calls, id)
+			call.result <- rpcResult{err: ErrConnectionClosed}
+		}
+	}
+}
+
+// accept serves the request in a slot, or replies ErrServerBusy at once
+// if there is no free slot, so dispatch never blocks on handlers
+func (r *RPCEndPoint) accept(epd EndPointData, id uint64) {
+	r.Lock()
+	slots := r.slots
+	r.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		go func() {
+			defer func() { <-slots }()
+			r.serve(epd, id, nil)
+		}()
+	default:
+		r.serve(epd, id, ErrServerBusy)
+	}
+}
+
+// serve calls the handler and sends the reply, the handler is skipped if
+// refused is not nil
+func (r *RPCEndPoint) serve(epd EndPointData, id uint64, refused error) {
+	r.Lock()
+	handler := r.handler
+	r.Unlock()
+
+	var result interface{}
+	err := refused
+	if err == nil {
+		err = ErrNoHandler
+		if handler != nil {
+			result, err = handler(epd.GetConnection(), epd.GetData())
+		}
+	}
+
+	var reply EndPointData
+	if err != nil {
+		reply = newEndPointDataWithOptions(map[string]interface{}{
+			"rpcID":     id,
+			"rpcKind":   RPCKindError,
+			"rpcError":  err.Error(),
+			"noPayload": true,
+		})
+	} else {
+		reply = newEndPointDataWithOptions(map[string]interface{}{
+			"rpcID":   id,
+			"rpcKind": RPCKindReply,
+		}).SetData(result)
+	}
+	reply.SetConnection(epd.GetConnection())
+
+	select {
+	case r.GetTxChannel() <- reply:
+	case <-r.quit:
+	}
+}
+
+// dispatch reads the rx channel until the endpoint is closed
+func (r *RPCEndPoint) dispatch() {
+	rx := r.GetRxChannel()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case epd := <-rx:
+			kind, _ := OptionParseByte(endPointDataOption(epd, "rpcKind"), RPCKindMessage)
+			id, _ := endPointDataOption(epd, "rpcID").(uint64)
+
+			switch kind {
+			case RPCKindRequest:
+				r.accept(epd, id)
+			case RPCKindReply:
+				r.finish(epd.GetConnection(), id, epd.GetData(), nil)
+			case RPCKindError:
+				err, _ := epd.GetData().(error)
+				r.finish(epd.GetConnection(), id, nil, err)
+			default:
+				r.Lock()
+				listener := r.dataListener
+				r.Unlock()
+
+				if listener != nil {
+					listener(r, epd)
+				}
+			}
+		}
+	}
+}
+
+// OnEvent fails the calls of the closed connection and the calls whose
+// requests fail to be sent
+func (r *RPCEndPoint) OnEvent(event Event) {
+	if perr, ok := event.Data.(*ProcessingError); ok {
+		// only the errors of the data sent by itself
+		if perr.EndPoint != nil && perr.EndPoint != EndPoint(r) {
+			return
+		}
+
+		if epd := perr.EndPointData; epd != nil && perr.Direction == DataDirectionDown {
+			kind, _ := OptionParseByte(endPointDataOption(epd, "rpcKind"), RPCKindMessage)
+			id, _ := endPointDataOption(epd, "rpcID").(uint64)
+
+			if kind == RPCKindRequest {
+				r.finish(epd.GetConnection(), id, nil, perr)
+			}
+		}
+	}
+
+	if event.Type == UStackEventConnectionClosed {
+		if connection, ok := event.Data.(TransportConnection); ok {
+			r.failCalls(connection)
+		}
+	}
+
+	r.Lock()
+	listener := r.eventListener
+	r.Unlock()
+
+	if listener != nil {
+		listener(r, event)
+	}
+}
+
+// Close fails the in-flight calls and stops dispatching, it is called by
+// the stack
+func (r *RPCEndPoint) Close() {
+	r.once.Do(func() {
+		close(r.quit)
+	})
+}
@@ -0,0 +1,143 @@
+package ustack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newRPCStack(name string, forServer bool, ep EndPoint) UStack {
+	return NewUStack().
+		SetName(name).
+		AddEndPoint(ep).
+		AppendDataProcessor(NewStringCodec()).
+		AppendDataProcessor(NewCorrelator()).
+		AppendDataProcessor(NewFrameDecoder()).
+		AddTransport(
+			NewTCPTransport(name + ":TP").
+				ForServer(forServer).
+				SetAddress("127.0.0.1:23471")).
+		Run()
+}
+
+func TestRPCEndPointCall(t *testing.T) {
+	release := make(chan struct{})
+
+	server := NewRPCEndPoint("RPCServer:EP-0", 0).
+		SetHandler(func(connection TransportConnection, request interface{}) (interface{}, error) {
+			switch request.(string) {
+			case "fail":
+				return nil, errors.New("failed")
+			case "slow":
+				<-release
+			}
+			return "re:" + request.(string), nil
+		})
+	defer server.Close()
+
+	serverStack := newRPCStack("RPCServer", true, server)
+	defer serverStack.Stop(context.Background())
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewRPCEndPoint("RPCClient:EP-0", 0).SetTimeout(2 * time.Second)
+	defer client.Close()
+
+	clientStack := newRPCStack("RPCClient", false, client)
+
+	var connection TransportConnection
+	for i := 0; i < 50 && connection == nil; i++ {
+		if connections := clientStack.GetConnections(); len(connections) > 0 {
+			connection = connections[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reply, err := client.Call(context.Background(), connection, "hello")
+	if err != nil || reply.(string) != "re:hello" {
+		t.Fatal("Unexpected reply:", reply, err)
+	}
+
+	_, err = client.Call(context.Background(), connection, "fail")
+	var rerr *RPCError
+	if !errors.As(err, &rerr) || rerr.Message != "failed" {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), connection, "slow")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	clientStack.Stop(context.Background())
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != ErrConnectionClosed {
+			t.Fatal("Unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("In-flight call did not fail")
+	}
+}
+
+func TestRPCEndPointMaxConcurrency(t *testing.T) {
+	release := make(chan struct{})
+
+	server := NewRPCEndPoint("Busy:EP-0", 0).
+		SetMaxConcurrency(1).
+		SetHandler(func(connection TransportConnection, request interface{}) (interface{}, error) {
+			<-release
+			return request, nil
+		})
+	defer server.Close()
+
+	c := &dummyConnection{name: "c"}
+	for id := uint64(1); id <= 2; id++ {
+		server.GetRxChannel() <- newEndPointDataWithOptions(map[string]interface{}{
+			"rpcKind": RPCKindRequest,
+			"rpcID":   id,
+		}).
+			SetConnection(c).
+			SetData("hello")
+	}
+
+	// the second request is refused while the first one is served
+	reply := <-server.GetTxChannel()
+	if id, _ := endPointDataOption(reply, "rpcID").(uint64); id != 2 || endPointDataOption(reply, "rpcError") != ErrServerBusy.Error() {
+		t.Fatal("Unexpected reply:", id, endPointDataOption(reply, "rpcError"))
+	}
+
+	close(release)
+
+	reply = <-server.GetTxChannel()
+	if id, _ := endPointDataOption(reply, "rpcID").(uint64); id != 1 || reply.GetData() != "hello" {
+		t.Fatal("Unexpected reply:", id, reply.GetData())
+	}
+}
+
+func TestRPCEndPointClosedByStack(t *testing.T) {
+	c := &dummyConnection{name: "c"}
+
+	deleted := NewRPCEndPoint("Closed:EP-0", 0)
+	stopped := NewRPCEndPoint("Closed:EP-1", 1)
+
+	stack := NewUStack().
+		AddEndPoint(deleted).
+		AddEndPoint(stopped).
+		Run()
+
+	stack.DeleteEndPoint(deleted)
+	if _, err := deleted.Call(context.Background(), c, "hello"); err != ErrEndPointClosed {
+		t.Fatal("Deleted endpoint is not closed:", err)
+	}
+
+	stack.Stop(context.Background())
+	if _, err := stopped.Call(context.Background(), c, "hello"); err != ErrEndPointClosed {
+		t.Fatal("Endpoint is not closed by stop:", err)
+	}
+}
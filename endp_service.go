@@ -0,0 +1,309 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ServiceMessage is the envelope of the service calls, the stack should
+// have a codec of it, e.g. NewGOBCodec(reflect.TypeOf(ServiceMessage{})),
+// and a Correlator below the codec
+type ServiceMessage struct {
+	// "Service.Method" of the request
+	Method string
+	// the args of request or the reply, encoded by ServiceEncoding
+	Body []byte
+	// not nil if the call failed
+	Error *ServiceError
+}
+
+// the codes of ServiceError
+const (
+	ServiceErrorBadRequest    string = "BadRequest"
+	ServiceErrorUnknownMethod string = "UnknownMethod"
+	ServiceErrorApplication   string = "Application"
+)
+
+// ServiceError is the error replied by ServiceServer
+type ServiceError struct {
+	Code    string
+	Method  string
+	Message string
+}
+
+// Error ...
+func (e *ServiceError) Error() string {
+	return e.Method + ": " + e.Code + ": " + e.Message
+}
+
+// ServiceEncoding encodes the args and replies, it matches the codec of
+// ServiceMessage usually
+type ServiceEncoding interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonServiceEncoding ...
+type jsonServiceEncoding struct{}
+
+func (jsonServiceEncoding) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonServiceEncoding) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// gobServiceEncoding ...
+type gobServiceEncoding struct{}
+
+func (gobServiceEncoding) Marshal(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	if err := gob.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobServiceEncoding) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// the built-in encodings
+var (
+	ServiceEncodingJSON ServiceEncoding = jsonServiceEncoding{}
+	ServiceEncodingGOB  ServiceEncoding = gobServiceEncoding{}
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// serviceMethod ...
+type serviceMethod struct {
+	method    reflect.Method
+	argsType  reflect.Type
+	replyType reflect.Type
+}
+
+// service is a registered receiver
+type service struct {
+	rcvr    reflect.Value
+	methods map[string]*serviceMethod
+}
+
+// isExportedOrBuiltin ...
+func isExportedOrBuiltin(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := t.Name()
+	return t.PkgPath() == "" || (name != "" && strings.ToUpper(name[:1]) == name[:1])
+}
+
+// suitableMethods returns the methods in the form of net/rpc:
+//
+//	func (t *T) MethodName(args T1, reply *T2) error
+func suitableMethods(typ reflect.Type) map[string]*serviceMethod {
+	methods := make(map[string]*serviceMethod)
+
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		mtype := method.Type
+
+		if method.PkgPath != "" || mtype.NumIn() != 3 || mtype.NumOut() != 1 {
+			continue
+		}
+
+		argsType := mtype.In(1)
+		replyType := mtype.In(2)
+
+		if !isExportedOrBuiltin(argsType) ||
+			replyType.Kind() != reflect.Ptr ||
+			!isExportedOrBuiltin(replyType) ||
+			mtype.Out(0) != typeOfError {
+			continue
+		}
+
+		methods[method.Name] = &serviceMethod{
+			method:    method,
+			argsType:  argsType,
+			replyType: replyType.Elem(),
+		}
+	}
+
+	return methods
+}
+
+// ServiceServer serves the exported methods of the registered receivers
+// as "Service.Method" on RPCEndPoint
+type ServiceServer struct {
+	sync.RWMutex
+	encoding ServiceEncoding
+	services map[string]*service
+}
+
+// NewServiceServer sets the handler of ep
+func NewServiceServer(ep *RPCEndPoint, encoding ServiceEncoding) *ServiceServer {
+	s := &ServiceServer{
+		encoding: encoding,
+		services: make(map[string]*service),
+	}
+
+	ep.SetHandler(s.handle)
+
+	return s
+}
+
+// Register publishes the methods of rcvr with the name of its type
+func (s *ServiceServer) Register(rcvr interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName publishes the methods of rcvr with the given name
+func (s *ServiceServer) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("ServiceServer: no service name")
+	}
+
+	methods := suitableMethods(reflect.TypeOf(rcvr))
+	if len(methods) == 0 {
+		return errors.New("ServiceServer: " + name + " has no suitable methods")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.services[name]; ok {
+		return errors.New("ServiceServer: " + name + " is already registered")
+	}
+
+	s.services[name] = &service{
+		rcvr:    reflect.ValueOf(rcvr),
+		methods: methods,
+	}
+
+	return nil
+}
+
+// fail returns the reply message with the error of code
+func (s *ServiceServer) fail(method string, code string, err error) *ServiceMessage {
+	return &ServiceMessage{
+		Method: method,
+		Error: &ServiceError{
+			Code:    code,
+			Method:  method,
+			Message: err.Error(),
+		},
+	}
+}
+
+// handle is the handler of RPCEndPoint
+func (s *ServiceServer) handle(connection TransportConnection, request interface{}) (interface{}, error) {
+	msg, ok := request.(*ServiceMessage)
+	if !ok {
+		return nil, errors.New("not a ServiceMessage")
+	}
+
+	dot := strings.LastIndex(msg.Method, ".")
+	if dot < 0 {
+		return s.fail(msg.Method, ServiceErrorUnknownMethod, errors.New("bad method name")), nil
+	}
+
+	s.RLock()
+	svc, ok := s.services[msg.Method[:dot]]
+	s.RUnlock()
+
+	if !ok {
+		return s.fail(msg.Method, ServiceErrorUnknownMethod, errors.New("unknown service")), nil
+	}
+
+	m, ok := svc.methods[msg.Method[dot+1:]]
+	if !ok {
+		return s.fail(msg.Method, ServiceErrorUnknownMethod, errors.New("unknown method")), nil
+	}
+
+	// the args are passed as value or pointer as declared
+	args := reflect.New(m.argsType)
+	argsIsPtr := m.argsType.Kind() == reflect.Ptr
+	if argsIsPtr {
+		args = reflect.New(m.argsType.Elem())
+	}
+
+	if err := s.encoding.Unmarshal(msg.Body, args.Interface()); err != nil {
+		return s.fail(msg.Method, ServiceErrorBadRequest, err), nil
+	}
+
+	if !argsIsPtr {
+		args = args.Elem()
+	}
+
+	reply := reflect.New(m.replyType)
+
+	out := m.method.Func.Call([]reflect.Value{svc.rcvr, args, reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return s.fail(msg.Method, ServiceErrorApplication, err), nil
+	}
+
+	body, err := s.encoding.Marshal(reply.Interface())
+	if err != nil {
+		return s.fail(msg.Method, ServiceErrorApplication, err), nil
+	}
+
+	return &ServiceMessage{
+		Method: msg.Method,
+		Body:   body,
+	}, nil
+}
+
+// ServiceClient calls the services on a connection
+type ServiceClient struct {
+	ep         *RPCEndPoint
+	connection TransportConnection
+	encoding   ServiceEncoding
+}
+
+// NewServiceClient returns the client of the services on connection
+func NewServiceClient(ep *RPCEndPoint, connection TransportConnection, encoding ServiceEncoding) *ServiceClient {
+	return &ServiceClient{
+		ep:         ep,
+		connection: connection,
+		encoding:   encoding,
+	}
+}
+
+// Call calls "Service.Method" with args and waits for the reply, the
+// error is *ServiceError if the server fails to serve it
+func (c *ServiceClient) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	body, err := c.encoding.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.ep.Call(ctx, c.connection, &ServiceMessage{
+		Method: serviceMethod,
+		Body:   body,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, ok := res.(*ServiceMessage)
+	if !ok {
+		return ErrBadFormat
+	}
+
+	if msg.Error != nil {
+		return msg.Error
+	}
+
+	return c.encoding.Unmarshal(msg.Body, reply)
+}
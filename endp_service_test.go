@@ -0,0 +1,89 @@
+package ustack
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type ArithArgs struct {
+	A, B int
+}
+
+type Arith struct{}
+
+func (t *Arith) Multiply(args ArithArgs, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Divide(args *ArithArgs, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+func newServiceStack(name string, forServer bool, ep EndPoint) UStack {
+	return NewUStack().
+		SetName(name).
+		AddEndPoint(ep).
+		AppendDataProcessor(NewGOBCodec(reflect.TypeOf(ServiceMessage{}))).
+		AppendDataProcessor(NewCorrelator()).
+		AppendDataProcessor(NewFrameDecoder()).
+		AddTransport(
+			NewTCPTransport(name + ":TP").
+				ForServer(forServer).
+				SetAddress("127.0.0.1:23472")).
+		Run()
+}
+
+func TestServiceCall(t *testing.T) {
+	serverEP := NewRPCEndPoint("ServiceServer:EP-0", 0)
+	defer serverEP.Close()
+
+	if err := NewServiceServer(serverEP, ServiceEncodingGOB).Register(&Arith{}); err != nil {
+		t.Fatal("Register failed:", err)
+	}
+
+	serverStack := newServiceStack("ServiceServer", true, serverEP)
+	defer serverStack.Stop(context.Background())
+
+	time.Sleep(100 * time.Millisecond)
+
+	clientEP := NewRPCEndPoint("ServiceClient:EP-0", 0).SetTimeout(2 * time.Second)
+	defer clientEP.Close()
+
+	clientStack := newServiceStack("ServiceClient", false, clientEP)
+	defer clientStack.Stop(context.Background())
+
+	var connection TransportConnection
+	for i := 0; i < 50 && connection == nil; i++ {
+		if connections := clientStack.GetConnections(); len(connections) > 0 {
+			connection = connections[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := NewServiceClient(clientEP, connection, ServiceEncodingGOB)
+
+	var product int
+	if err := client.Call(context.Background(), "Arith.Multiply", ArithArgs{6, 7}, &product); err != nil || product != 42 {
+		t.Fatal("Unexpected Multiply:", product, err)
+	}
+
+	var quotient int
+	err := client.Call(context.Background(), "Arith.Divide", ArithArgs{1, 0}, &quotient)
+	var serr *ServiceError
+	if !errors.As(err, &serr) || serr.Code != ServiceErrorApplication || serr.Message != "divide by zero" {
+		t.Fatal("Unexpected Divide error:", err)
+	}
+
+	err = client.Call(context.Background(), "Arith.Add", ArithArgs{1, 2}, &quotient)
+	if !errors.As(err, &serr) || serr.Code != ServiceErrorUnknownMethod {
+		t.Fatal("Unexpected Add error:", err)
+	}
+}
@@ -16,6 +16,14 @@ type EndPointData interface {
 	ClearDestinationSession() EndPointData
 }
 
+// EndPointDataOptions is implemented by the EndPointData carrying the
+// options between the endpoint and the data processors, e.g. the
+// correlation of RPC, DefaultEndPointData implements it
+type EndPointDataOptions interface {
+	SetOption(name string, value interface{}) EndPointData
+	GetOption(name string) interface{}
+}
+
 // EndPoint ...
 type EndPoint interface {
 	SetName(name string) EndPoint
@@ -28,3 +36,10 @@ type EndPoint interface {
 	SetEventListener(listener func(EndPoint, Event)) EndPoint
 	OnEvent(event Event)
 }
+
+// EndPointCloser is implemented by the endpoints running their own
+// routines, the stack closes the endpoint when it is deleted or the
+// stack is stopped
+type EndPointCloser interface {
+	Close()
+}
@@ -21,6 +21,21 @@ const (
 	UStackEventEndpointAdded
 	// UStackEventEndpointDeleted ...
 	UStackEventEndpointDeleted
+	// UStackEventReconnected is published after UStackEventNewConnection
+	// if the client transport redialed the server
+	UStackEventReconnected
+	// UStackEventProcessingError is published when a data processor fails
+	// to handle the data, Data is *ProcessingError
+	UStackEventProcessingError
+	// UStackEventStreamOpened is published when the peer opens a stream of
+	// Multiplexer, Data is *StreamInfo
+	UStackEventStreamOpened
+	// UStackEventStreamClosed is published when a stream is closed by both
+	// sides, Data is *StreamInfo
+	UStackEventStreamClosed
+	// UStackEventStreamReset is published when a stream is reset by either
+	// side, Data is *StreamInfo
+	UStackEventStreamReset
 )
 
 // Event ...
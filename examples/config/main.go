@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"ustack"
+)
+
+var serverConfig string = `{
+  "name": "ConfigServer",
+  "processors": [
+    {"type": "StringCodec"},
+    {"type": "StatCounter"},
+    {"type": "Heartbeat", "enable": false},
+    {"type": "FrameDecoder"}
+  ],
+  "transports": [
+    {"type": "TCP", "name": "tcpServer", "address": "127.0.0.1:1234", "role": "server"}
+  ],
+  "endpoints": [
+    {"name": "EP-Server", "session": 0}
+  ]
+}`
+
+var clientConfig string = `{
+  "name": "ConfigClient",
+  "processors": [
+    {"type": "StringCodec"},
+    {"type": "StatCounter"},
+    {"type": "Heartbeat", "enable": false, "role": "client"},
+    {"type": "FrameDecoder"}
+  ],
+  "transports": [
+    {"type": "TCP", "name": "tcpClient", "address": "127.0.0.1:1234", "role": "client",
+     "options": {"Reconnect": true, "Reconnect.Multiplier": 2, "Reconnect.MaxBackoff": "30s"}}
+  ],
+  "endpoints": [
+    {"name": "EP-Client", "session": 0}
+  ]
+}`
+
+// build loads the config from file if given
+func build(config string) ustack.UStack {
+	data := []byte(config)
+	if len(os.Args) > 2 {
+		var err error
+		data, err = ioutil.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	stack, err := ustack.NewUStackFromJSON(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return stack.SetLogger(ustack.NewTextLogger(os.Stdout, ustack.LogLevelInfo))
+}
+
+func server() {
+	stack := build(serverConfig)
+
+	stack.GetEndPoint()[0].
+		SetDataListener(
+			func(endpoint ustack.EndPoint, epd ustack.EndPointData) {
+				fmt.Println("RECV:", epd.GetConnection().GetName(), epd.GetData().(string))
+				endpoint.GetTxChannel() <- epd
+			})
+
+	stack.Run()
+}
+
+func client() {
+	stack := build(clientConfig)
+
+	stack.GetEndPoint()[0].
+		SetEventListener(
+			func(endpoint ustack.EndPoint, event ustack.Event) {
+				if event.Type == ustack.UStackEventNewConnection {
+					connection := event.Data.(ustack.TransportConnection)
+					go func() {
+						for !connection.Closed() {
+							endpoint.GetTxChannel() <- ustack.NewEndPointData().
+								SetConnection(connection).
+								SetData("hello")
+							time.Sleep(time.Second)
+						}
+					}()
+				}
+			}).
+		SetDataListener(
+			func(endpoint ustack.EndPoint, epd ustack.EndPointData) {
+				fmt.Println("ACK:", epd.GetConnection().GetName(), epd.GetData().(string))
+			})
+
+	stack.Run()
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if fn, ok := map[string]func(){
+			"-s": server,
+			"-c": client,
+		}[os.Args[1]]; ok {
+			fn()
+			time.Sleep(time.Second * 3600)
+			return
+		}
+	}
+
+	fmt.Println(os.Args[0], "<-s|-c|-h> [config.json]")
+}
@@ -11,16 +11,22 @@ import (
 func client() {
 	ustack.NewUStack().
 		SetName("Client").
+		SetLogger(ustack.NewTextLogger(os.Stdout, ustack.LogLevelDebug)).
 		SetEventListener(func(event ustack.Event) {
 			if event.Type == ustack.UStackEventHeartbeatLost {
 				connection := event.Data.(ustack.TransportConnection)
 				fmt.Println("connection:", connection.GetName(), "heartbeat lost")
 			}
+			if event.Type == ustack.UStackEventHeartbeatRecover {
+				connection := event.Data.(ustack.TransportConnection)
+				quality := event.Source.(*ustack.Heartbeat).GetQuality(connection)
+				fmt.Println("connection:", connection.GetName(), "heartbeat recovered, srtt", quality.SRTT)
+			}
 		}).
 		AppendDataProcessor(
 			ustack.NewHeartbeat().
 				SetOption("IntervalInSecond", 10).
-				SetOption("TimeoutInSecond", 3).
+				SetOption("Timeout", "2500ms").
 				SetOption("CloseOnLost", false).
 				ForServer(false)).
 		AddTransport(
@@ -33,6 +39,7 @@ func client() {
 func server() {
 	ustack.NewUStack().
 		SetName("Server").
+		SetLogger(ustack.NewTextLogger(os.Stdout, ustack.LogLevelDebug)).
 		SetEventListener(func(event ustack.Event) {
 			if event.Type == ustack.UStackEventHeartbeatLost {
 				connection := event.Data.(ustack.TransportConnection)
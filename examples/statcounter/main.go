@@ -14,6 +14,7 @@ var statServerAddress2 string = "127.0.0.1:8801"
 func client() {
 	ustack.NewUStack().
 		SetName("tcpStatClient").
+		SetLogger(ustack.NewTextLogger(os.Stdout, ustack.LogLevelInfo)).
 		AppendDataProcessor(ustack.NewStatCounter().SetOption("Collect.IntervalInSecond", 2)).
 		AppendDataProcessor(ustack.NewFrameDecoder()).
 		AddTransport(
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"ustack"
+)
+
+var dataServerAddress string = "127.0.0.1:1234"
+
+func client() {
+	ustack.NewUStack().
+		SetName("UDPClient").
+		AddEndPoint(
+			ustack.NewEndPoint("EP-Client", 0).
+				SetEventListener(
+					func(endpoint ustack.EndPoint, event ustack.Event) {
+						if event.Type == ustack.UStackEventNewConnection {
+							connection := event.Data.(ustack.TransportConnection)
+							go func() {
+								for {
+									// fire and forget
+									endpoint.GetTxChannel() <- ustack.NewEndPointData().
+										SetConnection(connection).
+										SetData("temperature:21.5")
+									time.Sleep(time.Second)
+								}
+							}()
+						}
+					})).
+		AppendDataProcessor(ustack.NewStringCodec()).
+		AddTransport(
+			ustack.NewUDPTransport("udpClient").
+				ForServer(false).
+				SetAddress(dataServerAddress)).
+		Run()
+}
+
+func server() {
+	ustack.NewUStack().
+		SetName("UDPServer").
+		AddEndPoint(
+			ustack.NewEndPoint("EP-Server", 0).
+				SetEventListener(
+					func(endpoint ustack.EndPoint, event ustack.Event) {
+						if event.Type == ustack.UStackEventConnectionClosed {
+							connection := event.Data.(ustack.TransportConnection)
+							fmt.Println("peer", connection.GetName(), "expired")
+						}
+					}).
+				SetDataListener(
+					func(endpoint ustack.EndPoint, epd ustack.EndPointData) {
+						fmt.Println("RECV:", epd.GetConnection().GetName(), epd.GetData().(string))
+					})).
+		AppendDataProcessor(ustack.NewStringCodec()).
+		AddTransport(
+			ustack.NewUDPTransport("udpServer").
+				ForServer(true).
+				SetOption("IdleTimeoutInSecond", 5).
+				SetAddress(dataServerAddress)).
+		Run()
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if fn, ok := map[string]func(){
+			"-s": server,
+			"-c": client,
+		}[os.Args[1]]; ok {
+			fn()
+			time.Sleep(time.Second * 3600)
+			return
+		}
+	}
+
+	fmt.Println(os.Args[0], "<-s|-c|-h>")
+}
@@ -5,18 +5,22 @@
 package ustack
 
 type FeatBase struct {
-	where   Feature
-	name    string
-	ustack  UStack
-	options map[string]interface{}
+	where    Feature
+	name     string
+	ustack   UStack
+	options  map[string]interface{}
+	routines *routineGroup
+	logger   *loggerValue
 }
 
 // NewFeatBaseInstance returns a new instance
 func NewFeatBaseInstance(name string) FeatBase {
 	base := FeatBase{
-		name:    name,
-		ustack:  nil,
-		options: make(map[string]interface{}),
+		name:     name,
+		ustack:   nil,
+		options:  make(map[string]interface{}),
+		routines: newRoutineGroup(),
+		logger:   newLoggerValue(),
 	}
 	// by default is itself
 	base.where = &base
@@ -60,11 +64,32 @@ func (fb *FeatBase) SetUStack(ustack UStack) Feature {
 	return fb.where
 }
 
+// SetLogger set the logger, it is usually inherited from UStack
+func (fb *FeatBase) SetLogger(logger Logger) Feature {
+	fb.logger.set(loggerOrSilent(logger).With("feature", fb.name))
+	return fb.where
+}
+
+// GetLogger returns the logger, the silent logger if none is set
+func (fb *FeatBase) GetLogger() Logger {
+	return fb.logger.get()
+}
+
 // OnEvent is called when any event hanppen
 func (base *FeatBase) OnEvent(event Event) {
 }
 
 // Run
 func (fb *FeatBase) Run() Feature {
+	fb.routines.restart()
+
+	return fb.where
+}
+
+// Stop asks the goroutines of the feature to quit and waits for them
+// to exit
+func (fb *FeatBase) Stop() Feature {
+	fb.routines.stop()
+	fb.routines.wait()
 	return fb.where
 }
@@ -0,0 +1,451 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ManagementProtocolVersion is the version of request and response
+const ManagementProtocolVersion int = 1
+
+// ManagementDefaultAddress is the address to listen on by default, only
+// the local host can reach it
+const ManagementDefaultAddress string = "127.0.0.1:7410"
+
+// ManagementRedactedOption replaces the values of the secret options
+const ManagementRedactedOption string = "<redacted>"
+
+// the commands of ManagementRequest
+const (
+	// no arguments, result is []ManagementProcessorInfo, the values of
+	// the secret options are ManagementRedactedOption
+	ManagementCommandListProcessors string = "ListProcessors"
+	// target is the data processor, args is ManagementSetEnableArgs
+	ManagementCommandSetEnable string = "SetEnable"
+	// target is the data processor, args is ManagementSetOptionArgs, the
+	// running data processor is restarted to parse the options again
+	ManagementCommandSetOption string = "SetOption"
+	// no arguments, result is []ManagementTransportInfo
+	ManagementCommandListTransports string = "ListTransports"
+	// args is TransportConfig
+	ManagementCommandAddTransport string = "AddTransport"
+	// target is the transport
+	ManagementCommandDeleteTransport string = "DeleteTransport"
+	// no arguments, result is []EndPointConfig
+	ManagementCommandListEndPoints string = "ListEndPoints"
+	// args is EndPointConfig
+	ManagementCommandAddEndPoint string = "AddEndPoint"
+	// target is the endpoint
+	ManagementCommandDeleteEndPoint string = "DeleteEndPoint"
+	// no arguments, result is the stats of data processors by name
+	ManagementCommandDumpStats string = "DumpStats"
+	// no arguments, result is the names of connections
+	ManagementCommandListConnections string = "ListConnections"
+)
+
+// ManagementRequest ...
+type ManagementRequest struct {
+	Version int    `json:"version"`
+	ID      uint64 `json:"id"`
+	Command string `json:"command"`
+	// the name of data processor, transport or endpoint
+	Target string          `json:"target,omitempty"`
+	Args   json.RawMessage `json:"args,omitempty"`
+}
+
+// ManagementResponse ...
+type ManagementResponse struct {
+	Version int         `json:"version"`
+	ID      uint64      `json:"id"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+// ManagementSetEnableArgs ...
+type ManagementSetEnableArgs struct {
+	Enable bool `json:"enable"`
+}
+
+// ManagementSetOptionArgs ...
+type ManagementSetOptionArgs struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// ManagementProcessorInfo ...
+type ManagementProcessorInfo struct {
+	Name     string                 `json:"name"`
+	Enable   bool                   `json:"enable"`
+	Overhead int                    `json:"overhead"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+// ManagementTransportInfo ...
+type ManagementTransportInfo struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// Management serves the commands to control the stack at runtime, it
+// listens on its own transport with a stack of JSONCodec and
+// FrameDecoder, so a client is a stack like
+//
+//	NewUStack().
+//		AddEndPoint(ep).
+//		AppendDataProcessor(NewJSONCodec(reflect.TypeOf(ManagementResponse{}))).
+//		AppendDataProcessor(NewFrameDecoder()).
+//		AddTransport(NewTCPTransport("mgmt").ForServer(false).SetAddress(address))
+//
+// sending ManagementRequest and receiving ManagementResponse.
+//
+// The commands are not authenticated, Management refuses to listen on an
+// address other hosts can reach unless AllowRemote is set, such a port
+// should be kept behind a firewall or served by TLS with ClientAuth.
+//
+// Options:
+//
+//	Transport: string, the registered transport type, TCP by default,
+//	  if no transport is given
+//	Address: string, the address to listen on, if no transport is given,
+//	  ManagementDefaultAddress by default
+//	AllowRemote: bool, false by default, listen on a non-loopback address
+type Management struct {
+	FeatBase
+	transport Transport
+	stack     UStack
+}
+
+// NewManagement returns the management feature serving on tp, the
+// transport is made from the options if tp is nil
+func NewManagement(tp Transport) Feature {
+	m := &Management{
+		FeatBase:  NewFeatBaseInstance("Management"),
+		transport: tp,
+	}
+	m.where = m
+	return m
+}
+
+// secretOptionWords are the words in the names of secret options, e.g.
+// Keys of Encryptor
+var secretOptionWords = []string{"key", "secret", "password", "passwd", "token", "credential", "certificate"}
+
+// isSecretOption ...
+func isSecretOption(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range secretOptionWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportOptions redacts the secret options and replaces the option values
+// which can not be marshalled, e.g. functions, with their type names
+func exportOptions(options map[string]interface{}) map[string]interface{} {
+	exported := make(map[string]interface{}, len(options))
+	for name, value := range options {
+		if isSecretOption(name) {
+			exported[name] = ManagementRedactedOption
+		} else if _, err := json.Marshal(value); err != nil {
+			exported[name] = fmt.Sprintf("%T", value)
+		} else {
+			exported[name] = value
+		}
+	}
+	return exported
+}
+
+// decodeArgs ...
+func decodeArgs(req *ManagementRequest, args interface{}) error {
+	if len(req.Args) == 0 {
+		return errors.New("missing args")
+	}
+	return json.Unmarshal(req.Args, args)
+}
+
+// processor returns the data processor of the target
+func (m *Management) processor(req *ManagementRequest) (DataProcessor, error) {
+	dp := m.ustack.GetDataProcessor(req.Target)
+	if dp == nil {
+		return nil, errors.New("not found data processor " + req.Target)
+	}
+	return dp, nil
+}
+
+// execute runs the command, returns the result
+func (m *Management) execute(req *ManagementRequest) (interface{}, error) {
+	switch req.Command {
+	case ManagementCommandListProcessors:
+		infos := make([]ManagementProcessorInfo, 0)
+		for _, dp := range m.ustack.GetDataProcessors() {
+			info := ManagementProcessorInfo{
+				Name:     dp.GetName(),
+				Enable:   dp.IsEnabled(),
+				Overhead: dp.GetOverhead(),
+			}
+			if base, ok := dp.(interface{ GetOptions() map[string]interface{} }); ok {
+				info.Options = exportOptions(base.GetOptions())
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+
+	case ManagementCommandSetEnable:
+		dp, err := m.processor(req)
+		if err != nil {
+			return nil, err
+		}
+
+		args := ManagementSetEnableArgs{}
+		if err := decodeArgs(req, &args); err != nil {
+			return nil, err
+		}
+
+		dp.SetEnable(args.Enable)
+		return nil, nil
+
+	case ManagementCommandSetOption:
+		dp, err := m.processor(req)
+		if err != nil {
+			return nil, err
+		}
+
+		args := ManagementSetOptionArgs{}
+		if err := decodeArgs(req, &args); err != nil {
+			return nil, err
+		}
+		if args.Name == "" {
+			return nil, errors.New("missing option name")
+		}
+
+		restarter, ok := m.ustack.(interface{ RestartDataProcessor(name string) error })
+		if !ok {
+			return nil, errors.New("the stack can not restart data processor " + req.Target)
+		}
+
+		dp.SetOption(args.Name, normalizeOption(args.Value))
+		return nil, restarter.RestartDataProcessor(dp.GetName())
+
+	case ManagementCommandListTransports:
+		infos := make([]ManagementTransportInfo, 0)
+		for _, tp := range m.ustack.GetTransport() {
+			infos = append(infos, ManagementTransportInfo{
+				Name:    tp.GetName(),
+				Address: tp.GetAddress(),
+			})
+		}
+		return infos, nil
+
+	case ManagementCommandAddTransport:
+		args := TransportConfig{}
+		if err := decodeArgs(req, &args); err != nil {
+			return nil, err
+		}
+
+		tp, err := newTransportFromConfig(&args)
+		if err != nil {
+			return nil, err
+		}
+
+		m.ustack.AddTransport(tp)
+		return nil, nil
+
+	case ManagementCommandDeleteTransport:
+		for _, tp := range m.ustack.GetTransport() {
+			if tp.GetName() == req.Target {
+				m.ustack.DeleteTransport(tp)
+				return nil, nil
+			}
+		}
+		return nil, errors.New("not found transport " + req.Target)
+
+	case ManagementCommandListEndPoints:
+		infos := make([]EndPointConfig, 0)
+		for _, ep := range m.ustack.GetEndPoint() {
+			infos = append(infos, EndPointConfig{
+				Name:    ep.GetName(),
+				Session: ep.GetSession(),
+			})
+		}
+		return infos, nil
+
+	case ManagementCommandAddEndPoint:
+		args := EndPointConfig{}
+		if err := decodeArgs(req, &args); err != nil {
+			return nil, err
+		}
+
+		for _, ep := range m.ustack.GetEndPoint() {
+			if ep.GetSession() == args.Session {
+				return nil, fmt.Errorf("session %d is used by endpoint %s", args.Session, ep.GetName())
+			}
+		}
+
+		m.ustack.AddEndPoint(NewEndPoint(args.Name, args.Session))
+		return nil, nil
+
+	case ManagementCommandDeleteEndPoint:
+		for _, ep := range m.ustack.GetEndPoint() {
+			if ep.GetName() == req.Target {
+				m.ustack.DeleteEndPoint(ep)
+				return nil, nil
+			}
+		}
+		return nil, errors.New("not found endpoint " + req.Target)
+
+	case ManagementCommandDumpStats:
+		stats := make(map[string]interface{})
+		for _, dp := range m.ustack.GetDataProcessors() {
+			if provider, ok := dp.(StatsProvider); ok {
+				stats[dp.GetName()] = provider.GetStats()
+			}
+		}
+		return stats, nil
+
+	case ManagementCommandListConnections:
+		names := make([]string, 0)
+		for _, connection := range m.ustack.GetConnections() {
+			names = append(names, connection.GetName())
+		}
+		return names, nil
+	}
+
+	return nil, errors.New("unknown command " + req.Command)
+}
+
+// handle serves one request
+func (m *Management) handle(req *ManagementRequest) *ManagementResponse {
+	res := &ManagementResponse{
+		Version: ManagementProtocolVersion,
+		ID:      req.ID,
+	}
+
+	if req.Version != ManagementProtocolVersion {
+		res.Error = fmt.Sprintf("unsupported version %d", req.Version)
+		return res
+	}
+
+	result, err := m.execute(req)
+	if err != nil {
+		m.GetLogger().Warn("command failed", "command", req.Command, "target", req.Target, "error", err)
+		res.Error = err.Error()
+		return res
+	}
+
+	m.GetLogger().Info("command done", "command", req.Command, "target", req.Target)
+
+	res.Success = true
+	res.Result = result
+	return res
+}
+
+// isLoopbackAddress returns true if only the local host can reach the
+// address, the address which is not host:port, e.g. the path of a unix
+// socket, is local
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return true
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Run starts serving
+func (m *Management) Run() Feature {
+	m.routines.restart()
+
+	tp := m.transport
+	if tp == nil {
+		typeName, _ := OptionParseString(m.GetOption("Transport"), "TCP")
+		address, _ := OptionParseString(m.GetOption("Address"), ManagementDefaultAddress)
+
+		factory, ok := lookupTransport(typeName)
+		if !ok {
+			m.GetLogger().Error("unknown transport type", "type", typeName)
+			return m
+		}
+		tp = factory(m.name).SetAddress(address)
+	}
+
+	allowRemote, exists := OptionParseBool(m.GetOption("AllowRemote"), false)
+	if exists {
+		m.GetLogger().Info("option", "AllowRemote", allowRemote)
+	}
+
+	if !allowRemote && !isLoopbackAddress(tp.GetAddress()) {
+		m.GetLogger().Error("refuse to listen on remote address, set AllowRemote to allow",
+			"address", tp.GetAddress())
+		return m
+	}
+
+	ep := NewEndPoint(m.name, 0)
+
+	m.stack = NewUStack().
+		SetName(m.ustack.GetName() + ":" + m.name).
+		SetLogger(m.GetLogger()).
+		AddEndPoint(ep).
+		AppendDataProcessor(NewJSONCodec(reflect.TypeOf(ManagementRequest{}))).
+		AppendDataProcessor(NewFrameDecoder()).
+		AddTransport(tp.ForServer(true)).
+		Run()
+
+	rx := ep.GetRxChannel()
+	tx := ep.GetTxChannel()
+
+	m.routines.spawn(func() {
+		for {
+			select {
+			case <-m.routines.quitting():
+				return
+			case epd := <-rx:
+				req, ok := epd.GetData().(*ManagementRequest)
+				if !ok {
+					continue
+				}
+
+				res := NewEndPointData().
+					SetConnection(epd.GetConnection()).
+					SetData(m.handle(req))
+
+				select {
+				case <-m.routines.quitting():
+					return
+				case tx <- res:
+				}
+			}
+		}
+	})
+
+	return m
+}
+
+// Stop stops serving
+func (m *Management) Stop() Feature {
+	if m.stack != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		m.stack.Stop(ctx)
+	}
+
+	return m.FeatBase.Stop()
+}
@@ -0,0 +1,125 @@
+package ustack
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestManagementExportOptions(t *testing.T) {
+	exported := exportOptions(map[string]interface{}{
+		"Keys":        "1:secret",
+		"KeyFile":     "server.key",
+		"Password":    "secret",
+		"WindowSize":  16,
+		"Strategy":    "RoundRobin",
+		"LoadFn":      func() int { return 0 },
+		"ServerName":  "example.com",
+		"Certificate": []byte("secret"),
+	})
+
+	for _, name := range []string{"Keys", "KeyFile", "Password", "Certificate"} {
+		if exported[name] != ManagementRedactedOption {
+			t.Errorf("expect %s redacted, got %v", name, exported[name])
+		}
+	}
+	if exported["WindowSize"] != 16 || exported["Strategy"] != "RoundRobin" || exported["ServerName"] != "example.com" {
+		t.Errorf("unexpected options %v", exported)
+	}
+	if exported["LoadFn"] != "func() int" {
+		t.Errorf("unexpected LoadFn %v", exported["LoadFn"])
+	}
+}
+
+func TestManagementListProcessorsRedacted(t *testing.T) {
+	stack := NewUStack().
+		AppendDataProcessor(NewEncryptor().SetOption("Keys", "1:0123456789abcdef0123456789abcdef")).
+		Run()
+	defer stack.Stop(context.Background())
+
+	m := NewManagement(nil).(*Management)
+	m.SetUStack(stack)
+
+	result, err := m.execute(&ManagementRequest{Version: ManagementProtocolVersion, Command: ManagementCommandListProcessors})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(result)
+	infos := result.([]ManagementProcessorInfo)
+	if len(infos) != 1 || infos[0].Options["Keys"] != ManagementRedactedOption {
+		t.Errorf("expect Keys redacted, got %s", data)
+	}
+}
+
+func TestManagementSetOption(t *testing.T) {
+	stack := NewUStack().AppendDataProcessor(NewFrameDecoder()).Run()
+	defer stack.Stop(context.Background())
+
+	m := NewManagement(nil).(*Management)
+	m.SetUStack(stack)
+
+	res := m.handle(&ManagementRequest{
+		Version: ManagementProtocolVersion,
+		Command: ManagementCommandSetOption,
+		Target:  "FrameDecoder",
+		Args:    json.RawMessage(`{"name":"MaxFrameSize","value":8}`),
+	})
+
+	// applied to the running data processor
+	if !res.Success {
+		t.Errorf("expect success, got %+v", res)
+	}
+	if size := stack.GetDataProcessor("FrameDecoder").(*FrameDecoder).maxFrameSize; size != 8 {
+		t.Errorf("expect option applied, got MaxFrameSize %d", size)
+	}
+
+	// the goroutines of the restarted one are spawned again
+	stack.AppendDataProcessor(NewHeartbeat())
+	res = m.handle(&ManagementRequest{
+		Version: ManagementProtocolVersion,
+		Command: ManagementCommandSetOption,
+		Target:  "Heartbeat",
+		Args:    json.RawMessage(`{"name":"Interval","value":"2s"}`),
+	})
+
+	hb := stack.GetDataProcessor("Heartbeat").(*Heartbeat)
+	if !res.Success || hb.interval != 2*time.Second || hb.routines.stopped {
+		t.Errorf("expect heartbeat restarted, got %+v", res)
+	}
+}
+
+func TestManagementRemoteAddress(t *testing.T) {
+	cases := []struct {
+		address  string
+		loopback bool
+	}{
+		{"127.0.0.1:7410", true},
+		{"[::1]:7410", true},
+		{"localhost:7410", true},
+		{"/tmp/mgmt.sock", true},
+		{":7410", false},
+		{"0.0.0.0:7410", false},
+		{"192.168.1.1:7410", false},
+		{"example.com:7410", false},
+	}
+
+	for _, tc := range cases {
+		if isLoopbackAddress(tc.address) != tc.loopback {
+			t.Errorf("expect %s loopback %v", tc.address, tc.loopback)
+		}
+	}
+
+	stack := NewUStack().Run()
+	defer stack.Stop(context.Background())
+
+	m := NewManagement(NewTCPTransport("mgmt").SetAddress(":23475")).(*Management)
+	m.SetUStack(stack)
+	m.Run()
+	defer m.Stop()
+
+	if m.stack != nil {
+		t.Errorf("expect remote address refused")
+	}
+}
@@ -11,6 +11,9 @@ type Feature interface {
 	SetOption(name string, value interface{}) Feature
 	GetOption(name string) interface{}
 	SetUStack(ustack UStack) Feature
+	SetLogger(logger Logger) Feature
+	GetLogger() Logger
 	OnEvent(event Event)
 	Run() Feature
+	Stop() Feature
 }
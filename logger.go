@@ -0,0 +1,197 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger is the structured logger of the stack. keyvals are alternating
+// keys and values, as log/slog does.
+//
+// The logger set on UStack is inherited by its data processors,
+// transports and features with the fields stack, processor, transport,
+// feature, and connection or session where it makes sense.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// With returns a logger which adds keyvals to every record
+	With(keyvals ...interface{}) Logger
+}
+
+// LogLevel ...
+type LogLevel int
+
+const (
+	// LogLevelDebug ...
+	LogLevelDebug LogLevel = iota
+	// LogLevelInfo ...
+	LogLevelInfo
+	// LogLevelWarn ...
+	LogLevelWarn
+	// LogLevelError ...
+	LogLevelError
+)
+
+// String ...
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// silentLogger drops everything
+type silentLogger struct{}
+
+// NewSilentLogger returns the logger which drops everything, it is used
+// if no logger is set
+func NewSilentLogger() Logger {
+	return silentLogger{}
+}
+
+func (silentLogger) Debug(msg string, keyvals ...interface{}) {}
+func (silentLogger) Info(msg string, keyvals ...interface{})  {}
+func (silentLogger) Warn(msg string, keyvals ...interface{})  {}
+func (silentLogger) Error(msg string, keyvals ...interface{}) {}
+func (l silentLogger) With(keyvals ...interface{}) Logger     { return l }
+
+// textLogger writes one line per record like
+// "2021-06-01T10:00:00.000Z INFO msg key=value ..."
+type textLogger struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	fields string
+}
+
+// NewTextLogger returns a logger writing the records not below level
+// to writer
+func NewTextLogger(writer io.Writer, level LogLevel) Logger {
+	return &textLogger{
+		mutex:  &sync.Mutex{},
+		writer: writer,
+		level:  level,
+	}
+}
+
+// formatKeyvals ...
+func formatKeyvals(keyvals []interface{}) string {
+	var b strings.Builder
+
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		value := "!MISSING"
+		if i+1 < len(keyvals) {
+			value = fmt.Sprint(keyvals[i+1])
+		}
+
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+
+	return b.String()
+}
+
+// log ...
+func (l *textLogger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	line := time.Now().UTC().Format("2006-01-02T15:04:05.000Z") + " " +
+		level.String() + " " + msg + l.fields + formatKeyvals(keyvals) + "\n"
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	io.WriteString(l.writer, line)
+}
+
+// Debug ...
+func (l *textLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LogLevelDebug, msg, keyvals)
+}
+
+// Info ...
+func (l *textLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LogLevelInfo, msg, keyvals)
+}
+
+// Warn ...
+func (l *textLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LogLevelWarn, msg, keyvals)
+}
+
+// Error ...
+func (l *textLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LogLevelError, msg, keyvals)
+}
+
+// With ...
+func (l *textLogger) With(keyvals ...interface{}) Logger {
+	return &textLogger{
+		mutex:  l.mutex,
+		writer: l.writer,
+		level:  l.level,
+		fields: l.fields + formatKeyvals(keyvals),
+	}
+}
+
+// loggerHolder makes the stored type of atomic.Value always the same
+type loggerHolder struct {
+	logger Logger
+}
+
+// loggerValue keeps a logger which may be replaced while it is used
+type loggerValue struct {
+	value atomic.Value
+}
+
+// newLoggerValue ...
+func newLoggerValue() *loggerValue {
+	return &loggerValue{}
+}
+
+// set ...
+func (lv *loggerValue) set(logger Logger) {
+	lv.value.Store(loggerHolder{logger: logger})
+}
+
+// get returns the silent logger if none is set
+func (lv *loggerValue) get() Logger {
+	if holder, ok := lv.value.Load().(loggerHolder); ok && holder.logger != nil {
+		return holder.logger
+	}
+	return NewSilentLogger()
+}
+
+// loggerOrSilent ...
+func loggerOrSilent(logger Logger) Logger {
+	if logger == nil {
+		return NewSilentLogger()
+	}
+	return logger
+}
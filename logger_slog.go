@@ -0,0 +1,49 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package ustack
+
+import "log/slog"
+
+// slogLogger adapts *slog.Logger to Logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to logger, slog.Default() is
+// used if logger is nil
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogLogger{logger: logger}
+}
+
+// Debug ...
+func (l *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, keyvals...)
+}
+
+// Info ...
+func (l *slogLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, keyvals...)
+}
+
+// Warn ...
+func (l *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn(msg, keyvals...)
+}
+
+// Error ...
+func (l *slogLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, keyvals...)
+}
+
+// With ...
+func (l *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{logger: l.logger.With(keyvals...)}
+}
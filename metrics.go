@@ -0,0 +1,543 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the kinds of metric
+const (
+	MetricKindCounter int = iota
+	MetricKindGauge
+	MetricKindHistogram
+)
+
+// metricKindNames ...
+var metricKindNames = []string{"counter", "gauge", "histogram"}
+
+// DefaultHistogramBuckets are the upper bounds in second for latencies
+var DefaultHistogramBuckets = []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Labels are the names and values identifying a series of metric
+type Labels map[string]string
+
+// key returns the sorted labels as the identity of series
+func (l Labels) key() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(l[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+// Inc ...
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add ...
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+// Value ...
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value going up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set ...
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add ...
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		value := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, value) {
+			return
+		}
+	}
+}
+
+// Value ...
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Histogram counts the observations in buckets
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Observe ...
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+	h.Unlock()
+}
+
+// ObserveDuration observes the duration in second
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Snapshot returns the cumulative counts of buckets
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	s := &HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		s.Counts[i] = cumulative
+	}
+	return s
+}
+
+// HistogramSnapshot is the state of histogram, Counts[i] is the number
+// of observations no more than Buckets[i]
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// MetricSample is a series of metric
+type MetricSample struct {
+	Labels Labels
+	// the value of counter and gauge
+	Value float64
+	// the value of histogram
+	Histogram *HistogramSnapshot
+}
+
+// MetricFamily is the samples of a metric
+type MetricFamily struct {
+	Name    string
+	Help    string
+	Kind    int
+	Samples []MetricSample
+}
+
+// metricSeries ...
+type metricSeries struct {
+	labels Labels
+	// *Counter, *Gauge, *Histogram, func() uint64 or func() float64
+	value interface{}
+}
+
+// sample ...
+func (s *metricSeries) sample() MetricSample {
+	sample := MetricSample{Labels: s.labels}
+
+	switch v := s.value.(type) {
+	case *Counter:
+		sample.Value = float64(v.Value())
+	case *Gauge:
+		sample.Value = v.Value()
+	case *Histogram:
+		sample.Histogram = v.Snapshot()
+	case func() uint64:
+		sample.Value = float64(v())
+	case func() float64:
+		sample.Value = v()
+	}
+
+	return sample
+}
+
+// metricFamily ...
+type metricFamily struct {
+	help   string
+	kind   int
+	series map[string]*metricSeries
+}
+
+// MetricsRegistry keeps the metrics of a stack, a metric is identified
+// by its name and labels, registering it again returns the same one
+type MetricsRegistry struct {
+	sync.Mutex
+	families    map[string]*metricFamily
+	constLabels Labels
+}
+
+// NewMetricsRegistry ...
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+// SetConstLabels sets the labels added to all the samples, e.g. the name
+// of stack
+func (r *MetricsRegistry) SetConstLabels(labels Labels) *MetricsRegistry {
+	r.Lock()
+	r.constLabels = labels
+	r.Unlock()
+	return r
+}
+
+// register returns the existing value of the series or the new one, it
+// panics if the name is registered with another kind
+func (r *MetricsRegistry) register(name string, help string, kind int, labels Labels, value func() interface{}) interface{} {
+	r.Lock()
+	defer r.Unlock()
+
+	family, ok := r.families[name]
+	if !ok {
+		family = &metricFamily{
+			help:   help,
+			kind:   kind,
+			series: make(map[string]*metricSeries),
+		}
+		r.families[name] = family
+	} else if family.kind != kind {
+		panic(fmt.Sprintf("metric %s is registered as %s", name, metricKindNames[family.kind]))
+	}
+
+	key := labels.key()
+	if series, ok := family.series[key]; ok {
+		return series.value
+	}
+
+	copied := make(Labels, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	series := &metricSeries{
+		labels: copied,
+		value:  value(),
+	}
+	family.series[key] = series
+
+	return series.value
+}
+
+// Counter returns the counter of name and labels
+func (r *MetricsRegistry) Counter(name string, help string, labels Labels) *Counter {
+	value := r.register(name, help, MetricKindCounter, labels, func() interface{} {
+		return &Counter{}
+	})
+
+	counter, ok := value.(*Counter)
+	if !ok {
+		panic(fmt.Sprintf("metric %s is registered as a function", name))
+	}
+	return counter
+}
+
+// CounterFunc registers a counter whose value is read by fn, e.g. the
+// atomic counter of a data processor, it replaces the registered one
+func (r *MetricsRegistry) CounterFunc(name string, help string, labels Labels, fn func() uint64) {
+	r.Unregister(name, labels)
+	r.register(name, help, MetricKindCounter, labels, func() interface{} {
+		return fn
+	})
+}
+
+// Gauge returns the gauge of name and labels
+func (r *MetricsRegistry) Gauge(name string, help string, labels Labels) *Gauge {
+	value := r.register(name, help, MetricKindGauge, labels, func() interface{} {
+		return &Gauge{}
+	})
+
+	gauge, ok := value.(*Gauge)
+	if !ok {
+		panic(fmt.Sprintf("metric %s is registered as a function", name))
+	}
+	return gauge
+}
+
+// GaugeFunc registers a gauge whose value is read by fn, e.g. the length
+// of a queue, it replaces the registered one
+func (r *MetricsRegistry) GaugeFunc(name string, help string, labels Labels, fn func() float64) {
+	r.Unregister(name, labels)
+	r.register(name, help, MetricKindGauge, labels, func() interface{} {
+		return fn
+	})
+}
+
+// Histogram returns the histogram of name and labels, the sorted buckets
+// are the upper bounds, DefaultHistogramBuckets if nil
+func (r *MetricsRegistry) Histogram(name string, help string, labels Labels, buckets []float64) *Histogram {
+	value := r.register(name, help, MetricKindHistogram, labels, func() interface{} {
+		if buckets == nil {
+			buckets = DefaultHistogramBuckets
+		}
+		return &Histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+	})
+	return value.(*Histogram)
+}
+
+// Unregister deletes the series of name and labels
+func (r *MetricsRegistry) Unregister(name string, labels Labels) {
+	r.Lock()
+	defer r.Unlock()
+
+	family, ok := r.families[name]
+	if !ok {
+		return
+	}
+
+	delete(family.series, labels.key())
+	if len(family.series) == 0 {
+		delete(r.families, name)
+	}
+}
+
+// Gather returns the samples of all metrics sorted by name and labels,
+// the const labels are added
+func (r *MetricsRegistry) Gather() []MetricFamily {
+	r.Lock()
+	constLabels := r.constLabels
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type pending struct {
+		family MetricFamily
+		series []*metricSeries
+	}
+
+	gathered := make([]pending, 0, len(names))
+	for _, name := range names {
+		family := r.families[name]
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		p := pending{
+			family: MetricFamily{
+				Name: name,
+				Help: family.help,
+				Kind: family.kind,
+			},
+		}
+		for _, key := range keys {
+			p.series = append(p.series, family.series[key])
+		}
+		gathered = append(gathered, p)
+	}
+	r.Unlock()
+
+	// the functions are called without the lock, they may register
+	families := make([]MetricFamily, 0, len(gathered))
+	for _, p := range gathered {
+		for _, series := range p.series {
+			sample := series.sample()
+
+			if len(constLabels) > 0 {
+				labels := make(Labels, len(constLabels)+len(sample.Labels))
+				for k, v := range constLabels {
+					labels[k] = v
+				}
+				for k, v := range sample.Labels {
+					labels[k] = v
+				}
+				sample.Labels = labels
+			}
+
+			p.family.Samples = append(p.family.Samples, sample)
+		}
+		families = append(families, p.family)
+	}
+
+	return families
+}
+
+// MetricsCollector is implemented by the data processors, transports,
+// endpoints and features registering their metrics, UStack calls
+// RegisterMetrics when it is running, and UnregisterMetrics when it is
+// removed, replaced or deleted from the stack
+type MetricsCollector interface {
+	RegisterMetrics(registry *MetricsRegistry)
+	UnregisterMetrics(registry *MetricsRegistry)
+}
+
+// MetricsExporter writes the metrics in its format
+type MetricsExporter interface {
+	ContentType() string
+	Export(w io.Writer, families []MetricFamily) error
+}
+
+// PrometheusExporter writes the Prometheus text format 0.0.4
+type PrometheusExporter struct{}
+
+// ContentType ...
+func (PrometheusExporter) ContentType() string {
+	return "text/plain; version=0.0.4; charset=utf-8"
+}
+
+// the escapers of the help text and the label values
+var (
+	prometheusHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// formatPrometheusLabels returns {name="value",...} sorted by name, extra
+// is appended as is
+func formatPrometheusLabels(labels Labels, extra string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+prometheusLabelEscaper.Replace(labels[name])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatPrometheusValue ...
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Export ...
+func (PrometheusExporter) Export(w io.Writer, families []MetricFamily) error {
+	bw := bufio.NewWriter(w)
+
+	for _, family := range families {
+		if family.Help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", family.Name, prometheusHelpEscaper.Replace(family.Help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", family.Name, metricKindNames[family.Kind])
+
+		for _, sample := range family.Samples {
+			if h := sample.Histogram; h != nil {
+				for i, bound := range h.Buckets {
+					fmt.Fprintf(bw, "%s_bucket%s %d\n", family.Name,
+						formatPrometheusLabels(sample.Labels, `le="`+formatPrometheusValue(bound)+`"`), h.Counts[i])
+				}
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", family.Name,
+					formatPrometheusLabels(sample.Labels, `le="+Inf"`), h.Count)
+				fmt.Fprintf(bw, "%s_sum%s %s\n", family.Name,
+					formatPrometheusLabels(sample.Labels, ""), formatPrometheusValue(h.Sum))
+				fmt.Fprintf(bw, "%s_count%s %d\n", family.Name,
+					formatPrometheusLabels(sample.Labels, ""), h.Count)
+				continue
+			}
+
+			fmt.Fprintf(bw, "%s%s %s\n", family.Name,
+				formatPrometheusLabels(sample.Labels, ""), formatPrometheusValue(sample.Value))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// mergeMetricFamilies merges the families of the same name from many
+// registries, e.g. of the stacks in a process
+func mergeMetricFamilies(registries []*MetricsRegistry) []MetricFamily {
+	var merged []MetricFamily
+	index := make(map[string]int)
+
+	for _, registry := range registries {
+		for _, family := range registry.Gather() {
+			if i, ok := index[family.Name]; ok {
+				merged[i].Samples = append(merged[i].Samples, family.Samples...)
+				continue
+			}
+			index[family.Name] = len(merged)
+			merged = append(merged, family)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+	return merged
+}
+
+// NewMetricsHandler returns the http handler exporting the metrics of
+// the registries, PrometheusExporter is used if exporter is nil
+func NewMetricsHandler(exporter MetricsExporter, registries ...*MetricsRegistry) http.Handler {
+	if exporter == nil {
+		exporter = PrometheusExporter{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", exporter.ContentType())
+		if err := exporter.Export(w, mergeMetricFamilies(registries)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+
+	counter := registry.Counter("test_total", "Test counter.", Labels{"kind": "a"})
+	counter.Add(2)
+	counter.Inc()
+
+	if registry.Counter("test_total", "Test counter.", Labels{"kind": "a"}) != counter {
+		t.Fatal("Counter is registered twice")
+	}
+
+	registry.Gauge("test_gauge", "Test gauge.", nil).Set(1.5)
+
+	h := registry.Histogram("test_seconds", "Test histogram.", nil, []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	registry.SetConstLabels(Labels{"ustack": "S"})
+
+	b := &strings.Builder{}
+	if err := (PrometheusExporter{}).Export(b, registry.Gather()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge{ustack="S"} 1.5
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{ustack="S",le="0.1"} 1
+test_seconds_bucket{ustack="S",le="1"} 2
+test_seconds_bucket{ustack="S",le="+Inf"} 3
+test_seconds_sum{ustack="S"} 5.55
+test_seconds_count{ustack="S"} 3
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a",ustack="S"} 3
+`
+	if b.String() != expected {
+		t.Fatal("Unexpected exposition:\n" + b.String())
+	}
+
+	registry.Unregister("test_total", Labels{"kind": "a"})
+	for _, family := range registry.Gather() {
+		if family.Name == "test_total" {
+			t.Fatal("Unregistered metric is gathered")
+		}
+	}
+}
+
+func TestUStackMetrics(t *testing.T) {
+	ep := NewEndPoint("Metrics:EP-0", 0)
+
+	stack := NewUStack().
+		SetName("Metrics").
+		AddEndPoint(ep).
+		AppendDataProcessor(NewFilter(func(context Context, toUpper bool) bool { return false })).
+		Run()
+	defer stack.Stop(context.Background())
+
+	filter := stack.GetDataProcessor("Filter")
+	filter.OnUpperData(NewUStackContext().SetConnection(&dummyConnection{name: "c"}))
+
+	server := httptest.NewServer(NewMetricsHandler(nil, stack.GetMetrics()))
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	for _, line := range []string{
+		`ustack_connections{ustack="Metrics"} 0`,
+		`ustack_endpoint_queue_length{endpoint="Metrics:EP-0",queue="rx",ustack="Metrics"} 0`,
+		fmt.Sprintf(`ustack_filtered_total{direction="down",instance="%d",processor="Filter",ustack="Metrics"} 1`,
+			filter.(*Filter).instance),
+		`ustack_messages_total{direction="up",ustack="Metrics"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatal("Missing", line, "in:\n"+string(body))
+		}
+	}
+
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatal("Unexpected content type:", ct)
+	}
+}
+
+// gatherSamples returns the number of samples of the metric name
+func gatherSamples(registry *MetricsRegistry, name string) int {
+	for _, family := range registry.Gather() {
+		if family.Name == name {
+			return len(family.Samples)
+		}
+	}
+	return 0
+}
+
+func TestUStackMetricsUnregister(t *testing.T) {
+	rpc := NewRPCEndPoint("Metrics:RPC", 1)
+
+	stack := NewUStack().
+		SetName("Metrics").
+		AddEndPoint(rpc).
+		AppendDataProcessor(NewStatCounter()).
+		AppendDataProcessor(NewStatCounter()).
+		Run()
+	defer stack.Stop(context.Background())
+
+	registry := stack.GetMetrics()
+
+	// the processors of the same name do not collide
+	if n := gatherSamples(registry, "ustack_statcounter_messages_total"); n != 4 {
+		t.Fatal("Expect 4 series of the two processors, got", n)
+	}
+
+	for _, dp := range stack.GetDataProcessors() {
+		dp.(*StatCounter).ReportError(nil, DataDirectionUp, ErrBadFormat)
+	}
+	if n := gatherSamples(registry, "ustack_processing_errors_total"); n != 2 {
+		t.Fatal("Expect 2 series of processing errors, got", n)
+	}
+
+	if err := stack.ReplaceDataProcessor("StatCounter", NewStatCounter()); err != nil {
+		t.Fatal(err)
+	}
+	if n := gatherSamples(registry, "ustack_statcounter_messages_total"); n != 4 {
+		t.Fatal("Expect 4 series after replaced, got", n)
+	}
+	if n := gatherSamples(registry, "ustack_processing_errors_total"); n != 1 {
+		t.Fatal("Expect 1 series of processing errors after replaced, got", n)
+	}
+
+	if err := stack.RemoveDataProcessor("StatCounter"); err != nil {
+		t.Fatal(err)
+	}
+	if n := gatherSamples(registry, "ustack_statcounter_messages_total"); n != 2 {
+		t.Fatal("Expect 2 series after removed, got", n)
+	}
+
+	if n := gatherSamples(registry, "ustack_rpc_calls_in_flight"); n != 1 {
+		t.Fatal("Expect the series of the endpoint, got", n)
+	}
+
+	stack.DeleteEndPoint(rpc)
+	for _, name := range []string{"ustack_rpc_call_duration_seconds", "ustack_rpc_calls_in_flight", "ustack_endpoint_queue_length"} {
+		if n := gatherSamples(registry, name); n != 0 {
+			t.Fatal("Unexpected", n, "series of", name, "after the endpoint deleted")
+		}
+	}
+}
@@ -4,34 +4,109 @@
 
 package ustack
 
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// procBaseInstances numbers the instances of data processors
+var procBaseInstances uint64
+
+// StateAllocFn allocates the state a data processor keeps for a connection
+type StateAllocFn func(connection TransportConnection) interface{}
+
+// connectionStates keeps the per-connection states of a data processor
+type connectionStates struct {
+	sync.Mutex
+	alloc  StateAllocFn
+	states map[TransportConnection]interface{}
+}
+
+// processorOptions may be set by management while the data processor
+// is running
+type processorOptions struct {
+	sync.RWMutex
+	values map[string]interface{}
+}
+
+// processorLinks keeps the neighbours of a data processor, they may be
+// changed while the data is flowing, see UStack.InsertDataProcessor
+type processorLinks struct {
+	upper atomic.Value
+	lower atomic.Value
+}
+
+// processorHolder makes the stored type of atomic.Value always the same
+type processorHolder struct {
+	dp DataProcessor
+}
+
+// loadProcessor ...
+func loadProcessor(v *atomic.Value) DataProcessor {
+	if holder, ok := v.Load().(processorHolder); ok {
+		return holder.dp
+	}
+	return nil
+}
+
 // ProcBase as a special data processor is used to manage and maintain
 // the common operations of all data processor. it is usually embedded
 // in other data processor and should NOT be used directly
 type ProcBase struct {
 	where     DataProcessor
 	name      string
-	enable    bool
+	enable    int32
 	ustack    UStack
 	forServer bool
-	options   map[string]interface{}
-	upper     DataProcessor
-	lower     DataProcessor
+	instance  uint64
+	options   *processorOptions
+	links     *processorLinks
+	routines  *routineGroup
+	states    *connectionStates
+	logger    *loggerValue
 }
 
 // NewProcBaseInstance returns a new instance
 func NewProcBaseInstance(name string) ProcBase {
 	base := ProcBase{
 		name:      name,
-		enable:    true,
+		enable:    1,
 		ustack:    nil,
 		forServer: true,
-		options:   make(map[string]interface{}),
+		instance:  atomic.AddUint64(&procBaseInstances, 1),
+		options: &processorOptions{
+			values: make(map[string]interface{}),
+		},
+		links:    &processorLinks{},
+		routines: newRoutineGroup(),
+		states: &connectionStates{
+			states: make(map[TransportConnection]interface{}, 16),
+		},
+		logger: newLoggerValue(),
 	}
 	// by default is itself
 	base.where = &base
 	return base
 }
 
+// metricsLabels returns labels with the name and the instance of the data
+// processor, the instance tells apart the ones of the same name
+func (base *ProcBase) metricsLabels(labels Labels) Labels {
+	labels["processor"] = base.name
+	labels["instance"] = strconv.FormatUint(base.instance, 10)
+	return labels
+}
+
+// unregisterErrorMetrics deletes the processing errors counted by
+// ReportError
+func (base *ProcBase) unregisterErrorMetrics(registry *MetricsRegistry) {
+	for _, direction := range []string{DataDirectionUp, DataDirectionDown} {
+		registry.Unregister("ustack_processing_errors_total",
+			base.metricsLabels(Labels{"direction": direction}))
+	}
+}
+
 // NewProcBase return a new instance that meets for DataProcessor interface
 func NewProcBase() DataProcessor {
 	base := NewProcBaseInstance("ProcBase")
@@ -61,28 +136,57 @@ func (base *ProcBase) GetOverhead() int {
 }
 
 // SetOption set the options
-//     name: option name
-//     value: option value
+//
+//	name: option name
+//	value: option value
 func (base *ProcBase) SetOption(name string, value interface{}) DataProcessor {
-	base.options[name] = value
+	base.options.Lock()
+	defer base.options.Unlock()
+
+	base.options.values[name] = value
 	return base.where
 }
 
 // GetOption returns the option vaule of given name
 // return nil if the option does not exist
 func (base *ProcBase) GetOption(name string) interface{} {
-	if value, ok := base.options[name]; ok {
+	base.options.RLock()
+	defer base.options.RUnlock()
+
+	if value, ok := base.options.values[name]; ok {
 		return value
 	}
 	return nil
 }
 
+// GetOptions returns a copy of all options
+func (base *ProcBase) GetOptions() map[string]interface{} {
+	base.options.RLock()
+	defer base.options.RUnlock()
+
+	options := make(map[string]interface{}, len(base.options.values))
+	for name, value := range base.options.values {
+		options[name] = value
+	}
+	return options
+}
+
 // SetEnable enable(true) or disable(false) the DataProcessor
 func (base *ProcBase) SetEnable(enable bool) DataProcessor {
-	base.enable = enable
+	if enable {
+		atomic.StoreInt32(&base.enable, 1)
+	} else {
+		atomic.StoreInt32(&base.enable, 0)
+	}
 	return base.where
 }
 
+// IsEnabled returns true if the DataProcessor is enabled, it may be
+// changed while the data is flowing
+func (base *ProcBase) IsEnabled() bool {
+	return atomic.LoadInt32(&base.enable) == 1
+}
+
 // ForServer set
 func (base *ProcBase) ForServer(forServer bool) DataProcessor {
 	base.forServer = forServer
@@ -95,18 +199,157 @@ func (base *ProcBase) SetUStack(ustack UStack) DataProcessor {
 	return base.where
 }
 
+// SetLogger set the logger, it is usually inherited from UStack
+func (base *ProcBase) SetLogger(logger Logger) DataProcessor {
+	base.logger.set(loggerOrSilent(logger).With("processor", base.name))
+	return base.where
+}
+
+// GetLogger returns the logger, the silent logger if none is set
+func (base *ProcBase) GetLogger() Logger {
+	return base.logger.get()
+}
+
+// ReportError publishes UStackEventProcessingError for the data the data
+// processor failed to handle
+func (base *ProcBase) ReportError(context Context, direction string, err error) {
+	perr := &ProcessingError{
+		Processor: base.name,
+		Direction: direction,
+		Context:   context,
+		Err:       err,
+	}
+
+	keyvals := []interface{}{"direction", direction, "error", err}
+
+	if context != nil {
+		if connection := context.GetConnection(); connection != nil {
+			keyvals = append(keyvals, "connection", connection.GetName())
+		}
+		if session, ok := OptionParseInt(context.GetOption("session"), 0); ok {
+			keyvals = append(keyvals, "session", session)
+		}
+		perr.EndPoint, _ = context.GetOption("endpoint").(EndPoint)
+		perr.EndPointData, _ = context.GetOption("endpointData").(EndPointData)
+	}
+
+	base.GetLogger().Warn("processing error", keyvals...)
+
+	if base.ustack == nil {
+		return
+	}
+
+	base.ustack.GetMetrics().Counter("ustack_processing_errors_total",
+		"The number of data dropped by the processing errors.",
+		base.metricsLabels(Labels{"direction": direction})).Inc()
+
+	base.ustack.PublishEvent(Event{
+		Type:   UStackEventProcessingError,
+		Source: base.where,
+		Data:   perr,
+	})
+}
+
+// SetStateAllocator set the function to allocate the per-connection
+// state, the state is allocated when a connection is coming and released
+// when it is closed
+func (base *ProcBase) SetStateAllocator(alloc StateAllocFn) DataProcessor {
+	base.states.Lock()
+	defer base.states.Unlock()
+
+	base.states.alloc = alloc
+	return base.where
+}
+
+// GetState returns the state of the connection, it is allocated if the
+// connection was unknown, e.g. the data processor was added after the
+// connection coming. returns nil if no allocator was set
+func (base *ProcBase) GetState(connection TransportConnection) interface{} {
+	base.states.Lock()
+	defer base.states.Unlock()
+
+	if state, ok := base.states.states[connection]; ok {
+		return state
+	}
+
+	if base.states.alloc == nil {
+		return nil
+	}
+
+	state := base.states.alloc(connection)
+
+	// do not keep the state of a closed connection, it would never be
+	// released
+	if !connection.Closed() {
+		base.states.states[connection] = state
+	}
+
+	return state
+}
+
+// RangeStates calls fn for each connection state until fn returns false
+func (base *ProcBase) RangeStates(fn func(connection TransportConnection, state interface{}) bool) {
+	base.states.Lock()
+	states := make(map[TransportConnection]interface{}, len(base.states.states))
+	for connection, state := range base.states.states {
+		states[connection] = state
+	}
+	base.states.Unlock()
+
+	for connection, state := range states {
+		if !fn(connection, state) {
+			return
+		}
+	}
+}
+
+// allocState is called by UStack when a connection is coming
+func (base *ProcBase) allocState(connection TransportConnection) {
+	base.GetState(connection)
+}
+
+// releaseState is called by UStack when a connection is closed
+func (base *ProcBase) releaseState(connection TransportConnection) {
+	base.states.Lock()
+	defer base.states.Unlock()
+
+	delete(base.states.states, connection)
+}
+
+// releaseClosedStates releases the states of all closed connections
+func (base *ProcBase) releaseClosedStates() {
+	base.states.Lock()
+	defer base.states.Unlock()
+
+	for connection := range base.states.states {
+		if connection.Closed() {
+			delete(base.states.states, connection)
+		}
+	}
+}
+
 // SetUpper set upper data processor instance
 func (base *ProcBase) SetUpper(upper DataProcessor) DataProcessor {
-	base.upper = upper
+	base.links.upper.Store(processorHolder{dp: upper})
 	return base.where
 }
 
 // SetLower set lower data processor instance
 func (base *ProcBase) SetLower(lower DataProcessor) DataProcessor {
-	base.lower = lower
+	base.links.lower.Store(processorHolder{dp: lower})
 	return base.where
 }
 
+// GetUpper returns upper data processor instance
+func (base *ProcBase) GetUpper() DataProcessor {
+	return loadProcessor(&base.links.upper)
+}
+
+// GetLower returns lower data processor instance
+func (base *ProcBase) GetLower() DataProcessor {
+	return loadProcessor(&base.links.lower)
+}
+
 // OnUpperData is called when upper layer sending data
 func (base *ProcBase) OnUpperData(context Context) {
 }
@@ -121,5 +364,15 @@ func (base *ProcBase) OnEvent(event Event) {
 
 // Run starts the data processor
 func (base *ProcBase) Run() DataProcessor {
+	base.routines.restart()
+
+	return base.where
+}
+
+// Stop asks the goroutines of the data processor to quit and waits
+// for them to exit
+func (base *ProcBase) Stop() DataProcessor {
+	base.routines.stop()
+	base.routines.wait()
 	return base.where
 }
@@ -0,0 +1,196 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// brokerSubscription is a pattern subscribed by the endpoint of session
+type brokerSubscription struct {
+	pattern string
+	session int
+}
+
+// brokerState is the subscriptions of a connection, the sessions of a
+// connection subscribe the same pattern separately
+type brokerState struct {
+	sync.Mutex
+	subscriptions map[brokerSubscription]bool
+}
+
+// Broker routes the pub/sub frames of PubSub, it is the top of the stack
+// acting as message bus. It keeps the subscriptions of each connection
+// until the connection is closed, and sends the published messages to
+// all the matched subscribers, the publisher included, once per session
+// of a connection. The session of subscriber is set to the context
+// option "session", so a SessionResolver may be put below.
+type Broker struct {
+	ProcBase
+	published uint64
+	delivered uint64
+}
+
+// NewBroker ...
+func NewBroker() DataProcessor {
+	bk := &Broker{
+		ProcBase: NewProcBaseInstance("Broker"),
+	}
+	bk.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &brokerState{
+			subscriptions: make(map[brokerSubscription]bool),
+		}
+	})
+	return bk.ProcBase.SetWhere(bk)
+}
+
+// GetOverhead returns the overhead, the topic is not counted
+func (bk *Broker) GetOverhead() int {
+	return PubSubHeaderSizeInByte
+}
+
+// OnUpperData passes the data as is, the broker publishes by Publish
+func (bk *Broker) OnUpperData(context Context) {
+	bk.GetLower().OnUpperData(context)
+}
+
+// OnLowerData ...
+func (bk *Broker) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() {
+		bk.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	kind, topic, err := readPubSubHeader(ub)
+	if err != nil {
+		bk.ReportError(context, DataDirectionUp, err)
+		return
+	}
+
+	switch kind {
+	case PubSubKindPublish:
+		if err := ValidateTopic(topic); err != nil {
+			bk.ReportError(context, DataDirectionUp, err)
+			return
+		}
+
+		payload := make([]byte, ub.ReadableLength())
+		ub.Read(payload)
+
+		bk.Publish(topic, payload)
+	case PubSubKindSubscribe, PubSubKindUnsubscribe:
+		if err := ValidatePattern(topic); err != nil {
+			bk.ReportError(context, DataDirectionUp, err)
+			return
+		}
+
+		session, _ := OptionParseInt(context.GetOption("session"), 0)
+		state := bk.GetState(context.GetConnection()).(*brokerState)
+
+		subscription := brokerSubscription{pattern: topic, session: session}
+
+		state.Lock()
+		if kind == PubSubKindSubscribe {
+			state.subscriptions[subscription] = true
+		} else {
+			delete(state.subscriptions, subscription)
+		}
+		state.Unlock()
+
+		bk.GetLogger().Debug("subscription", "connection", context.GetConnection().GetName(),
+			"kind", kind, "pattern", topic, "session", session)
+	default:
+		bk.ReportError(context, DataDirectionUp, ErrBadFormat)
+	}
+}
+
+// Publish sends the payload to the subscribers of the topic
+func (bk *Broker) Publish(topic string, payload []byte) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&bk.published, 1)
+
+	bk.RangeStates(func(connection TransportConnection, s interface{}) bool {
+		if connection.Closed() {
+			return true
+		}
+
+		state := s.(*brokerState)
+
+		sessions := make(map[int]bool)
+		state.Lock()
+		for subscription := range state.subscriptions {
+			if TopicMatch(subscription.pattern, topic) {
+				sessions[subscription.session] = true
+			}
+		}
+		state.Unlock()
+
+		for session := range sessions {
+			ub := allocPubSubBuffer(bk.ustack, topic, len(payload))
+			ub.Write(payload)
+
+			bk.GetLower().OnUpperData(
+				NewUStackContext().
+					SetConnection(connection).
+					SetBuffer(writePubSubHeader(bk.ustack, ub, PubSubKindPublish, topic)).
+					SetOption("session", session))
+
+			atomic.AddUint64(&bk.delivered, 1)
+		}
+
+		return true
+	})
+
+	return nil
+}
+
+// GetSubscriptions returns the sorted patterns subscribed on each
+// connection by the name of connection, a pattern subscribed by many
+// sessions is listed once
+func (bk *Broker) GetSubscriptions() map[string][]string {
+	subscriptions := make(map[string][]string)
+
+	bk.RangeStates(func(connection TransportConnection, s interface{}) bool {
+		state := s.(*brokerState)
+
+		state.Lock()
+		unique := make(map[string]bool, len(state.subscriptions))
+		for subscription := range state.subscriptions {
+			unique[subscription.pattern] = true
+		}
+		state.Unlock()
+
+		patterns := make([]string, 0, len(unique))
+		for pattern := range unique {
+			patterns = append(patterns, pattern)
+		}
+
+		if len(patterns) > 0 {
+			sort.Strings(patterns)
+			subscriptions[connection.GetName()] = patterns
+		}
+		return true
+	})
+
+	return subscriptions
+}
+
+// GetStats returns the counters of published and delivered messages
+func (bk *Broker) GetStats() map[string]interface{} {
+	return map[string]interface{}{
+		"published": atomic.LoadUint64(&bk.published),
+		"delivered": atomic.LoadUint64(&bk.delivered),
+	}
+}
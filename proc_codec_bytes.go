@@ -20,7 +20,7 @@ func NewBytesCodec() DataProcessor {
 // OnUpperData ...
 func (bc *BytesCodec) OnUpperData(context Context) {
 
-	if bc.enable {
+	if bc.IsEnabled() && !skipNoPayload(bc.ustack, context) {
 		message := context.GetMessage()
 		if message == nil {
 			return
@@ -31,9 +31,7 @@ func (bc *BytesCodec) OnUpperData(context Context) {
 			return
 		}
 
-		ub := UBufAllocWithHeadReserved(
-			bc.ustack.GetMTU(),
-			bc.ustack.GetOverhead())
+		ub := allocCodecBuffer(bc.ustack, len(bytes))
 
 		n, err := ub.Write(bytes)
 		if n == 0 || err != nil {
@@ -43,12 +41,12 @@ func (bc *BytesCodec) OnUpperData(context Context) {
 		context.SetBuffer(ub)
 	}
 
-	bc.lower.OnUpperData(context)
+	bc.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (bc *BytesCodec) OnLowerData(context Context) {
-	if bc.enable {
+	if bc.IsEnabled() && !skipNoPayload(bc.ustack, context) {
 		ub := context.GetBuffer()
 		if ub == nil {
 			return
@@ -64,5 +62,5 @@ func (bc *BytesCodec) OnLowerData(context Context) {
 		context.SetMessage(bytes)
 	}
 
-	bc.upper.OnLowerData(context)
+	bc.GetUpper().OnLowerData(context)
 }
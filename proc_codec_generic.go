@@ -5,7 +5,8 @@
 package ustack
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"io"
 )
 
@@ -18,6 +19,35 @@ type EncoderFn func(message interface{}, w io.Writer) error
 // EncoderFn does decode data from io.Reader to message
 type DecoderFn func(r io.Reader) (message interface{}, err error)
 
+// allocCodecBuffer returns a buffer for size bytes with the head space
+// reserved for the overhead of the stack, it is larger than the MTU if
+// the bytes do not fit, see Fragmenter
+func allocCodecBuffer(ustack UStack, size int) *UBuf {
+	overhead := ustack.GetOverhead()
+
+	capacity := ustack.GetMTU()
+	if size+overhead > capacity {
+		capacity = size + overhead
+	}
+
+	return UBufAllocWithHeadReserved(capacity, overhead)
+}
+
+// skipNoPayload returns true if the context has option "noPayload",
+// e.g. the error reply of RPCEndPoint, the codecs pass it as is, an empty
+// buffer is prepared if it is going down
+func skipNoPayload(ustack UStack, context Context) bool {
+	noPayload, _ := OptionParseBool(context.GetOption("noPayload"), false)
+	if !noPayload {
+		return false
+	}
+
+	if context.GetBuffer() == nil {
+		context.SetBuffer(allocCodecBuffer(ustack, 0))
+	}
+	return true
+}
+
 // GenericCodec ...
 type GenericCodec struct {
 	ProcBase
@@ -42,39 +72,40 @@ func NewGenericCodec(init InitFn, encoder EncoderFn, decoder DecoderFn) DataProc
 
 // OnUpperData ...
 func (gc *GenericCodec) OnUpperData(context Context) {
-	if gc.enable {
+	if gc.IsEnabled() && !skipNoPayload(gc.ustack, context) {
 		if gc.encoder == nil {
-			fmt.Println("GenericCodec: not found the encoder")
+			gc.ReportError(context, DataDirectionDown, errors.New("encoder not found"))
 			return
 		}
 
 		message := context.GetMessage()
 		if message == nil {
-			fmt.Println("GenericCodec: invalid message data")
+			gc.ReportError(context, DataDirectionDown, ErrNoMessage)
 			return
 		}
 
-		ub := UBufAllocWithHeadReserved(
-			gc.ustack.GetMTU(),
-			gc.ustack.GetOverhead())
+		encoded := &bytes.Buffer{}
 
-		err := gc.encoder(message, ub)
+		err := gc.encoder(message, encoded)
 		if err != nil {
-			fmt.Println("GenericCodec: encode error:")
+			gc.ReportError(context, DataDirectionDown, err)
 			return
 		}
 
+		ub := allocCodecBuffer(gc.ustack, encoded.Len())
+		ub.Write(encoded.Bytes())
+
 		context.SetBuffer(ub)
 	}
 
-	gc.lower.OnUpperData(context)
+	gc.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (gc *GenericCodec) OnLowerData(context Context) {
-	if gc.enable {
+	if gc.IsEnabled() && !skipNoPayload(gc.ustack, context) {
 		if gc.decoder == nil {
-			fmt.Println("GenericCodec: not found the decoder")
+			gc.ReportError(context, DataDirectionUp, errors.New("decoder not found"))
 			return
 		}
 
@@ -85,12 +116,12 @@ func (gc *GenericCodec) OnLowerData(context Context) {
 
 		message, err := gc.decoder(ub)
 		if err != nil {
-			fmt.Println("GenericCodec: encode error:", err)
+			gc.ReportError(context, DataDirectionUp, err)
 			return
 		}
 
 		context.SetMessage(message)
 	}
 
-	gc.upper.OnLowerData(context)
+	gc.GetUpper().OnLowerData(context)
 }
@@ -5,8 +5,8 @@
 package ustack
 
 import (
+	"bytes"
 	"encoding/gob"
-	"fmt"
 	"reflect"
 )
 
@@ -27,31 +27,32 @@ func NewGOBCodec(t reflect.Type) DataProcessor {
 
 // OnUpperData ...
 func (g *GOBCodec) OnUpperData(context Context) {
-	if g.enable {
+	if g.IsEnabled() && !skipNoPayload(g.ustack, context) {
 		message := context.GetMessage()
 		if message == nil {
 			return
 		}
 
-		ub := UBufAllocWithHeadReserved(
-			g.ustack.GetMTU(),
-			g.ustack.GetOverhead())
+		encoded := &bytes.Buffer{}
 
-		err := gob.NewEncoder(ub).Encode(message)
+		err := gob.NewEncoder(encoded).Encode(message)
 		if err != nil {
-			fmt.Println("GOBCodec: gob encode error:", err)
+			g.ReportError(context, DataDirectionDown, err)
 			return
 		}
 
+		ub := allocCodecBuffer(g.ustack, encoded.Len())
+		ub.Write(encoded.Bytes())
+
 		context.SetBuffer(ub)
 	}
 
-	g.lower.OnUpperData(context)
+	g.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (g *GOBCodec) OnLowerData(context Context) {
-	if g.enable {
+	if g.IsEnabled() && !skipNoPayload(g.ustack, context) {
 		ub := context.GetBuffer()
 		if ub == nil {
 			return
@@ -60,12 +61,12 @@ func (g *GOBCodec) OnLowerData(context Context) {
 		objectItf := reflect.New(g.objectType).Interface()
 		err := gob.NewDecoder(ub).Decode(objectItf)
 		if err != nil {
-			fmt.Println("GOBCodec: gob encode error:", err)
+			g.ReportError(context, DataDirectionUp, err)
 			return
 		}
 
 		context.SetMessage(objectItf)
 	}
 
-	g.upper.OnLowerData(context)
+	g.GetUpper().OnLowerData(context)
 }
@@ -6,7 +6,6 @@ package ustack
 
 import (
 	"encoding/json"
-	"fmt"
 	"reflect"
 )
 
@@ -27,7 +26,7 @@ func NewJSONCodec(t reflect.Type) DataProcessor {
 
 // OnUpperData ...
 func (jc *JSONCodec) OnUpperData(context Context) {
-	if jc.enable {
+	if jc.IsEnabled() && !skipNoPayload(jc.ustack, context) {
 		message := context.GetMessage()
 		if message == nil {
 			return
@@ -35,28 +34,30 @@ func (jc *JSONCodec) OnUpperData(context Context) {
 
 		jsonBytes, err := json.Marshal(message)
 		if err != nil {
-			fmt.Println("JSONCodec: failed to json marshal", err)
+			jc.ReportError(context, DataDirectionDown, err)
 			return
 		}
 
-		ub := UBufAllocWithHeadReserved(
-			jc.ustack.GetMTU(),
-			jc.ustack.GetOverhead())
+		ub := allocCodecBuffer(jc.ustack, len(jsonBytes))
 
 		n, err := ub.Write(jsonBytes)
-		if n == 0 || err != nil {
+		if err != nil {
+			jc.ReportError(context, DataDirectionDown, err)
+			return
+		}
+		if n == 0 {
 			return
 		}
 
 		context.SetBuffer(ub)
 	}
 
-	jc.lower.OnUpperData(context)
+	jc.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (jc *JSONCodec) OnLowerData(context Context) {
-	if jc.enable {
+	if jc.IsEnabled() && !skipNoPayload(jc.ustack, context) {
 		ub := context.GetBuffer()
 		if ub == nil {
 			return
@@ -65,19 +66,23 @@ func (jc *JSONCodec) OnLowerData(context Context) {
 		data := make([]byte, ub.ReadableLength())
 		
 		n, err := ub.Read(data)
-		if n == 0 || err != nil {
+		if err != nil {
+			jc.ReportError(context, DataDirectionUp, err)
+			return
+		}
+		if n == 0 {
 			return
 		}
 
 		objectItf := reflect.New(jc.objectType).Interface()
 		err = json.Unmarshal(data, objectItf)
 		if err != nil {
-			fmt.Println("JSONCodec: failed to json marshal", err)
+			jc.ReportError(context, DataDirectionUp, err)
 			return
 		}
 
 		context.SetMessage(objectItf)
 	}
 
-	jc.upper.OnLowerData(context)
+	jc.GetUpper().OnLowerData(context)
 }
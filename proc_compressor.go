@@ -0,0 +1,294 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// the one-byte header of compressed message
+const (
+	CompressorAlgorithmRaw   byte = 0x00
+	CompressorAlgorithmFlate byte = 0x01
+	CompressorAlgorithmGzip  byte = 0x02
+	CompressorAlgorithmZlib  byte = 0x03
+)
+
+// ErrDecompressedTooLarge is the cause of ProcessingError if the message
+// is larger than MaxDecompressedSize after being decompressed
+var ErrDecompressedTooLarge = errors.New("decompressed message too large")
+
+// compressorAlgorithms maps the option values to the headers
+var compressorAlgorithms = map[string]byte{
+	"flate": CompressorAlgorithmFlate,
+	"gzip":  CompressorAlgorithmGzip,
+	"zlib":  CompressorAlgorithmZlib,
+}
+
+// Compressor compresses the buffers from upper with one-byte header
+// telling the algorithm, the receiver supports all the algorithms
+// whatever it is configured to send.
+//
+// Options:
+//
+//	Algorithm: string, "flate", "gzip" or "zlib", "flate" by default
+//	Level: int, the compression level, flate.DefaultCompression by default
+//	MinSize: int, 256 by default, the smaller buffers are sent raw
+//	MaxDecompressedSize: int, 16MB by default
+type Compressor struct {
+	ProcBase
+	algorithm           byte
+	level               int
+	minSize             int
+	maxDecompressedSize int
+	// tx: bytes from upper and bytes sent to lower
+	txRawBytes        uint64
+	txCompressedBytes uint64
+	// rx: bytes from lower and bytes passed to upper
+	rxCompressedBytes uint64
+	rxRawBytes        uint64
+}
+
+// NewCompressor ...
+func NewCompressor() DataProcessor {
+	cp := &Compressor{
+		ProcBase:            NewProcBaseInstance("Compressor"),
+		algorithm:           CompressorAlgorithmFlate,
+		level:               flate.DefaultCompression,
+		minSize:             256,
+		maxDecompressedSize: 16 * 1024 * 1024,
+	}
+	return cp.ProcBase.SetWhere(cp)
+}
+
+// GetOverhead returns the overhead
+func (cp *Compressor) GetOverhead() int {
+	return 1
+}
+
+// compress writes the compressed data to w
+func (cp *Compressor) compress(w io.Writer, data []byte) error {
+	var zw io.WriteCloser
+	var err error
+
+	switch cp.algorithm {
+	case CompressorAlgorithmGzip:
+		zw, err = gzip.NewWriterLevel(w, cp.level)
+	case CompressorAlgorithmZlib:
+		zw, err = zlib.NewWriterLevel(w, cp.level)
+	default:
+		zw, err = flate.NewWriter(w, cp.level)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decompress returns the reader of decompressed data
+func (cp *Compressor) decompress(algorithm byte, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressorAlgorithmFlate:
+		return flate.NewReader(r), nil
+	case CompressorAlgorithmGzip:
+		return gzip.NewReader(r)
+	case CompressorAlgorithmZlib:
+		return zlib.NewReader(r)
+	}
+	return nil, ErrBadFormat
+}
+
+// OnUpperData ...
+func (cp *Compressor) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() {
+		cp.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		cp.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	size := ub.ReadableLength()
+
+	if !cp.IsEnabled() || size < cp.minSize {
+		if err := ub.WriteHeadByte(CompressorAlgorithmRaw); err != nil {
+			cp.ReportError(context, DataDirectionDown, err)
+			return
+		}
+		cp.GetLower().OnUpperData(context)
+		return
+	}
+
+	data := make([]byte, size)
+	ub.Peek(data)
+
+	compressed := &bytes.Buffer{}
+	if err := cp.compress(compressed, data); err != nil {
+		cp.ReportError(context, DataDirectionDown, err)
+		return
+	}
+
+	atomic.AddUint64(&cp.txRawBytes, uint64(size))
+
+	// not worth it
+	if compressed.Len() >= size {
+		atomic.AddUint64(&cp.txCompressedBytes, uint64(size))
+
+		if err := ub.WriteHeadByte(CompressorAlgorithmRaw); err != nil {
+			cp.ReportError(context, DataDirectionDown, err)
+			return
+		}
+		cp.GetLower().OnUpperData(context)
+		return
+	}
+
+	atomic.AddUint64(&cp.txCompressedBytes, uint64(compressed.Len()))
+
+	cub := allocCodecBuffer(cp.ustack, compressed.Len())
+	cub.Write(compressed.Bytes())
+	if err := cub.WriteHeadByte(cp.algorithm); err != nil {
+		cp.ReportError(context, DataDirectionDown, err)
+		return
+	}
+
+	context.SetBuffer(cub)
+
+	cp.GetLower().OnUpperData(context)
+}
+
+// OnLowerData ...
+func (cp *Compressor) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() {
+		cp.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	algorithm, err := ub.ReadByte()
+	if err != nil {
+		cp.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	if algorithm == CompressorAlgorithmRaw {
+		cp.GetUpper().OnLowerData(context)
+		return
+	}
+
+	size := ub.ReadableLength()
+
+	// UBuf returns no io.EOF when it is drained
+	compressed := make([]byte, size)
+	ub.Read(compressed)
+
+	zr, err := cp.decompress(algorithm, bytes.NewReader(compressed))
+	if err != nil {
+		cp.ReportError(context, DataDirectionUp, err)
+		return
+	}
+	defer zr.Close()
+
+	// read one more byte to know if it exceeds the limit
+	data, err := ioutil.ReadAll(io.LimitReader(zr, int64(cp.maxDecompressedSize)+1))
+	if err != nil {
+		cp.ReportError(context, DataDirectionUp, err)
+		return
+	}
+	if len(data) > cp.maxDecompressedSize {
+		cp.ReportError(context, DataDirectionUp, ErrDecompressedTooLarge)
+		return
+	}
+
+	atomic.AddUint64(&cp.rxCompressedBytes, uint64(size))
+	atomic.AddUint64(&cp.rxRawBytes, uint64(len(data)))
+
+	if len(data) == 0 {
+		cp.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	message := UBufAlloc(len(data))
+	message.Write(data)
+
+	context.SetBuffer(message)
+
+	cp.GetUpper().OnLowerData(context)
+}
+
+// ratio returns raw/compressed, 0 if nothing is counted
+func ratio(raw uint64, compressed uint64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(raw) / float64(compressed)
+}
+
+// GetStats returns the byte counters and the compression ratios
+func (cp *Compressor) GetStats() map[string]interface{} {
+	txRawBytes := atomic.LoadUint64(&cp.txRawBytes)
+	txCompressedBytes := atomic.LoadUint64(&cp.txCompressedBytes)
+	rxRawBytes := atomic.LoadUint64(&cp.rxRawBytes)
+	rxCompressedBytes := atomic.LoadUint64(&cp.rxCompressedBytes)
+
+	return map[string]interface{}{
+		"txRawBytes":        txRawBytes,
+		"txCompressedBytes": txCompressedBytes,
+		"txRatio":           ratio(txRawBytes, txCompressedBytes),
+		"rxRawBytes":        rxRawBytes,
+		"rxCompressedBytes": rxCompressedBytes,
+		"rxRatio":           ratio(rxRawBytes, rxCompressedBytes),
+	}
+}
+
+// Run ...
+func (cp *Compressor) Run() DataProcessor {
+	algorithm, exists := OptionParseString(cp.GetOption("Algorithm"), "flate")
+	if value, ok := compressorAlgorithms[algorithm]; ok {
+		cp.algorithm = value
+	} else {
+		cp.GetLogger().Warn("unknown algorithm, flate is used", "algorithm", algorithm)
+	}
+	if exists {
+		cp.GetLogger().Info("option", "Algorithm", algorithm)
+	}
+
+	level, exists := OptionParseInt(cp.GetOption("Level"), flate.DefaultCompression)
+	cp.level = level
+	if exists {
+		cp.GetLogger().Info("option", "Level", cp.level)
+	}
+
+	minSize, exists := OptionParseInt(cp.GetOption("MinSize"), 256)
+	cp.minSize = minSize
+	if exists {
+		cp.GetLogger().Info("option", "MinSize", cp.minSize)
+	}
+
+	maxDecompressedSize, exists := OptionParseInt(cp.GetOption("MaxDecompressedSize"), 16*1024*1024)
+	cp.maxDecompressedSize = maxDecompressedSize
+	if exists {
+		cp.GetLogger().Info("option", "MaxDecompressedSize", cp.maxDecompressedSize)
+	}
+
+	return cp
+}
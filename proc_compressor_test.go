@@ -0,0 +1,85 @@
+package ustack
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"flate", "gzip", "zlib"} {
+		collector := newBufferCollector()
+
+		sender := NewCompressor().SetOption("Algorithm", algorithm)
+		// the stack counts the overhead of sender
+		stack := NewUStack().AppendDataProcessor(sender).Run()
+		defer stack.Stop(context.Background())
+		sender.SetLower(collector)
+
+		upper := newFrameCollector()
+
+		receiver := NewCompressor().SetUStack(NewUStack())
+		receiver.SetUpper(upper)
+		receiver.Run()
+
+		c := &dummyConnection{name: "c"}
+
+		for _, payload := range []string{"tiny", strings.Repeat(`{"key":"value"}`, 100)} {
+			ub := UBufAllocWithHeadReserved(len(payload)+1, 1)
+			ub.Write([]byte(payload))
+			sender.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+		}
+
+		if len(collector.buffers) != 2 {
+			t.Fatal("Unexpected buffer count:", len(collector.buffers))
+		}
+
+		if header, _ := collector.buffers[0].PeekByte(); header != CompressorAlgorithmRaw {
+			t.Fatal("Small buffer is compressed:", header)
+		}
+
+		if header, _ := collector.buffers[1].PeekByte(); header != compressorAlgorithms[algorithm] {
+			t.Fatal("Unexpected header:", header)
+		}
+
+		for _, ub := range collector.buffers {
+			receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+		}
+
+		got := upper.frames[c]
+		if len(got) != 2 || got[0] != "tiny" || got[1] != strings.Repeat(`{"key":"value"}`, 100) {
+			t.Fatal("Unexpected messages of", algorithm, got)
+		}
+
+		if stats := sender.(StatsProvider).GetStats(); stats["txRatio"].(float64) <= 1 {
+			t.Fatal("Unexpected ratio:", stats)
+		}
+	}
+}
+
+func TestCompressorNoHeadSpace(t *testing.T) {
+	var reported int32
+	collector := newBufferCollector()
+
+	sender := NewCompressor().SetUStack(NewUStack().
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventProcessingError {
+				atomic.AddInt32(&reported, 1)
+			}
+		}))
+	sender.SetLower(collector)
+	sender.Run()
+
+	// no room for the header
+	ub := UBufAlloc(4)
+	ub.Write([]byte("tiny"))
+	sender.OnUpperData(NewUStackContext().SetConnection(&dummyConnection{name: "c"}).SetBuffer(ub))
+
+	if len(collector.buffers) != 0 {
+		t.Fatal("Unexpected buffer count:", len(collector.buffers))
+	}
+	if n := atomic.LoadInt32(&reported); n != 1 {
+		t.Fatal("Expect 1 error, got", n)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+// the kinds of correlated message
+const (
+	// not a call, just passed to the data listener
+	RPCKindMessage byte = 0x00
+	RPCKindRequest byte = 0x01
+	RPCKindReply   byte = 0x02
+	// the payload is the error text instead of the message
+	RPCKindError byte = 0x03
+)
+
+// CorrelatorHeaderSizeInByte is 1 byte kind and 8 bytes big endian id
+const CorrelatorHeaderSizeInByte int = 9
+
+// Correlator stamps the kind and the id of RPCEndPoint calls, it should
+// be put below the codec. They are taken from the context options
+// "rpcKind" (byte) and "rpcID" (uint64) going down, and set to them
+// going up. For RPCKindError, the error text in option "rpcError" is the
+// payload, and the message passed up is *RPCError.
+type Correlator struct {
+	ProcBase
+}
+
+// NewCorrelator ...
+func NewCorrelator() DataProcessor {
+	cr := &Correlator{
+		ProcBase: NewProcBaseInstance("Correlator"),
+	}
+	return cr.ProcBase.SetWhere(cr)
+}
+
+// GetOverhead returns the overhead
+func (cr *Correlator) GetOverhead() int {
+	return CorrelatorHeaderSizeInByte
+}
+
+// OnUpperData ...
+func (cr *Correlator) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() || !cr.IsEnabled() {
+		cr.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		cr.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	kind, _ := OptionParseByte(context.GetOption("rpcKind"), RPCKindMessage)
+	id, _ := context.GetOption("rpcID").(uint64)
+
+	if kind == RPCKindError {
+		text, _ := OptionParseString(context.GetOption("rpcError"), "")
+		if _, err := ub.Write([]byte(text)); err != nil {
+			cr.ReportError(context, DataDirectionDown, err)
+			return
+		}
+	}
+
+	ub.WriteHeadU64BE(id)
+	ub.WriteHeadByte(kind)
+
+	cr.GetLower().OnUpperData(context)
+}
+
+// OnLowerData ...
+func (cr *Correlator) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() || !cr.IsEnabled() {
+		cr.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	if ub.ReadableLength() < CorrelatorHeaderSizeInByte {
+		cr.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	kind, _ := ub.ReadByte()
+	id, _ := ub.ReadU64BE()
+
+	context.SetOption("rpcKind", kind)
+	context.SetOption("rpcID", id)
+
+	if kind == RPCKindError {
+		text := make([]byte, ub.ReadableLength())
+		ub.Read(text)
+
+		context.SetOption("rpcError", string(text))
+		context.SetOption("noPayload", true)
+		context.SetMessage(&RPCError{Message: string(text)})
+	}
+
+	cr.GetUpper().OnLowerData(context)
+}
@@ -4,8 +4,6 @@
 
 package ustack
 
-import "fmt"
-
 // Discarder ...
 type Discarder struct {
 	ProcBase
@@ -21,14 +19,14 @@ func NewDiscarder() DataProcessor {
 
 // OnUpperData ...
 func (dis *Discarder) OnUpperData(context Context) {
-	dis.lower.OnUpperData(context)
+	dis.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (dis *Discarder) OnLowerData(context Context) {
-	if dis.enable {
-		fmt.Println("Discarder: drop the lowlayer data")
+	if dis.IsEnabled() {
+		dis.GetLogger().Debug("drop the lowlayer data")
 	} else {
-		dis.upper.OnLowerData(context)
+		dis.GetUpper().OnLowerData(context)
 	}
 }
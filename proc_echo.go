@@ -4,8 +4,6 @@
 
 package ustack
 
-import "fmt"
-
 // Echo ...
 type Echo struct {
 	ProcBase
@@ -21,15 +19,15 @@ func NewEcho() DataProcessor {
 
 // OnUpperData ...
 func (echo *Echo) OnUpperData(context Context) {
-	echo.lower.OnUpperData(context)
+	echo.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (echo *Echo) OnLowerData(context Context) {
-	if echo.enable {
-		fmt.Println("Echo: send back the lowlayer data")
-		echo.lower.OnUpperData(context)
+	if echo.IsEnabled() {
+		echo.GetLogger().Debug("send back the lowlayer data")
+		echo.GetLower().OnUpperData(context)
 	} else {
-		echo.upper.OnLowerData(context)
+		echo.GetUpper().OnLowerData(context)
 	}
 }
@@ -0,0 +1,629 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Encrypted Frame Format:
+//
+//	+---------+-----------+---------+-----------+---------------------+
+//	| type 1B | key id 1B | seq 8B  | nonce 12B | ciphertext with tag |
+//	+---------+-----------+---------+-----------+---------------------+
+//
+// The type, key id and seq are authenticated as the additional data of
+// AES-GCM, the seq is big endian and starts from 1 on each connection.
+// The handshake frame is the type followed by the X25519 public key.
+//
+// With pre-shared keys, each side sends a salt frame, the type followed
+// by 16 random bytes, when a connection is coming. The salt of receiver
+// is appended to the additional data, so a frame captured on one
+// connection can not be replayed on another.
+const (
+	EncryptorFrameTypeData      byte = 0x00
+	EncryptorFrameTypeHandshake byte = 0x01
+	EncryptorFrameTypeSalt      byte = 0x02
+)
+
+const (
+	encryptorHeaderSize = 1 + 1 + 8
+	encryptorNonceSize  = 12
+	encryptorTagSize    = 16
+	encryptorSaltSize   = 16
+	// the bits of replay window
+	encryptorReplayWindow = 64
+)
+
+// the causes of ProcessingError of Encryptor
+var (
+	ErrNoKey           = errors.New("no key")
+	ErrAuthFailed      = errors.New("message authentication failed")
+	ErrReplayed        = errors.New("replayed message")
+	ErrHandshakeFailed = errors.New("handshake failed")
+)
+
+// encryptorState is the per-connection state
+type encryptorState struct {
+	sync.Mutex
+	txSeq uint64
+	// the highest seq received and the bitmap of the seqs before it
+	rxHighest uint64
+	rxWindow  uint64
+	// for handshake, the keys of each direction
+	local  *handshakeKey
+	txAEAD cipher.AEAD
+	rxAEAD cipher.AEAD
+	// for pre-shared keys, the salt of peer to seal and the local one to
+	// open
+	txSalt  []byte
+	rxSalt  []byte
+	pending []Context
+}
+
+// accept checks seq against the replay window and records it
+func (s *encryptorState) accept(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+
+	if seq > s.rxHighest {
+		shift := seq - s.rxHighest
+		if shift >= encryptorReplayWindow {
+			s.rxWindow = 1
+		} else {
+			s.rxWindow = s.rxWindow<<shift | 1
+		}
+		s.rxHighest = seq
+		return true
+	}
+
+	offset := s.rxHighest - seq
+	if offset >= encryptorReplayWindow {
+		return false
+	}
+
+	if s.rxWindow&(1<<offset) != 0 {
+		return false
+	}
+
+	s.rxWindow |= 1 << offset
+	return true
+}
+
+// Encryptor seals the buffers with AES-GCM, the keys are pre-shared or
+// derived by the X25519 handshake when a connection is coming. The
+// buffers are kept until the salt or the handshake of peer is received.
+// The handshake derives a key for each direction, so a frame can not be
+// reflected to the side sealing it.
+//
+// With pre-shared keys, the active key seals and all the keys open, so
+// rotating is: AddKey on all the peers, then SetActiveKey, then
+// RemoveKey of the old one.
+//
+// WARNING: the X25519 handshake alone is NOT authenticated, a man in the
+// middle can read and forge all the messages. Set the same active
+// pre-shared key on both peers with Handshake, it is mixed into the
+// derived key, so only the peers having it can talk.
+//
+// Options:
+//
+//	Keys: map[string]interface{}, the key ids to the hex-encoded keys of
+//	    16, 24 or 32 bytes, map[byte][]byte is also accepted
+//	ActiveKeyID: int, the id of the key to seal, 0 by default
+//	Handshake: bool, false by default, derive the key of each connection
+//	    by X25519, it requires go1.20
+//	MaxPending: int, 64 by default, the max buffers kept on a connection
+//	    until the salt or the handshake is received
+type Encryptor struct {
+	ProcBase
+	keys        sync.RWMutex
+	ciphers     map[byte]cipher.AEAD
+	secrets     map[byte][]byte
+	activeKeyID byte
+	handshake   bool
+	maxPending  int
+}
+
+// NewEncryptor ...
+func NewEncryptor() DataProcessor {
+	enc := &Encryptor{
+		ProcBase:   NewProcBaseInstance("Encryptor"),
+		ciphers:    make(map[byte]cipher.AEAD),
+		secrets:    make(map[byte][]byte),
+		maxPending: 64,
+	}
+	enc.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &encryptorState{}
+	})
+	return enc.ProcBase.SetWhere(enc)
+}
+
+// GetOverhead returns the overhead, the tag is at the tail
+func (enc *Encryptor) GetOverhead() int {
+	return encryptorHeaderSize + encryptorNonceSize + encryptorTagSize
+}
+
+// newAEAD ...
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AddKey adds a pre-shared key of 16, 24 or 32 bytes, the key of the
+// same id is replaced
+func (enc *Encryptor) AddKey(id byte, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	enc.keys.Lock()
+	enc.ciphers[id] = aead
+	enc.secrets[id] = append([]byte(nil), key...)
+	enc.keys.Unlock()
+
+	return nil
+}
+
+// RemoveKey removes a pre-shared key
+func (enc *Encryptor) RemoveKey(id byte) {
+	enc.keys.Lock()
+	delete(enc.ciphers, id)
+	delete(enc.secrets, id)
+	enc.keys.Unlock()
+}
+
+// SetActiveKey sets the key to seal
+func (enc *Encryptor) SetActiveKey(id byte) error {
+	enc.keys.Lock()
+	defer enc.keys.Unlock()
+
+	if _, ok := enc.ciphers[id]; !ok {
+		return ErrNoKey
+	}
+
+	enc.activeKeyID = id
+	return nil
+}
+
+// getCipher returns the cipher of the key id
+func (enc *Encryptor) getCipher(id byte) (cipher.AEAD, bool) {
+	enc.keys.RLock()
+	defer enc.keys.RUnlock()
+
+	aead, ok := enc.ciphers[id]
+	return aead, ok
+}
+
+// getActiveCipher returns the active key id and its cipher
+func (enc *Encryptor) getActiveCipher() (byte, cipher.AEAD, bool) {
+	enc.keys.RLock()
+	defer enc.keys.RUnlock()
+
+	aead, ok := enc.ciphers[enc.activeKeyID]
+	return enc.activeKeyID, aead, ok
+}
+
+// getActiveSecret returns the active pre-shared key, nil if none
+func (enc *Encryptor) getActiveSecret() []byte {
+	enc.keys.RLock()
+	defer enc.keys.RUnlock()
+
+	return enc.secrets[enc.activeKeyID]
+}
+
+// seal encrypts the buffer of context with the salt of peer and passes
+// it to lower
+func (enc *Encryptor) seal(context Context, state *encryptorState, keyID byte, aead cipher.AEAD, salt []byte) {
+	ub := context.GetBuffer()
+
+	plaintext := make([]byte, ub.ReadableLength())
+	ub.Read(plaintext)
+
+	state.Lock()
+	state.txSeq++
+	seq := state.txSeq
+	state.Unlock()
+
+	header := make([]byte, encryptorHeaderSize)
+	header[0] = EncryptorFrameTypeData
+	header[1] = keyID
+	binary.BigEndian.PutUint64(header[2:], seq)
+
+	nonce := make([]byte, encryptorNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		enc.ReportError(context, DataDirectionDown, err)
+		return
+	}
+
+	sealed := aead.Seal(nil, nonce, plaintext, append(header, salt...))
+
+	out := allocCodecBuffer(enc.ustack, len(sealed))
+	out.Write(sealed)
+	out.WriteHeadBytes(nonce)
+	out.WriteHeadBytes(header)
+
+	context.SetBuffer(out)
+
+	enc.GetLower().OnUpperData(context)
+}
+
+// OnUpperData ...
+func (enc *Encryptor) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() || !enc.IsEnabled() {
+		enc.GetLower().OnUpperData(context)
+		return
+	}
+
+	if context.GetBuffer() == nil {
+		enc.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	state := enc.GetState(context.GetConnection()).(*encryptorState)
+
+	state.Lock()
+	aead, salt := state.txAEAD, state.txSalt
+	if (enc.handshake && aead == nil) || (!enc.handshake && salt == nil) {
+		// keep it until the salt or the handshake is received
+		if len(state.pending) >= enc.maxPending {
+			state.Unlock()
+			enc.ReportError(context, DataDirectionDown, ErrQueueFull)
+			return
+		}
+
+		state.pending = append(state.pending, context)
+		state.Unlock()
+		return
+	}
+	state.Unlock()
+
+	enc.sealWithKey(context, state, aead, salt)
+}
+
+// sealWithKey seals by the key of handshake, or the active pre-shared
+// key if aead is nil
+func (enc *Encryptor) sealWithKey(context Context, state *encryptorState, aead cipher.AEAD, salt []byte) {
+	if aead != nil {
+		enc.seal(context, state, 0, aead, nil)
+		return
+	}
+
+	keyID, aead, ok := enc.getActiveCipher()
+	if !ok {
+		enc.ReportError(context, DataDirectionDown, ErrNoKey)
+		return
+	}
+
+	enc.seal(context, state, keyID, aead, salt)
+}
+
+// open decrypts the data frame
+func (enc *Encryptor) open(context Context, state *encryptorState, ub *UBuf) {
+	if ub.ReadableLength() < encryptorHeaderSize+encryptorNonceSize+encryptorTagSize {
+		enc.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	header := make([]byte, encryptorHeaderSize)
+	ub.Read(header)
+
+	nonce := make([]byte, encryptorNonceSize)
+	ub.Read(nonce)
+
+	sealed := make([]byte, ub.ReadableLength())
+	ub.Read(sealed)
+
+	state.Lock()
+	aead, salt := state.rxAEAD, state.rxSalt
+	state.Unlock()
+
+	if !enc.handshake {
+		if salt == nil {
+			enc.ReportError(context, DataDirectionUp, ErrNoKey)
+			return
+		}
+		aead, _ = enc.getCipher(header[1])
+	}
+	if aead == nil {
+		enc.ReportError(context, DataDirectionUp, ErrNoKey)
+		return
+	}
+
+	plaintext, err := aead.Open(nil, nonce, sealed, append(header, salt...))
+	if err != nil {
+		enc.ReportError(context, DataDirectionUp, ErrAuthFailed)
+		return
+	}
+
+	// check after authenticated, so the forged frames do not move the
+	// replay window
+	state.Lock()
+	accepted := state.accept(binary.BigEndian.Uint64(header[2:]))
+	state.Unlock()
+
+	if !accepted {
+		enc.ReportError(context, DataDirectionUp, ErrReplayed)
+		return
+	}
+
+	if len(plaintext) == 0 {
+		return
+	}
+
+	message := UBufAlloc(len(plaintext))
+	message.Write(plaintext)
+
+	context.SetBuffer(message)
+
+	enc.GetUpper().OnLowerData(context)
+}
+
+// localHandshakeKey returns the key pair of the connection, the caller
+// holds the lock of state
+func (enc *Encryptor) localHandshakeKey(state *encryptorState) (*handshakeKey, error) {
+	if state.local != nil {
+		return state.local, nil
+	}
+
+	local, err := newHandshakeKey()
+	if err != nil {
+		return nil, err
+	}
+
+	state.local = local
+	return local, nil
+}
+
+// onHandshake derives the key from the public key of the peer
+func (enc *Encryptor) onHandshake(context Context, state *encryptorState, ub *UBuf) {
+	peer := make([]byte, ub.ReadableLength())
+	ub.Read(peer)
+
+	state.Lock()
+
+	// the key is never replaced by an injected handshake
+	if state.txAEAD != nil {
+		state.Unlock()
+		enc.ReportError(context, DataDirectionUp, ErrHandshakeFailed)
+		return
+	}
+
+	local, err := enc.localHandshakeKey(state)
+	if err != nil {
+		state.Unlock()
+		enc.ReportError(context, DataDirectionUp, err)
+		return
+	}
+
+	txKey, rxKey, err := local.deriveKey(peer, enc.getActiveSecret())
+	if err != nil {
+		state.Unlock()
+		enc.ReportError(context, DataDirectionUp, ErrHandshakeFailed)
+		return
+	}
+
+	aead, err := newAEAD(txKey)
+	if err == nil {
+		state.rxAEAD, err = newAEAD(rxKey)
+	}
+	if err != nil {
+		state.Unlock()
+		enc.ReportError(context, DataDirectionUp, err)
+		return
+	}
+
+	state.txAEAD = aead
+	pending := state.pending
+	state.pending = nil
+
+	state.Unlock()
+
+	enc.GetLogger().Debug("handshake done", "connection", context.GetConnection().GetName())
+
+	for _, pc := range pending {
+		enc.seal(pc, state, 0, aead, nil)
+	}
+}
+
+// onSalt keeps the salt of peer to seal
+func (enc *Encryptor) onSalt(context Context, state *encryptorState, ub *UBuf) {
+	if ub.ReadableLength() != encryptorSaltSize {
+		enc.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	salt := make([]byte, encryptorSaltSize)
+	ub.Read(salt)
+
+	state.Lock()
+
+	// the salt is never replaced by an injected one
+	if state.txSalt != nil {
+		state.Unlock()
+		enc.ReportError(context, DataDirectionUp, ErrHandshakeFailed)
+		return
+	}
+
+	state.txSalt = salt
+	pending := state.pending
+	state.pending = nil
+
+	state.Unlock()
+
+	for _, pc := range pending {
+		enc.sealWithKey(pc, state, nil, salt)
+	}
+}
+
+// OnLowerData ...
+func (enc *Encryptor) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() || !enc.IsEnabled() {
+		enc.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	frameType, err := ub.PeekByte()
+	if err != nil {
+		enc.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	state := enc.GetState(context.GetConnection()).(*encryptorState)
+
+	switch frameType {
+	case EncryptorFrameTypeData:
+		enc.open(context, state, ub)
+	case EncryptorFrameTypeHandshake:
+		if !enc.handshake {
+			enc.ReportError(context, DataDirectionUp, ErrHandshakeFailed)
+			return
+		}
+		ub.ReadByte()
+		enc.onHandshake(context, state, ub)
+	case EncryptorFrameTypeSalt:
+		if enc.handshake {
+			enc.ReportError(context, DataDirectionUp, ErrHandshakeFailed)
+			return
+		}
+		ub.ReadByte()
+		enc.onSalt(context, state, ub)
+	default:
+		enc.ReportError(context, DataDirectionUp, ErrBadFormat)
+	}
+}
+
+// OnEvent ...
+func (enc *Encryptor) OnEvent(event Event) {
+	if event.Type != UStackEventNewConnection {
+		return
+	}
+
+	connection := event.Data.(TransportConnection)
+	if connection.UseReference() {
+		return
+	}
+
+	state := enc.GetState(connection).(*encryptorState)
+	context := NewUStackContext().SetConnection(connection)
+
+	var frame []byte
+	if enc.handshake {
+		state.Lock()
+		local, err := enc.localHandshakeKey(state)
+		state.Unlock()
+
+		if err != nil {
+			enc.ReportError(context, DataDirectionDown, err)
+			return
+		}
+
+		frame = append([]byte{EncryptorFrameTypeHandshake}, local.publicKey()...)
+	} else {
+		salt := make([]byte, encryptorSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			enc.ReportError(context, DataDirectionDown, err)
+			return
+		}
+
+		state.Lock()
+		state.rxSalt = salt
+		state.Unlock()
+
+		frame = append([]byte{EncryptorFrameTypeSalt}, salt...)
+	}
+
+	ub := allocCodecBuffer(enc.ustack, len(frame))
+	ub.Write(frame)
+
+	enc.GetLower().OnUpperData(context.SetBuffer(ub))
+}
+
+// parseKeys adds the keys of option
+func (enc *Encryptor) parseKeys(option interface{}) error {
+	switch keys := option.(type) {
+	case map[byte][]byte:
+		for id, key := range keys {
+			if err := enc.AddKey(id, key); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for name, value := range keys {
+			id, err := strconv.ParseUint(name, 10, 8)
+			if err != nil {
+				return err
+			}
+
+			str, _ := value.(string)
+			key, err := hex.DecodeString(str)
+			if err != nil {
+				return err
+			}
+
+			if err := enc.AddKey(byte(id), key); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		return errors.New("bad keys")
+	}
+	return nil
+}
+
+// Run ...
+func (enc *Encryptor) Run() DataProcessor {
+	if option := enc.GetOption("Keys"); option != nil {
+		if err := enc.parseKeys(option); err != nil {
+			enc.GetLogger().Error("bad option", "name", "Keys", "error", err)
+		} else {
+			enc.GetLogger().Info("option", "Keys", len(enc.ciphers))
+		}
+	}
+
+	activeKeyID, exists := OptionParseInt(enc.GetOption("ActiveKeyID"), 0)
+	if exists {
+		if err := enc.SetActiveKey(byte(activeKeyID)); err != nil {
+			enc.GetLogger().Error("bad option", "name", "ActiveKeyID", "error", err)
+		} else {
+			enc.GetLogger().Info("option", "ActiveKeyID", activeKeyID)
+		}
+	}
+
+	handshake, exists := OptionParseBool(enc.GetOption("Handshake"), false)
+	enc.handshake = handshake
+	if exists {
+		enc.GetLogger().Info("option", "Handshake", enc.handshake)
+	}
+
+	if enc.handshake && enc.getActiveSecret() == nil {
+		enc.GetLogger().Warn("handshake without pre-shared key is NOT authenticated, open to man in the middle")
+	}
+
+	maxPending, exists := OptionParseInt(enc.GetOption("MaxPending"), 64)
+	enc.maxPending = maxPending
+	if exists {
+		enc.GetLogger().Info("option", "MaxPending", enc.maxPending)
+	}
+
+	return enc
+}
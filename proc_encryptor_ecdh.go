@@ -0,0 +1,74 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.20
+// +build go1.20
+
+package ustack
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// handshakeKey is the X25519 key pair of a connection
+type handshakeKey struct {
+	private *ecdh.PrivateKey
+}
+
+// newHandshakeKey generates a key pair
+func newHandshakeKey() (*handshakeKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeKey{private: private}, nil
+}
+
+// publicKey returns the public key to send
+func (k *handshakeKey) publicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// deriveKey returns the AES-256 keys to seal and to open shared with the
+// peer. Each key is the HMAC-SHA-256 by the pre-shared key of the shared
+// secret, both public keys in order and the direction, so a frame
+// reflected to the side sealing it is not authenticated. The pre-shared
+// key may be nil.
+func (k *handshakeKey) deriveKey(peer []byte, psk []byte) ([]byte, []byte, error) {
+	remote, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := k.private.ECDH(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local := k.publicKey()
+
+	first, second := local, peer
+	if bytes.Compare(local, peer) > 0 {
+		first, second = peer, local
+	}
+
+	derive := func(direction string) []byte {
+		h := hmac.New(sha256.New, psk)
+		h.Write(secret)
+		h.Write(first)
+		h.Write(second)
+		h.Write([]byte(direction))
+		return h.Sum(nil)
+	}
+
+	// c2s seals the frames of the side whose public key sorts first
+	if bytes.Equal(first, local) {
+		return derive("c2s"), derive("s2c"), nil
+	}
+	return derive("s2c"), derive("c2s"), nil
+}
@@ -0,0 +1,131 @@
+//go:build go1.20
+// +build go1.20
+
+package ustack
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestEncryptorHandshake(t *testing.T) {
+	sender, _, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+		"Handshake": true,
+	})
+
+	c := &dummyConnection{name: "c"}
+
+	// kept until the handshake is done
+	sendPayload(sender, c, "early")
+
+	event := Event{Type: UStackEventNewConnection, Data: c}
+	sender.OnEvent(event)
+	receiver.OnEvent(event)
+
+	sendPayload(sender, c, "late")
+
+	if got := collector.frames[c]; len(got) != 2 || got[0] != "early" || got[1] != "late" {
+		t.Fatal("Unexpected messages:", got)
+	}
+}
+
+func TestEncryptorHandshakeInjected(t *testing.T) {
+	sender, _, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+		"Handshake": true,
+	})
+
+	c := &dummyConnection{name: "c"}
+
+	event := Event{Type: UStackEventNewConnection, Data: c}
+	sender.OnEvent(event)
+	receiver.OnEvent(event)
+
+	// a handshake of attacker after the key is set is ignored
+	attacker, err := newHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ub := UBufAlloc(1 + len(attacker.publicKey()))
+	ub.Write(append([]byte{EncryptorFrameTypeHandshake}, attacker.publicKey()...))
+	receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+
+	sendPayload(sender, c, "hello")
+
+	if got := collector.frames[c]; len(got) != 1 || got[0] != "hello" {
+		t.Fatal("Unexpected messages:", got)
+	}
+}
+
+func TestEncryptorHandshakePreSharedKey(t *testing.T) {
+	for _, tc := range []struct {
+		receiverKey string
+		expected    int
+	}{
+		{"000102030405060708090a0b0c0d0e0f", 1},
+		{"0f0e0d0c0b0a09080706050403020100", 0},
+	} {
+		sender, _, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+			"Handshake": true,
+		})
+		sender.(*Encryptor).AddKey(0, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+
+		key, _ := hex.DecodeString(tc.receiverKey)
+		receiver.(*Encryptor).AddKey(0, key)
+
+		c := &dummyConnection{name: "c"}
+
+		event := Event{Type: UStackEventNewConnection, Data: c}
+		sender.OnEvent(event)
+		receiver.OnEvent(event)
+
+		sendPayload(sender, c, "hello")
+
+		// the peers without the same pre-shared key can not talk
+		if got := collector.frames[c]; len(got) != tc.expected {
+			t.Fatal("Unexpected messages:", tc.receiverKey, got)
+		}
+	}
+}
+
+func TestEncryptorHandshakeReflected(t *testing.T) {
+	sender, w, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+		"Handshake": true,
+	})
+
+	var reported []error
+	sender.(*Encryptor).ustack.SetEventListener(func(event Event) {
+		if perr, ok := event.Data.(*ProcessingError); ok && event.Type == UStackEventProcessingError {
+			reported = append(reported, perr.Err)
+		}
+	})
+
+	replies := newFrameCollector()
+	sender.SetUpper(replies)
+
+	c := &dummyConnection{name: "c"}
+
+	event := Event{Type: UStackEventNewConnection, Data: c}
+	sender.OnEvent(event)
+	receiver.OnEvent(event)
+
+	sendPayload(sender, c, "hello")
+	sendPayload(receiver, c, "reply")
+
+	if got := collector.frames[c]; len(got) != 1 || got[0] != "hello" {
+		t.Fatal("Unexpected messages:", got)
+	}
+	if got := replies.frames[c]; len(got) != 1 || got[0] != "reply" {
+		t.Fatal("Unexpected replies:", got)
+	}
+
+	// the frame of sender is sent back to it by an attacker
+	frame := w.buffers[len(w.buffers)-1]
+	sender.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(frame))
+
+	if got := replies.frames[c]; len(got) != 1 {
+		t.Fatal("Reflected message is delivered:", got)
+	}
+	if len(reported) != 1 || reported[0] != ErrAuthFailed {
+		t.Fatal("Reflected message is not reported:", reported)
+	}
+}
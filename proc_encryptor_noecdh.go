@@ -0,0 +1,31 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.20
+// +build !go1.20
+
+package ustack
+
+import "errors"
+
+// errHandshakeNotUsable is returned since crypto/ecdh is not available
+var errHandshakeNotUsable = errors.New("handshake requires go1.20")
+
+// handshakeKey is not usable before go1.20
+type handshakeKey struct{}
+
+// newHandshakeKey ...
+func newHandshakeKey() (*handshakeKey, error) {
+	return nil, errHandshakeNotUsable
+}
+
+// publicKey ...
+func (k *handshakeKey) publicKey() []byte {
+	return nil
+}
+
+// deriveKey ...
+func (k *handshakeKey) deriveKey(peer []byte, psk []byte) ([]byte, []byte, error) {
+	return nil, nil, errHandshakeNotUsable
+}
@@ -0,0 +1,170 @@
+package ustack
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// wire is a lower data processor which passes the buffers to the peer
+type wire struct {
+	ProcBase
+	peer    DataProcessor
+	buffers []*UBuf
+}
+
+func newWire() *wire {
+	w := &wire{
+		ProcBase: NewProcBaseInstance("Wire"),
+	}
+	w.ProcBase.SetWhere(w)
+	return w
+}
+
+func (w *wire) OnUpperData(context Context) {
+	w.buffers = append(w.buffers, UBufMakeSnapshot(context.GetBuffer(), UBufSnapshotTypeCopyDirectly))
+	if w.peer != nil {
+		w.peer.OnLowerData(NewUStackContext().
+			SetConnection(context.GetConnection()).
+			SetBuffer(context.GetBuffer()))
+	}
+}
+
+// newEncryptorPair returns two linked encryptors, the messages received
+// by the second one are collected
+func newEncryptorPair(t *testing.T, options map[string]interface{}) (DataProcessor, *wire, DataProcessor, *frameCollector) {
+	sender := NewEncryptor()
+	receiver := NewEncryptor()
+
+	for _, dp := range []DataProcessor{sender, receiver} {
+		for name, value := range options {
+			dp.SetOption(name, value)
+		}
+		// the stack counts the overhead
+		stack := NewUStack().AppendDataProcessor(dp).Run()
+		t.Cleanup(func() { stack.Stop(context.Background()) })
+	}
+
+	w := newWire()
+	w.peer = receiver
+	sender.SetLower(w)
+
+	back := newWire()
+	back.peer = sender
+	receiver.SetLower(back)
+
+	collector := newFrameCollector()
+	receiver.SetUpper(collector)
+
+	return sender, w, receiver, collector
+}
+
+func sendPayload(dp DataProcessor, c TransportConnection, payload string) {
+	ub := UBufAllocWithHeadReserved(len(payload)+dp.GetOverhead(), dp.GetOverhead())
+	ub.Write([]byte(payload))
+	dp.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+}
+
+func TestEncryptorPreSharedKeys(t *testing.T) {
+	keys := map[string]interface{}{
+		"1": "000102030405060708090a0b0c0d0e0f",
+		"2": "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f",
+	}
+	sender, w, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+		"Keys":        keys,
+		"ActiveKeyID": 1,
+	})
+
+	c := &dummyConnection{name: "c"}
+
+	// kept until the salt of receiver is received
+	sendPayload(sender, c, "hello")
+
+	event := Event{Type: UStackEventNewConnection, Data: c}
+	sender.OnEvent(event)
+	receiver.OnEvent(event)
+
+	// drop the salt, the message is sealed after it
+	w.buffers = w.buffers[1:]
+
+	// rotate
+	sender.(*Encryptor).SetActiveKey(2)
+	sendPayload(sender, c, "world")
+
+	if got := collector.frames[c]; len(got) != 2 || got[0] != "hello" || got[1] != "world" {
+		t.Fatal("Unexpected messages:", got)
+	}
+
+	if bytes.Contains(w.buffers[0].data.bytes, []byte("hello")) {
+		t.Fatal("Plaintext is sent")
+	}
+
+	// replay
+	receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(w.buffers[0]))
+
+	// tamper
+	tampered := UBufMakeSnapshot(w.buffers[1], UBufSnapshotTypeCopyDirectly)
+	tampered.data.bytes[tampered.writerIndex-1] ^= 0xFF
+	receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(tampered))
+
+	// the old key is removed
+	receiver.(*Encryptor).RemoveKey(1)
+	sender.(*Encryptor).SetActiveKey(1)
+	sendPayload(sender, c, "lost")
+
+	if got := collector.frames[c]; len(got) != 2 {
+		t.Fatal("Unexpected messages:", got)
+	}
+}
+
+func TestEncryptorSalt(t *testing.T) {
+	sender, w, receiver, collector := newEncryptorPair(t, map[string]interface{}{
+		"Keys": map[string]interface{}{"0": "000102030405060708090a0b0c0d0e0f"},
+	})
+
+	c1 := &dummyConnection{name: "c1"}
+	c2 := &dummyConnection{name: "c2"}
+
+	for _, c := range []TransportConnection{c1, c2} {
+		event := Event{Type: UStackEventNewConnection, Data: c}
+		sender.OnEvent(event)
+		receiver.OnEvent(event)
+	}
+
+	w.buffers = nil
+	sendPayload(sender, c1, "hello")
+
+	// a frame of c1 is replayed on c2
+	receiver.OnLowerData(NewUStackContext().SetConnection(c2).SetBuffer(
+		UBufMakeSnapshot(w.buffers[0], UBufSnapshotTypeCopyDirectly)))
+
+	// an injected salt does not replace the salt of c1
+	salt := UBufAlloc(1 + encryptorSaltSize)
+	salt.Write(append([]byte{EncryptorFrameTypeSalt}, make([]byte, encryptorSaltSize)...))
+	sender.OnLowerData(NewUStackContext().SetConnection(c1).SetBuffer(salt))
+
+	sendPayload(sender, c1, "world")
+
+	if got := collector.frames[c1]; len(got) != 2 || got[0] != "hello" || got[1] != "world" {
+		t.Fatal("Unexpected messages of c1:", got)
+	}
+	if got := collector.frames[c2]; len(got) != 0 {
+		t.Fatal("Unexpected messages of c2:", got)
+	}
+}
+
+func TestEncryptorReplayWindow(t *testing.T) {
+	state := &encryptorState{}
+
+	for _, seq := range []uint64{1, 3, 2, 100, 40, 37} {
+		if !state.accept(seq) {
+			t.Fatal("Rejected:", seq)
+		}
+	}
+
+	for _, seq := range []uint64{0, 1, 3, 100, 36, 40} {
+		if state.accept(seq) {
+			t.Fatal("Accepted:", seq)
+		}
+	}
+}
@@ -4,6 +4,8 @@
 
 package ustack
 
+import "sync/atomic"
+
 type FilterFn func(context Context, toUpper bool) bool
 
 // Filter ...
@@ -18,7 +20,7 @@ type Filter struct {
 func NewFilter(filterFn ...FilterFn) DataProcessor {
 	filter := &Filter{
 		ProcBase:  NewProcBaseInstance("Filter"),
-		filterFn:  make([]FilterFn, 1),
+		filterFn:  make([]FilterFn, 0, len(filterFn)),
 		txCounter: 0,
 		rxCounter: 0,
 	}
@@ -40,24 +42,40 @@ func (filter *Filter) doFilter(context Context, toUpper bool) bool {
 
 // OnUpperData ...
 func (filter *Filter) OnUpperData(context Context) {
-	if filter.enable {
+	if filter.IsEnabled() {
 		if !filter.doFilter(context, false) {
-			filter.txCounter++
+			atomic.AddUint64(&filter.txCounter, 1)
 			return
 		}
 	}
 
-	filter.lower.OnUpperData(context)
+	filter.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (filter *Filter) OnLowerData(context Context) {
-	if filter.enable {
+	if filter.IsEnabled() {
 		if !filter.doFilter(context, true) {
-			filter.rxCounter++
+			atomic.AddUint64(&filter.rxCounter, 1)
 			return
 		}
 	}
 
-	filter.upper.OnLowerData(context)
+	filter.GetUpper().OnLowerData(context)
+}
+
+// RegisterMetrics exposes the counters of the filtered data
+func (filter *Filter) RegisterMetrics(registry *MetricsRegistry) {
+	registry.CounterFunc("ustack_filtered_total", "The number of data filtered out.",
+		filter.metricsLabels(Labels{"direction": DataDirectionDown}),
+		func() uint64 { return atomic.LoadUint64(&filter.txCounter) })
+	registry.CounterFunc("ustack_filtered_total", "The number of data filtered out.",
+		filter.metricsLabels(Labels{"direction": DataDirectionUp}),
+		func() uint64 { return atomic.LoadUint64(&filter.rxCounter) })
+}
+
+// UnregisterMetrics ...
+func (filter *Filter) UnregisterMetrics(registry *MetricsRegistry) {
+	registry.Unregister("ustack_filtered_total", filter.metricsLabels(Labels{"direction": DataDirectionDown}))
+	registry.Unregister("ustack_filtered_total", filter.metricsLabels(Labels{"direction": DataDirectionUp}))
 }
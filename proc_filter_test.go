@@ -0,0 +1,42 @@
+package ustack
+
+import (
+	"testing"
+)
+
+func TestFilterFunctions(t *testing.T) {
+	// the data passes if any function of the constructor lets it go
+	filter := NewFilter(
+		func(context Context, toUpper bool) bool { return context.GetOption("a") != nil },
+		func(context Context, toUpper bool) bool { return context.GetOption("b") != nil },
+	)
+
+	lower := newBufferCollector()
+	upper := newFrameCollector()
+	filter.SetLower(lower)
+	filter.SetUpper(upper)
+
+	c := &dummyConnection{name: "c"}
+
+	for _, option := range []string{"a", "b", "c"} {
+		ub := UBufAlloc(8)
+		ub.Write([]byte(option))
+		filter.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub).SetOption(option, true))
+
+		ub = UBufAlloc(8)
+		ub.Write([]byte(option))
+		filter.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub).SetOption(option, true))
+	}
+
+	if n := len(lower.buffers); n != 2 {
+		t.Errorf("expect 2 buffers passed down, got %d", n)
+	}
+	if got := upper.frames[c]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("unexpected buffers passed up %q", got)
+	}
+
+	f := filter.(*Filter)
+	if f.txCounter != 1 || f.rxCounter != 1 {
+		t.Errorf("expect 1 filtered out in each direction, got %d down and %d up", f.txCounter, f.rxCounter)
+	}
+}
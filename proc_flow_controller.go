@@ -4,35 +4,352 @@
 
 package ustack
 
-import "fmt"
+import (
+	"sync"
+)
 
-// FlowController ...
+const (
+	FlowControllerSelfMessageCreditTag byte = 0x47
+	FlowControllerUplayerMessageTag    byte = 0x00
+)
+
+// flowWindow is the credit window of one session
+type flowWindow struct {
+	sync.Mutex
+	cond *sync.Cond
+	// only one goroutine sends the queue at a time to keep messages in
+	// order, the lock is not held while sending
+	flushing bool
+	// sender side: the credits granted by peer and the waiting messages
+	credits int
+	queue   []Context
+	// receiver side: the messages passed to uplayer but not granted yet
+	consumed int
+	closed   bool
+}
+
+// newFlowWindow ...
+func newFlowWindow(credits int) *flowWindow {
+	w := &flowWindow{
+		credits: credits,
+	}
+	w.cond = sync.NewCond(w)
+	return w
+}
+
+// close drops the waiting messages and wakes up the blocked senders
+func (w *flowWindow) close() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.closed = true
+	w.queue = nil
+	w.cond.Broadcast()
+}
+
+// flowControllerState is the per-connection windows
+type flowControllerState struct {
+	sync.Mutex
+	windows map[int]*flowWindow
+}
+
+// FlowController does credit based flow control per connection and session.
+//
+// Each side starts with WindowSize credits for every session of a
+// connection, one message costs one credit. When the credits run out the
+// messages are queued until the receiver grants more credits, once the
+// queue is full the sender is blocked (or the message is dropped if
+// BlockOnFull is false). The receiver grants the credits back when the
+// messages were passed to uplayer.
+//
+// Both sides must use the same WindowSize. Each message carries the
+// session of sender, the credits are granted back to that session, so it
+// works with or without SessionResolver.
+//
+// Options:
+//
+//	WindowSize: int, the initial credits, 64 by default
+//	MaxQueueSize: int, max messages waiting for credits, 256 by default
+//	BlockOnFull: bool, block the sender if queue is full, true by default
 type FlowController struct {
 	ProcBase
+	windowSize   int
+	maxQueueSize int
+	blockOnFull  bool
 }
 
 // NewFlowController ...
 func NewFlowController() DataProcessor {
 	fc := &FlowController{
-		NewProcBaseInstance("FlowController"),
+		ProcBase:     NewProcBaseInstance("FlowController"),
+		windowSize:   64,
+		maxQueueSize: 256,
+		blockOnFull:  true,
 	}
+	fc.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &flowControllerState{
+			windows: make(map[int]*flowWindow),
+		}
+	})
 	return fc.ProcBase.SetWhere(fc)
 }
 
+// GetOverhead returns the overhead of the tag and session
+func (fc *FlowController) GetOverhead() int {
+	return 5
+}
+
+// window returns the window of the session on connection
+func (fc *FlowController) window(connection TransportConnection, session int) *flowWindow {
+	state := fc.GetState(connection).(*flowControllerState)
+
+	state.Lock()
+	defer state.Unlock()
+
+	w, ok := state.windows[session]
+	if !ok {
+		w = newFlowWindow(fc.windowSize)
+		state.windows[session] = w
+	}
+	return w
+}
+
+// closeWindows closes all windows of the connection
+func (fc *FlowController) closeWindows(state *flowControllerState) {
+	state.Lock()
+	defer state.Unlock()
+
+	for _, w := range state.windows {
+		w.close()
+	}
+}
+
+// claim makes the caller the one flushing the window if there is
+// nobody else, it must be called with the window locked
+func (w *flowWindow) claim() bool {
+	if w.flushing || w.closed || w.credits <= 0 || len(w.queue) == 0 {
+		return false
+	}
+
+	w.flushing = true
+	return true
+}
+
+// flush sends the waiting messages as many as the credits allow, the
+// caller must have claimed the window
+func (fc *FlowController) flush(w *flowWindow) {
+	for {
+		w.Lock()
+		if w.closed || w.credits <= 0 || len(w.queue) == 0 {
+			w.flushing = false
+			w.Unlock()
+			return
+		}
+
+		context := w.queue[0]
+		w.queue = w.queue[1:]
+		w.credits--
+
+		// there is room for blocked senders
+		w.cond.Broadcast()
+		w.Unlock()
+
+		fc.sendMessage(context)
+	}
+}
+
+// sendMessage passes the message of uplayer to lower with the session,
+// the peer grants the credits back to it
+func (fc *FlowController) sendMessage(context Context) {
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+
+	ub := context.GetBuffer()
+	ub.WriteHeadU32BE(uint32(session))
+	ub.WriteHeadByte(FlowControllerUplayerMessageTag)
+
+	fc.GetLower().OnUpperData(context)
+}
+
+// grant sends the credits to peer
+func (fc *FlowController) grant(connection TransportConnection, session int, credits int) {
+	ub := UBufAllocWithHeadReserved(
+		fc.ustack.GetMTU(),
+		fc.ustack.GetOverhead())
+
+	ub.WriteByte(FlowControllerSelfMessageCreditTag)
+	ub.WriteU32BE(uint32(session))
+	ub.WriteU32BE(uint32(credits))
+
+	fc.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub).
+			SetOption("session", session))
+}
+
 // OnUpperData ...
 func (fc *FlowController) OnUpperData(context Context) {
-	if fc.enable {
-		fmt.Println("FlowController: OnUpperData: todo")
+	connection := context.GetConnection()
+	if connection == nil {
+		return
+	}
+
+	if connection.UseReference() {
+		fc.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
 	}
 
-	fc.lower.OnUpperData(context)
+	if !fc.IsEnabled() {
+		fc.sendMessage(context)
+		return
+	}
+
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+	w := fc.window(connection, session)
+
+	w.Lock()
+	for !w.closed && len(w.queue) >= fc.maxQueueSize {
+		if !fc.blockOnFull {
+			w.Unlock()
+			fc.ReportError(context, DataDirectionDown, ErrQueueFull)
+			return
+		}
+		w.cond.Wait()
+	}
+
+	if w.closed {
+		w.Unlock()
+		return
+	}
+
+	w.queue = append(w.queue, context)
+	claimed := w.claim()
+	w.Unlock()
+
+	if claimed {
+		fc.flush(w)
+	}
 }
 
 // OnLowerData ...
 func (fc *FlowController) OnLowerData(context Context) {
-	if fc.enable {
-		fmt.Println("FlowController: OnLowerData: todo")
+	connection := context.GetConnection()
+
+	if connection.UseReference() {
+		fc.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	tag, err := ub.ReadByte()
+	if err != nil {
+		return
+	}
+
+	if tag == FlowControllerSelfMessageCreditTag {
+		session, err := ub.ReadU32BE()
+		if err != nil {
+			return
+		}
+
+		credits, err := ub.ReadU32BE()
+		if err != nil {
+			return
+		}
+
+		w := fc.window(connection, int(session))
+
+		w.Lock()
+		w.credits += int(credits)
+		claimed := w.claim()
+		w.Unlock()
+
+		// sending may block on the connection, do not do it on the
+		// receiving goroutine, or both peers may wait for each other
+		if claimed && !fc.routines.spawn(func() { fc.flush(w) }) {
+			w.Lock()
+			w.flushing = false
+			w.Unlock()
+		}
+		return
+	}
+
+	// the session of sender, it may differ from the session of receiver
+	session, err := ub.ReadU32BE()
+	if err != nil {
+		return
 	}
 
-	fc.upper.OnLowerData(context)
+	fc.GetUpper().OnLowerData(context)
+
+	if !fc.IsEnabled() {
+		return
+	}
+
+	// the message was consumed by uplayer, grant the credits back when
+	// half of the window is used
+	w := fc.window(connection, int(session))
+
+	w.Lock()
+	w.consumed++
+	credits := 0
+	if w.consumed >= (fc.windowSize+1)/2 {
+		credits = w.consumed
+		w.consumed = 0
+	}
+	w.Unlock()
+
+	if credits > 0 {
+		fc.grant(connection, int(session), credits)
+	}
+}
+
+// OnEvent ...
+func (fc *FlowController) OnEvent(event Event) {
+	if event.Type == UStackEventConnectionClosed {
+		connection := event.Data.(TransportConnection)
+		fc.closeWindows(fc.GetState(connection).(*flowControllerState))
+	}
+}
+
+// Run ...
+func (fc *FlowController) Run() DataProcessor {
+	windowSize, exists := OptionParseInt(fc.GetOption("WindowSize"), fc.windowSize)
+	fc.windowSize = windowSize
+	if exists {
+		fc.GetLogger().Info("option", "WindowSize", fc.windowSize)
+	}
+
+	maxQueueSize, exists := OptionParseInt(fc.GetOption("MaxQueueSize"), fc.maxQueueSize)
+	fc.maxQueueSize = maxQueueSize
+	if exists {
+		fc.GetLogger().Info("option", "MaxQueueSize", fc.maxQueueSize)
+	}
+
+	blockOnFull, exists := OptionParseBool(fc.GetOption("BlockOnFull"), fc.blockOnFull)
+	fc.blockOnFull = blockOnFull
+	if exists {
+		fc.GetLogger().Info("option", "BlockOnFull", fc.blockOnFull)
+	}
+
+	return fc.ProcBase.Run()
+}
+
+// Stop wakes up the blocked senders and waits for the flushing
+func (fc *FlowController) Stop() DataProcessor {
+	fc.RangeStates(func(connection TransportConnection, state interface{}) bool {
+		fc.closeWindows(state.(*flowControllerState))
+		return true
+	})
+
+	return fc.ProcBase.Stop()
 }
@@ -0,0 +1,205 @@
+package ustack
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newFlowControllerPair returns two flow controllers, the messages of the
+// first one are passed to the second one, the credits granted back are
+// kept in the returned wire until they are delivered
+func newFlowControllerPair(t *testing.T, options map[string]interface{}) (DataProcessor, DataProcessor, *wire, *frameCollector) {
+	sender := NewFlowController()
+	receiver := NewFlowController()
+
+	for _, dp := range []DataProcessor{sender, receiver} {
+		for name, value := range options {
+			dp.SetOption(name, value)
+		}
+		// the stack counts the overhead
+		stack := NewUStack().AppendDataProcessor(dp).Run()
+		t.Cleanup(func() { stack.Stop(context.Background()) })
+	}
+
+	w := newWire()
+	w.peer = receiver
+	sender.SetLower(w)
+
+	// the credits are delivered later, the sender is flushing
+	back := newWire()
+	receiver.SetLower(back)
+
+	collector := newFrameCollector()
+	receiver.SetUpper(collector)
+
+	return sender, receiver, back, collector
+}
+
+// deliverCredits passes the credits kept in back to the sender
+func deliverCredits(sender DataProcessor, back *wire, c TransportConnection) int {
+	buffers := back.buffers
+	back.buffers = nil
+
+	for _, ub := range buffers {
+		sender.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+	}
+	return len(buffers)
+}
+
+// waitFlushed waits until the messages let go by the credits were sent,
+// they are sent by another goroutine
+func waitFlushed(t *testing.T, sender DataProcessor, c TransportConnection, session int) {
+	w := sender.(*FlowController).window(c, session)
+	flushed := waitFor(func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return !w.flushing
+	})
+	if !flushed {
+		t.Fatalf("session %d is still flushing", session)
+	}
+}
+
+func sendSessionPayload(dp DataProcessor, c TransportConnection, session int, payload string) {
+	ub := UBufAllocWithHeadReserved(len(payload)+dp.GetOverhead(), dp.GetOverhead())
+	ub.Write([]byte(payload))
+	dp.OnUpperData(NewUStackContext().
+		SetConnection(c).
+		SetBuffer(ub).
+		SetOption("session", session))
+}
+
+func TestFlowControllerWindow(t *testing.T) {
+	const windowSize = 4
+
+	sender, _, back, collector := newFlowControllerPair(t, map[string]interface{}{
+		"WindowSize":  windowSize,
+		"BlockOnFull": false,
+	})
+
+	c := &dummyConnection{name: "c"}
+
+	// the endpoint session of sender, there is no SessionResolver so the
+	// receiver sees all the messages as session 0
+	for i := 0; i < 3*windowSize; i++ {
+		sendSessionPayload(sender, c, 5, "m")
+	}
+
+	if n := len(collector.frames[c]); n != windowSize {
+		t.Fatalf("expect %d messages before credits, got %d", windowSize, n)
+	}
+
+	// each delivered batch of credits lets the waiting messages go
+	for i := 0; i < 10 && len(collector.frames[c]) < 3*windowSize; i++ {
+		if deliverCredits(sender, back, c) == 0 {
+			break
+		}
+		waitFlushed(t, sender, c, 5)
+	}
+
+	if n := len(collector.frames[c]); n != 3*windowSize {
+		t.Fatalf("expect %d messages, got %d", 3*windowSize, n)
+	}
+}
+
+func TestFlowControllerSessions(t *testing.T) {
+	const windowSize = 2
+
+	sender, receiver, back, collector := newFlowControllerPair(t, map[string]interface{}{
+		"WindowSize":  windowSize,
+		"BlockOnFull": false,
+	})
+
+	c := &dummyConnection{name: "c"}
+
+	// session 1 runs out of credits, session 2 is not affected
+	for i := 0; i < windowSize+1; i++ {
+		sendSessionPayload(sender, c, 1, "a")
+	}
+	sendSessionPayload(sender, c, 2, "b")
+
+	if got := collector.frames[c]; len(got) != windowSize+1 || got[windowSize] != "b" {
+		t.Fatalf("unexpected messages %q", got)
+	}
+
+	// the credits are granted back to session 1 of sender
+	deliverCredits(sender, back, c)
+	waitFlushed(t, sender, c, 1)
+
+	if got := collector.frames[c]; len(got) != windowSize+2 || got[windowSize+1] != "a" {
+		t.Fatalf("unexpected messages %q", got)
+	}
+
+	state := receiver.(*FlowController).GetState(c).(*flowControllerState)
+	if _, ok := state.windows[0]; ok {
+		t.Errorf("unexpected credits of session 0")
+	}
+}
+
+// blockedWire blocks the sending until it is released
+type blockedWire struct {
+	ProcBase
+	release chan struct{}
+	sent    chan struct{}
+}
+
+func (bw *blockedWire) OnUpperData(context Context) {
+	<-bw.release
+	bw.sent <- struct{}{}
+}
+
+func TestFlowControllerCreditsNotBlocked(t *testing.T) {
+	sender := NewFlowController()
+	sender.SetOption("WindowSize", 1)
+	stack := NewUStack().AppendDataProcessor(sender).Run()
+	defer stack.Stop(context.Background())
+
+	bw := &blockedWire{
+		ProcBase: NewProcBaseInstance("BlockedWire"),
+		release:  make(chan struct{}),
+		sent:     make(chan struct{}, 2),
+	}
+	bw.ProcBase.SetWhere(bw)
+	sender.SetLower(bw)
+
+	c := &dummyConnection{name: "c"}
+
+	// the first message takes the only credit and the sending blocks
+	go sendSessionPayload(sender, c, 0, "a")
+	waitFor(func() bool {
+		w := sender.(*FlowController).window(c, 0)
+		w.Lock()
+		defer w.Unlock()
+		return w.credits == 0
+	})
+	sendSessionPayload(sender, c, 0, "b")
+
+	// the credits arrive on the receiving goroutine while the connection
+	// is blocked, they must not wait for the sending
+	ub := UBufAllocWithHeadReserved(16, 0)
+	ub.WriteByte(FlowControllerSelfMessageCreditTag)
+	ub.WriteU32BE(0)
+	ub.WriteU32BE(1)
+
+	done := make(chan struct{})
+	go func() {
+		sender.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("credits blocked by the sending")
+	}
+
+	close(bw.release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-bw.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("expect 2 messages sent, got %d", i)
+		}
+	}
+}
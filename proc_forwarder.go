@@ -4,6 +4,8 @@
 
 package ustack
 
+import "sync/atomic"
+
 type ForwardFn func(context Context, toUpper bool) bool
 
 // Forwarder ...
@@ -18,7 +20,7 @@ type Forwarder struct {
 func NewForwarder(forwardFn ...ForwardFn) DataProcessor {
 	fwd := &Forwarder{
 		ProcBase:  NewProcBaseInstance("Forwarder"),
-		forwardFn: make([]ForwardFn, 1),
+		forwardFn: make([]ForwardFn, 0, len(forwardFn)),
 		txCounter: 0,
 		rxCounter: 0,
 	}
@@ -40,24 +42,40 @@ func (fwd *Forwarder) doForward(context Context, toUpper bool) bool {
 
 // OnUpperData ...
 func (fwd *Forwarder) OnUpperData(context Context) {
-	if fwd.enable {
+	if fwd.IsEnabled() {
 		if fwd.doForward(context, false) {
-			fwd.txCounter++
+			atomic.AddUint64(&fwd.txCounter, 1)
 			return
 		}
 	}
 
-	fwd.lower.OnUpperData(context)
+	fwd.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (fwd *Forwarder) OnLowerData(context Context) {
-	if fwd.enable {
+	if fwd.IsEnabled() {
 		if fwd.doForward(context, true) {
-			fwd.rxCounter++
+			atomic.AddUint64(&fwd.rxCounter, 1)
 			return
 		}
 	}
 
-	fwd.upper.OnLowerData(context)
+	fwd.GetUpper().OnLowerData(context)
+}
+
+// RegisterMetrics exposes the counters of the forwarded data
+func (fwd *Forwarder) RegisterMetrics(registry *MetricsRegistry) {
+	registry.CounterFunc("ustack_forwarded_total", "The number of data forwarded.",
+		fwd.metricsLabels(Labels{"direction": DataDirectionDown}),
+		func() uint64 { return atomic.LoadUint64(&fwd.txCounter) })
+	registry.CounterFunc("ustack_forwarded_total", "The number of data forwarded.",
+		fwd.metricsLabels(Labels{"direction": DataDirectionUp}),
+		func() uint64 { return atomic.LoadUint64(&fwd.rxCounter) })
+}
+
+// UnregisterMetrics ...
+func (fwd *Forwarder) UnregisterMetrics(registry *MetricsRegistry) {
+	registry.Unregister("ustack_forwarded_total", fwd.metricsLabels(Labels{"direction": DataDirectionDown}))
+	registry.Unregister("ustack_forwarded_total", fwd.metricsLabels(Labels{"direction": DataDirectionUp}))
 }
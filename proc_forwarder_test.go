@@ -0,0 +1,60 @@
+package ustack
+
+import (
+	"testing"
+)
+
+func TestForwarderFunctions(t *testing.T) {
+	var forwarded []string
+
+	// the data is taken by the first function of the constructor which
+	// forwards it
+	fwd := NewForwarder(
+		func(context Context, toUpper bool) bool {
+			if context.GetOption("a") == nil {
+				return false
+			}
+			forwarded = append(forwarded, "a")
+			return true
+		},
+		func(context Context, toUpper bool) bool {
+			if context.GetOption("b") == nil {
+				return false
+			}
+			forwarded = append(forwarded, "b")
+			return true
+		},
+	)
+
+	lower := newBufferCollector()
+	upper := newFrameCollector()
+	fwd.SetLower(lower)
+	fwd.SetUpper(upper)
+
+	c := &dummyConnection{name: "c"}
+
+	for _, option := range []string{"a", "b", "c"} {
+		ub := UBufAlloc(8)
+		ub.Write([]byte(option))
+		fwd.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub).SetOption(option, true))
+
+		ub = UBufAlloc(8)
+		ub.Write([]byte(option))
+		fwd.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub).SetOption(option, true))
+	}
+
+	if len(forwarded) != 4 {
+		t.Errorf("expect 4 forwarded, got %q", forwarded)
+	}
+	if n := len(lower.buffers); n != 1 {
+		t.Errorf("expect 1 buffer passed down, got %d", n)
+	}
+	if got := upper.frames[c]; len(got) != 1 || got[0] != "c" {
+		t.Errorf("unexpected buffers passed up %q", got)
+	}
+
+	f := fwd.(*Forwarder)
+	if f.txCounter != 2 || f.rxCounter != 2 {
+		t.Errorf("expect 2 forwarded in each direction, got %d down and %d up", f.txCounter, f.rxCounter)
+	}
+}
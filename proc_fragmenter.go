@@ -0,0 +1,346 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Fragment Format:
+//
+//	+----------------+-----------+----------+-------------------+
+//	| message id: 4B | index: 2B | flags: 1B| fragment data     |
+//	+----------------+-----------+----------+-------------------+
+//
+// The fields are big endian, every message is sent as at least one
+// fragment and the last one has FragmentFlagLast set.
+const FragmentHeaderSizeInByte int = 7
+
+// the flags of fragment
+const (
+	FragmentFlagLast byte = 0x01
+)
+
+// the causes of ProcessingError of Fragmenter
+var (
+	ErrTooManyFragments  = errors.New("too many fragments")
+	ErrReassemblyTimeout = errors.New("reassembly timeout")
+	ErrReassemblyLimit   = errors.New("reassembly limit exceeded")
+)
+
+// fragmentKey identifies a message being reassembled on a connection
+type fragmentKey struct {
+	session int
+	id      uint32
+}
+
+// partialMessage is a message being reassembled
+type partialMessage struct {
+	fragments map[uint16]*UBuf
+	// the index of last fragment, -1 if it is not received yet
+	last int
+	// the max index received
+	maxIndex int
+	size     int
+	started  time.Time
+}
+
+// fragmenterState is the per-connection reassembly state
+type fragmenterState struct {
+	partials map[fragmentKey]*partialMessage
+	size     int
+}
+
+// Fragmenter splits the buffers larger than the MTU into fragments and
+// reassembles them on the other side, it should be put below the codec
+// and above the FrameDecoder for stream transports.
+//
+// Options:
+//
+//	FragmentSize: int, the max data bytes of a fragment, by default
+//	    it is the MTU minus the overhead of the stack
+//	ReassemblyTimeout: duration, 30s by default, the partial messages
+//	    older than it are dropped when data arrives on the connection
+//	MaxReassemblySize: int, 1MB by default, the max bytes being
+//	    reassembled on a connection
+//	MaxPartialMessages: int, 256 by default, the max messages being
+//	    reassembled on a connection
+type Fragmenter struct {
+	ProcBase
+	nextID             uint32
+	fragmentSize       int
+	reassemblyTimeout  time.Duration
+	maxReassemblySize  int
+	maxPartialMessages int
+}
+
+// NewFragmenter ...
+func NewFragmenter() DataProcessor {
+	frg := &Fragmenter{
+		ProcBase:           NewProcBaseInstance("Fragmenter"),
+		reassemblyTimeout:  30 * time.Second,
+		maxReassemblySize:  1024 * 1024,
+		maxPartialMessages: 256,
+	}
+	frg.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &fragmenterState{
+			partials: make(map[fragmentKey]*partialMessage),
+		}
+	})
+	return frg.ProcBase.SetWhere(frg)
+}
+
+// GetOverhead returns the overhead
+func (frg *Fragmenter) GetOverhead() int {
+	return FragmentHeaderSizeInByte
+}
+
+// getFragmentSize ...
+func (frg *Fragmenter) getFragmentSize() int {
+	if frg.fragmentSize > 0 {
+		return frg.fragmentSize
+	}
+
+	size := frg.ustack.GetMTU() - frg.ustack.GetOverhead()
+	if size <= 0 {
+		size = 1
+	}
+	return size
+}
+
+// OnUpperData ...
+func (frg *Fragmenter) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() {
+		frg.GetLower().OnUpperData(context)
+		return
+	}
+
+	if !frg.IsEnabled() {
+		frg.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		frg.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	fragmentSize := frg.getFragmentSize()
+
+	count := (ub.ReadableLength() + fragmentSize - 1) / fragmentSize
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xFFFF+1 {
+		frg.ReportError(context, DataDirectionDown, ErrTooManyFragments)
+		return
+	}
+
+	id := atomic.AddUint32(&frg.nextID, 1)
+
+	// send as is if it fits
+	if count == 1 && ub.HeadWritableLength() >= FragmentHeaderSizeInByte {
+		frg.writeHeader(ub, id, 0, true)
+		frg.GetLower().OnUpperData(context)
+		return
+	}
+
+	// the overhead of the stack includes the fragment header once the
+	// fragmenter is linked
+	overhead := frg.ustack.GetOverhead()
+	if overhead < FragmentHeaderSizeInByte {
+		overhead = FragmentHeaderSizeInByte
+	}
+
+	for index := 0; index < count; index++ {
+		size := fragmentSize
+		if remain := ub.ReadableLength(); remain < size {
+			size = remain
+		}
+
+		fragment := UBufAllocWithHeadReserved(overhead+size, overhead)
+		data := make([]byte, size)
+		ub.Read(data)
+		fragment.Write(data)
+
+		frg.writeHeader(fragment, id, uint16(index), index == count-1)
+
+		frg.GetLower().OnUpperData(cloneContext(context).SetBuffer(fragment))
+	}
+}
+
+// writeHeader adds fragment header in head space
+func (frg *Fragmenter) writeHeader(ub *UBuf, id uint32, index uint16, last bool) {
+	var flags byte
+	if last {
+		flags |= FragmentFlagLast
+	}
+
+	ub.WriteHeadByte(flags)
+	ub.WriteHeadU16BE(index)
+	ub.WriteHeadU32BE(id)
+}
+
+// drop drops the partial message
+func (frg *Fragmenter) drop(state *fragmenterState, key fragmentKey, partial *partialMessage) {
+	state.size -= partial.size
+	delete(state.partials, key)
+}
+
+// expire drops the partial messages older than the reassembly timeout
+func (frg *Fragmenter) expire(context Context, state *fragmenterState) {
+	now := time.Now()
+	for key, partial := range state.partials {
+		if now.Sub(partial.started) > frg.reassemblyTimeout {
+			frg.drop(state, key, partial)
+			frg.ReportError(context, DataDirectionUp, ErrReassemblyTimeout)
+		}
+	}
+}
+
+// OnLowerData ...
+func (frg *Fragmenter) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() || !frg.IsEnabled() {
+		frg.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	if ub.ReadableLength() < FragmentHeaderSizeInByte {
+		frg.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	id, _ := ub.ReadU32BE()
+	index, _ := ub.ReadU16BE()
+	flags, _ := ub.ReadByte()
+	last := flags&FragmentFlagLast != 0
+
+	// a message of single fragment
+	if index == 0 && last {
+		frg.GetUpper().OnLowerData(context)
+		return
+	}
+
+	// only the message of single fragment may be empty
+	if ub.ReadableLength() == 0 {
+		frg.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	state := frg.GetState(context.GetConnection()).(*fragmenterState)
+
+	frg.expire(context, state)
+
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+	key := fragmentKey{session: session, id: id}
+
+	size := ub.ReadableLength()
+
+	partial, ok := state.partials[key]
+	if state.size+size > frg.maxReassemblySize {
+		if ok {
+			frg.drop(state, key, partial)
+		}
+		frg.ReportError(context, DataDirectionUp, ErrReassemblyLimit)
+		return
+	}
+
+	if !ok {
+		// the peer must not make us keep any number of messages
+		if len(state.partials) >= frg.maxPartialMessages {
+			frg.ReportError(context, DataDirectionUp, ErrReassemblyLimit)
+			return
+		}
+
+		partial = &partialMessage{
+			fragments: make(map[uint16]*UBuf),
+			last:      -1,
+			started:   time.Now(),
+		}
+		state.partials[key] = partial
+	}
+
+	// the index must not be beyond the last one, and the last one must
+	// not be before the indexes received or change
+	if (partial.last >= 0 && int(index) > partial.last) ||
+		(last && (int(index) < partial.maxIndex || (partial.last >= 0 && int(index) != partial.last))) {
+		frg.drop(state, key, partial)
+		frg.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	if _, ok := partial.fragments[index]; !ok {
+		partial.fragments[index] = ub
+		partial.size += size
+		state.size += size
+	}
+
+	if int(index) > partial.maxIndex {
+		partial.maxIndex = int(index)
+	}
+
+	if last {
+		partial.last = int(index)
+	}
+
+	if partial.last < 0 || len(partial.fragments) != partial.last+1 {
+		// wait for more fragments
+		return
+	}
+
+	frg.drop(state, key, partial)
+
+	for i := 0; i <= partial.last; i++ {
+		if _, ok := partial.fragments[uint16(i)]; !ok {
+			frg.ReportError(context, DataDirectionUp, ErrBadFormat)
+			return
+		}
+	}
+
+	message := UBufAlloc(partial.size)
+	for i := 0; i <= partial.last; i++ {
+		partial.fragments[uint16(i)].WriteTo(message)
+	}
+
+	context.SetBuffer(message)
+	frg.GetUpper().OnLowerData(context)
+}
+
+// Run ...
+func (frg *Fragmenter) Run() DataProcessor {
+	fragmentSize, exists := OptionParseInt(frg.GetOption("FragmentSize"), 0)
+	frg.fragmentSize = fragmentSize
+	if exists {
+		frg.GetLogger().Info("option", "FragmentSize", frg.fragmentSize)
+	}
+
+	reassemblyTimeout, exists := OptionParseDuration(frg.GetOption("ReassemblyTimeout"), 30*time.Second)
+	frg.reassemblyTimeout = reassemblyTimeout
+	if exists {
+		frg.GetLogger().Info("option", "ReassemblyTimeout", frg.reassemblyTimeout)
+	}
+
+	maxReassemblySize, exists := OptionParseInt(frg.GetOption("MaxReassemblySize"), 1024*1024)
+	frg.maxReassemblySize = maxReassemblySize
+	if exists {
+		frg.GetLogger().Info("option", "MaxReassemblySize", frg.maxReassemblySize)
+	}
+
+	maxPartialMessages, exists := OptionParseInt(frg.GetOption("MaxPartialMessages"), 256)
+	frg.maxPartialMessages = maxPartialMessages
+	if exists {
+		frg.GetLogger().Info("option", "MaxPartialMessages", frg.maxPartialMessages)
+	}
+
+	return frg
+}
@@ -0,0 +1,165 @@
+package ustack
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// bufferCollector is a lower data processor which saves the buffers
+type bufferCollector struct {
+	ProcBase
+	buffers []*UBuf
+}
+
+func newBufferCollector() *bufferCollector {
+	bc := &bufferCollector{
+		ProcBase: NewProcBaseInstance("BufferCollector"),
+	}
+	bc.ProcBase.SetWhere(bc)
+	return bc
+}
+
+func (bc *bufferCollector) OnUpperData(context Context) {
+	bc.buffers = append(bc.buffers, context.GetBuffer())
+}
+
+func TestFragmenterReassembly(t *testing.T) {
+	collector := newBufferCollector()
+
+	sender := NewFragmenter().
+		SetUStack(NewUStack()).
+		SetOption("FragmentSize", 100)
+	sender.SetLower(collector)
+	sender.Run()
+
+	c := &dummyConnection{name: "c"}
+
+	payload := strings.Repeat("0123456789", 105)
+	ub := UBufAllocWithHeadReserved(len(payload)+FragmentHeaderSizeInByte, FragmentHeaderSizeInByte)
+	ub.Write([]byte(payload))
+	sender.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+
+	if len(collector.buffers) != 11 {
+		t.Fatal("Unexpected fragment count:", len(collector.buffers))
+	}
+
+	upper := newFrameCollector()
+
+	receiver := NewFragmenter().SetUStack(NewUStack())
+	receiver.SetUpper(upper)
+	receiver.Run()
+
+	// deliver out of order
+	for i := len(collector.buffers) - 1; i >= 0; i-- {
+		receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(collector.buffers[i]))
+	}
+
+	if got := upper.frames[c]; len(got) != 1 || got[0] != payload {
+		t.Fatal("Unexpected messages:", len(got))
+	}
+}
+
+func fragmentBytes(id uint32, index uint16, last bool, payload string) *UBuf {
+	ub := UBufAllocWithHeadReserved(64, FragmentHeaderSizeInByte)
+	ub.Write([]byte(payload))
+
+	var flags byte
+	if last {
+		flags = FragmentFlagLast
+	}
+	ub.WriteHeadByte(flags)
+	ub.WriteHeadU16BE(index)
+	ub.WriteHeadU32BE(id)
+	return ub
+}
+
+func TestFragmenterBadIndex(t *testing.T) {
+	var reported int32
+	upper := newFrameCollector()
+
+	receiver := NewFragmenter().SetUStack(NewUStack().
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventProcessingError {
+				atomic.AddInt32(&reported, 1)
+			}
+		}))
+	receiver.SetUpper(upper)
+	receiver.Run()
+
+	c := &dummyConnection{name: "c"}
+	feed := func(ub *UBuf) {
+		receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+	}
+
+	// index 1 is missing, the last is before index 5
+	feed(fragmentBytes(1, 5, false, "f"))
+	feed(fragmentBytes(1, 0, false, "a"))
+	feed(fragmentBytes(1, 2, true, "c"))
+
+	// index 7 is beyond the last
+	feed(fragmentBytes(2, 1, true, "b"))
+	feed(fragmentBytes(2, 7, false, "h"))
+
+	// the last changes
+	feed(fragmentBytes(3, 2, true, "c"))
+	feed(fragmentBytes(3, 1, true, "b"))
+
+	if got := upper.frames[c]; len(got) != 0 {
+		t.Fatal("Unexpected messages:", got)
+	}
+	if n := atomic.LoadInt32(&reported); n != 3 {
+		t.Fatal("Expect 3 errors, got", n)
+	}
+
+	// the state is clean for a good message
+	feed(fragmentBytes(4, 1, true, "b"))
+	feed(fragmentBytes(4, 0, false, "a"))
+
+	if got := upper.frames[c]; len(got) != 1 || got[0] != "ab" {
+		t.Fatal("Unexpected messages:", got)
+	}
+	if state := receiver.(*Fragmenter).GetState(c).(*fragmenterState); len(state.partials) != 0 || state.size != 0 {
+		t.Fatal("Unexpected partials:", len(state.partials), state.size)
+	}
+}
+
+func TestFragmenterPartialLimit(t *testing.T) {
+	var limited int32
+	upper := newFrameCollector()
+
+	receiver := NewFragmenter().SetUStack(NewUStack().
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventProcessingError &&
+				event.Data.(*ProcessingError).Err == ErrReassemblyLimit {
+				atomic.AddInt32(&limited, 1)
+			}
+		})).
+		SetOption("MaxPartialMessages", 2)
+	receiver.SetUpper(upper)
+	receiver.Run()
+
+	c := &dummyConnection{name: "c"}
+	feed := func(ub *UBuf) {
+		receiver.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+	}
+
+	// the first fragments of many messages, only 2 are kept
+	for id := uint32(1); id <= 10; id++ {
+		feed(fragmentBytes(id, 0, false, "a"))
+	}
+
+	state := receiver.(*Fragmenter).GetState(c).(*fragmenterState)
+	if len(state.partials) != 2 || state.size != 2 {
+		t.Fatal("Unexpected partials:", len(state.partials), state.size)
+	}
+	if n := atomic.LoadInt32(&limited); n != 8 {
+		t.Fatal("Expect 8 errors, got", n)
+	}
+
+	// the messages kept are still reassembled
+	feed(fragmentBytes(1, 1, true, "b"))
+	if got := upper.frames[c]; len(got) != 1 || got[0] != "ab" {
+		t.Fatal("Unexpected messages:", got)
+	}
+}
@@ -5,26 +5,63 @@
 package ustack
 
 import (
-	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 const FrameLengthFieldSizeInByte int = 4
 
-// FrameDecoder ...
+const (
+	// FrameDecoderPolicyClose reports the error and closes the connection
+	FrameDecoderPolicyClose string = "Close"
+	// FrameDecoderPolicyReport reports the error and skips the frame
+	FrameDecoderPolicyReport string = "Report"
+	// FrameDecoderPolicySkip skips the frame with a warning only
+	FrameDecoderPolicySkip string = "Skip"
+)
+
+// frameDecoderState is the per-connection reassembly state
+type frameDecoderState struct {
+	cache *UBuf
+	// the bytes of the oversized frame to be skipped
+	skip uint64
+	// the connection is closed by the policy, the data is dropped
+	broken bool
+}
+
+// FrameDecoder prefixes each frame with the 4 bytes big endian length
+// and splits the stream of each connection into frames. A frame larger
+// than MaxFrameSize is never cached, it is handled by BadFramePolicy:
+// the connection is closed, or the frame is skipped so that the stream
+// keeps in sync, with an error reported or not.
+//
+// Options:
+//
+//	CacheCapacity: int, 2*MTU by default
+//	MaxFrameSize: int, 16M by default
+//	BadFramePolicy: string, Close(default), Report or Skip
 type FrameDecoder struct {
 	ProcBase
-	cacheCapacity int
-	cache         *UBuf
+	cacheCapacity  int
+	maxFrameSize   int
+	badFramePolicy string
+	badFrames      uint64
+	skippedBytes   uint64
 }
 
 // NewFrameDecoder ...
 func NewFrameDecoder() DataProcessor {
 	frm := &FrameDecoder{
-		ProcBase:      NewProcBaseInstance("FrameDecoder"),
-		cacheCapacity: 1024,
-		cache:         nil,
+		ProcBase:       NewProcBaseInstance("FrameDecoder"),
+		cacheCapacity:  1024,
+		maxFrameSize:   16 << 20,
+		badFramePolicy: FrameDecoderPolicyClose,
 	}
+	frm.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &frameDecoderState{
+			cache: UBufAlloc(frm.cacheCapacity),
+		}
+	})
 	return frm.ProcBase.SetWhere(frm)
 }
 
@@ -33,71 +70,172 @@ func (frm *FrameDecoder) GetOverhead() int {
 	return FrameLengthFieldSizeInByte
 }
 
+// GetStats returns the counters of bad frames and the bytes skipped
+func (frm *FrameDecoder) GetStats() map[string]interface{} {
+	return map[string]interface{}{
+		"badFrames":    atomic.LoadUint64(&frm.badFrames),
+		"skippedBytes": atomic.LoadUint64(&frm.skippedBytes),
+	}
+}
+
 // OnUpperData ...
 func (frm *FrameDecoder) OnUpperData(context Context) {
 	if context.GetConnection().UseReference() {
-		frm.upper.OnUpperData(context)
+		frm.GetLower().OnUpperData(context)
 		return
 	}
 
-	if frm.enable {
+	if frm.IsEnabled() {
 		ub := context.GetBuffer()
 		if ub == nil {
 			return
 		}
 
+		if ub.ReadableLength() > frm.maxFrameSize {
+			frm.ReportError(context, DataDirectionDown, ErrFrameTooLarge)
+			return
+		}
+
 		// add frame length in head space
 		ub.WriteHeadU32BE(uint32(ub.ReadableLength()))
 	}
 
-	frm.lower.OnUpperData(context)
+	frm.GetLower().OnUpperData(context)
+}
+
+// cacheData appends the data of ub to the cache, the cached data is
+// moved to a new cache if there is no enough room at the tail
+func (frm *FrameDecoder) cacheData(state *frameDecoderState, ub *UBuf) {
+	cache := state.cache
+	if cache.TailWritableLength() < ub.ReadableLength() {
+		capacity := frm.cacheCapacity
+		if size := cache.ReadableLength() + ub.ReadableLength(); size > capacity {
+			capacity = size
+		}
+
+		state.cache = UBufAlloc(capacity)
+		cache.WriteTo(state.cache)
+		cache = state.cache
+	}
+
+	ub.WriteTo(cache)
+}
+
+// skipData drops the bytes of the oversized frame in ub
+func (frm *FrameDecoder) skipData(state *frameDecoderState, ub *UBuf) {
+	n := uint64(ub.ReadableLength())
+	if n > state.skip {
+		n = state.skip
+	}
+
+	io.CopyN(io.Discard, ub, int64(n))
+
+	state.skip -= n
+	atomic.AddUint64(&frm.skippedBytes, n)
+}
+
+// badFrame handles the bad frame in ub by the policy, false if the
+// connection is closed
+func (frm *FrameDecoder) badFrame(context Context, state *frameDecoderState, ub *UBuf, err error) bool {
+	atomic.AddUint64(&frm.badFrames, 1)
+
+	connection := context.GetConnection()
+
+	if err == ErrFrameTooLarge && frm.badFramePolicy != FrameDecoderPolicyClose {
+		expectedLength, _ := ub.ReadU32BE()
+		state.skip = uint64(expectedLength)
+
+		if frm.badFramePolicy == FrameDecoderPolicyReport {
+			frm.ReportError(context, DataDirectionUp, err)
+		}
+		frm.GetLogger().Warn("skip bad frame", "connection", connection.GetName(),
+			"length", expectedLength, "error", err)
+		return true
+	}
+
+	state.cache.Reset()
+	state.skip = 0
+	state.broken = true
+
+	frm.ReportError(context, DataDirectionUp, err)
+	frm.GetLogger().Warn("close on bad frame", "connection", connection.GetName(), "error", err)
+
+	connection.Close()
+	return false
+}
+
+// frameBuffer returns the buffer of a frame, the frame may be empty
+func frameBuffer(length uint32) *UBuf {
+	if length == 0 {
+		return UBufAlloc(1)
+	}
+	return UBufAlloc(int(length))
 }
 
 // handleCurrentData ...
-func (frm *FrameDecoder) handleCurrentData(context Context, ub *UBuf) {
+func (frm *FrameDecoder) handleCurrentData(context Context, state *frameDecoderState, ub *UBuf) {
+	cache := state.cache
+
 	// if there is data in cache, put current data into cache
-	if frm.cache.ReadableLength() > 0 {
-		frm.cache.ReadFrom(ub)
+	if cache.ReadableLength() > 0 {
+		frm.cacheData(state, ub)
 		return
 	}
 
 	// cache is empty
 	// handle as much as possiable with loop
 	for {
+		if state.skip > 0 {
+			frm.skipData(state, ub)
+		}
+
+		if ub.ReadableLength() == 0 {
+			return
+		}
+
 		// very less data, cache the data
 		if ub.ReadableLength() < FrameLengthFieldSizeInByte {
-			frm.cache.ReadFrom(ub)
+			frm.cacheData(state, ub)
 			return
 		}
 
 		expectedLength, err := ub.PeekU32BE()
 		if err != nil {
-			// bad buffer, discard it
-			frm.cache.Reset()
+			frm.badFrame(context, state, ub, ErrBadFormat)
 			return
 		}
 
-		actuallyLength := uint32(ub.ReadableLength())
+		// never cache the frame which would be dropped
+		if uint64(expectedLength) > uint64(frm.maxFrameSize) {
+			if !frm.badFrame(context, state, ub, ErrFrameTooLarge) {
+				return
+			}
+			continue
+		}
+
+		// the length field does not count itself
+		frameLength := uint64(expectedLength) + uint64(FrameLengthFieldSizeInByte)
+		actuallyLength := uint64(ub.ReadableLength())
 
 		// not a complete frame, cache the data
-		if expectedLength > actuallyLength {
-			frm.cache.ReadFrom(ub)
+		if frameLength > actuallyLength {
+			frm.cacheData(state, ub)
 			return
 		}
 
 		// just one frame, need not to alloc new UBuf
-		if expectedLength == actuallyLength {
+		if frameLength == actuallyLength {
 			// drop size-field-data by dummy reading
 			ub.ReadU32BE()
 
 			context.SetBuffer(ub)
-			frm.upper.OnLowerData(context)
+			frm.GetUpper().OnLowerData(context)
 			return
 		}
 
-		// here: expectedLength < actuallyLength
+		// here: frameLength < actuallyLength
 		// there must have at least one complete frame
-		newUbuf := UBufAlloc(int(expectedLength))
+		newUbuf := frameBuffer(expectedLength)
 
 		// drop size-field-data by dummy reading
 		ub.ReadU32BE()
@@ -105,26 +243,31 @@ func (frm *FrameDecoder) handleCurrentData(context Context, ub *UBuf) {
 		// fill the new buffer for uplayer
 		_, err = io.CopyN(newUbuf, ub, int64(expectedLength))
 		if err != nil {
-			// bad buffer, discard it
-			frm.cache.Reset()
+			frm.badFrame(context, state, ub, ErrBadFormat)
 			return
 		}
 
 		context.SetBuffer(newUbuf)
 
 		// invoke uplayer
-		frm.upper.OnLowerData(context)
+		frm.GetUpper().OnLowerData(context)
 	}
 }
 
 // handleCachedData ...
-func (frm *FrameDecoder) handleCachedData(context Context, ub *UBuf) {
+func (frm *FrameDecoder) handleCachedData(context Context, state *frameDecoderState) {
 	// handle as much as possiable with loop
 	for {
-		cachedLength := frm.cache.ReadableLength()
+		cache := state.cache
+
+		if state.skip > 0 {
+			frm.skipData(state, cache)
+		}
+
+		cachedLength := cache.ReadableLength()
 
 		if cachedLength == 0 {
-			frm.cache.Reset()
+			cache.Reset()
 			return
 		}
 
@@ -133,43 +276,49 @@ func (frm *FrameDecoder) handleCachedData(context Context, ub *UBuf) {
 			return
 		}
 
-		expectedLength, err := frm.cache.PeekU32BE()
+		expectedLength, err := cache.PeekU32BE()
 		if err != nil {
-			// bad buffer, discard it
-			frm.cache.Reset()
+			frm.badFrame(context, state, cache, ErrBadFormat)
 			return
 		}
 
-		if cachedLength < int(expectedLength) {
+		// never cache the frame which would be dropped
+		if uint64(expectedLength) > uint64(frm.maxFrameSize) {
+			if !frm.badFrame(context, state, cache, ErrFrameTooLarge) {
+				return
+			}
+			continue
+		}
+
+		if cachedLength < FrameLengthFieldSizeInByte+int(expectedLength) {
 			// wait for more data
 			return
 		}
 
 		// there must have at least one complete frame
-		newUbuf := UBufAlloc(int(expectedLength))
+		newUbuf := frameBuffer(expectedLength)
 
 		// drop size-field-data by dummy reading
-		frm.cache.ReadU32BE()
+		cache.ReadU32BE()
 
 		// fill the new buffer for uplayer
-		_, err = io.CopyN(newUbuf, frm.cache, int64(expectedLength))
+		_, err = io.CopyN(newUbuf, cache, int64(expectedLength))
 		if err != nil {
-			// bad buffer, discard it
-			frm.cache.Reset()
+			frm.badFrame(context, state, cache, ErrBadFormat)
 			return
 		}
 
 		context.SetBuffer(newUbuf)
 
 		// invoke uplayer
-		frm.upper.OnLowerData(context)
+		frm.GetUpper().OnLowerData(context)
 	}
 }
 
 // OnLowerData ...
 func (frm *FrameDecoder) OnLowerData(context Context) {
 	if context.GetConnection().UseReference() {
-		frm.upper.OnLowerData(context)
+		frm.GetUpper().OnLowerData(context)
 		return
 	}
 
@@ -178,14 +327,23 @@ func (frm *FrameDecoder) OnLowerData(context Context) {
 		return
 	}
 
-	if frm.enable {
+	if frm.IsEnabled() {
+		state := frm.GetState(context.GetConnection()).(*frameDecoderState)
+
+		// the rest of a closed stream is garbage
+		if state.broken {
+			return
+		}
+
 		// handle current received data
-		frm.handleCurrentData(context, ub)
+		frm.handleCurrentData(context, state, ub)
 
 		// handle history cached data
-		frm.handleCachedData(context, ub)
+		if !state.broken {
+			frm.handleCachedData(context, state)
+		}
 	} else {
-		frm.upper.OnLowerData(context)
+		frm.GetUpper().OnLowerData(context)
 	}
 }
 
@@ -196,10 +354,25 @@ func (frm *FrameDecoder) Run() DataProcessor {
 	frm.cacheCapacity = cacheCapacity
 
 	if exists {
-		fmt.Println("FrameDecoder: option CacheCapacity:", frm.cacheCapacity)
+		frm.GetLogger().Info("option", "CacheCapacity", frm.cacheCapacity)
 	}
 
-	frm.cache = UBufAlloc(frm.cacheCapacity)
+	maxFrameSize, exists := OptionParseInt(frm.GetOption("MaxFrameSize"), frm.maxFrameSize)
+	frm.maxFrameSize = maxFrameSize
+	if exists {
+		frm.GetLogger().Info("option", "MaxFrameSize", frm.maxFrameSize)
+	}
+
+	policy, exists := OptionParseString(frm.GetOption("BadFramePolicy"), frm.badFramePolicy)
+	switch policy {
+	case FrameDecoderPolicyClose, FrameDecoderPolicyReport, FrameDecoderPolicySkip:
+		frm.badFramePolicy = policy
+		if exists {
+			frm.GetLogger().Info("option", "BadFramePolicy", frm.badFramePolicy)
+		}
+	default:
+		frm.GetLogger().Error("bad policy, use default", "BadFramePolicy", policy, "default", frm.badFramePolicy)
+	}
 
 	return frm
 }
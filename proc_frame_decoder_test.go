@@ -0,0 +1,203 @@
+package ustack
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// dummyConnection is a TransportConnection that does nothing
+type dummyConnection struct {
+	name   string
+	closed bool
+}
+
+func (c *dummyConnection) GetName() string             { return c.name }
+func (c *dummyConnection) Read(p []byte) (int, error)  { return 0, errors.New("not supported") }
+func (c *dummyConnection) Write(p []byte) (int, error) { return len(p), nil }
+func (c *dummyConnection) UseReference() bool          { return false }
+func (c *dummyConnection) GetReference() (interface{}, error) {
+	return nil, errors.New("not supported")
+}
+func (c *dummyConnection) SetReference(p interface{}) error { return errors.New("not supported") }
+func (c *dummyConnection) Close()                           { c.closed = true }
+func (c *dummyConnection) Closed() bool                     { return c.closed }
+
+// frameCollector is an upper data processor which saves the frames
+type frameCollector struct {
+	ProcBase
+	frames map[TransportConnection][]string
+}
+
+func newFrameCollector() *frameCollector {
+	fc := &frameCollector{
+		ProcBase: NewProcBaseInstance("FrameCollector"),
+		frames:   make(map[TransportConnection][]string),
+	}
+	fc.ProcBase.SetWhere(fc)
+	return fc
+}
+
+func (fc *frameCollector) OnLowerData(context Context) {
+	ub := context.GetBuffer()
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
+	fc.frames[context.GetConnection()] = append(fc.frames[context.GetConnection()], string(data))
+}
+
+func frameBytes(payload string) []byte {
+	ub := UBufAllocWithHeadReserved(64, 4)
+	ub.Write([]byte(payload))
+	ub.WriteHeadU32BE(uint32(ub.ReadableLength()))
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
+	return data
+}
+
+func feedFrameDecoder(dp DataProcessor, c TransportConnection, data []byte) {
+	ub := UBufAlloc(64)
+	ub.Write(data)
+	dp.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+}
+
+func TestFrameDecoderPerConnection(t *testing.T) {
+	collector := newFrameCollector()
+
+	frm := NewFrameDecoder().SetUStack(NewUStack())
+	frm.SetUpper(collector)
+	frm.Run()
+
+	c1 := &dummyConnection{name: "c1"}
+	c2 := &dummyConnection{name: "c2"}
+
+	f1 := frameBytes("hello")
+	f2 := frameBytes("world!")
+
+	// interleave partial frames of two connections
+	feedFrameDecoder(frm, c1, f1[:3])
+	feedFrameDecoder(frm, c2, f2[:6])
+	feedFrameDecoder(frm, c1, f1[3:])
+	feedFrameDecoder(frm, c2, f2[6:])
+
+	if got := collector.frames[c1]; len(got) != 1 || got[0] != "hello" {
+		t.Fatal("Unexpected frames of c1:", got)
+	}
+
+	if got := collector.frames[c2]; len(got) != 1 || got[0] != "world!" {
+		t.Fatal("Unexpected frames of c2:", got)
+	}
+}
+
+func TestFrameDecoderEmptyFrames(t *testing.T) {
+	collector := newFrameCollector()
+
+	frm := NewFrameDecoder().SetUStack(NewUStack())
+	frm.SetUpper(collector)
+	frm.Run()
+
+	c := &dummyConnection{name: "c"}
+
+	data := append(frameBytes(""), frameBytes("x")...)
+	feedFrameDecoder(frm, c, append(data, frameBytes("")...))
+
+	if got := collector.frames[c]; len(got) != 3 || got[0] != "" || got[1] != "x" || got[2] != "" {
+		t.Fatalf("Unexpected frames: %q", got)
+	}
+}
+
+// newBadFrameDecoder returns a frame decoder of the policy, the errors
+// reported are counted
+func newBadFrameDecoder(policy string, reported *int32) (*FrameDecoder, *frameCollector) {
+	collector := newFrameCollector()
+
+	frm := NewFrameDecoder().
+		SetUStack(NewUStack().
+			SetEventListener(func(event Event) {
+				if event.Type == UStackEventProcessingError {
+					atomic.AddInt32(reported, 1)
+				}
+			})).
+		SetOption("MaxFrameSize", 8).
+		SetOption("BadFramePolicy", policy)
+	frm.SetUpper(collector)
+	frm.Run()
+
+	return frm.(*FrameDecoder), collector
+}
+
+func TestFrameDecoderBadFrameClose(t *testing.T) {
+	var reported int32
+	frm, collector := newBadFrameDecoder(FrameDecoderPolicyClose, &reported)
+
+	good := &dummyConnection{name: "good"}
+	bad := &dummyConnection{name: "bad"}
+
+	f := frameBytes("hello")
+
+	feedFrameDecoder(frm, good, f[:3])
+	feedFrameDecoder(frm, bad, []byte{0xff, 0xff, 0xff, 0xff, 'x'})
+	feedFrameDecoder(frm, good, f[3:])
+
+	// the rest of bad stream is dropped
+	feedFrameDecoder(frm, bad, frameBytes("ok"))
+
+	if !bad.Closed() || good.Closed() {
+		t.Fatal("Expect only the bad connection closed")
+	}
+	if got := collector.frames[good]; len(got) != 1 || got[0] != "hello" {
+		t.Fatal("Unexpected frames of good:", got)
+	}
+	if got := collector.frames[bad]; len(got) != 0 {
+		t.Fatal("Unexpected frames of bad:", got)
+	}
+	if atomic.LoadInt32(&reported) != 1 {
+		t.Fatal("Expect 1 error, got", atomic.LoadInt32(&reported))
+	}
+
+	// the oversized frame is refused to send
+	ub := UBufAllocWithHeadReserved(64, 4)
+	ub.Write([]byte("too large"))
+	frm.OnUpperData(NewUStackContext().SetConnection(good).SetBuffer(ub))
+	if atomic.LoadInt32(&reported) != 2 {
+		t.Fatal("Expect 2 errors, got", atomic.LoadInt32(&reported))
+	}
+}
+
+func TestFrameDecoderBadFrameSkip(t *testing.T) {
+	for _, policy := range []string{FrameDecoderPolicyReport, FrameDecoderPolicySkip} {
+		var reported int32
+		frm, collector := newBadFrameDecoder(policy, &reported)
+
+		c := &dummyConnection{name: "c"}
+
+		oversized := frameBytes("0123456789")
+		data := append(frameBytes("a"), oversized...)
+		data = append(data, frameBytes("b")...)
+
+		// the oversized frame is skipped in pieces, cached or not
+		feedFrameDecoder(frm, c, data[:2])
+		feedFrameDecoder(frm, c, data[2:8])
+		feedFrameDecoder(frm, c, data[8:12])
+		feedFrameDecoder(frm, c, data[12:])
+
+		if c.Closed() {
+			t.Fatal(policy, "Expect connection not closed")
+		}
+		if got := collector.frames[c]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Fatal(policy, "Unexpected frames:", got)
+		}
+
+		expected := int32(0)
+		if policy == FrameDecoderPolicyReport {
+			expected = 1
+		}
+		if atomic.LoadInt32(&reported) != expected {
+			t.Fatal(policy, "Expect errors", expected, "got", atomic.LoadInt32(&reported))
+		}
+
+		stats := frm.GetStats()
+		if stats["badFrames"] != uint64(1) || stats["skippedBytes"] != uint64(10) {
+			t.Fatal(policy, "Unexpected stats:", stats)
+		}
+	}
+}
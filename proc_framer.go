@@ -0,0 +1,288 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrFrameTooLarge is reported if a frame is larger than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Framing encodes and splits the frames of Framer
+type Framing interface {
+	// Configure parses the options of framer, it is called by Run
+	Configure(fr *Framer)
+	// Overhead returns the head room needed by Encode
+	Overhead() int
+	// MaxEncodedSize returns the max bytes of a frame of size on the wire
+	MaxEncodedSize(size int) int
+	// Encode returns the frame of data in ub, ub may be reused
+	Encode(fr *Framer, ub *UBuf) (*UBuf, error)
+	// Split returns the first frame in data and the bytes it takes,
+	// advance 0 for more data and nil frame for the bytes to skip. An
+	// error with advance 0 means the stream can not be recovered.
+	Split(data []byte) (advance int, frame []byte, err error)
+}
+
+// FramingResyncer is implemented by the framings which can find the next
+// frame after the bad data, e.g. by a delimiter
+type FramingResyncer interface {
+	// Resync returns the bytes to discard, found is true if the next
+	// frame starts after them
+	Resync(data []byte) (advance int, found bool)
+}
+
+// FramingDelimiter is implemented by the framings whose frames end with
+// a delimiter. The framer searches the delimiter from where it stopped
+// last time, and calls Split with the data up to the delimiter.
+type FramingDelimiter interface {
+	Delimiter() []byte
+}
+
+// framerState is the per-connection reassembly state
+type framerState struct {
+	cache []byte
+	// the bytes of cache searched for the delimiter
+	scanned    int
+	discarding bool
+}
+
+// append reads the data of ub to the tail of cache, the cache grows
+// twice as large if there is no enough room
+func (state *framerState) append(ub *UBuf) {
+	size := len(state.cache)
+	n := ub.ReadableLength()
+
+	if cap(state.cache)-size < n {
+		capacity := 2 * cap(state.cache)
+		if capacity < size+n {
+			capacity = size + n
+		}
+
+		cache := make([]byte, size, capacity)
+		copy(cache, state.cache)
+		state.cache = cache
+	}
+
+	state.cache = state.cache[:size+n]
+	ub.Read(state.cache[size:])
+}
+
+// compact moves the rest data to the head of cache after the frames are
+// consumed
+func (state *framerState) compact(rest []byte) {
+	if len(rest) == len(state.cache) {
+		return
+	}
+	state.cache = state.cache[:copy(state.cache, rest)]
+}
+
+// Framer splits the stream of a connection into frames by Framing and
+// frames the data going down. A frame larger than MaxFrameSize is
+// reported as ErrFrameTooLarge and skipped, the data is discarded until
+// the next frame if the framing is a FramingResyncer, otherwise the
+// connection is closed since the stream can not be recovered.
+//
+// Options:
+//
+//	MaxFrameSize: int, 1M by default
+type Framer struct {
+	ProcBase
+	framing      Framing
+	maxFrameSize int
+}
+
+// NewFramer returns a framer of framing
+func NewFramer(name string, framing Framing) DataProcessor {
+	fr := &Framer{
+		ProcBase:     NewProcBaseInstance(name),
+		framing:      framing,
+		maxFrameSize: 1 << 20,
+	}
+	fr.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &framerState{}
+	})
+	return fr.ProcBase.SetWhere(fr)
+}
+
+// GetMaxFrameSize ...
+func (fr *Framer) GetMaxFrameSize() int {
+	return fr.maxFrameSize
+}
+
+// GetOverhead returns the overhead
+func (fr *Framer) GetOverhead() int {
+	return fr.framing.Overhead()
+}
+
+// OnUpperData ...
+func (fr *Framer) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() {
+		fr.GetLower().OnUpperData(context)
+		return
+	}
+
+	if fr.IsEnabled() {
+		ub := context.GetBuffer()
+		if ub == nil {
+			return
+		}
+
+		if ub.ReadableLength() > fr.maxFrameSize {
+			fr.ReportError(context, DataDirectionDown, ErrFrameTooLarge)
+			return
+		}
+
+		encoded, err := fr.framing.Encode(fr, ub)
+		if err != nil {
+			fr.ReportError(context, DataDirectionDown, err)
+			return
+		}
+
+		context.SetBuffer(encoded)
+	}
+
+	fr.GetLower().OnUpperData(context)
+}
+
+// broken drops the cache and closes the connection
+func (fr *Framer) broken(context Context, state *framerState, err error) {
+	state.cache = nil
+	state.scanned = 0
+	state.discarding = false
+
+	fr.ReportError(context, DataDirectionUp, err)
+
+	fr.GetLogger().Warn("stream broken", "connection", context.GetConnection().GetName(), "error", err)
+	context.GetConnection().Close()
+}
+
+// OnLowerData ...
+func (fr *Framer) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() {
+		fr.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	if !fr.IsEnabled() {
+		fr.GetUpper().OnLowerData(context)
+		return
+	}
+
+	state := fr.GetState(context.GetConnection()).(*framerState)
+	state.append(ub)
+	cache := state.cache
+
+	resyncer, _ := fr.framing.(FramingResyncer)
+	delimiter, _ := fr.framing.(FramingDelimiter)
+
+	for len(cache) > 0 {
+		if state.discarding {
+			advance, found := resyncer.Resync(cache)
+			cache = cache[advance:]
+			state.scanned = 0
+			if !found {
+				break
+			}
+			state.discarding = false
+			continue
+		}
+
+		data := cache
+		if delimiter != nil {
+			// the delimiter may be split across the data received
+			sep := delimiter.Delimiter()
+			from := state.scanned - len(sep) + 1
+			if from < 0 {
+				from = 0
+			}
+
+			if i := bytes.Index(cache[from:], sep); i >= 0 {
+				data = cache[:from+i+len(sep)]
+			} else {
+				state.scanned = len(cache)
+				data = nil
+			}
+		}
+
+		var advance int
+		var frame []byte
+		var err error
+		if data != nil {
+			advance, frame, err = fr.framing.Split(data)
+		}
+		if err != nil {
+			if advance == 0 {
+				fr.broken(context, state, err)
+				return
+			}
+
+			fr.ReportError(context, DataDirectionUp, err)
+			cache = cache[advance:]
+			state.scanned = 0
+			continue
+		}
+
+		if advance == 0 {
+			if len(cache) <= fr.framing.MaxEncodedSize(fr.maxFrameSize) {
+				// wait for more data
+				break
+			}
+
+			if resyncer == nil {
+				fr.broken(context, state, ErrFrameTooLarge)
+				return
+			}
+
+			fr.ReportError(context, DataDirectionUp, ErrFrameTooLarge)
+			state.discarding = true
+			continue
+		}
+
+		cache = cache[advance:]
+		state.scanned = 0
+
+		if frame == nil {
+			continue
+		}
+
+		if len(frame) > fr.maxFrameSize {
+			fr.ReportError(context, DataDirectionUp, ErrFrameTooLarge)
+			continue
+		}
+
+		// the empty frame is delivered too, e.g. an empty line
+		newUbuf := allocCodecBuffer(fr.ustack, len(frame))
+		newUbuf.Write(frame)
+
+		context.SetBuffer(newUbuf)
+
+		// invoke uplayer
+		fr.GetUpper().OnLowerData(context)
+	}
+
+	// do not keep the consumed data
+	state.compact(cache)
+}
+
+// Run ...
+func (fr *Framer) Run() DataProcessor {
+	maxFrameSize, exists := OptionParseInt(fr.GetOption("MaxFrameSize"), fr.maxFrameSize)
+	fr.maxFrameSize = maxFrameSize
+	if exists {
+		fr.GetLogger().Info("option", "MaxFrameSize", fr.maxFrameSize)
+	}
+
+	fr.framing.Configure(fr)
+
+	return fr
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bytes"
+)
+
+// delimiterFraming ends each frame with the delimiter, the frame must
+// not contain the delimiter
+type delimiterFraming struct {
+	delimiter []byte
+}
+
+// NewDelimiterFramer returns a framer for the line-oriented protocols,
+// MaxFrameSize is the max length of a line without the delimiter.
+//
+// Options:
+//
+//	Delimiter: string, "\n" by default, e.g. "\r\n" for CRLF
+func NewDelimiterFramer() DataProcessor {
+	return NewFramer("DelimiterFramer", &delimiterFraming{
+		delimiter: []byte("\n"),
+	})
+}
+
+// Configure ...
+func (df *delimiterFraming) Configure(fr *Framer) {
+	delimiter, exists := OptionParseString(fr.GetOption("Delimiter"), string(df.delimiter))
+	if delimiter == "" {
+		fr.GetLogger().Error("empty delimiter, use default", "delimiter", string(df.delimiter))
+		return
+	}
+
+	df.delimiter = []byte(delimiter)
+	if exists {
+		fr.GetLogger().Info("option", "Delimiter", delimiter)
+	}
+}
+
+// Overhead ...
+func (df *delimiterFraming) Overhead() int {
+	return 0
+}
+
+// MaxEncodedSize ...
+func (df *delimiterFraming) MaxEncodedSize(size int) int {
+	return size + len(df.delimiter)
+}
+
+// Encode ...
+func (df *delimiterFraming) Encode(fr *Framer, ub *UBuf) (*UBuf, error) {
+	data := make([]byte, ub.ReadableLength())
+	ub.Peek(data)
+
+	if bytes.Contains(data, df.delimiter) {
+		return nil, ErrBadFormat
+	}
+
+	if ub.TailWritableLength() < len(df.delimiter) {
+		ub = allocCodecBuffer(fr.ustack, len(data)+len(df.delimiter))
+		ub.Write(data)
+	}
+
+	ub.Write(df.delimiter)
+	return ub, nil
+}
+
+// Delimiter ...
+func (df *delimiterFraming) Delimiter() []byte {
+	return df.delimiter
+}
+
+// Split ...
+func (df *delimiterFraming) Split(data []byte) (int, []byte, error) {
+	i := bytes.Index(data, df.delimiter)
+	if i < 0 {
+		return 0, nil, nil
+	}
+	return i + len(df.delimiter), data[:i], nil
+}
+
+// Resync ...
+func (df *delimiterFraming) Resync(data []byte) (int, bool) {
+	if i := bytes.Index(data, df.delimiter); i >= 0 {
+		return i + len(df.delimiter), true
+	}
+
+	// keep the part of delimiter may be at the tail
+	advance := len(data) - len(df.delimiter) + 1
+	if advance < 0 {
+		advance = 0
+	}
+	return advance, false
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"encoding/binary"
+)
+
+// lengthFieldFraming prefixes each frame with its length
+type lengthFieldFraming struct {
+	size           int
+	littleEndian   bool
+	includesHeader bool
+	maxFrameSize   int
+}
+
+// NewLengthFieldFramer returns a framer of length prefix, unlike the
+// FrameDecoder the width and endianness of the prefix are configurable.
+// The stream can not be recovered from a bad length, so the connection
+// is closed.
+//
+// Options:
+//
+//	LengthFieldSize: int, 2, 4 or 8, 4 by default, 0 for unsigned varint
+//	LittleEndian: bool, false by default
+//	LengthIncludesHeader: bool, false by default, not for varint
+func NewLengthFieldFramer() DataProcessor {
+	return NewFramer("LengthFieldFramer", &lengthFieldFraming{
+		size: 4,
+	})
+}
+
+// Configure ...
+func (lf *lengthFieldFraming) Configure(fr *Framer) {
+	size, exists := OptionParseInt(fr.GetOption("LengthFieldSize"), lf.size)
+	switch size {
+	case 0, 2, 4, 8:
+		lf.size = size
+		if exists {
+			fr.GetLogger().Info("option", "LengthFieldSize", lf.size)
+		}
+	default:
+		fr.GetLogger().Error("bad length field size, use default", "LengthFieldSize", size, "default", lf.size)
+	}
+
+	littleEndian, exists := OptionParseBool(fr.GetOption("LittleEndian"), lf.littleEndian)
+	lf.littleEndian = littleEndian
+	if exists {
+		fr.GetLogger().Info("option", "LittleEndian", lf.littleEndian)
+	}
+
+	includesHeader, exists := OptionParseBool(fr.GetOption("LengthIncludesHeader"), lf.includesHeader)
+	lf.includesHeader = includesHeader && lf.size > 0
+	if exists {
+		fr.GetLogger().Info("option", "LengthIncludesHeader", lf.includesHeader)
+	}
+
+	lf.maxFrameSize = fr.GetMaxFrameSize()
+}
+
+// Overhead ...
+func (lf *lengthFieldFraming) Overhead() int {
+	if lf.size == 0 {
+		return binary.MaxVarintLen64
+	}
+	return lf.size
+}
+
+// MaxEncodedSize ...
+func (lf *lengthFieldFraming) MaxEncodedSize(size int) int {
+	return size + lf.Overhead()
+}
+
+// byteOrder ...
+func (lf *lengthFieldFraming) byteOrder() binary.ByteOrder {
+	if lf.littleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Encode ...
+func (lf *lengthFieldFraming) Encode(fr *Framer, ub *UBuf) (*UBuf, error) {
+	length := uint64(ub.ReadableLength())
+
+	if lf.size == 0 {
+		b := make([]byte, binary.MaxVarintLen64)
+		return ub, ub.WriteHeadBytes(b[:binary.PutUvarint(b, length)])
+	}
+
+	if lf.includesHeader {
+		length += uint64(lf.size)
+	}
+
+	b := make([]byte, lf.size)
+	switch lf.size {
+	case 2:
+		if length > 0xffff {
+			return nil, ErrFrameTooLarge
+		}
+		lf.byteOrder().PutUint16(b, uint16(length))
+	case 4:
+		if length > 0xffffffff {
+			return nil, ErrFrameTooLarge
+		}
+		lf.byteOrder().PutUint32(b, uint32(length))
+	case 8:
+		lf.byteOrder().PutUint64(b, length)
+	}
+
+	return ub, ub.WriteHeadBytes(b)
+}
+
+// Split ...
+func (lf *lengthFieldFraming) Split(data []byte) (int, []byte, error) {
+	var length uint64
+	header := lf.size
+
+	if lf.size == 0 {
+		n := 0
+		length, n = binary.Uvarint(data)
+		if n == 0 {
+			return 0, nil, nil
+		}
+		if n < 0 {
+			return 0, nil, ErrBadFormat
+		}
+		header = n
+	} else {
+		if len(data) < lf.size {
+			return 0, nil, nil
+		}
+
+		switch lf.size {
+		case 2:
+			length = uint64(lf.byteOrder().Uint16(data))
+		case 4:
+			length = uint64(lf.byteOrder().Uint32(data))
+		case 8:
+			length = lf.byteOrder().Uint64(data)
+		}
+
+		if lf.includesHeader {
+			if length < uint64(lf.size) {
+				return 0, nil, ErrBadFormat
+			}
+			length -= uint64(lf.size)
+		}
+	}
+
+	// do not wait for the data which would be dropped
+	if length > uint64(lf.maxFrameSize) {
+		return 0, nil, ErrFrameTooLarge
+	}
+
+	total := header + int(length)
+	if len(data) < total {
+		return 0, nil, nil
+	}
+	return total, data[header:total], nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"bytes"
+)
+
+const (
+	SLIPEnd    byte = 0xc0
+	SLIPEsc    byte = 0xdb
+	SLIPEscEnd byte = 0xdc
+	SLIPEscEsc byte = 0xdd
+)
+
+// cobsFraming encodes each frame by Consistent Overhead Byte Stuffing,
+// the frames are delimited by zero
+type cobsFraming struct{}
+
+// NewCOBSFramer returns a framer of COBS, each frame is followed by a
+// zero byte
+func NewCOBSFramer() DataProcessor {
+	return NewFramer("COBSFramer", &cobsFraming{})
+}
+
+// Configure ...
+func (cf *cobsFraming) Configure(fr *Framer) {}
+
+// Overhead returns 0, the frame is copied when it is encoded
+func (cf *cobsFraming) Overhead() int {
+	return 0
+}
+
+// MaxEncodedSize ...
+func (cf *cobsFraming) MaxEncodedSize(size int) int {
+	return size + size/254 + 2
+}
+
+// cobsEncode appends the encoded src to dst
+func cobsEncode(dst, src []byte) []byte {
+	codeIndex := len(dst)
+	dst = append(dst, 0)
+	code := byte(1)
+
+	for _, b := range src {
+		if b != 0 {
+			dst = append(dst, b)
+			code++
+		}
+
+		if b == 0 || code == 0xff {
+			dst[codeIndex] = code
+			codeIndex = len(dst)
+			dst = append(dst, 0)
+			code = 1
+		}
+	}
+
+	dst[codeIndex] = code
+	return dst
+}
+
+// cobsDecode returns the decoded src which has no zero
+func cobsDecode(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src))
+
+	for i := 0; i < len(src); {
+		code := int(src[i])
+		if code == 0 || i+code > len(src) {
+			return nil, ErrBadFormat
+		}
+
+		dst = append(dst, src[i+1:i+code]...)
+		i += code
+
+		if code < 0xff && i < len(src) {
+			dst = append(dst, 0)
+		}
+	}
+
+	return dst, nil
+}
+
+// Encode ...
+func (cf *cobsFraming) Encode(fr *Framer, ub *UBuf) (*UBuf, error) {
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
+
+	encoded := append(cobsEncode(make([]byte, 0, cf.MaxEncodedSize(len(data))), data), 0)
+
+	eub := allocCodecBuffer(fr.ustack, len(encoded))
+	eub.Write(encoded)
+	return eub, nil
+}
+
+// Delimiter ...
+func (cf *cobsFraming) Delimiter() []byte {
+	return []byte{0}
+}
+
+// Split ...
+func (cf *cobsFraming) Split(data []byte) (int, []byte, error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return 0, nil, nil
+	}
+	if i == 0 {
+		return 1, nil, nil
+	}
+
+	frame, err := cobsDecode(data[:i])
+	return i + 1, frame, err
+}
+
+// Resync ...
+func (cf *cobsFraming) Resync(data []byte) (int, bool) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, true
+	}
+	return len(data), false
+}
+
+// slipFraming encodes each frame as RFC 1055
+type slipFraming struct{}
+
+// NewSLIPFramer returns a framer of SLIP, each frame is enclosed by
+// SLIPEnd, the empty frames are ignored
+func NewSLIPFramer() DataProcessor {
+	return NewFramer("SLIPFramer", &slipFraming{})
+}
+
+// Configure ...
+func (sf *slipFraming) Configure(fr *Framer) {}
+
+// Overhead returns 0, the frame is copied when it is encoded
+func (sf *slipFraming) Overhead() int {
+	return 0
+}
+
+// MaxEncodedSize ...
+func (sf *slipFraming) MaxEncodedSize(size int) int {
+	return 2*size + 2
+}
+
+// Encode ...
+func (sf *slipFraming) Encode(fr *Framer, ub *UBuf) (*UBuf, error) {
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
+
+	// the leading end flushes the noise on line
+	encoded := make([]byte, 0, sf.MaxEncodedSize(len(data)))
+	encoded = append(encoded, SLIPEnd)
+	for _, b := range data {
+		switch b {
+		case SLIPEnd:
+			encoded = append(encoded, SLIPEsc, SLIPEscEnd)
+		case SLIPEsc:
+			encoded = append(encoded, SLIPEsc, SLIPEscEsc)
+		default:
+			encoded = append(encoded, b)
+		}
+	}
+	encoded = append(encoded, SLIPEnd)
+
+	eub := allocCodecBuffer(fr.ustack, len(encoded))
+	eub.Write(encoded)
+	return eub, nil
+}
+
+// Delimiter ...
+func (sf *slipFraming) Delimiter() []byte {
+	return []byte{SLIPEnd}
+}
+
+// Split ...
+func (sf *slipFraming) Split(data []byte) (int, []byte, error) {
+	i := bytes.IndexByte(data, SLIPEnd)
+	if i < 0 {
+		return 0, nil, nil
+	}
+	if i == 0 {
+		return 1, nil, nil
+	}
+
+	frame := make([]byte, 0, i)
+	for j := 0; j < i; j++ {
+		b := data[j]
+		if b == SLIPEsc {
+			if j++; j == i {
+				return i + 1, nil, ErrBadFormat
+			}
+
+			switch data[j] {
+			case SLIPEscEnd:
+				b = SLIPEnd
+			case SLIPEscEsc:
+				b = SLIPEsc
+			default:
+				return i + 1, nil, ErrBadFormat
+			}
+		}
+		frame = append(frame, b)
+	}
+
+	return i + 1, frame, nil
+}
+
+// Resync ...
+func (sf *slipFraming) Resync(data []byte) (int, bool) {
+	if i := bytes.IndexByte(data, SLIPEnd); i >= 0 {
+		return i + 1, true
+	}
+	return len(data), false
+}
@@ -0,0 +1,241 @@
+package ustack
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// newFramer returns a running framer with the options, its lower and
+// upper are collectors
+func newFramer(t *testing.T, dp DataProcessor, options map[string]interface{}) (DataProcessor, *bufferCollector, *frameCollector) {
+	for name, value := range options {
+		dp.SetOption(name, value)
+	}
+
+	// the stack counts the overhead
+	stack := NewUStack().AppendDataProcessor(dp).Run()
+	t.Cleanup(func() { stack.Stop(context.Background()) })
+
+	lower := newBufferCollector()
+	upper := newFrameCollector()
+	dp.SetLower(lower)
+	dp.SetUpper(upper)
+
+	return dp, lower, upper
+}
+
+func feedFramer(dp DataProcessor, c TransportConnection, data []byte) {
+	ub := UBufAlloc(len(data))
+	ub.Write(data)
+	dp.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+}
+
+// encodeFrames returns the bytes on wire of the payloads
+func encodeFrames(dp DataProcessor, lower *bufferCollector, c TransportConnection, payloads []string) []byte {
+	lower.buffers = nil
+	for _, payload := range payloads {
+		ub := UBufAllocWithHeadReserved(len(payload)+16, 16)
+		ub.Write([]byte(payload))
+		dp.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+	}
+
+	var wire []byte
+	for _, ub := range lower.buffers {
+		data := make([]byte, ub.ReadableLength())
+		ub.Read(data)
+		wire = append(wire, data...)
+	}
+	return wire
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	payloads := []string{"hello", "", "a\x00b\xc0c\xdb", string(bytes.Repeat([]byte{'x'}, 600)), "end"}
+
+	cases := []struct {
+		name    string
+		new     func() DataProcessor
+		options map[string]interface{}
+		// the frames are not expected
+		skip map[int]bool
+	}{
+		{"LF", NewDelimiterFramer, nil, nil},
+		{"CRLF", NewDelimiterFramer, map[string]interface{}{"Delimiter": "\r\n"}, nil},
+		{"BE4", NewLengthFieldFramer, nil, nil},
+		{"LE2", NewLengthFieldFramer, map[string]interface{}{"LengthFieldSize": 2, "LittleEndian": true}, nil},
+		{"BE8Header", NewLengthFieldFramer, map[string]interface{}{"LengthFieldSize": 8, "LengthIncludesHeader": true}, nil},
+		{"Varint", NewLengthFieldFramer, map[string]interface{}{"LengthFieldSize": 0}, nil},
+		{"COBS", NewCOBSFramer, nil, nil},
+		{"SLIP", NewSLIPFramer, nil, map[int]bool{1: true}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dp, lower, upper := newFramer(t, tc.new(), tc.options)
+			c := &dummyConnection{name: "c"}
+
+			sent := payloads
+			if tc.new().GetName() == "DelimiterFramer" {
+				// the delimiter is not allowed in the frame
+				sent = payloads[:2]
+			}
+
+			wire := encodeFrames(dp, lower, c, sent)
+
+			var expected []string
+			for i, payload := range sent {
+				if !tc.skip[i] {
+					expected = append(expected, payload)
+				}
+			}
+
+			// byte by byte, then all at once
+			for _, chunk := range []int{1, len(wire)} {
+				upper.frames = make(map[TransportConnection][]string)
+				for i := 0; i < len(wire); i += chunk {
+					end := i + chunk
+					if end > len(wire) {
+						end = len(wire)
+					}
+					feedFramer(dp, c, wire[i:end])
+				}
+
+				if got := upper.frames[c]; len(got) != len(expected) {
+					t.Fatalf("chunk %d: expect %d frames, got %d: %q", chunk, len(expected), len(got), got)
+				}
+				for i, frame := range upper.frames[c] {
+					if frame != expected[i] {
+						t.Errorf("chunk %d: expect frame %d %q, got %q", chunk, i, expected[i], frame)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFramerWireFormat(t *testing.T) {
+	c := &dummyConnection{name: "c"}
+
+	cases := []struct {
+		name    string
+		new     func() DataProcessor
+		options map[string]interface{}
+		payload string
+		wire    []byte
+	}{
+		{"CRLF", NewDelimiterFramer, map[string]interface{}{"Delimiter": "\r\n"}, "ok", []byte("ok\r\n")},
+		{"LE2Header", NewLengthFieldFramer, map[string]interface{}{"LengthFieldSize": 2, "LittleEndian": true, "LengthIncludesHeader": true}, "abc", []byte{5, 0, 'a', 'b', 'c'}},
+		{"Varint", NewLengthFieldFramer, map[string]interface{}{"LengthFieldSize": 0}, string(bytes.Repeat([]byte{'x'}, 300)), append([]byte{0xac, 0x02}, bytes.Repeat([]byte{'x'}, 300)...)},
+		{"COBS", NewCOBSFramer, nil, "\x11\x22\x00\x33", []byte{0x03, 0x11, 0x22, 0x02, 0x33, 0x00}},
+		{"SLIP", NewSLIPFramer, nil, "\xc0\xdb", []byte{0xc0, 0xdb, 0xdc, 0xdb, 0xdd, 0xc0}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dp, lower, _ := newFramer(t, tc.new(), tc.options)
+
+			if wire := encodeFrames(dp, lower, c, []string{tc.payload}); !bytes.Equal(wire, tc.wire) {
+				t.Errorf("expect % x, got % x", tc.wire, wire)
+			}
+		})
+	}
+
+	// 254 non-zero bytes end a COBS block
+	block := bytes.Repeat([]byte{'a'}, 254)
+	if encoded := cobsEncode(nil, block); len(encoded) != 256 || encoded[0] != 0xff || encoded[255] != 0x01 {
+		t.Errorf("unexpected COBS block % x", encoded[:1])
+	}
+	if decoded, err := cobsDecode(cobsEncode(nil, block)); err != nil || !bytes.Equal(decoded, block) {
+		t.Errorf("unexpected COBS decoded block, error %v", err)
+	}
+}
+
+func TestFramerMaxFrameSize(t *testing.T) {
+	t.Run("Delimiter", func(t *testing.T) {
+		dp, _, upper := newFramer(t, NewDelimiterFramer(), map[string]interface{}{"MaxFrameSize": 8})
+		c := &dummyConnection{name: "c"}
+
+		// the long line is discarded in pieces until the delimiter
+		feedFramer(dp, c, []byte("short\nthis line"))
+		feedFramer(dp, c, []byte(" is too long"))
+		feedFramer(dp, c, []byte(" indeed\nnext\n"))
+		feedFramer(dp, c, []byte("123456789\n12345678\n"))
+
+		expected := []string{"short", "next", "12345678"}
+		if got := upper.frames[c]; len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] || got[2] != expected[2] {
+			t.Errorf("expect %q, got %q", expected, got)
+		}
+		if c.Closed() {
+			t.Errorf("expect connection not closed")
+		}
+	})
+
+	t.Run("LengthField", func(t *testing.T) {
+		dp, _, upper := newFramer(t, NewLengthFieldFramer(), map[string]interface{}{"MaxFrameSize": 8})
+		good := &dummyConnection{name: "good"}
+		bad := &dummyConnection{name: "bad"}
+
+		feedFramer(dp, good, []byte{0, 0, 0, 3, 'a'})
+		feedFramer(dp, bad, []byte{0xff, 0xff, 0xff, 0xff, 'x'})
+		feedFramer(dp, good, []byte{'b', 'c'})
+
+		if !bad.Closed() || good.Closed() {
+			t.Errorf("expect only the bad connection closed")
+		}
+		if got := upper.frames[good]; len(got) != 1 || got[0] != "abc" {
+			t.Errorf("unexpected frames %q", got)
+		}
+		if len(upper.frames[bad]) != 0 {
+			t.Errorf("unexpected frames %q", upper.frames[bad])
+		}
+	})
+
+	t.Run("SLIP", func(t *testing.T) {
+		dp, _, upper := newFramer(t, NewSLIPFramer(), map[string]interface{}{"MaxFrameSize": 4})
+		c := &dummyConnection{name: "c"}
+
+		// a bad escape and a long frame are skipped
+		feedFramer(dp, c, []byte{0xc0, 0xdb, 'x', 0xc0, '1', '2', '3', '4', '5', '6', '7', '8', '9', '0', 0xc0, 'o', 'k', 0xc0})
+
+		if got := upper.frames[c]; len(got) != 1 || got[0] != "ok" {
+			t.Errorf("unexpected frames %q", got)
+		}
+	})
+}
+
+// countingFraming counts the bytes passed to Split
+type countingFraming struct {
+	*delimiterFraming
+	split int
+}
+
+func (cf *countingFraming) Split(data []byte) (int, []byte, error) {
+	cf.split += len(data)
+	return cf.delimiterFraming.Split(data)
+}
+
+func TestFramerIncrementalScan(t *testing.T) {
+	framing := &countingFraming{delimiterFraming: &delimiterFraming{delimiter: []byte("\r\n")}}
+	dp, _, upper := newFramer(t, NewFramer("CountingFramer", framing), nil)
+	c := &dummyConnection{name: "c"}
+
+	// the line and the delimiter arrive byte by byte
+	line := string(bytes.Repeat([]byte{'x'}, 1000))
+	for _, b := range []byte(line + "\r\n" + line + "\r\n") {
+		feedFramer(dp, c, []byte{b})
+	}
+
+	if got := upper.frames[c]; len(got) != 2 || got[0] != line || got[1] != line {
+		t.Fatalf("unexpected frames of %d", len(got))
+	}
+
+	// each frame is split once, the cache is not scanned again and again
+	if framing.split != 2*(len(line)+2) {
+		t.Errorf("expect %d bytes split, got %d", 2*(len(line)+2), framing.split)
+	}
+
+	state := dp.(*Framer).GetState(c).(*framerState)
+	if len(state.cache) != 0 || state.scanned != 0 {
+		t.Errorf("unexpected cache of %d bytes, %d scanned", len(state.cache), state.scanned)
+	}
+}
@@ -5,74 +5,186 @@
 package ustack
 
 import (
-	"fmt"
+	"encoding/binary"
 	"sync"
 	"time"
 )
 
 const (
 	HeartbeatSelfMessageTag    byte = 0x83
+	HeartbeatPongMessageTag    byte = 0x84
 	HeartbeatUplayerMessageTag byte = 0x00
 )
 
-// Heartbeat ...
+// HeartbeatTimestampSizeInByte is the size of the timestamp carried by
+// ping and pong
+const HeartbeatTimestampSizeInByte = 8
+
+const (
+	HeartbeatDefaultInterval = time.Second
+	HeartbeatDefaultTimeout  = 30 * time.Second
+)
+
+// HeartbeatQuality is the heartbeat quality of a connection
+type HeartbeatQuality struct {
+	// the last round trip time
+	RTT time.Duration
+	// the smoothed round trip time as RFC 6298
+	SRTT time.Duration
+	// the mean deviation of round trip time as RFC 3550
+	Jitter time.Duration
+	// the number of pongs measured
+	Samples uint64
+	// when the last ping or pong was received
+	LastSeen time.Time
+	Lost     bool
+}
+
+// heartbeatState is the per-connection monitor state
+type heartbeatState struct {
+	lastTime time.Time
+	lost     bool
+	rtt      time.Duration
+	srtt     time.Duration
+	jitter   time.Duration
+	samples  uint64
+}
+
+// Heartbeat pings the peer every interval and declares the connection
+// lost if nothing is received from the peer within timeout. The ping
+// carries a timestamp which is echoed back by a pong, so the round trip
+// time of each connection is measured, see GetQuality. A peer sending
+// pings without timestamp is monitored but not measured.
+//
+// Options:
+//
+//	IntervalInSecond: int, 1 by default
+//	TimeoutInSecond: int, 30 by default
+//	Interval: time.Duration, overrides IntervalInSecond
+//	Timeout: time.Duration, overrides TimeoutInSecond
+//	CloseOnLost: bool, true by default, or UStackEventHeartbeatRecover
+//	             is published when the lost peer resumes
 type Heartbeat struct {
 	ProcBase
-	intervalInSecond int
-	timeoutInSecond  int
-	closeOnLost      bool
-	mutex            sync.Mutex
-	monitors         map[TransportConnection]time.Time
+	interval    time.Duration
+	timeout     time.Duration
+	closeOnLost bool
+	mutex       sync.Mutex
+	// the base of timestamps, for monotonic time
+	epoch time.Time
 }
 
 // NewHeartbeat ...
 func NewHeartbeat() DataProcessor {
 	hb := &Heartbeat{
-		ProcBase:         NewProcBaseInstance("Heartbeat"),
-		intervalInSecond: 1,
-		timeoutInSecond:  30,
-		closeOnLost:      true,
-		monitors:         make(map[TransportConnection]time.Time, 16),
+		ProcBase:    NewProcBaseInstance("Heartbeat"),
+		interval:    HeartbeatDefaultInterval,
+		timeout:     HeartbeatDefaultTimeout,
+		closeOnLost: true,
+		epoch:       time.Now(),
 	}
+	hb.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &heartbeatState{
+			lastTime: time.Now(),
+		}
+	})
 	return hb.ProcBase.SetWhere(hb)
 }
 
 // updateMonitor ...
 func (hb *Heartbeat) updateMonitor(connection TransportConnection) {
+	state := hb.GetState(connection).(*heartbeatState)
+
 	hb.mutex.Lock()
-	defer hb.mutex.Unlock()
+	lost := state.lost
+	state.lastTime = time.Now()
+	state.lost = false
+	hb.mutex.Unlock()
+
+	if !lost {
+		return
+	}
+
+	hb.GetLogger().Info("heartbeat recovered", "connection", connection.GetName())
 
-	hb.monitors[connection] = time.Now()
+	hb.ustack.PublishEvent(Event{
+		Type:   UStackEventHeartbeatRecover,
+		Source: hb,
+		Data:   connection,
+	})
 }
 
-// deleteMonitor ...
-func (hb *Heartbeat) deleteMonitor(connection TransportConnection) {
+// measure updates the round trip time by the timestamp of pong
+func (hb *Heartbeat) measure(connection TransportConnection, timestamp time.Duration) {
+	rtt := time.Since(hb.epoch) - timestamp
+	if rtt < 0 {
+		return
+	}
+
+	state := hb.GetState(connection).(*heartbeatState)
+
 	hb.mutex.Lock()
 	defer hb.mutex.Unlock()
 
-	_, ok := hb.monitors[connection]
-	if ok {
-		delete(hb.monitors, connection)
+	if state.samples == 0 {
+		state.srtt = rtt
+	} else {
+		state.srtt += (rtt - state.srtt) / 8
+
+		d := rtt - state.rtt
+		if d < 0 {
+			d = -d
+		}
+		state.jitter += (d - state.jitter) / 16
 	}
+	state.rtt = rtt
+	state.samples++
 }
 
-// deleteMonitor ...
-func (hb *Heartbeat) check() {
+// GetQuality returns the heartbeat quality of the connection
+func (hb *Heartbeat) GetQuality(connection TransportConnection) HeartbeatQuality {
+	state := hb.GetState(connection).(*heartbeatState)
+
 	hb.mutex.Lock()
 	defer hb.mutex.Unlock()
 
-	if len(hb.monitors) == 0 {
-		return
+	return HeartbeatQuality{
+		RTT:      state.rtt,
+		SRTT:     state.srtt,
+		Jitter:   state.jitter,
+		Samples:  state.samples,
+		LastSeen: state.lastTime,
+		Lost:     state.lost,
 	}
+}
 
-	for connection, lastTime := range hb.monitors {
-		if int(time.Since(lastTime).Seconds()) < hb.timeoutInSecond {
-			continue
-		}
+// GetQualities returns the heartbeat quality of each connection by the
+// name of connection
+func (hb *Heartbeat) GetQualities() map[string]HeartbeatQuality {
+	qualities := make(map[string]HeartbeatQuality)
 
-		fmt.Println("Heartbeat: connection", connection.GetName(), "lost")
+	hb.RangeStates(func(connection TransportConnection, s interface{}) bool {
+		qualities[connection.GetName()] = hb.GetQuality(connection)
+		return true
+	})
 
-		delete(hb.monitors, connection)
+	return qualities
+}
+
+// check ...
+func (hb *Heartbeat) check() {
+	hb.RangeStates(func(connection TransportConnection, s interface{}) bool {
+		state := s.(*heartbeatState)
+
+		hb.mutex.Lock()
+		if state.lost || time.Since(state.lastTime) < hb.timeout {
+			hb.mutex.Unlock()
+			return true
+		}
+		state.lost = true
+		hb.mutex.Unlock()
+
+		hb.GetLogger().Warn("heartbeat lost", "connection", connection.GetName())
 
 		if hb.closeOnLost {
 			connection.Close()
@@ -83,7 +195,27 @@ func (hb *Heartbeat) check() {
 			Source: hb,
 			Data:   connection,
 		})
-	}
+
+		return true
+	})
+}
+
+// send sends a ping or pong with timestamp
+func (hb *Heartbeat) send(connection TransportConnection, tag byte, timestamp time.Duration) {
+	ub := UBufAllocWithHeadReserved(
+		hb.ustack.GetMTU(),
+		hb.ustack.GetOverhead())
+
+	ub.WriteByte(tag)
+
+	b := make([]byte, HeartbeatTimestampSizeInByte)
+	binary.BigEndian.PutUint64(b, uint64(timestamp))
+	ub.Write(b)
+
+	hb.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
 }
 
 // GetOverhead returns the overhead
@@ -94,7 +226,7 @@ func (hb *Heartbeat) GetOverhead() int {
 // OnUpperData ...
 func (hb *Heartbeat) OnUpperData(context Context) {
 	if context.GetConnection().UseReference() {
-		hb.lower.OnUpperData(context)
+		hb.GetLower().OnUpperData(context)
 		return
 	}
 
@@ -105,13 +237,13 @@ func (hb *Heartbeat) OnUpperData(context Context) {
 
 	ub.WriteHeadByte(HeartbeatUplayerMessageTag)
 
-	hb.lower.OnUpperData(context)
+	hb.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (hb *Heartbeat) OnLowerData(context Context) {
 	if context.GetConnection().UseReference() {
-		hb.upper.OnLowerData(context)
+		hb.GetUpper().OnLowerData(context)
 		return
 	}
 
@@ -125,77 +257,119 @@ func (hb *Heartbeat) OnLowerData(context Context) {
 		return
 	}
 
-	if tag == HeartbeatSelfMessageTag {
-		hb.updateMonitor(context.GetConnection())
+	if tag == HeartbeatSelfMessageTag || tag == HeartbeatPongMessageTag {
+		connection := context.GetConnection()
+
+		hb.updateMonitor(connection)
+
+		// the ping of legacy peer has no timestamp
+		if ub.ReadableLength() < HeartbeatTimestampSizeInByte {
+			hb.GetLogger().Debug("receive heartbeat", "connection", connection.GetName())
+			return
+		}
 
-		fmt.Printf("Heartbeat: %s, receive heartbeat\n", hb.GetName())
+		b := make([]byte, HeartbeatTimestampSizeInByte)
+		ub.Read(b)
+		timestamp := time.Duration(binary.BigEndian.Uint64(b))
+
+		if tag == HeartbeatSelfMessageTag {
+			hb.GetLogger().Debug("receive heartbeat", "connection", connection.GetName())
+			hb.send(connection, HeartbeatPongMessageTag, timestamp)
+		} else {
+			hb.measure(connection, timestamp)
+		}
 		return
 	}
 
-	hb.upper.OnLowerData(context)
+	hb.GetUpper().OnLowerData(context)
 }
 
 // OnEvent ...
 func (hb *Heartbeat) OnEvent(event Event) {
 	if event.Type == UStackEventNewConnection {
-		interval := hb.intervalInSecond
+		interval := hb.interval
 		connection := event.Data.(TransportConnection)
 
-		hb.updateMonitor(connection)
-
-		go func() {
+		hb.routines.spawn(func() {
 			for {
 				if connection.Closed() {
-					fmt.Printf("Heartbeat: connection %s is closed\n", connection.GetName())
-					hb.deleteMonitor(connection)
+					hb.GetLogger().Debug("connection is closed", "connection", connection.GetName())
 					return
 				}
 
-				ub := UBufAllocWithHeadReserved(
-					hb.ustack.GetMTU(),
-					hb.ustack.GetOverhead())
+				hb.send(connection, HeartbeatSelfMessageTag, time.Since(hb.epoch))
 
-				ub.WriteByte(HeartbeatSelfMessageTag)
+				hb.GetLogger().Debug("send heartbeat", "connection", connection.GetName())
 
-				hb.lower.OnUpperData(
-					NewUStackContext().
-						SetConnection(connection).
-						SetBuffer(ub))
-
-				fmt.Printf("Heartbeat: %s, send heartbeat\n", hb.GetName())
-
-				time.Sleep(time.Second * time.Duration(interval))
+				if !hb.routines.sleep(interval) {
+					return
+				}
 			}
-		}()
+		})
 	}
 }
 
 // Run ...
 func (hb *Heartbeat) Run() DataProcessor {
-	interval, exists := OptionParseInt(hb.GetOption("IntervalInSecond"), hb.intervalInSecond)
-	hb.intervalInSecond = interval
+	hb.routines.restart()
+
+	intervalInSecond, exists := OptionParseInt(hb.GetOption("IntervalInSecond"), 0)
+	if exists {
+		hb.interval = time.Second * time.Duration(intervalInSecond)
+		hb.GetLogger().Info("option", "IntervalInSecond", intervalInSecond)
+	}
+
+	interval, exists := OptionParseDuration(hb.GetOption("Interval"), hb.interval)
+	hb.interval = interval
+	if exists {
+		hb.GetLogger().Info("option", "Interval", hb.interval)
+	}
+
+	if hb.interval <= 0 {
+		hb.GetLogger().Error("bad interval, use default", "Interval", hb.interval, "default", HeartbeatDefaultInterval)
+		hb.interval = HeartbeatDefaultInterval
+	}
+
+	timeoutInSecond, exists := OptionParseInt(hb.GetOption("TimeoutInSecond"), 0)
 	if exists {
-		fmt.Println("Heartbeat: option IntervalInSecond:", hb.intervalInSecond)
+		hb.timeout = time.Second * time.Duration(timeoutInSecond)
+		hb.GetLogger().Info("option", "TimeoutInSecond", timeoutInSecond)
 	}
 
-	timeout, exists := OptionParseInt(hb.GetOption("TimeoutInSecond"), hb.timeoutInSecond)
-	hb.timeoutInSecond = timeout
+	timeout, exists := OptionParseDuration(hb.GetOption("Timeout"), hb.timeout)
+	hb.timeout = timeout
 	if exists {
-		fmt.Println("Heartbeat: option TimeoutInSecond:", hb.timeoutInSecond)
+		hb.GetLogger().Info("option", "Timeout", hb.timeout)
+	}
+
+	if hb.timeout <= 0 {
+		hb.GetLogger().Error("bad timeout, use default", "Timeout", hb.timeout, "default", HeartbeatDefaultTimeout)
+		hb.timeout = HeartbeatDefaultTimeout
 	}
 
 	closeOnLost, exists := OptionParseBool(hb.GetOption("CloseOnLost"), hb.closeOnLost)
 	hb.closeOnLost = closeOnLost
 	if exists {
-		fmt.Println("Heartbeat: option CloseOnLost:", hb.timeoutInSecond)
+		hb.GetLogger().Info("option", "CloseOnLost", hb.closeOnLost)
 	}
 
-	go func() {
+	// check often enough for the sub-second timeout
+	period := time.Second
+	if hb.timeout/4 < period {
+		period = hb.timeout / 4
+	}
+	if period < 10*time.Millisecond {
+		period = 10 * time.Millisecond
+	}
+
+	hb.routines.spawn(func() {
 		for {
 			hb.check()
-			time.Sleep(time.Second)
+			if !hb.routines.sleep(period) {
+				return
+			}
 		}
-	}()
+	})
 
 	return hb
 }
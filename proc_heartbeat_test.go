@@ -0,0 +1,157 @@
+package ustack
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newHeartbeat returns a running heartbeat whose events are sent to
+// events
+func newHeartbeat(t *testing.T, events chan Event, options map[string]interface{}) *Heartbeat {
+	hb := NewHeartbeat()
+	for name, value := range options {
+		hb.SetOption(name, value)
+	}
+
+	stack := NewUStack().
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventHeartbeatLost || event.Type == UStackEventHeartbeatRecover {
+				events <- event
+			}
+		}).
+		AppendDataProcessor(hb).
+		Run()
+	t.Cleanup(func() { stack.Stop(context.Background()) })
+
+	return hb.(*Heartbeat)
+}
+
+func TestHeartbeatRTT(t *testing.T) {
+	events := make(chan Event, 10)
+	options := map[string]interface{}{
+		"Interval": 20 * time.Millisecond,
+		"Timeout":  "1s",
+	}
+
+	a := newHeartbeat(t, events, options)
+	b := newHeartbeat(t, events, options)
+
+	ab := newWire()
+	ab.peer = b
+	a.SetLower(ab)
+
+	ba := newWire()
+	ba.peer = a
+	b.SetLower(ba)
+
+	c := &dummyConnection{name: "c"}
+	a.OnEvent(Event{Type: UStackEventNewConnection, Data: TransportConnection(c)})
+
+	if !waitFor(func() bool { return a.GetQuality(c).Samples >= 3 }) {
+		t.Fatalf("expect RTT samples, got %+v", a.GetQuality(c))
+	}
+
+	quality := a.GetQualities()["c"]
+	if quality.Lost || quality.LastSeen.IsZero() || quality.SRTT < 0 || quality.SRTT > time.Second {
+		t.Errorf("unexpected quality %+v", quality)
+	}
+
+	// b only answers, it never measures
+	if quality := b.GetQuality(c); quality.Samples != 0 || quality.LastSeen.IsZero() {
+		t.Errorf("unexpected peer quality %+v", quality)
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %v", event.Type)
+	default:
+	}
+}
+
+func TestHeartbeatRecover(t *testing.T) {
+	events := make(chan Event, 10)
+	hb := newHeartbeat(t, events, map[string]interface{}{
+		"Timeout":     50 * time.Millisecond,
+		"CloseOnLost": false,
+	})
+	hb.SetLower(newWire())
+	hb.SetUpper(newFrameCollector())
+
+	c := &dummyConnection{name: "c"}
+
+	// the ping of legacy peer has no timestamp
+	ping := func() {
+		ub := UBufAlloc(1)
+		ub.WriteByte(HeartbeatSelfMessageTag)
+		hb.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+	}
+
+	ping()
+
+	for _, expected := range []int{UStackEventHeartbeatLost, UStackEventHeartbeatRecover} {
+		select {
+		case event := <-events:
+			if event.Type != expected || event.Data.(TransportConnection) != c {
+				t.Fatalf("expect event %v on c, got %v", expected, event.Type)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expect event %v", expected)
+		}
+
+		if expected == UStackEventHeartbeatLost {
+			if !hb.GetQuality(c).Lost {
+				t.Errorf("expect lost")
+			}
+			ping()
+		}
+	}
+
+	if quality := hb.GetQuality(c); quality.Samples != 0 {
+		t.Errorf("unexpected quality %+v", quality)
+	}
+	if c.Closed() {
+		t.Errorf("expect connection not closed")
+	}
+}
+
+func TestHeartbeatBadOptions(t *testing.T) {
+	events := make(chan Event, 10)
+	hb := newHeartbeat(t, events, map[string]interface{}{
+		"Interval": "0s",
+		"Timeout":  "-1s",
+	})
+
+	if hb.interval != HeartbeatDefaultInterval || hb.timeout != HeartbeatDefaultTimeout {
+		t.Errorf("expect defaults, got interval %v, timeout %v", hb.interval, hb.timeout)
+	}
+}
+
+func TestHeartbeatRunAgain(t *testing.T) {
+	events := make(chan Event, 10)
+	hb := newHeartbeat(t, events, map[string]interface{}{
+		"Timeout":     50 * time.Millisecond,
+		"CloseOnLost": false,
+	})
+	hb.SetLower(newWire())
+	hb.SetUpper(newFrameCollector())
+
+	// detached and attached again
+	hb.Stop()
+	hb.Run()
+
+	c := &dummyConnection{name: "c"}
+
+	ub := UBufAlloc(1)
+	ub.WriteByte(HeartbeatSelfMessageTag)
+	hb.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+
+	select {
+	case event := <-events:
+		if event.Type != UStackEventHeartbeatLost {
+			t.Fatalf("expect lost, got %v", event.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect the connection lost checked after run again")
+	}
+}
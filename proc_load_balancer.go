@@ -4,7 +4,12 @@
 
 package ustack
 
-import "fmt"
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
 
 const LoadBalancerFieldSizeInByte int = 1
 
@@ -16,16 +21,68 @@ const (
 	LoadBalancerUplayerMessageTag     byte = 0x00
 )
 
-// LoadBalancer ...
+// the strategies to choose the worker
+const (
+	LoadBalancerStrategyLeastLoad  string = "LeastLoad"
+	LoadBalancerStrategyRoundRobin string = "RoundRobin"
+	LoadBalancerStrategyWeighted   string = "Weighted"
+)
+
+// loadBalancerState is the per-connection load information
+type loadBalancerState struct {
+	// balancer side
+	worker  bool
+	live    bool
+	load    int
+	weight  int
+	current int
+	// worker side
+	pending int
+}
+
+// LoadBalancer spreads the uplayer messages over a pool of workers.
+//
+// The balancer side (ForServer(false)) connects to the workers, it asks
+// every connection for its load regularly, the workers (ForServer(true))
+// report their load and weight. A message sent with no connection is
+// dispatched to a live worker chosen by the strategy, the replies of the
+// workers are passed to uplayer as usual. A worker is not chosen once
+// its connection is closed or its heartbeat is lost.
+//
+// On balancer side, the processors above it see the messages with no
+// connection, so it is usually placed right below the codec.
+//
+// Options:
+//
+//	Strategy: string, LeastLoad(default), RoundRobin or Weighted
+//	ReportIntervalInSecond: int, for balancer, 1 by default
+//	Weight: int, for worker, 1 by default
+//	LoadFn: func() int, for worker, the load to report, the number of
+//	    not replied works by default
 type LoadBalancer struct {
 	ProcBase
+	mutex                  sync.Mutex
+	strategy               string
+	reportIntervalInSecond int
+	weight                 int
+	loadFn                 func() int
+	next                   int
 }
 
 // NewLoadBalancer ...
 func NewLoadBalancer() DataProcessor {
 	lb := &LoadBalancer{
-		NewProcBaseInstance("LoadBalancer"),
+		ProcBase:               NewProcBaseInstance("LoadBalancer"),
+		strategy:               LoadBalancerStrategyLeastLoad,
+		reportIntervalInSecond: 1,
+		weight:                 1,
 	}
+	lb.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &loadBalancerState{
+			live:   true,
+			weight: 1,
+		}
+	})
 	return lb.ProcBase.SetWhere(lb)
 }
 
@@ -35,10 +92,153 @@ func (lb *LoadBalancer) GetOverhead() int {
 	return LoadBalancerFieldSizeInByte
 }
 
+// state ...
+func (lb *LoadBalancer) state(connection TransportConnection) *loadBalancerState {
+	return lb.GetState(connection).(*loadBalancerState)
+}
+
+// workers returns the live workers in a stable order
+func (lb *LoadBalancer) workers() ([]TransportConnection, []*loadBalancerState) {
+	connections := make([]TransportConnection, 0)
+
+	lb.RangeStates(func(connection TransportConnection, s interface{}) bool {
+		state := s.(*loadBalancerState)
+		if state.worker && state.live && !connection.Closed() {
+			connections = append(connections, connection)
+		}
+		return true
+	})
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].GetName() < connections[j].GetName()
+	})
+
+	states := make([]*loadBalancerState, len(connections))
+	for i, connection := range connections {
+		states[i] = lb.state(connection)
+	}
+
+	return connections, states
+}
+
+// choose returns the worker for next work, nil if no live worker
+func (lb *LoadBalancer) choose() TransportConnection {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	connections, states := lb.workers()
+	if len(connections) == 0 {
+		return nil
+	}
+
+	chosen := 0
+
+	switch lb.strategy {
+	case LoadBalancerStrategyRoundRobin:
+		chosen = lb.next % len(connections)
+		lb.next = chosen + 1
+
+	case LoadBalancerStrategyWeighted:
+		// smooth weighted round robin
+		total := 0
+		for i, state := range states {
+			state.current += state.weight
+			total += state.weight
+			if state.current > states[chosen].current {
+				chosen = i
+			}
+		}
+		states[chosen].current -= total
+
+	default:
+		for i, state := range states {
+			if state.load < states[chosen].load {
+				chosen = i
+			}
+		}
+	}
+
+	states[chosen].load++
+
+	return connections[chosen]
+}
+
+// setLive marks the worker as live or not
+func (lb *LoadBalancer) setLive(connection TransportConnection, live bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.state(connection).live = live
+}
+
+// requestLoad asks the connection for its load
+func (lb *LoadBalancer) requestLoad(connection TransportConnection) {
+	ub := UBufAllocWithHeadReserved(
+		lb.ustack.GetMTU(),
+		lb.ustack.GetOverhead())
+
+	ub.WriteByte(LoadBalancerSelfMessageReqLoadTag)
+
+	lb.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
+}
+
+// responseLoad reports the load of worker
+func (lb *LoadBalancer) responseLoad(connection TransportConnection) {
+	lb.mutex.Lock()
+	load := lb.state(connection).pending
+	lb.mutex.Unlock()
+
+	if lb.loadFn != nil {
+		load = lb.loadFn()
+	}
+
+	ub := UBufAllocWithHeadReserved(
+		lb.ustack.GetMTU(),
+		lb.ustack.GetOverhead())
+
+	ub.WriteByte(LoadBalancerSelfMessageResLoadTag)
+	ub.WriteU32BE(uint32(load))
+	ub.WriteU32BE(uint32(lb.weight))
+
+	lb.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
+}
+
+// updateLoad saves the load reported by worker
+func (lb *LoadBalancer) updateLoad(connection TransportConnection, ub *UBuf) {
+	load, err := ub.ReadU32BE()
+	if err != nil {
+		return
+	}
+
+	weight, err := ub.ReadU32BE()
+	if err != nil {
+		return
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	state := lb.state(connection)
+	state.worker = true
+	state.load = int(load)
+	state.weight = int(weight)
+	if state.weight <= 0 {
+		state.weight = 1
+	}
+}
+
 // OnUpperData ...
 func (lb *LoadBalancer) OnUpperData(context Context) {
-	if context.GetConnection().UseReference() {
-		lb.lower.OnUpperData(context)
+	connection := context.GetConnection()
+
+	if connection != nil && connection.UseReference() {
+		lb.GetLower().OnUpperData(context)
 		return
 	}
 
@@ -47,20 +247,63 @@ func (lb *LoadBalancer) OnUpperData(context Context) {
 		return
 	}
 
-	if lb.enable {
-		fmt.Println("LoadBalancer: OnUpperData: todo")
+	if !lb.IsEnabled() {
+		ub.WriteHeadByte(LoadBalancerUplayerMessageTag)
+		lb.GetLower().OnUpperData(context)
+		return
+	}
+
+	if lb.forServer {
+		// worker: replies the work
+		if connection == nil {
+			return
+		}
+
+		lb.mutex.Lock()
+		state := lb.state(connection)
+		if state.pending > 0 {
+			state.pending--
+		}
+		lb.mutex.Unlock()
+
+		ub.WriteHeadByte(LoadBalancerSelfMessageResWorkTag)
+		lb.GetLower().OnUpperData(context)
+		return
+	}
+
+	// balancer: dispatches the work if no connection specified
+	if connection == nil {
+		connection = lb.choose()
+		if connection == nil {
+			lb.ReportError(context, DataDirectionDown, errors.New("no live worker"))
+			return
+		}
+		context.SetConnection(connection)
 		ub.WriteHeadByte(LoadBalancerSelfMessageReqWorkTag)
 	} else {
-		ub.WriteHeadByte(StatCounterUplayerMessageTag)
+		lb.mutex.Lock()
+		worker := lb.state(connection).worker
+		if worker {
+			lb.state(connection).load++
+		}
+		lb.mutex.Unlock()
+
+		if worker {
+			ub.WriteHeadByte(LoadBalancerSelfMessageReqWorkTag)
+		} else {
+			ub.WriteHeadByte(LoadBalancerUplayerMessageTag)
+		}
 	}
 
-	lb.lower.OnUpperData(context)
+	lb.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (lb *LoadBalancer) OnLowerData(context Context) {
-	if context.GetConnection().UseReference() {
-		lb.upper.OnLowerData(context)
+	connection := context.GetConnection()
+
+	if connection.UseReference() {
+		lb.GetUpper().OnLowerData(context)
 		return
 	}
 
@@ -74,12 +317,90 @@ func (lb *LoadBalancer) OnLowerData(context Context) {
 		return
 	}
 
-	if lb.enable {
-		if tag != LoadBalancerUplayerMessageTag {
-			fmt.Println("LoadBalancer: OnUpperData: todo")
+	switch tag {
+	case LoadBalancerSelfMessageReqLoadTag:
+		lb.responseLoad(connection)
+		return
+
+	case LoadBalancerSelfMessageResLoadTag:
+		lb.updateLoad(connection, ub)
+		return
+
+	case LoadBalancerSelfMessageReqWorkTag:
+		lb.mutex.Lock()
+		lb.state(connection).pending++
+		lb.mutex.Unlock()
+
+	case LoadBalancerSelfMessageResWorkTag:
+		lb.mutex.Lock()
+		state := lb.state(connection)
+		if state.load > 0 {
+			state.load--
+		}
+		lb.mutex.Unlock()
+	}
+
+	lb.GetUpper().OnLowerData(context)
+}
+
+// OnEvent ...
+func (lb *LoadBalancer) OnEvent(event Event) {
+	connection, ok := event.Data.(TransportConnection)
+	if !ok {
+		return
+	}
+
+	switch event.Type {
+	case UStackEventNewConnection:
+		// workers do not ask for the load
+		if lb.forServer || !lb.IsEnabled() || connection.UseReference() {
 			return
 		}
+
+		interval := lb.reportIntervalInSecond
+
+		lb.routines.spawn(func() {
+			for !connection.Closed() {
+				lb.requestLoad(connection)
+				if !lb.routines.sleep(time.Second * time.Duration(interval)) {
+					return
+				}
+			}
+		})
+
+	case UStackEventHeartbeatLost:
+		lb.setLive(connection, false)
+
+	case UStackEventHeartbeatRecover:
+		lb.setLive(connection, true)
+	}
+}
+
+// Run ...
+func (lb *LoadBalancer) Run() DataProcessor {
+	lb.routines.restart()
+
+	strategy, exists := OptionParseString(lb.GetOption("Strategy"), lb.strategy)
+	lb.strategy = strategy
+	if exists {
+		lb.GetLogger().Info("option", "Strategy", lb.strategy)
+	}
+
+	interval, exists := OptionParseInt(lb.GetOption("ReportIntervalInSecond"), lb.reportIntervalInSecond)
+	lb.reportIntervalInSecond = interval
+	if exists {
+		lb.GetLogger().Info("option", "ReportIntervalInSecond", lb.reportIntervalInSecond)
+	}
+
+	weight, exists := OptionParseInt(lb.GetOption("Weight"), lb.weight)
+	lb.weight = weight
+	if exists {
+		lb.GetLogger().Info("option", "Weight", lb.weight)
+	}
+
+	if loadFn, ok := lb.GetOption("LoadFn").(func() int); ok {
+		lb.loadFn = loadFn
 	}
 
-	lb.upper.OnLowerData(context)
+	return lb
 }
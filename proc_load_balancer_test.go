@@ -0,0 +1,187 @@
+package ustack
+
+import (
+	"context"
+	"testing"
+)
+
+// connectionCollector keeps the buffers sent to each connection
+type connectionCollector struct {
+	ProcBase
+	buffers map[TransportConnection][]*UBuf
+}
+
+func newConnectionCollector() *connectionCollector {
+	cc := &connectionCollector{
+		ProcBase: NewProcBaseInstance("ConnectionCollector"),
+		buffers:  make(map[TransportConnection][]*UBuf),
+	}
+	cc.ProcBase.SetWhere(cc)
+	return cc
+}
+
+func (cc *connectionCollector) OnUpperData(context Context) {
+	c := context.GetConnection()
+	cc.buffers[c] = append(cc.buffers[c], context.GetBuffer())
+}
+
+// newLoadBalancer returns a running load balancer with the options
+func newLoadBalancer(t *testing.T, forServer bool, options map[string]interface{}) (*LoadBalancer, *connectionCollector, *frameCollector) {
+	lb := NewLoadBalancer()
+	lb.ForServer(forServer)
+	for name, value := range options {
+		lb.SetOption(name, value)
+	}
+
+	// the stack counts the overhead
+	stack := NewUStack().AppendDataProcessor(lb).Run()
+	t.Cleanup(func() { stack.Stop(context.Background()) })
+
+	lower := newConnectionCollector()
+	upper := newFrameCollector()
+	lb.SetLower(lower)
+	lb.SetUpper(upper)
+
+	return lb.(*LoadBalancer), lower, upper
+}
+
+// reportLoad passes the load and the weight reported by worker c
+func reportLoad(lb DataProcessor, c TransportConnection, load, weight uint32) {
+	ub := UBufAlloc(16)
+	ub.WriteByte(LoadBalancerSelfMessageResLoadTag)
+	ub.WriteU32BE(load)
+	ub.WriteU32BE(weight)
+	lb.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+}
+
+// dispatch sends n works with no connection
+func dispatch(lb DataProcessor, n int) {
+	for i := 0; i < n; i++ {
+		ub := UBufAllocWithHeadReserved(16, 8)
+		ub.Write([]byte("work"))
+		lb.OnUpperData(NewUStackContext().SetBuffer(ub))
+	}
+}
+
+func TestLoadBalancerStrategies(t *testing.T) {
+	cases := []struct {
+		strategy string
+		loads    []uint32
+		weights  []uint32
+		expected []int
+	}{
+		{LoadBalancerStrategyRoundRobin, []uint32{0, 0, 0}, []uint32{1, 1, 1}, []int{2, 2, 2}},
+		{LoadBalancerStrategyWeighted, []uint32{0, 0, 0}, []uint32{1, 2, 3}, []int{1, 2, 3}},
+		{LoadBalancerStrategyLeastLoad, []uint32{5, 0, 2}, []uint32{1, 1, 1}, []int{0, 4, 2}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			lb, lower, _ := newLoadBalancer(t, false, map[string]interface{}{"Strategy": tc.strategy})
+
+			workers := []TransportConnection{
+				&dummyConnection{name: "w1"},
+				&dummyConnection{name: "w2"},
+				&dummyConnection{name: "w3"},
+			}
+			for i, w := range workers {
+				reportLoad(lb, w, tc.loads[i], tc.weights[i])
+			}
+
+			dispatch(lb, 6)
+
+			for i, w := range workers {
+				if n := len(lower.buffers[w]); n != tc.expected[i] {
+					t.Errorf("expect %d works of %s, got %d", tc.expected[i], w.GetName(), n)
+				}
+				for _, ub := range lower.buffers[w] {
+					if tag, _ := ub.ReadByte(); tag != LoadBalancerSelfMessageReqWorkTag {
+						t.Errorf("unexpected tag %#x", tag)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBalancerLiveWorkers(t *testing.T) {
+	lb, lower, upper := newLoadBalancer(t, false, map[string]interface{}{
+		"Strategy": LoadBalancerStrategyRoundRobin,
+	})
+
+	lost := &dummyConnection{name: "lost"}
+	closed := &dummyConnection{name: "closed"}
+	live := &dummyConnection{name: "live"}
+	for _, w := range []TransportConnection{lost, closed, live} {
+		reportLoad(lb, w, 0, 1)
+	}
+
+	lb.OnEvent(Event{Type: UStackEventHeartbeatLost, Data: lost})
+	closed.Close()
+
+	dispatch(lb, 3)
+
+	if len(lower.buffers[lost]) != 0 || len(lower.buffers[closed]) != 0 || len(lower.buffers[live]) != 3 {
+		t.Fatalf("expect all works to the live worker")
+	}
+
+	// the recovered worker is chosen again
+	lb.OnEvent(Event{Type: UStackEventHeartbeatRecover, Data: lost})
+	dispatch(lb, 2)
+
+	if len(lower.buffers[lost]) != 1 {
+		t.Errorf("expect the recovered worker chosen")
+	}
+
+	// the reply of the work is passed to uplayer
+	ub := UBufAlloc(16)
+	ub.WriteByte(LoadBalancerSelfMessageResWorkTag)
+	ub.Write([]byte("done"))
+	lb.OnLowerData(NewUStackContext().SetConnection(live).SetBuffer(ub))
+
+	if got := upper.frames[live]; len(got) != 1 || got[0] != "done" {
+		t.Errorf("unexpected replies %q", got)
+	}
+}
+
+func TestLoadBalancerWorker(t *testing.T) {
+	lb, lower, upper := newLoadBalancer(t, true, map[string]interface{}{"Weight": 3})
+	balancer := &dummyConnection{name: "balancer"}
+
+	// a work is pending until it is replied
+	ub := UBufAlloc(16)
+	ub.WriteByte(LoadBalancerSelfMessageReqWorkTag)
+	ub.Write([]byte("work"))
+	lb.OnLowerData(NewUStackContext().SetConnection(balancer).SetBuffer(ub))
+
+	if got := upper.frames[balancer]; len(got) != 1 || got[0] != "work" {
+		t.Fatalf("unexpected works %q", got)
+	}
+
+	requestLoad := func() (uint32, uint32) {
+		ub := UBufAlloc(1)
+		ub.WriteByte(LoadBalancerSelfMessageReqLoadTag)
+		lb.OnLowerData(NewUStackContext().SetConnection(balancer).SetBuffer(ub))
+
+		buffers := lower.buffers[balancer]
+		res := buffers[len(buffers)-1]
+		if tag, _ := res.ReadByte(); tag != LoadBalancerSelfMessageResLoadTag {
+			t.Fatalf("unexpected tag %#x", tag)
+		}
+		load, _ := res.ReadU32BE()
+		weight, _ := res.ReadU32BE()
+		return load, weight
+	}
+
+	if load, weight := requestLoad(); load != 1 || weight != 3 {
+		t.Errorf("expect load 1 and weight 3, got %d and %d", load, weight)
+	}
+
+	reply := UBufAllocWithHeadReserved(16, 8)
+	reply.Write([]byte("done"))
+	lb.OnUpperData(NewUStackContext().SetConnection(balancer).SetBuffer(reply))
+
+	if load, _ := requestLoad(); load != 0 {
+		t.Errorf("expect load 0 after replied, got %d", load)
+	}
+}
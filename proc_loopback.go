@@ -4,8 +4,6 @@
 
 package ustack
 
-import "fmt"
-
 // Loopback ...
 type Loopback struct {
 	ProcBase
@@ -21,6 +19,6 @@ func NewLoopback() DataProcessor {
 
 // OnUpperData sends back the message
 func (lb *Loopback) OnUpperData(context Context) {
-	fmt.Println("Loopback: send back the uplayer data")
-	lb.upper.OnLowerData(context)
+	lb.GetLogger().Debug("send back the uplayer data")
+	lb.GetUpper().OnLowerData(context)
 }
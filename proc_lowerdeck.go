@@ -4,25 +4,61 @@
 
 package ustack
 
-import "fmt"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 // LowerDeck manages transports
 type LowerDeck struct {
 	ProcBase
+	sync.Mutex
+	stopping    bool
+	connections map[TransportConnection]Transport
+	txMessages  uint64
+	txBytes     uint64
+	rxMessages  uint64
+	rxBytes     uint64
 }
 
 // NewLowerDeck returns a new instance
 func NewLowerDeck() DataProcessor {
 	ld := &LowerDeck{
-		NewProcBaseInstance("LowerDeck"),
+		ProcBase:    NewProcBaseInstance("LowerDeck"),
+		connections: make(map[TransportConnection]Transport, 16),
 	}
 	return ld.ProcBase.SetWhere(ld)
 }
 
+// saveConnection keeps the connection alive until it is closed,
+// returns false if the deck is stopping
+func (ld *LowerDeck) saveConnection(c TransportConnection, tp Transport) bool {
+	ld.Lock()
+	defer ld.Unlock()
+
+	if ld.stopping {
+		return false
+	}
+
+	ld.connections[c] = tp
+	return true
+}
+
 func (ld *LowerDeck) closeConnection(c TransportConnection) {
 	// close first
 	c.Close()
 
+	// the connection may be closed by both receiving and sending sides,
+	// only publish the event once
+	ld.Lock()
+	_, ok := ld.connections[c]
+	delete(ld.connections, c)
+	ld.Unlock()
+
+	if !ok {
+		return
+	}
+
 	// publish event
 	ld.ustack.PublishEvent(Event{
 		Type:   UStackEventConnectionClosed,
@@ -31,13 +67,62 @@ func (ld *LowerDeck) closeConnection(c TransportConnection) {
 	})
 }
 
+// getConnections returns the alive connections
+func (ld *LowerDeck) getConnections() []TransportConnection {
+	ld.Lock()
+	defer ld.Unlock()
+
+	connections := make([]TransportConnection, 0, len(ld.connections))
+	for c := range ld.connections {
+		connections = append(connections, c)
+	}
+	return connections
+}
+
+// receive reads data from connection until it is closed
+func (ld *LowerDeck) receive(connection TransportConnection) {
+	for {
+		if connection.UseReference() {
+			message, err := connection.GetReference()
+			if message == nil || err != nil {
+				ld.closeConnection(connection)
+				return
+			}
+
+			atomic.AddUint64(&ld.rxMessages, 1)
+
+			ld.GetUpper().OnLowerData(
+				NewUStackContext().
+					SetConnection(connection).
+					SetMessage(message))
+		} else {
+			ub := UBufAlloc(ld.ustack.GetMTU())
+
+			n, err := ub.ReadFrom(connection)
+			if n == 0 || err != nil {
+				ld.closeConnection(connection)
+				return
+			}
+
+			atomic.AddUint64(&ld.rxMessages, 1)
+			atomic.AddUint64(&ld.rxBytes, uint64(n))
+
+			// invoke the uplayer
+			ld.GetUpper().OnLowerData(
+				NewUStackContext().
+					SetConnection(connection).
+					SetBuffer(ub))
+		}
+	}
+}
+
 // acceptTransport ...
 func (ld *LowerDeck) acceptTransport(tp Transport) {
 
 	tp.Run()
 
 	// New routinue to wait connections
-	go func() {
+	ld.routines.spawn(func() {
 		for {
 			// this call will be blocked until new connection coming
 			connection := tp.NextConnection()
@@ -46,7 +131,12 @@ func (ld *LowerDeck) acceptTransport(tp Transport) {
 				return
 			}
 
-			fmt.Println("New connection:", connection.GetName(), "on transport:", tp.GetName())
+			if !ld.saveConnection(connection, tp) {
+				connection.Close()
+				continue
+			}
+
+			ld.GetLogger().Info("new connection", "connection", connection.GetName(), "transport", tp.GetName())
 
 			// publish event
 			ld.ustack.PublishEvent(Event{
@@ -55,38 +145,20 @@ func (ld *LowerDeck) acceptTransport(tp Transport) {
 				Data:   connection,
 			})
 
+			if rc, ok := connection.(Reconnectable); ok && rc.IsReconnected() {
+				ld.ustack.PublishEvent(Event{
+					Type:   UStackEventReconnected,
+					Source: ld,
+					Data:   connection,
+				})
+			}
+
 			// New routine to continue receive data from connection
-			go func() {
-				for {
-					if connection.UseReference() {
-						message, err := connection.GetReference()
-						if message == nil || err != nil {
-							ld.closeConnection(connection)
-							return
-						}
-
-						ld.upper.OnLowerData(
-							NewUStackContext().
-								SetConnection(connection).
-								SetMessage(message))
-					} else {
-						ub := UBufAlloc(ld.ustack.GetMTU())
-
-						n, err := ub.ReadFrom(connection)
-						if n == 0 || err != nil {
-							ld.closeConnection(connection)
-							return
-						}
-						// invoke the uplayer
-						ld.upper.OnLowerData(
-							NewUStackContext().
-								SetConnection(connection).
-								SetBuffer(ub))
-					}
-				}
-			}()
+			if !ld.routines.spawn(func() { ld.receive(connection) }) {
+				ld.closeConnection(connection)
+			}
 		}
-	}()
+	})
 }
 
 // deleteTransport ...
@@ -94,12 +166,21 @@ func (ld *LowerDeck) deleteTransport(tp Transport) {
 	tp.Stop()
 }
 
+// stopAccepting closes any new connection from now on
+func (ld *LowerDeck) stopAccepting() {
+	ld.Lock()
+	defer ld.Unlock()
+
+	ld.stopping = true
+}
+
 // OnUpperData sends ulayer data with connection
 func (ld *LowerDeck) OnUpperData(context Context) {
 	var err error
 
 	connection := context.GetConnection()
 	if connection == nil {
+		ld.ReportError(context, DataDirectionDown, ErrNoConnection)
 		return
 	}
 
@@ -108,17 +189,51 @@ func (ld *LowerDeck) OnUpperData(context Context) {
 	} else {
 		ub := context.GetBuffer()
 		if ub == nil {
+			ld.ReportError(context, DataDirectionDown, ErrNoBuffer)
 			return
 		}
-		_, err = ub.WriteTo(connection)
+
+		var n int64
+		n, err = ub.WriteTo(connection)
+		atomic.AddUint64(&ld.txBytes, uint64(n))
 	}
 
-	if err != nil {
-		fmt.Printf("Connection is closed: %s\n", connection.GetName())
+	if err == nil {
+		atomic.AddUint64(&ld.txMessages, 1)
+	} else {
+		ld.ReportError(context, DataDirectionDown, err)
+		ld.GetLogger().Info("send failed, close the connection", "connection", connection.GetName(), "error", err)
 		ld.closeConnection(connection)
 	}
 }
 
+// RegisterMetrics exposes the traffic and the connections of the stack
+func (ld *LowerDeck) RegisterMetrics(registry *MetricsRegistry) {
+	registry.CounterFunc("ustack_messages_total", "The number of messages sent or received by the transports.",
+		Labels{"direction": DataDirectionDown},
+		func() uint64 { return atomic.LoadUint64(&ld.txMessages) })
+	registry.CounterFunc("ustack_messages_total", "The number of messages sent or received by the transports.",
+		Labels{"direction": DataDirectionUp},
+		func() uint64 { return atomic.LoadUint64(&ld.rxMessages) })
+	registry.CounterFunc("ustack_bytes_total", "The number of bytes sent or received by the transports.",
+		Labels{"direction": DataDirectionDown},
+		func() uint64 { return atomic.LoadUint64(&ld.txBytes) })
+	registry.CounterFunc("ustack_bytes_total", "The number of bytes sent or received by the transports.",
+		Labels{"direction": DataDirectionUp},
+		func() uint64 { return atomic.LoadUint64(&ld.rxBytes) })
+	registry.GaugeFunc("ustack_connections", "The number of alive connections.", nil,
+		func() float64 { return float64(len(ld.getConnections())) })
+}
+
+// UnregisterMetrics ...
+func (ld *LowerDeck) UnregisterMetrics(registry *MetricsRegistry) {
+	for _, direction := range []string{DataDirectionDown, DataDirectionUp} {
+		registry.Unregister("ustack_messages_total", Labels{"direction": direction})
+		registry.Unregister("ustack_bytes_total", Labels{"direction": direction})
+	}
+	registry.Unregister("ustack_connections", nil)
+}
+
 // OnEvent is called when any event hanppen
 func (ld *LowerDeck) OnEvent(event Event) {
 	tp, ok := event.Data.(Transport)
@@ -136,9 +251,27 @@ func (ld *LowerDeck) OnEvent(event Event) {
 // Run monitor new coming connection with routine
 // and receive data from any new connection with routine
 func (ld *LowerDeck) Run() DataProcessor {
+	ld.routines.restart()
+
 	for _, tp := range ld.ustack.GetTransport() {
 		ld.acceptTransport(tp)
 	}
 
 	return ld
 }
+
+// Stop stops all the transports, closes the remaining connections
+// and waits for the receiving routines to exit
+func (ld *LowerDeck) Stop() DataProcessor {
+	ld.stopAccepting()
+
+	for _, tp := range ld.ustack.GetTransport() {
+		tp.Stop()
+	}
+
+	for _, c := range ld.getConnections() {
+		ld.closeConnection(c)
+	}
+
+	return ld.ProcBase.Stop()
+}
@@ -0,0 +1,516 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// the frame types of Multiplexer
+const (
+	MultiplexerFrameData   byte = 0x00
+	MultiplexerFrameSyn    byte = 0x01
+	MultiplexerFrameFin    byte = 0x02
+	MultiplexerFrameRst    byte = 0x03
+	MultiplexerFrameWindow byte = 0x04
+)
+
+// MultiplexerHeaderSizeInByte is 1 byte type and 4 bytes big endian
+// stream id
+const MultiplexerHeaderSizeInByte int = 5
+
+// the errors of Multiplexer streams
+var (
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamRefused = errors.New("stream refused")
+	ErrFlowControl   = errors.New("flow control window exceeded")
+)
+
+// StreamInfo is the Data of the stream events
+type StreamInfo struct {
+	Connection TransportConnection
+	ID         uint32
+	// the session of the local endpoint, the data of the stream is passed
+	// up with it
+	Session int
+	// the session of the peer's endpoint
+	RemoteSession int
+}
+
+// muxStream ...
+type muxStream struct {
+	info *StreamInfo
+	// the credit of sending, it may go negative by the last message
+	sendWindow int64
+	// the credit of the peer
+	recvWindow int64
+	// received but not yet granted back
+	consumed     int64
+	localClosed  bool
+	remoteClosed bool
+	// closed and replaced when sendWindow grows, so all the waiting
+	// senders check the window again
+	windowUpdated chan struct{}
+	// closed when the stream is gone
+	done chan struct{}
+}
+
+// multiplexerState is the per-connection streams
+type multiplexerState struct {
+	sync.Mutex
+	nextID  uint32
+	streams map[uint32]*muxStream
+}
+
+// Multiplexer carries many streams over one connection. A stream is
+// opened by OpenStream between a local endpoint and an endpoint of the
+// peer, the frames of the stream are then passed up with the context
+// options "stream" (uint32) and "session" of the endpoint on each side,
+// so the endpoint replies on the stream by setting the option "stream"
+// of EndPointData. The data without option "stream" is sent out of any
+// stream without flow control.
+//
+// The client side (ForServer(false)) opens the odd streams and the
+// server side opens the even ones, so the ids never collide. The config
+// loader sets the role of the processor, a SYN of the same role is
+// refused.
+//
+// Each stream has a receive window of InitialWindow bytes, the sender
+// blocks when the peer does not grant more. FIN closes the sending
+// direction, the stream is closed when both sides sent FIN. RST drops
+// the stream at once.
+//
+// Options:
+//
+//	InitialWindow: int, 256KB by default
+//	MaxStreams: int, the streams opened by the peer, 256 by default
+type Multiplexer struct {
+	ProcBase
+	initialWindow int
+	maxStreams    int
+}
+
+// NewMultiplexer ...
+func NewMultiplexer() DataProcessor {
+	mx := &Multiplexer{
+		ProcBase:      NewProcBaseInstance("Multiplexer"),
+		initialWindow: 256 * 1024,
+		maxStreams:    256,
+	}
+	mx.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &multiplexerState{
+			streams: make(map[uint32]*muxStream),
+		}
+	})
+	return mx.ProcBase.SetWhere(mx)
+}
+
+// GetOverhead returns the overhead
+func (mx *Multiplexer) GetOverhead() int {
+	return MultiplexerHeaderSizeInByte
+}
+
+// newStream ...
+func (mx *Multiplexer) newStream(connection TransportConnection, id uint32, session int, remoteSession int) *muxStream {
+	return &muxStream{
+		info: &StreamInfo{
+			Connection:    connection,
+			ID:            id,
+			Session:       session,
+			RemoteSession: remoteSession,
+		},
+		sendWindow:    int64(mx.initialWindow),
+		recvWindow:    int64(mx.initialWindow),
+		windowUpdated: make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// sendFrame sends a control frame with the optional value
+func (mx *Multiplexer) sendFrame(connection TransportConnection, frame byte, id uint32, value []byte) {
+	ub := UBufAllocWithHeadReserved(
+		mx.ustack.GetMTU(),
+		mx.ustack.GetOverhead())
+
+	ub.Write(value)
+	ub.WriteHeadU32BE(id)
+	ub.WriteHeadByte(frame)
+
+	mx.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
+}
+
+// muxU32 ...
+func muxU32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// isLocalStream returns true if the stream id is opened by this side
+func (mx *Multiplexer) isLocalStream(id uint32) bool {
+	return (id%2 == 1) != mx.forServer
+}
+
+// publish ...
+func (mx *Multiplexer) publish(eventType int, stream *muxStream) {
+	mx.ustack.PublishEvent(Event{
+		Type:   eventType,
+		Source: mx,
+		Data:   stream.info,
+	})
+}
+
+// remove drops the stream, the state must be locked
+func (mx *Multiplexer) remove(state *multiplexerState, stream *muxStream) {
+	if state.streams[stream.info.ID] == stream {
+		delete(state.streams, stream.info.ID)
+		close(stream.done)
+	}
+}
+
+// OpenStream opens a stream from the local endpoint of session to the
+// endpoint of remoteSession on the peer, the returned id is set to the
+// option "stream" of EndPointData to send on it
+func (mx *Multiplexer) OpenStream(connection TransportConnection, session int, remoteSession int) (uint32, error) {
+	if connection == nil {
+		return 0, ErrNoConnection
+	}
+	if connection.Closed() {
+		return 0, ErrConnectionClosed
+	}
+
+	state := mx.GetState(connection).(*multiplexerState)
+
+	state.Lock()
+	if state.nextID == 0 {
+		state.nextID = 2
+		if !mx.forServer {
+			state.nextID = 1
+		}
+	}
+	id := state.nextID
+	state.nextID += 2
+	state.streams[id] = mx.newStream(connection, id, session, remoteSession)
+	state.Unlock()
+
+	// the session on the peer, then the session of opener
+	mx.sendFrame(connection, MultiplexerFrameSyn, id,
+		append(muxU32(uint32(remoteSession)), muxU32(uint32(session))...))
+
+	return id, nil
+}
+
+// CloseStream sends FIN, no more data can be sent on the stream, it is
+// closed once the peer sends FIN too
+func (mx *Multiplexer) CloseStream(connection TransportConnection, id uint32) error {
+	state := mx.GetState(connection).(*multiplexerState)
+
+	state.Lock()
+	stream, ok := state.streams[id]
+	if !ok || stream.localClosed {
+		state.Unlock()
+		return ErrStreamClosed
+	}
+	stream.localClosed = true
+	closed := stream.remoteClosed
+	if closed {
+		mx.remove(state, stream)
+	}
+	state.Unlock()
+
+	mx.sendFrame(connection, MultiplexerFrameFin, id, nil)
+
+	if closed {
+		mx.publish(UStackEventStreamClosed, stream)
+	}
+
+	return nil
+}
+
+// ResetStream drops the stream on both sides
+func (mx *Multiplexer) ResetStream(connection TransportConnection, id uint32) error {
+	state := mx.GetState(connection).(*multiplexerState)
+
+	state.Lock()
+	stream, ok := state.streams[id]
+	if ok {
+		mx.remove(state, stream)
+	}
+	state.Unlock()
+
+	if !ok {
+		return ErrStreamClosed
+	}
+
+	mx.sendFrame(connection, MultiplexerFrameRst, id, nil)
+	mx.publish(UStackEventStreamReset, stream)
+
+	return nil
+}
+
+// OnUpperData ...
+func (mx *Multiplexer) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() {
+		mx.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		mx.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	id, _ := context.GetOption("stream").(uint32)
+	if id == 0 || !mx.IsEnabled() {
+		ub.WriteHeadU32BE(0)
+		ub.WriteHeadByte(MultiplexerFrameData)
+		mx.GetLower().OnUpperData(context)
+		return
+	}
+
+	state := mx.GetState(context.GetConnection()).(*multiplexerState)
+	size := int64(ub.ReadableLength())
+
+	// wait for the credit without holding the lock
+	for {
+		state.Lock()
+		stream, ok := state.streams[id]
+		if !ok || stream.localClosed {
+			state.Unlock()
+			mx.ReportError(context, DataDirectionDown, ErrStreamClosed)
+			return
+		}
+		if stream.sendWindow > 0 {
+			stream.sendWindow -= size
+			state.Unlock()
+			break
+		}
+		updated := stream.windowUpdated
+		state.Unlock()
+
+		select {
+		case <-updated:
+		case <-stream.done:
+		case <-mx.routines.quitting():
+			mx.ReportError(context, DataDirectionDown, ErrStreamClosed)
+			return
+		}
+	}
+
+	ub.WriteHeadU32BE(id)
+	ub.WriteHeadByte(MultiplexerFrameData)
+
+	mx.GetLower().OnUpperData(context)
+}
+
+// OnLowerData ...
+func (mx *Multiplexer) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() {
+		mx.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	if ub.ReadableLength() < MultiplexerHeaderSizeInByte {
+		mx.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	frame, _ := ub.ReadByte()
+	id, _ := ub.ReadU32BE()
+
+	connection := context.GetConnection()
+
+	if frame == MultiplexerFrameData && id == 0 {
+		mx.GetUpper().OnLowerData(context)
+		return
+	}
+
+	state := mx.GetState(connection).(*multiplexerState)
+
+	switch frame {
+	case MultiplexerFrameData:
+		mx.onData(context, state, id)
+	case MultiplexerFrameSyn:
+		session, err := ub.ReadU32BE()
+		if err != nil {
+			mx.ReportError(context, DataDirectionUp, ErrBadFormat)
+			return
+		}
+
+		remoteSession, err := ub.ReadU32BE()
+		if err != nil {
+			mx.ReportError(context, DataDirectionUp, ErrBadFormat)
+			return
+		}
+
+		if mx.isLocalStream(id) {
+			mx.GetLogger().Error("stream opened by peer of the same role, check ForServer",
+				"connection", connection.GetName(), "stream", id)
+		}
+
+		state.Lock()
+		_, exists := state.streams[id]
+		refused := exists || mx.isLocalStream(id) || len(state.streams) >= mx.maxStreams
+		var stream *muxStream
+		if !refused {
+			stream = mx.newStream(connection, id, int(session), int(remoteSession))
+			state.streams[id] = stream
+		}
+		state.Unlock()
+
+		if refused {
+			mx.sendFrame(connection, MultiplexerFrameRst, id, nil)
+			mx.ReportError(context, DataDirectionUp, ErrStreamRefused)
+			return
+		}
+
+		mx.publish(UStackEventStreamOpened, stream)
+	case MultiplexerFrameFin:
+		state.Lock()
+		stream, ok := state.streams[id]
+		closed := false
+		if ok {
+			stream.remoteClosed = true
+			closed = stream.localClosed
+			if closed {
+				mx.remove(state, stream)
+			}
+		}
+		state.Unlock()
+
+		if closed {
+			mx.publish(UStackEventStreamClosed, stream)
+		}
+	case MultiplexerFrameRst:
+		state.Lock()
+		stream, ok := state.streams[id]
+		if ok {
+			mx.remove(state, stream)
+		}
+		state.Unlock()
+
+		if ok {
+			mx.publish(UStackEventStreamReset, stream)
+		}
+	case MultiplexerFrameWindow:
+		increment, err := ub.ReadU32BE()
+		if err != nil {
+			mx.ReportError(context, DataDirectionUp, ErrBadFormat)
+			return
+		}
+
+		state.Lock()
+		if stream, ok := state.streams[id]; ok {
+			stream.sendWindow += int64(increment)
+			close(stream.windowUpdated)
+			stream.windowUpdated = make(chan struct{})
+		}
+		state.Unlock()
+	default:
+		mx.ReportError(context, DataDirectionUp, ErrBadFormat)
+	}
+}
+
+// onData passes the data of stream up and grants the credit back
+func (mx *Multiplexer) onData(context Context, state *multiplexerState, id uint32) {
+	connection := context.GetConnection()
+	size := int64(context.GetBuffer().ReadableLength())
+
+	state.Lock()
+	stream, ok := state.streams[id]
+	var err error
+	switch {
+	case !ok || stream.remoteClosed:
+		err = ErrStreamClosed
+	case stream.recvWindow < 0:
+		// the last message may exceed the window, not any more
+		err = ErrFlowControl
+	}
+	if err != nil {
+		if ok {
+			mx.remove(state, stream)
+		}
+		state.Unlock()
+
+		mx.sendFrame(connection, MultiplexerFrameRst, id, nil)
+		mx.ReportError(context, DataDirectionUp, err)
+		if ok {
+			mx.publish(UStackEventStreamReset, stream)
+		}
+		return
+	}
+	stream.recvWindow -= size
+	state.Unlock()
+
+	context.SetOption("stream", id)
+	context.SetOption("session", stream.info.Session)
+
+	mx.GetUpper().OnLowerData(context)
+
+	state.Lock()
+	stream.consumed += size
+	increment := int64(0)
+	if stream.consumed >= int64(mx.initialWindow)/2 {
+		increment = stream.consumed
+		stream.recvWindow += increment
+		stream.consumed = 0
+	}
+	_, alive := state.streams[id]
+	state.Unlock()
+
+	if increment > 0 && alive {
+		mx.sendFrame(connection, MultiplexerFrameWindow, id, muxU32(uint32(increment)))
+	}
+}
+
+// OnEvent drops the streams of the closed connection
+func (mx *Multiplexer) OnEvent(event Event) {
+	if event.Type != UStackEventConnectionClosed {
+		return
+	}
+
+	connection, ok := event.Data.(TransportConnection)
+	if !ok {
+		return
+	}
+
+	state := mx.GetState(connection).(*multiplexerState)
+
+	state.Lock()
+	for _, stream := range state.streams {
+		mx.remove(state, stream)
+	}
+	state.Unlock()
+}
+
+// Run ...
+func (mx *Multiplexer) Run() DataProcessor {
+	mx.routines.restart()
+
+	initialWindow, exists := OptionParseInt(mx.GetOption("InitialWindow"), mx.initialWindow)
+	mx.initialWindow = initialWindow
+	if exists {
+		mx.GetLogger().Info("option", "InitialWindow", mx.initialWindow)
+	}
+
+	maxStreams, exists := OptionParseInt(mx.GetOption("MaxStreams"), mx.maxStreams)
+	mx.maxStreams = maxStreams
+	if exists {
+		mx.GetLogger().Info("option", "MaxStreams", mx.maxStreams)
+	}
+
+	return mx
+}
@@ -0,0 +1,336 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamCollector saves the payloads with their stream ids
+type streamCollector struct {
+	ProcBase
+	sync.Mutex
+	payloads []string
+	streams  []uint32
+	sessions []int
+}
+
+func newStreamCollector() *streamCollector {
+	sc := &streamCollector{
+		ProcBase: NewProcBaseInstance("StreamCollector"),
+	}
+	sc.ProcBase.SetWhere(sc)
+	return sc
+}
+
+func (sc *streamCollector) OnLowerData(context Context) {
+	ub := context.GetBuffer()
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
+
+	id, _ := context.GetOption("stream").(uint32)
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+
+	sc.Lock()
+	sc.payloads = append(sc.payloads, string(data))
+	sc.streams = append(sc.streams, id)
+	sc.sessions = append(sc.sessions, session)
+	sc.Unlock()
+}
+
+// newMultiplexerPair returns two multiplexers linked by wires and the
+// events published by the second one
+func newMultiplexerPair(t *testing.T, options map[string]interface{}) (*Multiplexer, *wire, *Multiplexer, *streamCollector, *[]Event) {
+	var events []Event
+
+	client := NewMultiplexer().ForServer(false)
+	server := NewMultiplexer()
+
+	for i, dp := range []DataProcessor{client, server} {
+		for name, value := range options {
+			dp.SetOption(name, value)
+		}
+		stack := NewUStack().AppendDataProcessor(dp)
+		if i == 1 {
+			stack.SetEventListener(func(event Event) {
+				events = append(events, event)
+			})
+		}
+		stack.Run()
+		t.Cleanup(func() { stack.Stop(context.Background()) })
+	}
+
+	w := newWire()
+	w.peer = server
+	client.SetLower(w)
+
+	back := newWire()
+	back.peer = client
+	server.SetLower(back)
+
+	collector := newStreamCollector()
+	server.SetUpper(collector)
+	client.SetUpper(newStreamCollector())
+
+	return client.(*Multiplexer), back, server.(*Multiplexer), collector, &events
+}
+
+// clientCollector returns the collector of the client side
+func clientCollector(client *Multiplexer) *streamCollector {
+	return client.GetUpper().(*streamCollector)
+}
+
+func sendOnStream(dp DataProcessor, c TransportConnection, id uint32, payload string) {
+	ub := UBufAllocWithHeadReserved(len(payload)+dp.GetOverhead(), dp.GetOverhead())
+	ub.Write([]byte(payload))
+	dp.OnUpperData(NewUStackContext().
+		SetConnection(c).
+		SetBuffer(ub).
+		SetOption("stream", id))
+}
+
+func TestMultiplexerStreams(t *testing.T) {
+	client, _, server, collector, events := newMultiplexerPair(t, nil)
+	c := &dummyConnection{name: "c"}
+
+	id, err := client.OpenStream(c, 3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatal("Unexpected stream id of client:", id)
+	}
+
+	if len(*events) != 1 || (*events)[0].Type != UStackEventStreamOpened {
+		t.Fatal("Stream opened is not published:", *events)
+	}
+	if info := (*events)[0].Data.(*StreamInfo); info.ID != id || info.Session != 7 || info.RemoteSession != 3 {
+		t.Fatal("Unexpected stream info:", info)
+	}
+
+	sendOnStream(client, c, id, "hello")
+	sendOnStream(client, c, 0, "streamless")
+
+	if len(collector.payloads) != 2 ||
+		collector.payloads[0] != "hello" || collector.streams[0] != id || collector.sessions[0] != 7 ||
+		collector.payloads[1] != "streamless" || collector.streams[1] != 0 {
+		t.Fatal("Unexpected payloads:", collector.payloads, collector.streams, collector.sessions)
+	}
+
+	// half closed, the server can still send
+	if err := client.CloseStream(c, id); err != nil {
+		t.Fatal(err)
+	}
+	sendOnStream(client, c, id, "late")
+	if len(collector.payloads) != 2 {
+		t.Fatal("Data is sent after FIN")
+	}
+
+	if err := server.CloseStream(c, id); err != nil {
+		t.Fatal(err)
+	}
+	if last := (*events)[len(*events)-1]; last.Type != UStackEventStreamClosed {
+		t.Fatal("Stream closed is not published:", last)
+	}
+
+	// the server opens even streams
+	if id, _ := server.OpenStream(c, 1, 1); id != 2 {
+		t.Fatal("Unexpected stream id of server:", id)
+	}
+}
+
+func TestMultiplexerWindow(t *testing.T) {
+	client, back, _, collector, _ := newMultiplexerPair(t, map[string]interface{}{
+		"InitialWindow": 8,
+	})
+	c := &dummyConnection{name: "c"}
+
+	// hold the window updates
+	server := back.peer
+	back.peer = nil
+
+	id, _ := client.OpenStream(c, 1, 1)
+
+	sendOnStream(client, c, id, "12345678")
+
+	sent := make(chan struct{})
+	go func() {
+		sendOnStream(client, c, id, "blocked")
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Sender is not blocked by the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// deliver the window update
+	update := back.buffers[len(back.buffers)-1]
+	back.peer = server
+	client.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(update))
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Sender is not released by the window update")
+	}
+
+	collector.Lock()
+	defer collector.Unlock()
+	if len(collector.payloads) != 2 || collector.payloads[1] != "blocked" {
+		t.Fatal("Unexpected payloads:", collector.payloads)
+	}
+}
+
+func TestMultiplexerReset(t *testing.T) {
+	client, _, server, collector, events := newMultiplexerPair(t, nil)
+	c := &dummyConnection{name: "c"}
+
+	id, _ := client.OpenStream(c, 1, 1)
+
+	if err := server.ResetStream(c, id); err != nil {
+		t.Fatal(err)
+	}
+	if last := (*events)[len(*events)-1]; last.Type != UStackEventStreamReset {
+		t.Fatal("Stream reset is not published:", last)
+	}
+
+	// the client got RST too
+	if err := client.CloseStream(c, id); err != ErrStreamClosed {
+		t.Fatal("Stream is not reset on client:", err)
+	}
+
+	// data on an unknown stream is refused
+	ub := UBufAllocWithHeadReserved(64, MultiplexerHeaderSizeInByte)
+	ub.Write([]byte("lost"))
+	ub.WriteHeadU32BE(99)
+	ub.WriteHeadByte(MultiplexerFrameData)
+	server.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+
+	if len(collector.payloads) != 0 {
+		t.Fatal("Unexpected payloads:", collector.payloads)
+	}
+	last := (*events)[len(*events)-1]
+	if perr, ok := last.Data.(*ProcessingError); !ok || perr.Err != ErrStreamClosed {
+		t.Fatal("Data on unknown stream is not reported:", last)
+	}
+}
+
+func TestMultiplexerReply(t *testing.T) {
+	client, _, server, collector, _ := newMultiplexerPair(t, nil)
+	c := &dummyConnection{name: "c"}
+
+	// the endpoint of session 3 talks to the endpoint of session 7
+	id, _ := client.OpenStream(c, 3, 7)
+
+	sendOnStream(client, c, id, "request")
+	sendOnStream(server, c, id, "reply")
+
+	if len(collector.sessions) != 1 || collector.sessions[0] != 7 {
+		t.Fatal("Unexpected sessions of server:", collector.sessions)
+	}
+
+	// the reply goes to the opener's endpoint
+	replies := clientCollector(client)
+	if len(replies.payloads) != 1 || replies.payloads[0] != "reply" ||
+		replies.streams[0] != id || replies.sessions[0] != 3 {
+		t.Fatal("Unexpected replies:", replies.payloads, replies.streams, replies.sessions)
+	}
+}
+
+func TestMultiplexerSameRole(t *testing.T) {
+	client, _, server, _, events := newMultiplexerPair(t, nil)
+	c := &dummyConnection{name: "c"}
+
+	// both sides are servers, the even stream of the peer is refused
+	client.ForServer(true)
+
+	id, _ := client.OpenStream(c, 1, 1)
+	if id != 2 {
+		t.Fatal("Unexpected stream id:", id)
+	}
+
+	last := (*events)[len(*events)-1]
+	if perr, ok := last.Data.(*ProcessingError); !ok || perr.Err != ErrStreamRefused {
+		t.Fatal("Stream of the same role is not refused:", last)
+	}
+
+	// the opener got RST
+	if err := client.CloseStream(c, id); err != ErrStreamClosed {
+		t.Fatal("Stream is not reset on client:", err)
+	}
+	if state := server.GetState(c).(*multiplexerState); len(state.streams) != 0 {
+		t.Fatal("Unexpected streams:", state.streams)
+	}
+}
+
+// frameCounter counts the frames sent, it is safe for the concurrent
+// senders
+type frameCounter struct {
+	ProcBase
+	sync.Mutex
+	frames int
+}
+
+func (fc *frameCounter) OnUpperData(context Context) {
+	fc.Lock()
+	fc.frames++
+	fc.Unlock()
+}
+
+func TestMultiplexerWindowSenders(t *testing.T) {
+	client, _, _, _, _ := newMultiplexerPair(t, map[string]interface{}{
+		"InitialWindow": 8,
+	})
+	c := &dummyConnection{name: "c"}
+
+	counter := &frameCounter{ProcBase: NewProcBaseInstance("FrameCounter")}
+	counter.ProcBase.SetWhere(counter)
+	client.SetLower(counter)
+
+	id, _ := client.OpenStream(c, 1, 1)
+	sendOnStream(client, c, id, "12345678")
+
+	// both senders wait for the credit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendOnStream(client, c, id, "blocked")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// one update lets both check the window, the first one leaves 1
+	ub := UBufAllocWithHeadReserved(64, MultiplexerHeaderSizeInByte)
+	ub.WriteU32BE(8)
+	ub.WriteHeadU32BE(id)
+	ub.WriteHeadByte(MultiplexerFrameWindow)
+	client.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(ub))
+
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Sender is not released by the window update")
+	}
+
+	counter.Lock()
+	defer counter.Unlock()
+	// SYN and the three messages
+	if counter.frames != 4 {
+		t.Fatal("Unexpected frames:", counter.frames)
+	}
+}
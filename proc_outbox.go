@@ -0,0 +1,752 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the frame types of Outbox
+const (
+	OutboxFrameData byte = 0x00
+	OutboxFrameAck  byte = 0x01
+)
+
+// OutboxHeaderSizeInByte is 1 byte type, 8 bytes origin and 8 bytes
+// sequence, all big endian
+const OutboxHeaderSizeInByte int = 17
+
+// outboxRecordHeaderSize is the length and the crc32 of record on disk
+const outboxRecordHeaderSize int = 8
+
+// outboxRecord is a message waiting for the ack
+type outboxRecord struct {
+	origin  uint64
+	seq     uint64
+	time    time.Time
+	data    []byte
+	segment *outboxSegment
+}
+
+// outboxSegment is a log file of records
+type outboxSegment struct {
+	path string
+	size int
+	// the records neither acked nor dropped
+	live int
+}
+
+// outboxPeer is the outbox of the connections with the same name, e.g.
+// the server redialed by a client transport
+type outboxPeer struct {
+	sync.Mutex
+	// serializes the sending to keep the order of records
+	sending sync.Mutex
+	name    string
+	dir     string
+	// the origin and the last sequence of the records stored by this run
+	origin     uint64
+	seq        uint64
+	connection TransportConnection
+	pending    []*outboxRecord
+	size       int
+	segments   []*outboxSegment
+	// the file of the last segment
+	active *os.File
+	// dropped from the peers, a new one is made for the name
+	removed bool
+}
+
+// outboxOrigin is the last delivered sequence of an origin
+type outboxOrigin struct {
+	seq  uint64
+	time time.Time
+}
+
+// Outbox stores the buffers going down in log segments on disk until
+// they are acked by the Outbox of peer, it should be the last data
+// processor above the transports. The buffers sent on a closed
+// connection are kept and replayed in order once a connection with the
+// same name is coming, e.g. when a client transport with Reconnect
+// redials the server. The receiver drops the duplicated ones, the
+// records of a segment are replayed again if the process restarted
+// before all of them were acked, so the delivery is at least once across
+// restarts.
+//
+// The peers without connection and pending records are dropped, and the
+// origins not delivered for MaxAge are forgotten, so both sides should
+// use the same MaxAge.
+//
+// Options:
+//
+//	Dir: string, the directory of segments, $TMPDIR/ustack-outbox by default
+//	SegmentSize: int, 4MB by default
+//	MaxSize: int, the bytes kept for a peer, 64MB by default, the oldest
+//	  records are dropped beyond it
+//	MaxAge: time.Duration, 24h by default, the older records are dropped
+//	Store: bool, false only acks and dedups the buffers from peer. It is
+//	  true by default on the client side (ForServer(false)) and false on
+//	  the server side, whose connections are named by the ephemeral
+//	  addresses of clients and never come back
+type Outbox struct {
+	ProcBase
+	sync.Mutex
+	dir         string
+	segmentSize int
+	maxSize     int
+	maxAge      time.Duration
+	store       bool
+	peers       map[string]*outboxPeer
+	// the last delivered sequence of each origin
+	delivered map[uint64]*outboxOrigin
+	stored    uint64
+	replayed  uint64
+	acked     uint64
+	dropped   uint64
+}
+
+// NewOutbox ...
+func NewOutbox() DataProcessor {
+	ob := &Outbox{
+		ProcBase:    NewProcBaseInstance("Outbox"),
+		dir:         filepath.Join(os.TempDir(), "ustack-outbox"),
+		segmentSize: 4 * 1024 * 1024,
+		maxSize:     64 * 1024 * 1024,
+		maxAge:      24 * time.Hour,
+		peers:       make(map[string]*outboxPeer),
+		delivered:   make(map[uint64]*outboxOrigin),
+	}
+	return ob.ProcBase.SetWhere(ob)
+}
+
+// GetOverhead returns the overhead
+func (ob *Outbox) GetOverhead() int {
+	return OutboxHeaderSizeInByte
+}
+
+// encodeOutboxRecord ...
+func encodeOutboxRecord(record *outboxRecord) []byte {
+	body := make([]byte, 24+len(record.data))
+	binary.BigEndian.PutUint64(body[0:], record.origin)
+	binary.BigEndian.PutUint64(body[8:], record.seq)
+	binary.BigEndian.PutUint64(body[16:], uint64(record.time.UnixNano()))
+	copy(body[24:], record.data)
+
+	b := make([]byte, outboxRecordHeaderSize, outboxRecordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(b[0:], uint32(len(body)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+	return append(b, body...)
+}
+
+// decodeOutboxRecords returns the records until the end or the first
+// broken one, e.g. the last one written partly
+func decodeOutboxRecords(b []byte) []*outboxRecord {
+	var records []*outboxRecord
+
+	for len(b) >= outboxRecordHeaderSize {
+		size := int(binary.BigEndian.Uint32(b[0:]))
+		sum := binary.BigEndian.Uint32(b[4:])
+		if size < 24 || len(b) < outboxRecordHeaderSize+size {
+			break
+		}
+
+		body := b[outboxRecordHeaderSize : outboxRecordHeaderSize+size]
+		if crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+
+		records = append(records, &outboxRecord{
+			origin: binary.BigEndian.Uint64(body[0:]),
+			seq:    binary.BigEndian.Uint64(body[8:]),
+			time:   time.Unix(0, int64(binary.BigEndian.Uint64(body[16:]))),
+			data:   append([]byte(nil), body[24:]...),
+		})
+
+		b = b[outboxRecordHeaderSize+size:]
+	}
+
+	return records
+}
+
+// getPeer returns the peer of name, it is created if create is true
+func (ob *Outbox) getPeer(name string, create bool) *outboxPeer {
+	ob.Lock()
+	defer ob.Unlock()
+
+	p, ok := ob.peers[name]
+	if !ok && create {
+		// a new origin for each peer of each run, the records of the last
+		// run keep theirs
+		b := make([]byte, 8)
+		rand.Read(b)
+
+		p = &outboxPeer{
+			name:   name,
+			dir:    filepath.Join(ob.dir, url.QueryEscape(name)),
+			origin: binary.BigEndian.Uint64(b),
+		}
+		ob.peers[name] = p
+	}
+	return p
+}
+
+// append writes the record to the last segment, a new segment is
+// created if it is full. The peer must be locked.
+func (p *outboxPeer) append(record *outboxRecord, segmentSize int) error {
+	b := encodeOutboxRecord(record)
+
+	var segment *outboxSegment
+	if n := len(p.segments); n > 0 && p.active != nil && p.segments[n-1].size < segmentSize {
+		segment = p.segments[n-1]
+	} else {
+		if p.active != nil {
+			p.active.Close()
+			p.active = nil
+		}
+
+		if err := os.MkdirAll(p.dir, 0700); err != nil {
+			return err
+		}
+
+		// named by time to be replayed in order after restart
+		name := time.Now().UnixNano()
+		if n := len(p.segments); n > 0 {
+			var last int64
+			fmt.Sscanf(filepath.Base(p.segments[n-1].path), "%d.log", &last)
+			if name <= last {
+				name = last + 1
+			}
+		}
+
+		path := filepath.Join(p.dir, fmt.Sprintf("%020d.log", name))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		p.active = file
+		segment = &outboxSegment{path: path}
+		p.segments = append(p.segments, segment)
+	}
+
+	if _, err := p.active.Write(b); err != nil {
+		return err
+	}
+
+	segment.size += len(b)
+	segment.live++
+
+	record.segment = segment
+	p.pending = append(p.pending, record)
+	p.size += len(record.data)
+
+	return nil
+}
+
+// release deletes the segment of record if all of its records are done.
+// The peer must be locked.
+func (p *outboxPeer) release(record *outboxRecord) {
+	p.size -= len(record.data)
+
+	segment := record.segment
+	segment.live--
+	if segment.live > 0 {
+		return
+	}
+
+	for i, s := range p.segments {
+		if s != segment {
+			continue
+		}
+
+		if i == len(p.segments)-1 && p.active != nil {
+			p.active.Close()
+			p.active = nil
+		}
+
+		os.Remove(segment.path)
+		p.segments = append(p.segments[:i], p.segments[i+1:]...)
+		return
+	}
+}
+
+// ack releases the records of origin up to seq, returns the number of
+// them. The peer must be locked.
+func (p *outboxPeer) ack(origin uint64, seq uint64) int {
+	n := 0
+	pending := p.pending[:0]
+	for _, record := range p.pending {
+		if record.origin == origin && record.seq <= seq {
+			p.release(record)
+			n++
+			continue
+		}
+		pending = append(pending, record)
+	}
+	p.pending = pending
+	return n
+}
+
+// expire drops the oldest records beyond the limits, returns the number
+// of them. The peer must be locked.
+func (p *outboxPeer) expire(maxSize int, maxAge time.Duration) int {
+	n := 0
+	for len(p.pending) > 0 {
+		record := p.pending[0]
+		if p.size <= maxSize && time.Since(record.time) <= maxAge {
+			break
+		}
+		p.release(record)
+		p.pending = p.pending[1:]
+		n++
+	}
+	return n
+}
+
+// idle returns true if the peer has nothing to send. The peer must be
+// locked.
+func (p *outboxPeer) idle() bool {
+	return len(p.pending) == 0 && (p.connection == nil || p.connection.Closed())
+}
+
+// close ...
+func (p *outboxPeer) close() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.active != nil {
+		p.active.Close()
+		p.active = nil
+	}
+}
+
+// load reads the segments of peers left by the last run
+func (ob *Outbox) load() {
+	dirs, err := ioutil.ReadDir(ob.dir)
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		name, err := url.QueryUnescape(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		p := ob.getPeer(name, true)
+		files, _ := filepath.Glob(filepath.Join(p.dir, "*.log"))
+		sort.Strings(files)
+
+		p.Lock()
+		for _, path := range files {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+
+			segment := &outboxSegment{path: path, size: len(b)}
+			for _, record := range decodeOutboxRecords(b) {
+				record.segment = segment
+				segment.live++
+				p.pending = append(p.pending, record)
+				p.size += len(record.data)
+			}
+
+			if segment.live == 0 {
+				os.Remove(path)
+				continue
+			}
+			p.segments = append(p.segments, segment)
+		}
+		dropped := p.expire(ob.maxSize, ob.maxAge)
+		pending := len(p.pending)
+		p.Unlock()
+
+		atomic.AddUint64(&ob.dropped, uint64(dropped))
+
+		if pending > 0 {
+			ob.GetLogger().Info("load outbox", "peer", name, "pending", pending, "dropped", dropped)
+		}
+	}
+}
+
+// sendRecord ...
+func (ob *Outbox) sendRecord(connection TransportConnection, record *outboxRecord) {
+	overhead := ob.ustack.GetOverhead()
+
+	capacity := ob.ustack.GetMTU()
+	if len(record.data)+overhead > capacity {
+		capacity = len(record.data) + overhead
+	}
+
+	ub := UBufAllocWithHeadReserved(capacity, overhead)
+	ub.Write(record.data)
+	ub.WriteHeadU64BE(record.seq)
+	ub.WriteHeadU64BE(record.origin)
+	ub.WriteHeadByte(OutboxFrameData)
+
+	ob.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
+}
+
+// flush sends the records to the connection, all the pending records are
+// replayed if it is a new connection of the peer. p.sending must be
+// locked.
+func (ob *Outbox) flush(p *outboxPeer, connection TransportConnection, records []*outboxRecord) {
+	p.Lock()
+	replay := p.connection != connection
+	if replay {
+		p.connection = connection
+		records = append([]*outboxRecord(nil), p.pending...)
+	}
+	p.Unlock()
+
+	if replay && len(records) > 0 {
+		atomic.AddUint64(&ob.replayed, uint64(len(records)))
+		ob.GetLogger().Info("replay outbox", "connection", connection.GetName(), "records", len(records))
+	}
+
+	for _, record := range records {
+		if connection.Closed() {
+			return
+		}
+		ob.sendRecord(connection, record)
+	}
+}
+
+// sendAck ...
+func (ob *Outbox) sendAck(connection TransportConnection, origin uint64, seq uint64) {
+	ub := UBufAllocWithHeadReserved(
+		ob.ustack.GetMTU(),
+		ob.ustack.GetOverhead())
+
+	ub.WriteByte(OutboxFrameAck)
+	ub.WriteU64BE(origin)
+	ub.WriteU64BE(seq)
+
+	ob.GetLower().OnUpperData(
+		NewUStackContext().
+			SetConnection(connection).
+			SetBuffer(ub))
+}
+
+// OnUpperData ...
+func (ob *Outbox) OnUpperData(context Context) {
+	connection := context.GetConnection()
+	if connection.UseReference() {
+		ob.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		ob.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	if !ob.store || !ob.IsEnabled() {
+		ub.WriteHeadU64BE(0)
+		ub.WriteHeadU64BE(0)
+		ub.WriteHeadByte(OutboxFrameData)
+		ob.GetLower().OnUpperData(context)
+		return
+	}
+
+	record := &outboxRecord{
+		time: time.Now(),
+		data: make([]byte, ub.ReadableLength()),
+	}
+	ub.Peek(record.data)
+
+	var p *outboxPeer
+	for {
+		p = ob.getPeer(connection.GetName(), true)
+
+		// the receiver drops the sequences out of order, they are sent in
+		// the order of being assigned
+		p.sending.Lock()
+		p.Lock()
+		if !p.removed {
+			break
+		}
+		p.Unlock()
+		p.sending.Unlock()
+	}
+	defer p.sending.Unlock()
+
+	p.seq++
+	record.origin = p.origin
+	record.seq = p.seq
+	err := p.append(record, ob.segmentSize)
+	dropped := p.expire(ob.maxSize, ob.maxAge)
+
+	target := connection
+	if target.Closed() {
+		target = p.connection
+	}
+	p.Unlock()
+
+	atomic.AddUint64(&ob.dropped, uint64(dropped))
+
+	if err != nil {
+		ob.ReportError(context, DataDirectionDown, err)
+		return
+	}
+	atomic.AddUint64(&ob.stored, 1)
+
+	// kept until a connection of the peer is coming
+	if target == nil || target.Closed() {
+		return
+	}
+
+	ob.flush(p, target, []*outboxRecord{record})
+}
+
+// OnLowerData ...
+func (ob *Outbox) OnLowerData(context Context) {
+	connection := context.GetConnection()
+	if connection.UseReference() {
+		ob.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	if ub.ReadableLength() < OutboxHeaderSizeInByte {
+		ob.ReportError(context, DataDirectionUp, ErrBadFormat)
+		return
+	}
+
+	frame, _ := ub.ReadByte()
+	origin, _ := ub.ReadU64BE()
+	seq, _ := ub.ReadU64BE()
+
+	switch frame {
+	case OutboxFrameData:
+		// not stored by the peer
+		if seq == 0 {
+			ob.GetUpper().OnLowerData(context)
+			return
+		}
+
+		ob.Lock()
+		last, ok := ob.delivered[origin]
+		if !ok {
+			last = &outboxOrigin{}
+			ob.delivered[origin] = last
+		}
+		duplicated := seq <= last.seq
+		if !duplicated {
+			last.seq = seq
+		}
+		last.time = time.Now()
+		ob.Unlock()
+
+		if !duplicated {
+			ob.GetUpper().OnLowerData(context)
+		}
+
+		ob.sendAck(connection, origin, seq)
+	case OutboxFrameAck:
+		p := ob.getPeer(connection.GetName(), false)
+		if p == nil {
+			return
+		}
+
+		p.Lock()
+		n := p.ack(origin, seq)
+		p.Unlock()
+
+		atomic.AddUint64(&ob.acked, uint64(n))
+	default:
+		ob.ReportError(context, DataDirectionUp, ErrBadFormat)
+	}
+}
+
+// OnEvent replays the pending records on the new connection
+func (ob *Outbox) OnEvent(event Event) {
+	connection, ok := event.Data.(TransportConnection)
+	if !ok {
+		return
+	}
+
+	p := ob.getPeer(connection.GetName(), false)
+	if p == nil {
+		return
+	}
+
+	switch event.Type {
+	case UStackEventNewConnection:
+		p.sending.Lock()
+		ob.flush(p, connection, nil)
+		p.sending.Unlock()
+	case UStackEventConnectionClosed:
+		// do not wait for the sending, it may be closing the connection
+		p.Lock()
+		if p.connection == connection {
+			p.connection = nil
+		}
+		p.Unlock()
+	}
+}
+
+// GetPending returns the number of records waiting for the ack by the
+// name of connection
+func (ob *Outbox) GetPending() map[string]int {
+	ob.Lock()
+	peers := make([]*outboxPeer, 0, len(ob.peers))
+	for _, p := range ob.peers {
+		peers = append(peers, p)
+	}
+	ob.Unlock()
+
+	pending := make(map[string]int)
+	for _, p := range peers {
+		p.Lock()
+		if len(p.pending) > 0 {
+			pending[p.name] = len(p.pending)
+		}
+		p.Unlock()
+	}
+	return pending
+}
+
+// GetStats returns the counters of records
+func (ob *Outbox) GetStats() map[string]interface{} {
+	return map[string]interface{}{
+		"stored":   atomic.LoadUint64(&ob.stored),
+		"replayed": atomic.LoadUint64(&ob.replayed),
+		"acked":    atomic.LoadUint64(&ob.acked),
+		"dropped":  atomic.LoadUint64(&ob.dropped),
+	}
+}
+
+// Run ...
+func (ob *Outbox) Run() DataProcessor {
+	ob.routines.restart()
+
+	dir, exists := OptionParseString(ob.GetOption("Dir"), ob.dir)
+	ob.dir = dir
+	if exists {
+		ob.GetLogger().Info("option", "Dir", ob.dir)
+	}
+
+	segmentSize, exists := OptionParseInt(ob.GetOption("SegmentSize"), ob.segmentSize)
+	ob.segmentSize = segmentSize
+	if exists {
+		ob.GetLogger().Info("option", "SegmentSize", ob.segmentSize)
+	}
+
+	maxSize, exists := OptionParseInt(ob.GetOption("MaxSize"), ob.maxSize)
+	ob.maxSize = maxSize
+	if exists {
+		ob.GetLogger().Info("option", "MaxSize", ob.maxSize)
+	}
+
+	maxAge, exists := OptionParseDuration(ob.GetOption("MaxAge"), ob.maxAge)
+	ob.maxAge = maxAge
+	if exists {
+		ob.GetLogger().Info("option", "MaxAge", ob.maxAge)
+	}
+
+	store, exists := OptionParseBool(ob.GetOption("Store"), !ob.forServer)
+	ob.store = store
+	if exists {
+		ob.GetLogger().Info("option", "Store", ob.store)
+	}
+
+	if ob.store {
+		ob.load()
+	}
+
+	ob.routines.spawn(func() {
+		for ob.routines.sleep(time.Second) {
+			ob.expire()
+		}
+	})
+
+	return ob
+}
+
+// expire drops the expired records, the idle peers and the origins not
+// delivered for MaxAge
+func (ob *Outbox) expire() {
+	ob.Lock()
+	peers := make([]*outboxPeer, 0, len(ob.peers))
+	for _, p := range ob.peers {
+		peers = append(peers, p)
+	}
+	ob.Unlock()
+
+	for _, p := range peers {
+		p.Lock()
+		n := p.expire(ob.maxSize, ob.maxAge)
+		p.Unlock()
+
+		if n > 0 {
+			atomic.AddUint64(&ob.dropped, uint64(n))
+			ob.GetLogger().Warn("outbox records expired", "peer", p.name, "dropped", n)
+		}
+	}
+
+	ob.Lock()
+	defer ob.Unlock()
+
+	for name, p := range ob.peers {
+		p.Lock()
+		if p.idle() {
+			p.removed = true
+			delete(ob.peers, name)
+
+			if p.active != nil {
+				p.active.Close()
+				p.active = nil
+			}
+			// only if it is empty
+			os.Remove(p.dir)
+		}
+		p.Unlock()
+	}
+
+	for origin, last := range ob.delivered {
+		if time.Since(last.time) > ob.maxAge {
+			delete(ob.delivered, origin)
+		}
+	}
+}
+
+// Stop closes the segments, they are loaded by the next run
+func (ob *Outbox) Stop() DataProcessor {
+	ob.ProcBase.Stop()
+
+	ob.Lock()
+	defer ob.Unlock()
+
+	for _, p := range ob.peers {
+		p.close()
+	}
+
+	return ob
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newOutboxPair returns a storing outbox linked to an acking one, the
+// messages received by the second one are collected
+func newOutboxPair(t *testing.T, dir string, options map[string]interface{}) (*Outbox, UStack, *wire, *frameCollector) {
+	sender := NewOutbox().ForServer(false).SetOption("Dir", dir)
+	for name, value := range options {
+		sender.SetOption(name, value)
+	}
+	// the server side does not store by default
+	receiver := NewOutbox().SetOption("Dir", dir)
+
+	senderStack := NewUStack().AppendDataProcessor(sender).Run()
+	t.Cleanup(func() { senderStack.Stop(context.Background()) })
+
+	receiverStack := NewUStack().AppendDataProcessor(receiver).Run()
+	t.Cleanup(func() { receiverStack.Stop(context.Background()) })
+
+	w := newWire()
+	w.peer = receiver
+	sender.SetLower(w)
+
+	back := newWire()
+	back.peer = sender
+	receiver.SetLower(back)
+
+	collector := newFrameCollector()
+	receiver.SetUpper(collector)
+
+	return sender.(*Outbox), senderStack, w, collector
+}
+
+// receiverOf returns the outbox linked to sender
+func receiverOf(sender *Outbox) *Outbox {
+	return sender.GetLower().(*wire).peer.(*Outbox)
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestOutboxReplay(t *testing.T) {
+	dir := t.TempDir()
+	sender, stack, w, collector := newOutboxPair(t, dir, nil)
+
+	c1 := &dummyConnection{name: "server"}
+	sendPayload(sender, c1, "a")
+
+	if got := collector.frames[c1]; len(got) != 1 || got[0] != "a" {
+		t.Fatal("Unexpected frames:", got)
+	}
+	if pending := sender.GetPending(); len(pending) != 0 {
+		t.Fatal("Acked records are pending:", pending)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatal("Acked segments are not deleted:", files)
+	}
+
+	// the uplink is down
+	c1.closed = true
+	sendPayload(sender, c1, "b")
+	sendPayload(sender, c1, "c")
+
+	if got := collector.frames[c1]; len(got) != 1 {
+		t.Fatal("Sent on closed connection:", got)
+	}
+	if pending := sender.GetPending(); pending["server"] != 2 {
+		t.Fatal("Unexpected pending:", pending)
+	}
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatal("Unexpected segments:", files)
+	}
+
+	// redialed
+	c2 := &dummyConnection{name: "server"}
+	stack.PublishEvent(Event{Type: UStackEventNewConnection, Data: c2})
+
+	if got := collector.frames[c2]; len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatal("Unexpected replayed frames:", got)
+	}
+	if pending := sender.GetPending(); len(pending) != 0 {
+		t.Fatal("Replayed records are pending:", pending)
+	}
+
+	// the duplicated one is acked but not delivered
+	receiverOf(sender).OnLowerData(NewUStackContext().
+		SetConnection(c2).
+		SetBuffer(w.buffers[len(w.buffers)-1]))
+
+	if got := collector.frames[c2]; len(got) != 2 {
+		t.Fatal("Duplicated frame is delivered:", got)
+	}
+}
+
+func TestOutboxRestart(t *testing.T) {
+	dir := t.TempDir()
+	sender, stack, _, _ := newOutboxPair(t, dir, nil)
+
+	c1 := &dummyConnection{name: "server", closed: true}
+	sendPayload(sender, c1, "x")
+	sendPayload(sender, c1, "y")
+
+	stack.Stop(context.Background())
+
+	sender, stack, _, collector := newOutboxPair(t, dir, nil)
+	if pending := sender.GetPending(); pending["server"] != 2 {
+		t.Fatal("Records are not loaded:", pending)
+	}
+
+	c2 := &dummyConnection{name: "server"}
+	stack.PublishEvent(Event{Type: UStackEventNewConnection, Data: c2})
+
+	if got := collector.frames[c2]; len(got) != 2 || got[0] != "x" || got[1] != "y" {
+		t.Fatal("Unexpected replayed frames:", got)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatal("Acked segments are not deleted:", files)
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	dir := t.TempDir()
+	sender, stack, _, collector := newOutboxPair(t, dir, map[string]interface{}{
+		"MaxSize":     8,
+		"SegmentSize": 16,
+	})
+
+	c1 := &dummyConnection{name: "server", closed: true}
+	for _, payload := range []string{"1111", "2222", "3333", "4444"} {
+		sendPayload(sender, c1, payload)
+	}
+
+	if pending := sender.GetPending(); pending["server"] != 2 {
+		t.Fatal("Oldest records are not dropped:", pending)
+	}
+	if dropped := sender.GetStats()["dropped"]; dropped != uint64(2) {
+		t.Fatal("Unexpected dropped:", dropped)
+	}
+
+	c2 := &dummyConnection{name: "server"}
+	stack.PublishEvent(Event{Type: UStackEventNewConnection, Data: c2})
+
+	if got := collector.frames[c2]; len(got) != 2 || got[0] != "3333" || got[1] != "4444" {
+		t.Fatal("Unexpected replayed frames:", got)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatal("Segments are not deleted:", files)
+	}
+}
+
+func TestOutboxExpire(t *testing.T) {
+	dir := t.TempDir()
+	sender, _, _, _ := newOutboxPair(t, dir, map[string]interface{}{
+		"MaxAge": "50ms",
+	})
+	receiver := receiverOf(sender)
+	receiver.maxAge = 50 * time.Millisecond
+
+	// the expiring routine may be running
+	counts := func(ob *Outbox) (int, int) {
+		ob.Lock()
+		defer ob.Unlock()
+		return len(ob.peers), len(ob.delivered)
+	}
+
+	// the accepted connections of server come and go
+	for _, name := range []string{"127.0.0.1:50001", "127.0.0.1:50002"} {
+		c := &dummyConnection{name: name}
+		sendPayload(sender, c, "a")
+		sendPayload(receiver, c, "b")
+		c.closed = true
+	}
+
+	// the server side acks only
+	if peers, _ := counts(receiver); peers != 0 {
+		t.Fatal("Unexpected peers of server:", peers)
+	}
+	peers, _ := counts(sender)
+	if _, origins := counts(receiver); peers != 2 || origins != 2 {
+		t.Fatal("Unexpected peers:", peers, origins)
+	}
+
+	// a peer with pending records is kept
+	pending := &dummyConnection{name: "pending", closed: true}
+	sendPayload(sender, pending, "c")
+
+	sender.expire()
+	if peers, _ := counts(sender); peers != 1 || sender.getPeer("pending", false) == nil {
+		t.Fatal("Idle peers are not dropped:", peers)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	receiver.expire()
+	if _, origins := counts(receiver); origins != 0 {
+		t.Fatal("Old origins are not dropped:", origins)
+	}
+
+	// a new peer is made for the name
+	c := &dummyConnection{name: "127.0.0.1:50001"}
+	sendPayload(sender, c, "d")
+	if peers, _ := counts(sender); peers != 2 || sender.GetPending()["127.0.0.1:50001"] != 0 {
+		t.Fatal("Unexpected peers:", peers, sender.GetPending())
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"errors"
+	"strings"
+)
+
+// the kinds of pub/sub frame
+const (
+	PubSubKindPublish     byte = 0x00
+	PubSubKindSubscribe   byte = 0x01
+	PubSubKindUnsubscribe byte = 0x02
+)
+
+// PubSubHeaderSizeInByte is 1 byte kind and 2 bytes big endian length of
+// the topic which follows
+const PubSubHeaderSizeInByte int = 3
+
+// the errors of topics
+var (
+	ErrBadTopic   = errors.New("bad topic")
+	ErrBadPattern = errors.New("bad topic pattern")
+)
+
+// ValidateTopic returns ErrBadTopic if the topic is empty, too long or
+// has wildcards
+func ValidateTopic(topic string) error {
+	if topic == "" || len(topic) > 0xffff || strings.ContainsAny(topic, "*#") {
+		return ErrBadTopic
+	}
+	return nil
+}
+
+// ValidatePattern returns ErrBadPattern if "#" is not the last level or
+// "*" is in the middle of a level
+func ValidatePattern(pattern string) error {
+	if pattern == "" || len(pattern) > 0xffff {
+		return ErrBadPattern
+	}
+
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return ErrBadPattern
+		}
+		if n := strings.Count(level, "*"); n > 1 || (n == 1 && !strings.HasSuffix(level, "*")) {
+			return ErrBadPattern
+		}
+	}
+	return nil
+}
+
+// TopicMatch reports whether the topic matches the pattern. The levels
+// are separated by "/":
+//
+//	"a/b" matches "a/b" only
+//	"*" matches any one level, e.g. "a/*/c" matches "a/b/c"
+//	"x*" matches the levels prefixed by "x", e.g. "log/err*" matches "log/error"
+//	"#" as the last level matches any levels, e.g. "a/#" matches "a" and "a/b/c"
+func TopicMatch(pattern string, topic string) bool {
+	patterns := strings.Split(pattern, "/")
+	topics := strings.Split(topic, "/")
+
+	for i, p := range patterns {
+		if p == "#" {
+			return true
+		}
+		if i >= len(topics) {
+			return false
+		}
+		if strings.HasSuffix(p, "*") {
+			if !strings.HasPrefix(topics[i], p[:len(p)-1]) {
+				return false
+			}
+			continue
+		}
+		if p != topics[i] {
+			return false
+		}
+	}
+
+	return len(patterns) == len(topics)
+}
+
+// allocPubSubBuffer returns a buffer of size with the head room for the
+// topic and the overhead of stack
+func allocPubSubBuffer(ustack UStack, topic string, size int) *UBuf {
+	reserved := ustack.GetOverhead() + PubSubHeaderSizeInByte + len(topic)
+
+	capacity := ustack.GetMTU()
+	if size+reserved > capacity {
+		capacity = size + reserved
+	}
+
+	return UBufAllocWithHeadReserved(capacity, reserved)
+}
+
+// writePubSubHeader prepends the header, ub is copied to a new buffer if
+// its head room is not enough for the topic
+func writePubSubHeader(ustack UStack, ub *UBuf, kind byte, topic string) *UBuf {
+	if ub.HeadWritableLength() < ustack.GetOverhead()+PubSubHeaderSizeInByte+len(topic) {
+		data := make([]byte, ub.ReadableLength())
+		ub.Peek(data)
+
+		ub = allocPubSubBuffer(ustack, topic, len(data))
+		ub.Write(data)
+	}
+
+	ub.WriteHeadBytes([]byte(topic))
+	ub.WriteHeadU16BE(uint16(len(topic)))
+	ub.WriteHeadByte(kind)
+
+	return ub
+}
+
+// readPubSubHeader ...
+func readPubSubHeader(ub *UBuf) (byte, string, error) {
+	kind, err := ub.ReadByte()
+	if err != nil {
+		return 0, "", ErrBadFormat
+	}
+
+	size, err := ub.ReadU16BE()
+	if err != nil || int(size) > ub.ReadableLength() {
+		return 0, "", ErrBadFormat
+	}
+
+	topic := make([]byte, size)
+	ub.Read(topic)
+
+	return kind, string(topic), nil
+}
+
+// PubSub frames the messages of PubSubEndPoint for Broker, it should be
+// put below the codec. The kind and the topic are taken from the context
+// options "pubsubKind" (byte) and "topic" (string) going down, and set
+// to them going up.
+type PubSub struct {
+	ProcBase
+}
+
+// NewPubSub ...
+func NewPubSub() DataProcessor {
+	ps := &PubSub{
+		ProcBase: NewProcBaseInstance("PubSub"),
+	}
+	return ps.ProcBase.SetWhere(ps)
+}
+
+// GetOverhead returns the overhead, the topic is not counted
+func (ps *PubSub) GetOverhead() int {
+	return PubSubHeaderSizeInByte
+}
+
+// OnUpperData ...
+func (ps *PubSub) OnUpperData(context Context) {
+	if context.GetConnection().UseReference() || !ps.IsEnabled() {
+		ps.GetLower().OnUpperData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		ps.ReportError(context, DataDirectionDown, ErrNoBuffer)
+		return
+	}
+
+	kind, _ := OptionParseByte(context.GetOption("pubsubKind"), PubSubKindPublish)
+	topic, _ := OptionParseString(context.GetOption("topic"), "")
+
+	if topic == "" {
+		ps.ReportError(context, DataDirectionDown, ErrBadTopic)
+		return
+	}
+
+	context.SetBuffer(writePubSubHeader(ps.ustack, ub, kind, topic))
+
+	ps.GetLower().OnUpperData(context)
+}
+
+// OnLowerData ...
+func (ps *PubSub) OnLowerData(context Context) {
+	if context.GetConnection().UseReference() || !ps.IsEnabled() {
+		ps.GetUpper().OnLowerData(context)
+		return
+	}
+
+	ub := context.GetBuffer()
+	if ub == nil {
+		return
+	}
+
+	kind, topic, err := readPubSubHeader(ub)
+	if err != nil {
+		ps.ReportError(context, DataDirectionUp, err)
+		return
+	}
+
+	context.SetOption("pubsubKind", kind)
+	context.SetOption("topic", topic)
+
+	ps.GetUpper().OnLowerData(context)
+}
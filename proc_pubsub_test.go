@@ -0,0 +1,240 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/*/c", "a/x/c", true},
+		{"a/*/c", "a/x/y/c", false},
+		{"log/err*", "log/error", true},
+		{"log/err*", "log/warn", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "any/thing", true},
+	}
+
+	for _, c := range cases {
+		if got := TopicMatch(c.pattern, c.topic); got != c.match {
+			t.Error("Unexpected match of", c.pattern, c.topic, ":", got)
+		}
+	}
+
+	for _, pattern := range []string{"", "a/#/b", "a#", "a/*b", "a/**"} {
+		if ValidatePattern(pattern) == nil {
+			t.Error("Bad pattern is accepted:", pattern)
+		}
+	}
+	for _, topic := range []string{"", "a/*", "a/#"} {
+		if ValidateTopic(topic) == nil {
+			t.Error("Bad topic is accepted:", topic)
+		}
+	}
+}
+
+func newPubSubClient(t *testing.T, name string, ep EndPoint) TransportConnection {
+	stack := NewUStack().
+		SetName(name).
+		AddEndPoint(ep).
+		AppendDataProcessor(NewStringCodec()).
+		AppendDataProcessor(NewPubSub()).
+		AppendDataProcessor(NewFrameDecoder()).
+		AddTransport(
+			NewTCPTransport(name + ":TP").
+				ForServer(false).
+				SetAddress("127.0.0.1:23474")).
+		Run()
+	t.Cleanup(func() { stack.Stop(context.Background()) })
+
+	for i := 0; i < 50; i++ {
+		if connections := stack.GetConnections(); len(connections) > 0 {
+			return connections[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No connection of", name)
+	return nil
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestBrokerRouting(t *testing.T) {
+	broker := NewBroker().(*Broker)
+	brokerStack := NewUStack().
+		SetName("Broker").
+		AppendDataProcessor(broker).
+		AppendDataProcessor(NewFrameDecoder()).
+		AddTransport(
+			NewTCPTransport("Broker:TP").
+				ForServer(true).
+				SetAddress("127.0.0.1:23474")).
+		Run()
+	defer brokerStack.Stop(context.Background())
+
+	time.Sleep(100 * time.Millisecond)
+
+	subscriber := NewPubSubEndPoint("Subscriber:EP-0", 0)
+	defer subscriber.Close()
+	subConn := newPubSubClient(t, "Subscriber", subscriber)
+
+	publisher := NewPubSubEndPoint("Publisher:EP-0", 0)
+	defer publisher.Close()
+	pubConn := newPubSubClient(t, "Publisher", publisher)
+
+	var mutex sync.Mutex
+	var received []string
+	handler := func(connection TransportConnection, topic string, message interface{}) {
+		mutex.Lock()
+		received = append(received, topic+"="+message.(string))
+		mutex.Unlock()
+	}
+
+	subscriber.Subscribe(subConn, "sensors/*/temp", handler)
+	subscriber.Subscribe(subConn, "log/#", handler)
+
+	if !waitFor(func() bool {
+		for _, patterns := range broker.GetSubscriptions() {
+			return len(patterns) == 2
+		}
+		return false
+	}) {
+		t.Fatal("Subscriptions are not registered:", broker.GetSubscriptions())
+	}
+
+	publisher.Publish(pubConn, "sensors/k1/hum", "40")
+	publisher.Publish(pubConn, "sensors/k1/temp", "21")
+	publisher.Publish(pubConn, "log/app/error", "oops")
+
+	if !waitFor(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received) == 2
+	}) {
+		t.Fatal("Unexpected messages:", received)
+	}
+
+	mutex.Lock()
+	if received[0] != "sensors/k1/temp=21" || received[1] != "log/app/error=oops" {
+		t.Fatal("Unexpected messages:", received)
+	}
+	mutex.Unlock()
+
+	// the subscriptions are dropped with the connection
+	subConn.Close()
+	if !waitFor(func() bool { return len(broker.GetSubscriptions()) == 0 }) {
+		t.Fatal("Subscriptions are not dropped:", broker.GetSubscriptions())
+	}
+}
+
+// sessionCollector is a lower data processor which saves the sessions of
+// the data going down
+type sessionCollector struct {
+	ProcBase
+	sessions []int
+}
+
+func newSessionCollector() *sessionCollector {
+	sc := &sessionCollector{
+		ProcBase: NewProcBaseInstance("SessionCollector"),
+	}
+	sc.ProcBase.SetWhere(sc)
+	return sc
+}
+
+func (sc *sessionCollector) OnUpperData(context Context) {
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+	sc.sessions = append(sc.sessions, session)
+}
+
+func TestBrokerSessions(t *testing.T) {
+	stack := NewUStack()
+	broker := NewBroker().SetUStack(stack).(*Broker)
+	lower := newSessionCollector()
+	broker.SetLower(lower)
+
+	c := &dummyConnection{name: "c"}
+
+	subscription := func(kind byte, pattern string, session int) {
+		ub := writePubSubHeader(stack, allocPubSubBuffer(stack, pattern, 0), kind, pattern)
+		broker.OnLowerData(NewUStackContext().
+			SetConnection(c).
+			SetBuffer(ub).
+			SetOption("session", session))
+	}
+
+	// two endpoints of a connection subscribe the same pattern
+	subscription(PubSubKindSubscribe, "a/#", 1)
+	subscription(PubSubKindSubscribe, "a/#", 2)
+	subscription(PubSubKindSubscribe, "a/b", 2)
+
+	broker.Publish("a/b", []byte("x"))
+	if len(lower.sessions) != 2 || lower.sessions[0]+lower.sessions[1] != 3 {
+		t.Fatal("Unexpected sessions:", lower.sessions)
+	}
+
+	// the other session keeps its subscription
+	subscription(PubSubKindUnsubscribe, "a/#", 1)
+
+	lower.sessions = nil
+	broker.Publish("a/c", []byte("x"))
+	if len(lower.sessions) != 1 || lower.sessions[0] != 2 {
+		t.Fatal("Unexpected sessions:", lower.sessions)
+	}
+
+	if patterns := broker.GetSubscriptions()["c"]; len(patterns) != 2 || patterns[0] != "a/#" || patterns[1] != "a/b" {
+		t.Fatal("Unexpected subscriptions:", patterns)
+	}
+}
+
+func TestPubSubEndPointClosedByStack(t *testing.T) {
+	deleted := NewPubSubEndPoint("Closed:EP-0", 0)
+	stopped := NewPubSubEndPoint("Closed:EP-1", 1)
+
+	stack := NewUStack().
+		AddEndPoint(deleted).
+		AddEndPoint(stopped).
+		Run()
+
+	closed := func(p *PubSubEndPoint) bool {
+		select {
+		case <-p.quit:
+			return true
+		default:
+			return false
+		}
+	}
+
+	stack.DeleteEndPoint(deleted)
+	if !closed(deleted) || closed(stopped) {
+		t.Fatal("Deleted endpoint is not closed")
+	}
+
+	stack.Stop(context.Background())
+	if !closed(stopped) {
+		t.Fatal("Endpoint is not closed by stop")
+	}
+}
@@ -27,9 +27,10 @@ func (sr *SessionResolver) GetOverhead() int {
 
 // OnUpperData ...
 func (sr *SessionResolver) OnUpperData(context Context) {
-	if sr.enable {
+	if sr.IsEnabled() {
 		ub := context.GetBuffer()
 		if ub == nil {
+			sr.ReportError(context, DataDirectionDown, ErrNoBuffer)
 			return
 		}
 
@@ -37,16 +38,17 @@ func (sr *SessionResolver) OnUpperData(context Context) {
 
 		err := ub.WriteHeadU32BE(uint32(session))
 		if err != nil {
+			sr.ReportError(context, DataDirectionDown, err)
 			return
 		}
 	}
 
-	sr.lower.OnUpperData(context)
+	sr.GetLower().OnUpperData(context)
 }
 
 // OnLowerData ...
 func (sr *SessionResolver) OnLowerData(context Context) {
-	if sr.enable {
+	if sr.IsEnabled() {
 		ub := context.GetBuffer()
 		if ub == nil {
 			return
@@ -54,11 +56,12 @@ func (sr *SessionResolver) OnLowerData(context Context) {
 
 		session, err := ub.ReadU32BE()
 		if err != nil {
+			sr.ReportError(context, DataDirectionUp, ErrBadFormat)
 			return
 		}
 
 		context.SetOption("session", int(session))
 	}
 
-	sr.upper.OnLowerData(context)
+	sr.GetUpper().OnLowerData(context)
 }
@@ -5,7 +5,10 @@
 package ustack
 
 import (
-	"fmt"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,12 +18,99 @@ const (
 	StatCounterUplayerMessageTag byte = 0x00
 )
 
-// StatCounter ...
+// StatCounterResVersion is the version of the collection response
+const StatCounterResVersion byte = 1
+
+// StatCounterStats is the statistics of the uplayer messages
+type StatCounterStats struct {
+	TxMessages uint64
+	TxBytes    uint64
+	RxMessages uint64
+	RxBytes    uint64
+	// the data dropped by the processing errors
+	Drops        uint64
+	LastActivity time.Time
+}
+
+// StatCounterSnapshot is the statistics of a stack at Time
+type StatCounterSnapshot struct {
+	Name  string
+	Time  time.Time
+	Total StatCounterStats
+	// by the name of connection
+	Connections map[string]StatCounterStats
+	// by session
+	Sessions map[int]StatCounterStats
+}
+
+// statCounterEntry is the atomic counters of StatCounterStats
+type statCounterEntry struct {
+	txMessages   uint64
+	txBytes      uint64
+	rxMessages   uint64
+	rxBytes      uint64
+	drops        uint64
+	lastActivity int64
+}
+
+// count ...
+func (e *statCounterEntry) count(direction string, size int) {
+	if direction == DataDirectionDown {
+		atomic.AddUint64(&e.txMessages, 1)
+		atomic.AddUint64(&e.txBytes, uint64(size))
+	} else {
+		atomic.AddUint64(&e.rxMessages, 1)
+		atomic.AddUint64(&e.rxBytes, uint64(size))
+	}
+	atomic.StoreInt64(&e.lastActivity, time.Now().UnixNano())
+}
+
+// drop ...
+func (e *statCounterEntry) drop() {
+	atomic.AddUint64(&e.drops, 1)
+}
+
+// stats ...
+func (e *statCounterEntry) stats() StatCounterStats {
+	s := StatCounterStats{
+		TxMessages: atomic.LoadUint64(&e.txMessages),
+		TxBytes:    atomic.LoadUint64(&e.txBytes),
+		RxMessages: atomic.LoadUint64(&e.rxMessages),
+		RxBytes:    atomic.LoadUint64(&e.rxBytes),
+		Drops:      atomic.LoadUint64(&e.drops),
+	}
+	if last := atomic.LoadInt64(&e.lastActivity); last != 0 {
+		s.LastActivity = time.Unix(0, last)
+	}
+	return s
+}
+
+// statCounterState is the per-connection statistics
+type statCounterState struct {
+	statCounterEntry
+	// the last collection response of the peer
+	remote atomic.Value
+}
+
+// StatCounter counts the uplayer messages, their bytes and drops of the
+// stack, of each connection and of each session. The session is taken
+// from the context option "session", so it should be put above the
+// SessionResolver.
+//
+// The peer collects the snapshot if Collect.IntervalInSecond is set, the
+// response is versioned by StatCounterResVersion.
+//
+// Options:
+//
+//	Collect.IntervalInSecond: int, 0 by default, no collection
 type StatCounter struct {
 	ProcBase
 	intervalInSecond int
 	txCounter        uint64
 	rxCounter        uint64
+	total            statCounterEntry
+	sessionsLock     sync.Mutex
+	sessions         map[int]*statCounterEntry
 }
 
 // NewStatCounter ...
@@ -30,7 +120,11 @@ func NewStatCounter() DataProcessor {
 		intervalInSecond: 0,
 		txCounter:        0,
 		rxCounter:        0,
+		sessions:         make(map[int]*statCounterEntry),
 	}
+	sc.SetStateAllocator(func(connection TransportConnection) interface{} {
+		return &statCounterState{}
+	})
 	return sc.ProcBase.SetWhere(sc)
 }
 
@@ -39,10 +133,38 @@ func (hb *StatCounter) GetOverhead() int {
 	return 1
 }
 
+// session returns the entry of the session in context
+func (sc *StatCounter) session(context Context) *statCounterEntry {
+	session, _ := OptionParseInt(context.GetOption("session"), 0)
+
+	sc.sessionsLock.Lock()
+	defer sc.sessionsLock.Unlock()
+
+	entry, ok := sc.sessions[session]
+	if !ok {
+		entry = &statCounterEntry{}
+		sc.sessions[session] = entry
+	}
+	return entry
+}
+
+// count counts the message in all the entries
+func (sc *StatCounter) count(context Context, direction string, size int) {
+	if direction == DataDirectionDown {
+		atomic.AddUint64(&sc.txCounter, 1)
+	} else {
+		atomic.AddUint64(&sc.rxCounter, 1)
+	}
+
+	sc.total.count(direction, size)
+	sc.session(context).count(direction, size)
+	sc.GetState(context.GetConnection()).(*statCounterState).count(direction, size)
+}
+
 // OnUpperData ...
 func (sc *StatCounter) OnUpperData(context Context) {
 	if context.GetConnection().UseReference() {
-		sc.lower.OnUpperData(context)
+		sc.GetLower().OnUpperData(context)
 		return
 	}
 
@@ -51,17 +173,252 @@ func (sc *StatCounter) OnUpperData(context Context) {
 		return
 	}
 
-	if sc.enable {
-		sc.txCounter++
-		// fmt.Println("StatCounter: txCounter:", sc.txCounter)
+	if sc.IsEnabled() {
+		sc.count(context, DataDirectionDown, ub.ReadableLength())
 	}
 
 	ub.WriteHeadByte(StatCounterUplayerMessageTag)
 
-	sc.lower.OnUpperData(context)
+	sc.GetLower().OnUpperData(context)
+}
+
+// GetStats returns the counters of the uplayer messages
+func (sc *StatCounter) GetStats() map[string]interface{} {
+	total := sc.total.stats()
+	return map[string]interface{}{
+		"txCounter": atomic.LoadUint64(&sc.txCounter),
+		"rxCounter": atomic.LoadUint64(&sc.rxCounter),
+		"txBytes":   total.TxBytes,
+		"rxBytes":   total.RxBytes,
+		"drops":     total.Drops,
+	}
+}
+
+// Snapshot returns the statistics of now, the closed connections are not
+// included
+func (sc *StatCounter) Snapshot() *StatCounterSnapshot {
+	s := &StatCounterSnapshot{
+		Time:        time.Now(),
+		Total:       sc.total.stats(),
+		Connections: make(map[string]StatCounterStats),
+		Sessions:    make(map[int]StatCounterStats),
+	}
+
+	if sc.ustack != nil {
+		s.Name = sc.ustack.GetName()
+	}
+
+	sc.RangeStates(func(connection TransportConnection, state interface{}) bool {
+		s.Connections[connection.GetName()] = state.(*statCounterState).stats()
+		return true
+	})
+
+	sc.sessionsLock.Lock()
+	for session, entry := range sc.sessions {
+		s.Sessions[session] = entry.stats()
+	}
+	sc.sessionsLock.Unlock()
+
+	return s
+}
+
+// GetRemoteSnapshot returns the last snapshot collected from the peer of
+// the connection, nil if none
+func (sc *StatCounter) GetRemoteSnapshot(connection TransportConnection) *StatCounterSnapshot {
+	s, _ := sc.GetState(connection).(*statCounterState).remote.Load().(*StatCounterSnapshot)
+	return s
+}
+
+// RegisterMetrics exposes the counters of the uplayer messages
+func (sc *StatCounter) RegisterMetrics(registry *MetricsRegistry) {
+	registry.CounterFunc("ustack_statcounter_messages_total", "The number of uplayer messages counted.",
+		sc.metricsLabels(Labels{"direction": DataDirectionDown}),
+		func() uint64 { return atomic.LoadUint64(&sc.txCounter) })
+	registry.CounterFunc("ustack_statcounter_messages_total", "The number of uplayer messages counted.",
+		sc.metricsLabels(Labels{"direction": DataDirectionUp}),
+		func() uint64 { return atomic.LoadUint64(&sc.rxCounter) })
+}
+
+// UnregisterMetrics ...
+func (sc *StatCounter) UnregisterMetrics(registry *MetricsRegistry) {
+	registry.Unregister("ustack_statcounter_messages_total", sc.metricsLabels(Labels{"direction": DataDirectionDown}))
+	registry.Unregister("ustack_statcounter_messages_total", sc.metricsLabels(Labels{"direction": DataDirectionUp}))
+}
+
+// statCounterU16 appends v in big endian
+func statCounterU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// statCounterU32 appends v in big endian
+func statCounterU32(b []byte, v uint32) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], v)
+	return append(b, p[:]...)
+}
+
+// statCounterU64 appends v in big endian
+func statCounterU64(b []byte, v uint64) []byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], v)
+	return append(b, p[:]...)
+}
+
+// appendStatCounterStats ...
+func appendStatCounterStats(b []byte, s StatCounterStats) []byte {
+	var last int64
+	if !s.LastActivity.IsZero() {
+		last = s.LastActivity.UnixNano()
+	}
+
+	for _, v := range []uint64{s.TxMessages, s.TxBytes, s.RxMessages, s.RxBytes, s.Drops, uint64(last)} {
+		b = statCounterU64(b, v)
+	}
+	return b
+}
+
+// appendStatCounterString appends the string with 2 bytes length
+func appendStatCounterString(b []byte, s string) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	b = statCounterU16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// EncodeStatCounterSnapshot encodes the snapshot in the format of
+// StatCounterResVersion, all integers are big endian:
+//
+//	version: 1 byte
+//	time: 8 bytes, unix nano
+//	name: 2 bytes length and the name of stack
+//	total: stats
+//	connections: 2 bytes count, each is the name as above and stats
+//	sessions: 2 bytes count, each is 4 bytes session and stats
+//
+// stats is 8 bytes each of TxMessages, TxBytes, RxMessages, RxBytes,
+// Drops and LastActivity in unix nano, 0 if never active. The
+// connections and sessions are sorted, no more than 65535 of each.
+func EncodeStatCounterSnapshot(s *StatCounterSnapshot) []byte {
+	b := []byte{StatCounterResVersion}
+	b = statCounterU64(b, uint64(s.Time.UnixNano()))
+	b = appendStatCounterString(b, s.Name)
+	b = appendStatCounterStats(b, s.Total)
+
+	names := make([]string, 0, len(s.Connections))
+	for name := range s.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0xffff {
+		names = names[:0xffff]
+	}
+
+	b = statCounterU16(b, uint16(len(names)))
+	for _, name := range names {
+		b = appendStatCounterString(b, name)
+		b = appendStatCounterStats(b, s.Connections[name])
+	}
+
+	sessions := make([]int, 0, len(s.Sessions))
+	for session := range s.Sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Ints(sessions)
+	if len(sessions) > 0xffff {
+		sessions = sessions[:0xffff]
+	}
+
+	b = statCounterU16(b, uint16(len(sessions)))
+	for _, session := range sessions {
+		b = statCounterU32(b, uint32(session))
+		b = appendStatCounterStats(b, s.Sessions[session])
+	}
+
+	return b
+}
+
+// statCounterReader reads the fields of the response
+type statCounterReader struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes
+func (r *statCounterReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrBadFormat
+		return make([]byte, n)
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+// u16 ...
+func (r *statCounterReader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+// u64 ...
+func (r *statCounterReader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+// string ...
+func (r *statCounterReader) string() string {
+	return string(r.next(int(r.u16())))
 }
 
-// request, just for test
+// stats ...
+func (r *statCounterReader) stats() StatCounterStats {
+	s := StatCounterStats{
+		TxMessages: r.u64(),
+		TxBytes:    r.u64(),
+		RxMessages: r.u64(),
+		RxBytes:    r.u64(),
+		Drops:      r.u64(),
+	}
+	if last := int64(r.u64()); last != 0 {
+		s.LastActivity = time.Unix(0, last)
+	}
+	return s
+}
+
+// DecodeStatCounterSnapshot decodes the response encoded by
+// EncodeStatCounterSnapshot, ErrBadFormat if the version is unknown
+func DecodeStatCounterSnapshot(b []byte) (*StatCounterSnapshot, error) {
+	r := &statCounterReader{b: b}
+
+	if version := r.next(1)[0]; r.err == nil && version != StatCounterResVersion {
+		return nil, ErrBadFormat
+	}
+
+	s := &StatCounterSnapshot{
+		Time:        time.Unix(0, int64(r.u64())),
+		Name:        r.string(),
+		Total:       r.stats(),
+		Connections: make(map[string]StatCounterStats),
+		Sessions:    make(map[int]StatCounterStats),
+	}
+
+	for n := int(r.u16()); n > 0 && r.err == nil; n-- {
+		name := r.string()
+		s.Connections[name] = r.stats()
+	}
+
+	for n := int(r.u16()); n > 0 && r.err == nil; n-- {
+		session := int(int32(binary.BigEndian.Uint32(r.next(4))))
+		s.Sessions[session] = r.stats()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s, nil
+}
+
+// request asks the peer for its snapshot
 func (sc *StatCounter) request(connection TransportConnection) {
 	ub := UBufAllocWithHeadReserved(
 		sc.ustack.GetMTU(),
@@ -69,46 +426,67 @@ func (sc *StatCounter) request(connection TransportConnection) {
 
 	ub.WriteByte(StatCounterSelfMessageReqTag)
 
-	sc.lower.OnUpperData(
+	sc.GetLower().OnUpperData(
 		NewUStackContext().
 			SetConnection(connection).
 			SetBuffer(ub))
 }
 
-// response, just for test
+// response sends the snapshot back
 func (sc *StatCounter) response(context Context) {
-	ub := UBufAllocWithHeadReserved(
-		sc.ustack.GetMTU(),
-		sc.ustack.GetOverhead())
-
-	ub.WriteHeadByte(StatCounterSelfMessageResTag)
+	data := EncodeStatCounterSnapshot(sc.Snapshot())
 
-	ub.WriteU64BE(sc.txCounter)
-	ub.WriteU64BE(sc.rxCounter)
+	ub := allocCodecBuffer(sc.ustack, len(data)+1)
 
-	ub.Write([]byte(sc.ustack.GetName()))
+	ub.WriteByte(StatCounterSelfMessageResTag)
+	ub.Write(data)
 
 	context.SetBuffer(ub)
-	sc.lower.OnUpperData(context)
+	sc.GetLower().OnUpperData(context)
 }
 
-// show, just for test
+// show keeps the snapshot of peer and logs the busiest connection
 func (sc *StatCounter) show(context Context) {
 	ub := context.GetBuffer()
 
-	txCounter, _ := ub.ReadU64BE()
-	rxCounter, _ := ub.ReadU64BE()
+	data := make([]byte, ub.ReadableLength())
+	ub.Read(data)
 
-	name := make([]byte, 128)
-	ub.Read(name)
+	s, err := DecodeStatCounterSnapshot(data)
+	if err != nil {
+		sc.ReportError(context, DataDirectionUp, err)
+		return
+	}
 
-	fmt.Println("\n######## UStack:", string(name), "txCounter:", txCounter, "rxCounter", rxCounter)
+	sc.GetState(context.GetConnection()).(*statCounterState).remote.Store(s)
+
+	keyvals := []interface{}{
+		"peer", s.Name,
+		"txCounter", s.Total.TxMessages,
+		"rxCounter", s.Total.RxMessages,
+		"txBytes", s.Total.TxBytes,
+		"rxBytes", s.Total.RxBytes,
+		"drops", s.Total.Drops,
+		"connections", len(s.Connections),
+	}
+
+	busiest, max := "", uint64(0)
+	for name, stats := range s.Connections {
+		if stats.RxBytes > max || busiest == "" {
+			busiest, max = name, stats.RxBytes
+		}
+	}
+	if busiest != "" {
+		keyvals = append(keyvals, "busiest", busiest, "busiestRxBytes", max)
+	}
+
+	sc.GetLogger().Info("collected", keyvals...)
 }
 
 // OnLowerData ...
 func (sc *StatCounter) OnLowerData(context Context) {
 	if context.GetConnection().UseReference() {
-		sc.upper.OnLowerData(context)
+		sc.GetUpper().OnLowerData(context)
 		return
 	}
 
@@ -122,28 +500,32 @@ func (sc *StatCounter) OnLowerData(context Context) {
 		return
 	}
 
-	if sc.enable {
+	if sc.IsEnabled() {
 		if tag == StatCounterSelfMessageReqTag {
-			// fmt.Printf("StatCounter: collect request received on connection: %s\n",
-			// 	context.GetConnection().GetName())
 			sc.response(context)
 			return
 		} else if tag == StatCounterSelfMessageResTag {
-			// fmt.Printf("StatCounter: collect response received on connection: %s\n",
-			// 	context.GetConnection().GetName())
 			sc.show(context)
 			return
 		} else {
-			sc.rxCounter++
-			// fmt.Println("StatCounter: rxCounter:", sc.rxCounter)
+			sc.count(context, DataDirectionUp, ub.ReadableLength())
 		}
 	}
 
-	sc.upper.OnLowerData(context)
+	sc.GetUpper().OnLowerData(context)
 }
 
 // OnEvent ...
 func (sc *StatCounter) OnEvent(event Event) {
+	if perr, ok := event.Data.(*ProcessingError); ok && perr.Context != nil {
+		if connection := perr.Context.GetConnection(); connection != nil {
+			sc.total.drop()
+			sc.session(perr.Context).drop()
+			sc.GetState(connection).(*statCounterState).drop()
+		}
+		return
+	}
+
 	if event.Type == UStackEventNewConnection {
 		interval := sc.intervalInSecond
 
@@ -153,27 +535,29 @@ func (sc *StatCounter) OnEvent(event Event) {
 
 		connection := event.Data.(TransportConnection)
 
-		go func() {
+		sc.routines.spawn(func() {
 			for {
 				if connection.Closed() {
-					fmt.Printf("StatCounter: connection %s is closed\n", connection.GetName())
+					sc.GetLogger().Debug("connection is closed", "connection", connection.GetName())
 					return
 				}
 				sc.request(connection)
-				// fmt.Printf("StatCounter: send collect request on connection: %s\n",
-				// 	connection.GetName())
-				time.Sleep(time.Second * time.Duration(interval))
+				if !sc.routines.sleep(time.Second * time.Duration(interval)) {
+					return
+				}
 			}
-		}()
+		})
 	}
 }
 
 // Run ...
 func (sc *StatCounter) Run() DataProcessor {
+	sc.routines.restart()
+
 	interval, exists := OptionParseInt(sc.GetOption("Collect.IntervalInSecond"), sc.intervalInSecond)
 	sc.intervalInSecond = interval
 	if exists {
-		fmt.Println("StatCounter: option Collect.IntervalInSecond:", sc.intervalInSecond)
+		sc.GetLogger().Info("option", "Collect.IntervalInSecond", sc.intervalInSecond)
 	}
 	return sc
 }
@@ -0,0 +1,157 @@
+package ustack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sendStatCounter(dp DataProcessor, c TransportConnection, session int, payload string) {
+	ub := UBufAllocWithHeadReserved(len(payload)+1, 1)
+	ub.Write([]byte(payload))
+	dp.OnUpperData(NewUStackContext().SetConnection(c).SetBuffer(ub).SetOption("session", session))
+}
+
+func TestStatCounterSnapshot(t *testing.T) {
+	collector := newBufferCollector()
+	upper := newFrameCollector()
+
+	sc := NewStatCounter().SetUStack(NewUStack().SetName("Stats"))
+	sc.SetLower(collector)
+	sc.SetUpper(upper)
+	sc.Run()
+
+	c1 := &dummyConnection{name: "c1"}
+	c2 := &dummyConnection{name: "c2"}
+
+	sendStatCounter(sc, c1, 0, "hello")
+	sendStatCounter(sc, c1, 1, "world!")
+	sendStatCounter(sc, c2, 1, "hi")
+
+	for _, ub := range collector.buffers {
+		sc.OnLowerData(NewUStackContext().SetConnection(c2).SetBuffer(ub).SetOption("session", 2))
+	}
+
+	sc.OnEvent(Event{
+		Type: UStackEventProcessingError,
+		Data: &ProcessingError{Context: NewUStackContext().SetConnection(c1).SetOption("session", 1)},
+	})
+
+	s := sc.(*StatCounter).Snapshot()
+	if s.Name != "Stats" {
+		t.Errorf("expect name Stats, got %s", s.Name)
+	}
+
+	check := func(what string, got StatCounterStats, tx, txBytes, rx, rxBytes, drops uint64) {
+		t.Helper()
+		want := StatCounterStats{tx, txBytes, rx, rxBytes, drops, got.LastActivity}
+		if got != want {
+			t.Errorf("%s: expect %+v, got %+v", what, want, got)
+		}
+		if tx+rx > 0 && got.LastActivity.IsZero() {
+			t.Errorf("%s: expect last activity", what)
+		}
+	}
+
+	check("total", s.Total, 3, 13, 3, 13, 1)
+	check("c1", s.Connections["c1"], 2, 11, 0, 0, 1)
+	check("c2", s.Connections["c2"], 1, 2, 3, 13, 0)
+	check("session 0", s.Sessions[0], 1, 5, 0, 0, 0)
+	check("session 1", s.Sessions[1], 2, 8, 0, 0, 1)
+	check("session 2", s.Sessions[2], 0, 0, 3, 13, 0)
+
+	if len(upper.frames[c2]) != 3 || upper.frames[c2][1] != "world!" {
+		t.Errorf("unexpected upper frames %v", upper.frames[c2])
+	}
+
+	decoded, err := DecodeStatCounterSnapshot(EncodeStatCounterSnapshot(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Time.Equal(s.Time) {
+		t.Errorf("expect time %v, got %v", s.Time, decoded.Time)
+	}
+	decoded.Time = s.Time
+	if !reflect.DeepEqual(normalizeStatCounterSnapshot(decoded), normalizeStatCounterSnapshot(s)) {
+		t.Errorf("expect %+v, got %+v", s, decoded)
+	}
+
+	if _, err := DecodeStatCounterSnapshot([]byte{StatCounterResVersion + 1}); err != ErrBadFormat {
+		t.Errorf("expect ErrBadFormat for unknown version, got %v", err)
+	}
+	if _, err := DecodeStatCounterSnapshot(EncodeStatCounterSnapshot(s)[:20]); err != ErrBadFormat {
+		t.Errorf("expect ErrBadFormat for truncated response, got %v", err)
+	}
+}
+
+// normalizeStatCounterSnapshot drops the monotonic clock readings
+func normalizeStatCounterSnapshot(s *StatCounterSnapshot) *StatCounterSnapshot {
+	round := func(stats StatCounterStats) StatCounterStats {
+		stats.LastActivity = stats.LastActivity.Round(0)
+		return stats
+	}
+
+	n := *s
+	n.Time = n.Time.Round(0)
+	n.Total = round(n.Total)
+	n.Connections = make(map[string]StatCounterStats)
+	for name, stats := range s.Connections {
+		n.Connections[name] = round(stats)
+	}
+	n.Sessions = make(map[int]StatCounterStats)
+	for session, stats := range s.Sessions {
+		n.Sessions[session] = round(stats)
+	}
+	return &n
+}
+
+func TestStatCounterCollect(t *testing.T) {
+	serverLower := newBufferCollector()
+	server := NewStatCounter().SetUStack(NewUStack().SetName("Server"))
+	server.SetLower(serverLower)
+	server.SetUpper(newFrameCollector())
+	server.Run()
+
+	clientLower := newBufferCollector()
+	client := NewStatCounter().SetUStack(NewUStack().SetName("Client"))
+	client.SetLower(clientLower)
+	client.Run()
+
+	c := &dummyConnection{name: "c"}
+	peer := &dummyConnection{name: "peer"}
+	for i := 0; i < 4; i++ {
+		sendStatCounter(server, peer, 0, "data")
+	}
+
+	client.(*StatCounter).request(c)
+	if len(clientLower.buffers) != 1 {
+		t.Fatalf("expect 1 request, got %d", len(clientLower.buffers))
+	}
+
+	server.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(clientLower.buffers[0]))
+	if len(serverLower.buffers) != 5 {
+		t.Fatalf("expect a response, got %d buffers", len(serverLower.buffers))
+	}
+
+	if client.(*StatCounter).GetRemoteSnapshot(c) != nil {
+		t.Errorf("expect no remote snapshot before response")
+	}
+
+	client.OnLowerData(NewUStackContext().SetConnection(c).SetBuffer(serverLower.buffers[4]))
+
+	remote := client.(*StatCounter).GetRemoteSnapshot(c)
+	if remote == nil {
+		t.Fatal("expect remote snapshot")
+	}
+	if remote.Name != "Server" || remote.Total.TxMessages != 4 || remote.Connections["peer"].TxBytes != 16 {
+		t.Errorf("unexpected remote snapshot %+v", remote)
+	}
+	if time.Since(remote.Time) > time.Minute {
+		t.Errorf("unexpected remote time %v", remote.Time)
+	}
+
+	// the self messages are not counted
+	if stats := client.(*StatCounter).Snapshot().Total; stats.TxMessages != 0 || stats.RxMessages != 0 {
+		t.Errorf("expect self messages not counted, got %+v", stats)
+	}
+}
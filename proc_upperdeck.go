@@ -8,6 +8,20 @@ import (
 	"sync"
 )
 
+// the signals for endpoint routine
+const (
+	// sends the pending data of the endpoint then exits
+	upperDeckDrainEndpoint bool = false
+	// exits immediately
+	upperDeckStopEndpoint bool = true
+)
+
+// the options of context passed to the endpoints, they are set by Correlator,
+// Broker and Multiplexer
+var upperDeckEndPointDataOptions = []string{
+	"rpcKind", "rpcID", "rpcError", "pubsubKind", "topic", "stream",
+}
+
 // UpperDeck manages endpoints
 type UpperDeck struct {
 	ProcBase
@@ -36,35 +50,63 @@ func (ud *UpperDeck) acceptEndpoint(ep EndPoint) {
 	ud.Lock()
 	defer ud.Unlock()
 
-	ud.endpoints[ep] = make(chan bool, 1)
+	signal := make(chan bool, 1)
+	ud.endpoints[ep] = signal
 
-	session := ep.GetSession()
 	txchan := ep.GetTxChannel()
-	lower := ud.lower
 
 	// create routinue for each endpoint
 	// read data from endpoint and pass it to lower
-	go func() {
+	ud.routines.spawn(func() {
 		for {
 			select {
-			case stop := <-ud.endpoints[ep]:
-				if stop {
-					return
+			case sig := <-signal:
+				if sig == upperDeckDrainEndpoint {
+					ud.drainEndpoint(ep)
 				}
+				return
 			case epd := <-txchan:
-				destinationSession := session
-				if epd.HasDestinationSession() {
-					destinationSession = epd.GetDestinationSession()
-				}
-
-				lower.OnUpperData(
-					NewUStackContext().
-						SetConnection(epd.GetConnection()).
-						SetMessage(epd.GetData()).
-						SetOption("session", destinationSession))
+				ud.sendEndpointData(ep, epd)
 			}
 		}
-	}()
+	})
+}
+
+// sendEndpointData passes the endpoint data to lower
+func (ud *UpperDeck) sendEndpointData(ep EndPoint, epd EndPointData) {
+	destinationSession := ep.GetSession()
+	if epd.HasDestinationSession() {
+		destinationSession = epd.GetDestinationSession()
+	}
+
+	context := NewUStackContext()
+
+	if data, ok := epd.(*DefaultEndPointData); ok {
+		for name, value := range data.options {
+			context.SetOption(name, value)
+		}
+	}
+
+	ud.GetLower().OnUpperData(
+		context.
+			SetConnection(epd.GetConnection()).
+			SetMessage(epd.GetData()).
+			SetOption("session", destinationSession).
+			SetOption("endpoint", ep).
+			SetOption("endpointData", epd))
+}
+
+// drainEndpoint sends all the pending data of the endpoint
+func (ud *UpperDeck) drainEndpoint(ep EndPoint) {
+	txchan := ep.GetTxChannel()
+	for {
+		select {
+		case epd := <-txchan:
+			ud.sendEndpointData(ep, epd)
+		default:
+			return
+		}
+	}
 }
 
 // deleteTransport ...
@@ -74,7 +116,7 @@ func (ud *UpperDeck) deleteEndpoint(ep EndPoint) {
 
 	ch, ok := ud.endpoints[ep]
 	if ok {
-		ch <- true
+		ch <- upperDeckStopEndpoint
 		close(ch)
 		delete(ud.endpoints, ep)
 	}
@@ -113,9 +155,25 @@ func (ud *UpperDeck) OnLowerData(context Context) {
 
 	ep := ud.findEndPoint(session)
 	if ep != nil {
-		ep.GetRxChannel() <- NewEndPointData().
+		epd := NewEndPointData().
 			SetConnection(context.GetConnection()).
 			SetData(message)
+
+		// the options set by the data processors for the endpoints,
+		// e.g. Correlator, the internal ones of the stack are not passed
+		if o, ok := epd.(EndPointDataOptions); ok {
+			for _, name := range upperDeckEndPointDataOptions {
+				if value := context.GetOption(name); value != nil {
+					o.SetOption(name, value)
+				}
+			}
+		}
+
+		// do not block forever on an endpoint nobody reads once stopped
+		select {
+		case ep.GetRxChannel() <- epd:
+		case <-ud.routines.quitting():
+		}
 	}
 }
 
@@ -135,9 +193,27 @@ func (ud *UpperDeck) OnEvent(event Event) {
 
 // Run ...
 func (ud *UpperDeck) Run() DataProcessor {
+	ud.routines.restart()
+
 	for _, ep := range ud.ustack.GetEndPoint() {
 		ud.acceptEndpoint(ep)
 	}
 
 	return ud
 }
+
+// Stop flushes the pending data of all endpoints to lower and waits for
+// the endpoint routines to exit
+func (ud *UpperDeck) Stop() DataProcessor {
+	ud.Lock()
+	for ep, ch := range ud.endpoints {
+		ch <- upperDeckDrainEndpoint
+		close(ch)
+		delete(ud.endpoints, ep)
+	}
+	ud.Unlock()
+
+	ud.routines.wait()
+
+	return ud.ProcBase.Stop()
+}
@@ -0,0 +1,39 @@
+package ustack
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpperDeckEndPointDataOptions(t *testing.T) {
+	ep := NewEndPoint("UpperDeck:EP-0", 0)
+
+	stack := NewUStack().
+		SetName("UpperDeck").
+		AddEndPoint(ep).
+		Run()
+	defer stack.Stop(context.Background())
+
+	c := &dummyConnection{name: "c"}
+	stack.(*DefaultUStack).upperDeck.OnLowerData(NewUStackContext().
+		SetConnection(c).
+		SetMessage("hello").
+		SetOption("rpcID", uint64(7)).
+		SetOption("endpoint", ep).
+		SetOption("endpointData", NewEndPointData()))
+
+	select {
+	case epd := <-ep.GetRxChannel():
+		if id, _ := endPointDataOption(epd, "rpcID").(uint64); id != 7 || epd.GetData() != "hello" {
+			t.Fatal("Unexpected data:", id, epd.GetData())
+		}
+		for _, name := range []string{"endpoint", "endpointData", "session"} {
+			if value := endPointDataOption(epd, name); value != nil {
+				t.Errorf("Unexpected option %s: %v", name, value)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No data received")
+	}
+}
@@ -4,6 +4,50 @@
 
 package ustack
 
+import "errors"
+
+// the directions of the data passing through the data processors
+const (
+	// DataDirectionDown is from endpoint to transport
+	DataDirectionDown string = "down"
+	// DataDirectionUp is from transport to endpoint
+	DataDirectionUp string = "up"
+)
+
+// the common causes of ProcessingError
+var (
+	ErrNoConnection = errors.New("no connection")
+	ErrNoMessage    = errors.New("no message")
+	ErrNoBuffer     = errors.New("no buffer")
+	ErrBadFormat    = errors.New("bad format")
+	ErrQueueFull    = errors.New("queue is full")
+)
+
+// ProcessingError describes why a data processor dropped the data
+type ProcessingError struct {
+	// the name of data processor
+	Processor string
+	// DataDirectionDown or DataDirectionUp
+	Direction string
+	// the data being processed
+	Context Context
+	// for DataDirectionDown, the endpoint and the data it sent, they are
+	// nil if the data was not sent by an endpoint
+	EndPoint     EndPoint
+	EndPointData EndPointData
+	Err          error
+}
+
+// Error ...
+func (e *ProcessingError) Error() string {
+	return e.Processor + " (" + e.Direction + "): " + e.Err.Error()
+}
+
+// Unwrap ...
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
+
 // DataProcessor ...
 type DataProcessor interface {
 	SetName(name string) DataProcessor
@@ -17,11 +61,17 @@ type DataProcessor interface {
 	GetOption(name string) interface{}
 
 	SetEnable(enable bool) DataProcessor
+	IsEnabled() bool
 
 	SetUStack(ustack UStack) DataProcessor
 
+	SetLogger(logger Logger) DataProcessor
+	GetLogger() Logger
+
 	SetUpper(upper DataProcessor) DataProcessor
 	SetLower(lower DataProcessor) DataProcessor
+	GetUpper() DataProcessor
+	GetLower() DataProcessor
 
 	OnUpperData(context Context)
 	OnLowerData(context Context)
@@ -29,4 +79,18 @@ type DataProcessor interface {
 	OnEvent(event Event)
 
 	Run() DataProcessor
+	Stop() DataProcessor
+}
+
+// StatsProvider is implemented by the data processors having statistics
+type StatsProvider interface {
+	GetStats() map[string]interface{}
+}
+
+// connectionStateHolder is implemented by data processors embedding
+// ProcBase, UStack uses it to manage the per-connection states
+type connectionStateHolder interface {
+	allocState(connection TransportConnection)
+	releaseState(connection TransportConnection)
+	releaseClosedStates()
 }
@@ -0,0 +1,198 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectDefaultMaxBackoff is the max wait between the retries by default
+const ReconnectDefaultMaxBackoff = 30 * time.Second
+
+// ReconnectPolicy controls how a client transport dials the server.
+//
+// The n-th retry waits InitialBackoff * Multiplier^n randomly shifted by
+// Jitter (0.2 means +/-20%), and never more than MaxBackoff.
+// If Enable is true, the server is redialed after the connection is
+// closed, the new connection is published with UStackEventNewConnection
+// and UStackEventReconnected.
+//
+// Options of client transport:
+//
+//	MaxRetryCount: int, 180 by default, negative means unlimited
+//	RetryIntervalInSecond: int, 1 by default, InitialBackoff in second
+//	Reconnect: bool, false by default
+//	Reconnect.InitialBackoff: time.Duration, overrides RetryIntervalInSecond
+//	Reconnect.MaxBackoff: time.Duration, 30s or InitialBackoff if longer by default
+//	Reconnect.Multiplier: float64, 1 by default
+//	Reconnect.Jitter: float64, 0 by default, clamped to [0,1]
+type ReconnectPolicy struct {
+	Enable         bool
+	MaxRetryCount  int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// reconnectableConnection is a connection of client transport
+type reconnectableConnection interface {
+	TransportConnection
+	IsReconnected() bool
+	setReconnected()
+	closing() <-chan struct{}
+}
+
+// parseReconnectPolicy reads the policy from the options of transport
+func parseReconnectPolicy(tp Transport, logger Logger) ReconnectPolicy {
+	p := ReconnectPolicy{}
+	var exists bool
+
+	p.MaxRetryCount, exists = OptionParseInt(tp.GetOption("MaxRetryCount"), 180)
+	if exists {
+		logger.Info("option", "MaxRetryCount", p.MaxRetryCount)
+	}
+
+	interval, exists := OptionParseInt(tp.GetOption("RetryIntervalInSecond"), 1)
+	if exists {
+		logger.Info("option", "RetryIntervalInSecond", interval)
+	}
+
+	p.Enable, exists = OptionParseBool(tp.GetOption("Reconnect"), false)
+	if exists {
+		logger.Info("option", "Reconnect", p.Enable)
+	}
+
+	p.InitialBackoff, exists = OptionParseDuration(tp.GetOption("Reconnect.InitialBackoff"),
+		time.Second*time.Duration(interval))
+	if exists {
+		logger.Info("option", "Reconnect.InitialBackoff", p.InitialBackoff)
+	}
+
+	maxBackoff := ReconnectDefaultMaxBackoff
+	if p.InitialBackoff > maxBackoff {
+		maxBackoff = p.InitialBackoff
+	}
+
+	p.MaxBackoff, exists = OptionParseDuration(tp.GetOption("Reconnect.MaxBackoff"), maxBackoff)
+	if p.MaxBackoff <= 0 {
+		logger.Error("bad max backoff, use default", "Reconnect.MaxBackoff", p.MaxBackoff, "default", maxBackoff)
+		p.MaxBackoff = maxBackoff
+	} else if exists {
+		logger.Info("option", "Reconnect.MaxBackoff", p.MaxBackoff)
+	}
+
+	p.Multiplier, exists = OptionParseFloat(tp.GetOption("Reconnect.Multiplier"), 1)
+	if exists {
+		logger.Info("option", "Reconnect.Multiplier", p.Multiplier)
+	}
+
+	p.Jitter, exists = OptionParseFloat(tp.GetOption("Reconnect.Jitter"), 0)
+	// NaN is clamped to 0 as well
+	if !(p.Jitter >= 0 && p.Jitter <= 1) {
+		jitter := 0.0
+		if p.Jitter > 1 {
+			jitter = 1.0
+		}
+		logger.Error("bad jitter, clamp to [0,1]", "Reconnect.Jitter", p.Jitter, "clamped", jitter)
+		p.Jitter = jitter
+	} else if exists {
+		logger.Info("option", "Reconnect.Jitter", p.Jitter)
+	}
+
+	return p
+}
+
+// Backoff returns how long to wait before the n-th retry, n starts at 0.
+// It is never more than MaxBackoff, ReconnectDefaultMaxBackoff if not set.
+func (p ReconnectPolicy) Backoff(n int) time.Duration {
+	maxBackoff := float64(p.MaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = float64(ReconnectDefaultMaxBackoff)
+	}
+
+	backoff := float64(p.InitialBackoff)
+	if p.Multiplier > 1 {
+		backoff *= math.Pow(p.Multiplier, float64(n))
+	}
+
+	if p.Jitter > 0 {
+		backoff = math.Min(backoff, maxBackoff)
+		backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(math.Min(backoff, maxBackoff))
+}
+
+// dial tries to connect until success, returns nil if it gives up or
+// quit is closed
+func (p ReconnectPolicy) dial(
+	quit <-chan struct{},
+	dial func() (reconnectableConnection, error),
+	logger Logger) reconnectableConnection {
+
+	for i := 0; p.MaxRetryCount < 0 || i < p.MaxRetryCount; i++ {
+		connection, err := dial()
+		if err == nil {
+			return connection
+		}
+
+		logger.Warn("dial failed", "error", err, "retry", i)
+
+		select {
+		case <-quit:
+			return nil
+		case <-time.After(p.Backoff(i)):
+		}
+	}
+
+	logger.Error("timeout to connect server")
+
+	return nil
+}
+
+// keepConnected dials the server and passes the connection to deliver,
+// the server is redialed after the connection is closed if the policy
+// enables. returns false if it gives up
+func (p ReconnectPolicy) keepConnected(
+	quit <-chan struct{},
+	dial func() (reconnectableConnection, error),
+	deliver func(TransportConnection) bool,
+	logger Logger) bool {
+
+	reconnected := false
+
+	for {
+		connection := p.dial(quit, dial, logger)
+		if connection == nil {
+			select {
+			case <-quit:
+				return true
+			default:
+				return false
+			}
+		}
+
+		if reconnected {
+			connection.setReconnected()
+		}
+
+		if !deliver(connection) || !p.Enable {
+			return true
+		}
+
+		select {
+		case <-quit:
+			return true
+		case <-connection.closing():
+		}
+
+		logger.Info("connection is closed, reconnect", "connection", connection.GetName())
+
+		reconnected = true
+	}
+}
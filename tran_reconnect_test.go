@@ -0,0 +1,73 @@
+package ustack
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   ReconnectPolicy
+		n        int
+		expected time.Duration
+	}{
+		{"Initial", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2}, 0, time.Second},
+		{"Multiplied", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2}, 3, 8 * time.Second},
+		{"Capped", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}, 3, 5 * time.Second},
+		{"Overflow", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}, 10000, 5 * time.Second},
+		{"CappedInitial", ReconnectPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Second}, 0, time.Second},
+		{"DefaultCap", ReconnectPolicy{InitialBackoff: time.Second, Multiplier: 2}, 100, ReconnectDefaultMaxBackoff},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if backoff := tc.policy.Backoff(tc.n); backoff != tc.expected {
+				t.Errorf("expect %v, got %v", tc.expected, backoff)
+			}
+		})
+	}
+
+	// the jitter never exceeds the cap
+	p := ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		backoff := p.Backoff(i % 5)
+		if backoff < time.Second/2 || backoff > p.MaxBackoff {
+			t.Fatalf("unexpected backoff %v of retry %d", backoff, i%5)
+		}
+	}
+}
+
+func TestReconnectPolicyOptions(t *testing.T) {
+	tp := NewTCPTransport("Reconnect")
+	tp.SetOption("Reconnect.Multiplier", 2)
+
+	p := parseReconnectPolicy(tp, NewSilentLogger())
+	if p.InitialBackoff != time.Second || p.MaxBackoff != ReconnectDefaultMaxBackoff {
+		t.Errorf("unexpected default backoff %v, max %v", p.InitialBackoff, p.MaxBackoff)
+	}
+
+	// the default cap is not less than the initial backoff
+	tp.SetOption("RetryIntervalInSecond", 60)
+	if p = parseReconnectPolicy(tp, NewSilentLogger()); p.MaxBackoff != time.Minute {
+		t.Errorf("expect max backoff %v, got %v", time.Minute, p.MaxBackoff)
+	}
+
+	tp.SetOption("Reconnect.MaxBackoff", "-1s")
+	if p = parseReconnectPolicy(tp, NewSilentLogger()); p.MaxBackoff != time.Minute {
+		t.Errorf("expect bad max backoff ignored, got %v", p.MaxBackoff)
+	}
+
+	tp.SetOption("Reconnect.MaxBackoff", "10s")
+	if p = parseReconnectPolicy(tp, NewSilentLogger()); p.MaxBackoff != 10*time.Second {
+		t.Errorf("expect max backoff %v, got %v", 10*time.Second, p.MaxBackoff)
+	}
+
+	for jitter, clamped := range map[float64]float64{-0.5: 0, 0.3: 0.3, 2: 1, math.NaN(): 0} {
+		tp.SetOption("Reconnect.Jitter", jitter)
+		if p = parseReconnectPolicy(tp, NewSilentLogger()); p.Jitter != clamped {
+			t.Errorf("expect jitter %v clamped to %v, got %v", jitter, clamped, p.Jitter)
+		}
+	}
+}
@@ -6,7 +6,6 @@ package ustack
 
 import (
 	"errors"
-	"fmt"
 	"sync"
 )
 
@@ -60,8 +59,10 @@ func deleteReferenceChannel(smc *referenceChannel) {
 type ReferenceTransportConnection struct {
 	name      string
 	forServer bool
-	closed    bool
 	channel   *referenceChannel
+	done      chan struct{}
+	once      sync.Once
+	logger    Logger
 }
 
 // NewReferenceTransportConnection ...
@@ -73,8 +74,8 @@ func NewReferenceTransportConnection(
 	return &ReferenceTransportConnection{
 		name:      name,
 		forServer: forServer,
-		closed:    false,
 		channel:   channel,
+		done:      make(chan struct{}),
 	}
 }
 
@@ -100,26 +101,28 @@ func (c *ReferenceTransportConnection) UseReference() bool {
 
 // GetReference ...
 func (c *ReferenceTransportConnection) GetReference() (p interface{}, err error) {
-	if c.closed {
-		fmt.Println("GetReference failed as connection is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("get reference on closed connection")
 		return nil, errors.New("SetReference: connection is closed")
 	}
 
-	var data interface{}
-
+	rx := c.channel.serverTxClientRx
 	if c.forServer {
-		data = <-c.channel.serverRxClientTx
-	} else {
-		data = <-c.channel.serverTxClientRx
+		rx = c.channel.serverRxClientTx
 	}
 
-	return data, nil
+	select {
+	case data := <-rx:
+		return data, nil
+	case <-c.done:
+		return nil, errors.New("GetReference: connection is closed")
+	}
 }
 
 // SetReference ...
 func (c *ReferenceTransportConnection) SetReference(p interface{}) error {
-	if c.closed {
-		fmt.Println("SetReference failed as connection is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("set reference on closed connection")
 		return errors.New("SetReference: connection is closed")
 	}
 
@@ -127,23 +130,32 @@ func (c *ReferenceTransportConnection) SetReference(p interface{}) error {
 		return errors.New("SetReference: null input")
 	}
 
+	tx := c.channel.serverRxClientTx
 	if c.forServer {
-		c.channel.serverTxClientRx <- p
-	} else {
-		c.channel.serverRxClientTx <- p
+		tx = c.channel.serverTxClientRx
 	}
 
-	return nil
+	select {
+	case tx <- p:
+		return nil
+	case <-c.done:
+		return errors.New("SetReference: connection is closed")
+	}
 }
 
 // Close ...
 func (c *ReferenceTransportConnection) Close() {
-	c.closed = true
+	c.once.Do(func() { close(c.done) })
 }
 
 // Closed ...
 func (c *ReferenceTransportConnection) Closed() bool {
-	return c.closed
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // ReferenceTransport ...
@@ -157,6 +169,7 @@ type ReferenceTransport struct {
 	connection TransportConnection
 	next       chan TransportConnection
 	queueSize  int
+	logger     *loggerValue
 }
 
 // NewReferenceTransport ...
@@ -169,6 +182,7 @@ func NewReferenceTransport(name string) Transport {
 		connection: nil,
 		next:       make(chan TransportConnection, 1),
 		queueSize:  512,
+		logger:     newLoggerValue(),
 	}
 }
 
@@ -177,7 +191,7 @@ func (sm *ReferenceTransport) parseOptions() {
 	size, exists := OptionParseInt(sm.GetOption("MaxQueueSize"), 512)
 	sm.queueSize = size
 	if exists {
-		fmt.Println("ReferenceTransport: option MaxQueueSize:", sm.queueSize)
+		sm.logger.get().Info("option", "MaxQueueSize", sm.queueSize)
 	}
 }
 
@@ -217,11 +231,23 @@ func (sm *ReferenceTransport) GetAddress() string {
 	return sm.address
 }
 
-// NextConnection ...
+// SetLogger ...
+func (sm *ReferenceTransport) SetLogger(logger Logger) Transport {
+	sm.logger.set(loggerOrSilent(logger).With("transport", sm.name))
+	return sm
+}
+
+// NextConnection returns the connection, or nil once the transport
+// is stopped
 func (sm *ReferenceTransport) NextConnection() TransportConnection {
-	next := <-sm.next
+	next, ok := <-sm.next
+	if !ok {
+		return nil
+	}
+	sm.Lock()
 	sm.connection = next
-	return sm.connection
+	sm.Unlock()
+	return next
 }
 
 // Two Transports(Client side and Server side) should use the same
@@ -253,7 +279,11 @@ func (sm *ReferenceTransport) Run() Transport {
 
 	ch.refCount++
 
-	sm.next <- NewReferenceTransportConnection(sm.name, sm.forServer, ch)
+	sm.next = make(chan TransportConnection, 1)
+	c := NewReferenceTransportConnection(sm.name, sm.forServer, ch).(*ReferenceTransportConnection)
+	c.logger = sm.logger.get().With("connection", c.name)
+	sm.next <- c
+	sm.isRunning = true
 
 	mutex.Unlock()
 
@@ -269,7 +299,13 @@ func (sm *ReferenceTransport) Stop() Transport {
 		return sm
 	}
 
-	sm.connection.Close()
+	if sm.connection != nil {
+		sm.connection.Close()
+		sm.connection = nil
+	}
+
+	close(sm.next)
+	sm.isRunning = false
 
 	mutex.Lock()
 
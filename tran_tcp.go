@@ -6,11 +6,10 @@ package ustack
 
 import (
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,7 +17,12 @@ import (
 type TCPTransportConnection struct {
 	name   string
 	conn   net.Conn
-	closed bool
+	closed int32
+	done   chan struct{}
+	once   sync.Once
+	logger Logger
+	// for client, it is a redialed connection
+	reconnected bool
 }
 
 // NewTCPTransportConnection ...
@@ -26,7 +30,8 @@ func NewTCPTransportConnection(name string, conn net.Conn) TransportConnection {
 	return &TCPTransportConnection{
 		name:   name,
 		conn:   conn,
-		closed: false,
+		closed: 0,
+		done:   make(chan struct{}),
 	}
 }
 
@@ -37,15 +42,15 @@ func (c *TCPTransportConnection) GetName() string {
 
 // Read ...
 func (c *TCPTransportConnection) Read(p []byte) (n int, err error) {
-	if c.closed {
-		fmt.Println("read failed as connection", c.name, " is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("read on closed connection")
 		return 0, nil
 	}
 
 	n, err = c.conn.Read(p)
 	if err != nil {
 		if err != io.EOF {
-			fmt.Println("connection", c.name, "read failed:", err)
+			loggerOrSilent(c.logger).Warn("read failed", "error", err)
 		}
 	}
 
@@ -54,8 +59,8 @@ func (c *TCPTransportConnection) Read(p []byte) (n int, err error) {
 
 // Write ...
 func (c *TCPTransportConnection) Write(p []byte) (n int, err error) {
-	if c.closed {
-		fmt.Println("write failed as connection", c.name, " is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("write on closed connection")
 		return 0, nil
 	}
 
@@ -79,13 +84,32 @@ func (c *TCPTransportConnection) SetReference(p interface{}) error {
 
 // Close ...
 func (c *TCPTransportConnection) Close() {
-	c.closed = true
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.done)
+	})
 	c.conn.Close()
 }
 
 // Closed ...
 func (c *TCPTransportConnection) Closed() bool {
-	return c.closed
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// IsReconnected returns true if the client redialed the server for this
+// connection
+func (c *TCPTransportConnection) IsReconnected() bool {
+	return c.reconnected
+}
+
+// setReconnected ...
+func (c *TCPTransportConnection) setReconnected() {
+	c.reconnected = true
+}
+
+// closing returns a channel which is closed when the connection is closed
+func (c *TCPTransportConnection) closing() <-chan struct{} {
+	return c.done
 }
 
 // TCPTransport ...
@@ -98,11 +122,12 @@ type TCPTransport struct {
 	forServer   bool
 	connections []TransportConnection
 	next        chan TransportConnection
+	quit        chan struct{}
+	logger      *loggerValue
 	// for server
 	listener net.Listener
 	// for client
-	maxRetryCount         int
-	retryIntervalInSecond int
+	reconnect ReconnectPolicy
 }
 
 // NewTCPTransport ...
@@ -113,28 +138,32 @@ func NewTCPTransport(name string) Transport {
 		isRunning: false,
 		forServer: true,
 		listener:  nil,
+		logger:    newLoggerValue(),
 	}
 }
 
 // parseOptions ...
 func (t *TCPTransport) parseOptions() {
-	retry, exists := OptionParseInt(t.GetOption("MaxRetryCount"), 180)
-	t.maxRetryCount = retry
-	if exists {
-		fmt.Println("TCPTransport: option MaxRetryCount:", t.maxRetryCount)
-	}
-
-	interval, exists := OptionParseInt(t.GetOption("RetryIntervalInSecond"), 1)
-	t.retryIntervalInSecond = interval
-	if exists {
-		fmt.Println("TCPTransport: option RetryIntervalInSecond:", t.retryIntervalInSecond)
-	}
+	t.reconnect = parseReconnectPolicy(t, t.logger.get())
 }
 
 // doInit ...
 func (t *TCPTransport) doInit() {
 	t.connections = make([]TransportConnection, 0)
 	t.next = make(chan TransportConnection, 16)
+	t.quit = make(chan struct{})
+}
+
+// deliver passes the new connection to NextConnection, the connection
+// is closed if the transport is stopped in the meantime
+func (t *TCPTransport) deliver(tc TransportConnection) bool {
+	select {
+	case t.next <- tc:
+		return true
+	case <-t.quit:
+		tc.Close()
+		return false
+	}
 }
 
 // saveConnections ...
@@ -142,12 +171,17 @@ func (t *TCPTransport) saveConnection(tc TransportConnection) {
 	t.Lock()
 	defer t.Unlock()
 
+	// forget the closed ones, a reconnecting client makes many
+	connections := t.connections[:0]
 	for _, c := range t.connections {
 		if c == tc {
 			return
 		}
+		if !c.Closed() {
+			connections = append(connections, c)
+		}
 	}
-	t.connections = append(t.connections, tc)
+	t.connections = append(connections, tc)
 }
 
 // dropConnections ...
@@ -161,49 +195,55 @@ func (t *TCPTransport) dropConnections() {
 func (t *TCPTransport) accept() {
 	listener, err := net.Listen("tcp", t.address)
 	if err != nil {
-		log.Fatal(err)
+		t.logger.get().Error("listen failed", "error", err)
+		t.Stop()
+		return
 	}
 
+	t.Lock()
 	t.listener = listener
+	t.Unlock()
 
-	fmt.Println("Wait client connection ...")
+	t.logger.get().Info("wait client connection", "address", t.GetAddress())
 
 	for {
-		next, err := t.listener.Accept()
+		next, err := listener.Accept()
 		if err != nil {
 			break
 		}
 
-		t.next <- NewTCPTransportConnection(
-			next.RemoteAddr().String(),
-			next)
+		if !t.deliver(t.newConnection(next)) {
+			break
+		}
 	}
 
 	t.Stop()
 }
 
-// connect ...
+// connect dials the server, and redials it after the connection is
+// closed if Reconnect is enabled
 func (t *TCPTransport) connect() {
-	fmt.Println("Dial server ...")
+	t.logger.get().Info("dial server", "address", t.GetAddress())
 
-	for i := 0; i < t.maxRetryCount; i++ {
+	dial := func() (reconnectableConnection, error) {
 		connection, err := net.DialTimeout("tcp", t.address, time.Second)
-
-		if connection != nil && err == nil {
-			t.next <- NewTCPTransportConnection(
-				connection.RemoteAddr().String(),
-				connection)
-			return
+		if err != nil {
+			return nil, err
 		}
 
-		fmt.Println(err, "retry", i)
-
-		time.Sleep(time.Second * time.Duration(t.retryIntervalInSecond))
+		return t.newConnection(connection), nil
 	}
 
-	fmt.Println("Timeout to connect server")
+	if !t.reconnect.keepConnected(t.quit, dial, t.deliver, t.logger.get()) {
+		t.Stop()
+	}
+}
 
-	t.Stop()
+// newConnection returns the connection logging with the transport logger
+func (t *TCPTransport) newConnection(conn net.Conn) *TCPTransportConnection {
+	c := NewTCPTransportConnection(conn.RemoteAddr().String(), conn).(*TCPTransportConnection)
+	c.logger = t.logger.get().With("connection", c.name)
+	return c
 }
 
 // ForServer ...
@@ -242,11 +282,22 @@ func (t *TCPTransport) GetAddress() string {
 	return t.address
 }
 
-// NextConnection ...
+// SetLogger ...
+func (t *TCPTransport) SetLogger(logger Logger) Transport {
+	t.logger.set(loggerOrSilent(logger).With("transport", t.name))
+	return t
+}
+
+// NextConnection returns the next new connection, or nil once the
+// transport is stopped
 func (t *TCPTransport) NextConnection() TransportConnection {
-	next := <-t.next
-	t.saveConnection(next)
-	return next
+	select {
+	case next := <-t.next:
+		t.saveConnection(next)
+		return next
+	case <-t.quit:
+		return nil
+	}
 }
 
 // Run ...
@@ -285,7 +336,7 @@ func (t *TCPTransport) Stop() Transport {
 		t.listener = nil
 	}
 
-	close(t.next)
+	close(t.quit)
 
 	t.dropConnections()
 
@@ -0,0 +1,544 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLSTransportConnection ...
+type TLSTransportConnection struct {
+	name   string
+	conn   *tls.Conn
+	closed int32
+	done   chan struct{}
+	once   sync.Once
+	logger Logger
+	// for client, it is a redialed connection
+	reconnected bool
+}
+
+// NewTLSTransportConnection ...
+func NewTLSTransportConnection(name string, conn *tls.Conn) TransportConnection {
+	return &TLSTransportConnection{
+		name:   name,
+		conn:   conn,
+		closed: 0,
+		done:   make(chan struct{}),
+	}
+}
+
+// GetName ...
+func (c *TLSTransportConnection) GetName() string {
+	return c.name
+}
+
+// Read ...
+func (c *TLSTransportConnection) Read(p []byte) (n int, err error) {
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("read on closed connection")
+		return 0, nil
+	}
+
+	n, err = c.conn.Read(p)
+	if err != nil {
+		if err != io.EOF {
+			loggerOrSilent(c.logger).Warn("read failed", "error", err)
+		}
+	}
+
+	return n, err
+}
+
+// Write ...
+func (c *TLSTransportConnection) Write(p []byte) (n int, err error) {
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("write on closed connection")
+		return 0, nil
+	}
+
+	return c.conn.Write(p)
+}
+
+// UseReference ...
+func (c *TLSTransportConnection) UseReference() bool {
+	return false
+}
+
+// GetReference ...
+func (c *TLSTransportConnection) GetReference() (p interface{}, err error) {
+	return nil, errors.New("TLSTransportConnection:GetReference: does not support this call")
+}
+
+// SetReference ...
+func (c *TLSTransportConnection) SetReference(p interface{}) error {
+	return errors.New("TLSTransportConnection:SetReference: does not support this call")
+}
+
+// Close ...
+func (c *TLSTransportConnection) Close() {
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.done)
+	})
+	c.conn.Close()
+}
+
+// Closed ...
+func (c *TLSTransportConnection) Closed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// IsReconnected returns true if the client redialed the server for this
+// connection
+func (c *TLSTransportConnection) IsReconnected() bool {
+	return c.reconnected
+}
+
+// setReconnected ...
+func (c *TLSTransportConnection) setReconnected() {
+	c.reconnected = true
+}
+
+// closing returns a channel which is closed when the connection is closed
+func (c *TLSTransportConnection) closing() <-chan struct{} {
+	return c.done
+}
+
+// PeerCertificates returns the certificate chain presented by the peer,
+// the first one is the leaf certificate
+func (c *TLSTransportConnection) PeerCertificates() []*x509.Certificate {
+	return c.conn.ConnectionState().PeerCertificates
+}
+
+// VerifiedChains returns the chains built from the peer certificate to
+// the trusted CAs, it is empty if the peer was not verified
+func (c *TLSTransportConnection) VerifiedChains() [][]*x509.Certificate {
+	return c.conn.ConnectionState().VerifiedChains
+}
+
+// TLSTransport works like TCPTransport over crypto/tls. The typed options
+// have the string forms too, so they can be set by the configuration of
+// UStack.
+//
+// Options:
+//
+//	Certificate: tls.Certificate, the certificate presented to the peer
+//	CertFile, KeyFile: string, PEM files to load the certificate from
+//	CertPEM, KeyPEM: string, PEM blocks of the certificate
+//	CAPool: *x509.CertPool, CAs to verify the peer certificate
+//	CAFile: string, PEM file to load the CAs from
+//	CAPEM: string, PEM blocks of the CAs
+//	ClientAuth: tls.ClientAuthType or its name, for server, e.g.
+//	            RequireAndVerifyClientCert enables the mutual authentication
+//	ServerName: string, for client, the name to verify the server
+//	            certificate, the host of address by default
+//	HandshakeTimeoutInSecond: int, 10 by default
+//	MaxRetryCount, RetryIntervalInSecond, Reconnect.*: for client, see
+//	            ReconnectPolicy
+type TLSTransport struct {
+	name    string
+	options map[string]interface{}
+	sync.Mutex
+	address     string
+	isRunning   bool
+	forServer   bool
+	connections []TransportConnection
+	next        chan TransportConnection
+	quit        chan struct{}
+	logger      *loggerValue
+	config      *tls.Config
+	// for server
+	listener                 net.Listener
+	handshakeTimeoutInSecond int
+	// for client
+	reconnect ReconnectPolicy
+}
+
+// NewTLSTransport ...
+func NewTLSTransport(name string) Transport {
+	return &TLSTransport{
+		name:      name,
+		options:   make(map[string]interface{}),
+		isRunning: false,
+		forServer: true,
+		listener:  nil,
+		logger:    newLoggerValue(),
+	}
+}
+
+// parseOptions ...
+func (t *TLSTransport) parseOptions() {
+	timeout, exists := OptionParseInt(t.GetOption("HandshakeTimeoutInSecond"), 10)
+	t.handshakeTimeoutInSecond = timeout
+	if exists {
+		t.logger.get().Info("option", "HandshakeTimeoutInSecond", t.handshakeTimeoutInSecond)
+	}
+
+	t.reconnect = parseReconnectPolicy(t, t.logger.get())
+}
+
+// tlsClientAuthTypes are the names of ClientAuth option
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// parseClientAuth returns the ClientAuth option, by type or by name
+func parseClientAuth(option interface{}) (tls.ClientAuthType, error) {
+	switch value := option.(type) {
+	case nil:
+		return tls.NoClientCert, nil
+	case tls.ClientAuthType:
+		return value, nil
+	case string:
+		if clientAuth, ok := tlsClientAuthTypes[value]; ok {
+			return clientAuth, nil
+		}
+	}
+	return tls.NoClientCert, fmt.Errorf("TLSTransport: bad ClientAuth %v", option)
+}
+
+// loadCertificate returns the certificate of the options, nil if there
+// is none
+func (t *TLSTransport) loadCertificate() (*tls.Certificate, error) {
+	if certificate, ok := t.GetOption("Certificate").(tls.Certificate); ok {
+		return &certificate, nil
+	}
+
+	var certificate tls.Certificate
+	var err error
+
+	certPEM, hasCertPEM := OptionParseString(t.GetOption("CertPEM"), "")
+	keyPEM, hasKeyPEM := OptionParseString(t.GetOption("KeyPEM"), "")
+	certFile, hasCert := OptionParseString(t.GetOption("CertFile"), "")
+	keyFile, hasKey := OptionParseString(t.GetOption("KeyFile"), "")
+
+	switch {
+	case hasCertPEM && hasKeyPEM:
+		certificate, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	case hasCert && hasKey:
+		certificate, err = tls.LoadX509KeyPair(certFile, keyFile)
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// loadCAPool returns the CAs of the options, nil if there is none
+func (t *TLSTransport) loadCAPool() (*x509.CertPool, error) {
+	if pool, ok := t.GetOption("CAPool").(*x509.CertPool); ok {
+		return pool, nil
+	}
+
+	pem, source := []byte(nil), ""
+	if caPEM, exists := OptionParseString(t.GetOption("CAPEM"), ""); exists {
+		pem, source = []byte(caPEM), "CAPEM"
+	} else if caFile, exists := OptionParseString(t.GetOption("CAFile"), ""); exists {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pem, source = data, caFile
+	} else {
+		return nil, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("TLSTransport: no certificate found in " + source)
+	}
+	return pool, nil
+}
+
+// buildConfig makes the tls config with the options
+func (t *TLSTransport) buildConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	certificate, err := t.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{*certificate}
+	}
+
+	pool, err := t.loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.forServer {
+		if len(config.Certificates) == 0 {
+			return nil, errors.New("TLSTransport: server needs a certificate")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth, err = parseClientAuth(t.GetOption("ClientAuth"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		config.RootCAs = pool
+
+		serverName, exists := OptionParseString(t.GetOption("ServerName"), "")
+		if !exists {
+			host, _, err := net.SplitHostPort(t.address)
+			if err != nil {
+				return nil, err
+			}
+			serverName = host
+		}
+		config.ServerName = serverName
+	}
+
+	return config, nil
+}
+
+// doInit ...
+func (t *TLSTransport) doInit() {
+	t.connections = make([]TransportConnection, 0)
+	t.next = make(chan TransportConnection, 16)
+	t.quit = make(chan struct{})
+}
+
+// deliver passes the new connection to NextConnection, the connection
+// is closed if the transport is stopped in the meantime
+func (t *TLSTransport) deliver(tc TransportConnection) bool {
+	select {
+	case t.next <- tc:
+		return true
+	case <-t.quit:
+		tc.Close()
+		return false
+	}
+}
+
+// saveConnections ...
+func (t *TLSTransport) saveConnection(tc TransportConnection) {
+	t.Lock()
+	defer t.Unlock()
+
+	// forget the closed ones, a reconnecting client makes many
+	connections := t.connections[:0]
+	for _, c := range t.connections {
+		if c == tc {
+			return
+		}
+		if !c.Closed() {
+			connections = append(connections, c)
+		}
+	}
+	t.connections = append(connections, tc)
+}
+
+// dropConnections ...
+func (t *TLSTransport) dropConnections() {
+	for _, c := range t.connections {
+		c.Close()
+	}
+}
+
+// handshake verifies the peer before the connection is used, so a slow
+// or bad peer does not block the others
+func (t *TLSTransport) handshake(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second * time.Duration(t.handshakeTimeoutInSecond)))
+
+	err := conn.Handshake()
+	if err != nil {
+		t.logger.get().Warn("handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	t.deliver(t.newConnection(conn))
+}
+
+// accept ...
+func (t *TLSTransport) accept() {
+	listener, err := tls.Listen("tcp", t.address, t.config)
+	if err != nil {
+		t.logger.get().Error("listen failed", "error", err)
+		t.Stop()
+		return
+	}
+
+	t.Lock()
+	t.listener = listener
+	t.Unlock()
+
+	t.logger.get().Info("wait client connection", "address", t.GetAddress())
+
+	for {
+		next, err := listener.Accept()
+		if err != nil {
+			break
+		}
+
+		go t.handshake(next.(*tls.Conn))
+	}
+
+	t.Stop()
+}
+
+// connect dials the server, and redials it after the connection is
+// closed if Reconnect is enabled
+func (t *TLSTransport) connect() {
+	t.logger.get().Info("dial server", "address", t.GetAddress())
+
+	dialer := &net.Dialer{
+		Timeout: time.Second * time.Duration(t.handshakeTimeoutInSecond),
+	}
+
+	dial := func() (reconnectableConnection, error) {
+		connection, err := tls.DialWithDialer(dialer, "tcp", t.address, t.config)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.newConnection(connection), nil
+	}
+
+	if !t.reconnect.keepConnected(t.quit, dial, t.deliver, t.logger.get()) {
+		t.Stop()
+	}
+}
+
+// newConnection returns the connection logging with the transport logger
+func (t *TLSTransport) newConnection(conn *tls.Conn) *TLSTransportConnection {
+	c := NewTLSTransportConnection(conn.RemoteAddr().String(), conn).(*TLSTransportConnection)
+	c.logger = t.logger.get().With("connection", c.name)
+	return c
+}
+
+// ForServer ...
+func (t *TLSTransport) ForServer(forServer bool) Transport {
+	t.forServer = forServer
+	return t
+}
+
+// GetName ...
+func (t *TLSTransport) GetName() string {
+	return t.name
+}
+
+// SetOption ...
+func (t *TLSTransport) SetOption(name string, value interface{}) Transport {
+	t.options[name] = value
+	return t
+}
+
+// GetOption ...
+func (t *TLSTransport) GetOption(name string) interface{} {
+	if value, ok := t.options[name]; ok {
+		return value
+	}
+	return nil
+}
+
+// SetAddress ...
+func (t *TLSTransport) SetAddress(address string) Transport {
+	t.address = address
+	return t
+}
+
+// GetAddress ...
+func (t *TLSTransport) GetAddress() string {
+	return t.address
+}
+
+// SetLogger ...
+func (t *TLSTransport) SetLogger(logger Logger) Transport {
+	t.logger.set(loggerOrSilent(logger).With("transport", t.name))
+	return t
+}
+
+// NextConnection returns the next new connection, or nil once the
+// transport is stopped
+func (t *TLSTransport) NextConnection() TransportConnection {
+	select {
+	case next := <-t.next:
+		t.saveConnection(next)
+		return next
+	case <-t.quit:
+		return nil
+	}
+}
+
+// Run ...
+func (t *TLSTransport) Run() Transport {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.isRunning {
+		return t
+	}
+
+	t.isRunning = true
+
+	t.parseOptions()
+	t.doInit()
+
+	config, err := t.buildConfig()
+	if err != nil {
+		t.logger.get().Error("bad config", "error", err)
+		// NextConnection returns nil at once
+		close(t.quit)
+		t.isRunning = false
+		return t
+	}
+
+	t.config = config
+
+	if t.forServer {
+		go t.accept()
+	} else {
+		go t.connect()
+	}
+	return t
+}
+
+// Stop ...
+func (t *TLSTransport) Stop() Transport {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.isRunning {
+		return t
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+
+	close(t.quit)
+
+	t.dropConnections()
+
+	t.isRunning = false
+
+	return t
+}
@@ -0,0 +1,147 @@
+package ustack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns the PEM blocks of a self-signed certificate
+// of localhost and its key, the certificate is the CA of itself
+func newTestCertificate(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// newTLSTransportFromConfig returns the TLS transport of the config
+func newTLSTransportFromConfig(t *testing.T, role string, options map[string]interface{}) Transport {
+	config := &UStackConfig{
+		Name: "TLS",
+		Transports: []TransportConfig{
+			{Type: "TLS", Address: "127.0.0.1:23477", Role: role, Options: options},
+		},
+	}
+
+	// the options go through JSON as the config file
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack, err := NewUStackFromJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stack.GetTransport()[0]
+}
+
+func TestTLSTransportStringOptions(t *testing.T) {
+	serverCert, serverKey := newTestCertificate(t, "server")
+	clientCert, clientKey := newTestCertificate(t, "client")
+
+	server := newTLSTransportFromConfig(t, ConfigRoleServer, map[string]interface{}{
+		"CertPEM":    serverCert,
+		"KeyPEM":     serverKey,
+		"CAPEM":      clientCert,
+		"ClientAuth": "RequireAndVerifyClientCert",
+	}).Run()
+	defer server.Stop()
+
+	config := server.(*TLSTransport).config
+	if config == nil || config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Fatalf("unexpected server config %+v", config)
+	}
+
+	client := newTLSTransportFromConfig(t, ConfigRoleClient, map[string]interface{}{
+		"CertPEM": clientCert,
+		"KeyPEM":  clientKey,
+		"CAPEM":   serverCert,
+	}).Run()
+	defer client.Stop()
+
+	// the mutual authentication passes
+	sc := server.NextConnection()
+	cc := client.NextConnection()
+	if sc == nil || cc == nil {
+		t.Fatal("expect the connections")
+	}
+
+	if certs := sc.(*TLSTransportConnection).PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "client" {
+		t.Errorf("expect the client certificate")
+	}
+	if chains := cc.(*TLSTransportConnection).VerifiedChains(); len(chains) == 0 {
+		t.Errorf("expect the server verified")
+	}
+}
+
+func TestTLSTransportClientAuth(t *testing.T) {
+	cases := []struct {
+		option   interface{}
+		expected tls.ClientAuthType
+		bad      bool
+	}{
+		{nil, tls.NoClientCert, false},
+		{tls.VerifyClientCertIfGiven, tls.VerifyClientCertIfGiven, false},
+		{"RequireAnyClientCert", tls.RequireAnyClientCert, false},
+		{"RequireAndVerifyClientCert", tls.RequireAndVerifyClientCert, false},
+		{"requireandverifyclientcert", tls.NoClientCert, true},
+		{4, tls.NoClientCert, true},
+	}
+
+	for _, tc := range cases {
+		clientAuth, err := parseClientAuth(tc.option)
+		if clientAuth != tc.expected || (err != nil) != tc.bad {
+			t.Errorf("ClientAuth %v: expect %v, got %v, error %v", tc.option, tc.expected, clientAuth, err)
+		}
+	}
+
+	// the server does not run with the bad option
+	cert, key := newTestCertificate(t, "server")
+	server := newTLSTransportFromConfig(t, ConfigRoleServer, map[string]interface{}{
+		"CertPEM":    cert,
+		"KeyPEM":     key,
+		"ClientAuth": "Always",
+	}).Run()
+	defer server.Stop()
+
+	if server.NextConnection() != nil {
+		t.Errorf("expect no connection")
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPTransport carries datagrams, every Read returns one datagram and
+// every Write sends one datagram. A datagram larger than the buffer of
+// Read, which is MTU of the stack, is reported and dropped instead of
+// being truncated.
+//
+// The server side listens on one socket and creates a virtual connection
+// per remote address, so the peers can be handled like stream connections.
+// A virtual connection is closed if nothing is received from the peer
+// within the idle timeout.
+
+// UDPTransportConnection ...
+type UDPTransportConnection struct {
+	name   string
+	conn   *net.UDPConn
+	closed int32
+	// for server side virtual connection
+	remote     *net.UDPAddr
+	rx         chan []byte
+	done       chan struct{}
+	once       sync.Once
+	lastActive int64
+	onClose    func(c *UDPTransportConnection)
+	logger     Logger
+	// for client side connection, one byte more than the datagram read
+	// tells the datagram is too large
+	buffer []byte
+}
+
+// NewUDPTransportConnection returns a connection for a connected socket
+func NewUDPTransportConnection(name string, conn *net.UDPConn) TransportConnection {
+	return &UDPTransportConnection{
+		name:   name,
+		conn:   conn,
+		closed: 0,
+		done:   make(chan struct{}),
+	}
+}
+
+// newUDPVirtualConnection returns a server side connection for a peer
+func newUDPVirtualConnection(
+	conn *net.UDPConn,
+	remote *net.UDPAddr,
+	queueSize int,
+	onClose func(c *UDPTransportConnection)) *UDPTransportConnection {
+
+	return &UDPTransportConnection{
+		name:       remote.String(),
+		conn:       conn,
+		closed:     0,
+		remote:     remote,
+		rx:         make(chan []byte, queueSize),
+		done:       make(chan struct{}),
+		lastActive: time.Now().UnixNano(),
+		onClose:    onClose,
+	}
+}
+
+// GetName ...
+func (c *UDPTransportConnection) GetName() string {
+	return c.name
+}
+
+// Read ...
+func (c *UDPTransportConnection) Read(p []byte) (n int, err error) {
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("read on closed connection")
+		return 0, io.EOF
+	}
+
+	if c.remote == nil {
+		if len(c.buffer) < len(p)+1 {
+			c.buffer = make([]byte, len(p)+1)
+		}
+
+		for {
+			n, err = c.conn.Read(c.buffer[:len(p)+1])
+			if err != nil {
+				loggerOrSilent(c.logger).Warn("read failed", "error", err)
+				return n, err
+			}
+
+			if n <= len(p) {
+				return copy(p, c.buffer[:n]), nil
+			}
+			c.dropDatagram(n, len(p))
+		}
+	}
+
+	for {
+		select {
+		case datagram := <-c.rx:
+			if len(datagram) <= len(p) {
+				return copy(p, datagram), nil
+			}
+			c.dropDatagram(len(datagram), len(p))
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+}
+
+// dropDatagram reports the datagram which is too large to be read
+func (c *UDPTransportConnection) dropDatagram(size int, limit int) {
+	loggerOrSilent(c.logger).Error("datagram too large, drop it", "size", size, "limit", limit)
+}
+
+// Write ...
+func (c *UDPTransportConnection) Write(p []byte) (n int, err error) {
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("write on closed connection")
+		return 0, errors.New("UDPTransportConnection:Write: connection is closed")
+	}
+
+	if c.remote == nil {
+		return c.conn.Write(p)
+	}
+
+	return c.conn.WriteToUDP(p, c.remote)
+}
+
+// UseReference ...
+func (c *UDPTransportConnection) UseReference() bool {
+	return false
+}
+
+// GetReference ...
+func (c *UDPTransportConnection) GetReference() (p interface{}, err error) {
+	return nil, errors.New("UDPTransportConnection:GetReference: does not support this call")
+}
+
+// SetReference ...
+func (c *UDPTransportConnection) SetReference(p interface{}) error {
+	return errors.New("UDPTransportConnection:SetReference: does not support this call")
+}
+
+// Close ...
+func (c *UDPTransportConnection) Close() {
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.done)
+
+		// the socket of virtual connection is shared and owned by the
+		// transport
+		if c.remote == nil {
+			c.conn.Close()
+		}
+
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+}
+
+// Closed ...
+func (c *UDPTransportConnection) Closed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// received queues a datagram of the virtual connection, it is dropped if
+// the queue is full
+func (c *UDPTransportConnection) received(datagram []byte) {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+
+	select {
+	case c.rx <- datagram:
+	default:
+		loggerOrSilent(c.logger).Warn("queue is full, drop datagram")
+	}
+}
+
+// idle returns how long nothing is received
+func (c *UDPTransportConnection) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastActive))
+}
+
+// UDPTransport ...
+type UDPTransport struct {
+	name    string
+	options map[string]interface{}
+	sync.Mutex
+	address     string
+	isRunning   bool
+	forServer   bool
+	connections map[string]*UDPTransportConnection
+	next        chan TransportConnection
+	quit        chan struct{}
+	logger      *loggerValue
+	// for server
+	listener            *net.UDPConn
+	idleTimeoutInSecond int
+	maxQueueSize        int
+	// for client
+	maxRetryCount         int
+	retryIntervalInSecond int
+}
+
+// NewUDPTransport ...
+func NewUDPTransport(name string) Transport {
+	return &UDPTransport{
+		name:      name,
+		options:   make(map[string]interface{}),
+		isRunning: false,
+		forServer: true,
+		listener:  nil,
+		logger:    newLoggerValue(),
+	}
+}
+
+// parseOptions ...
+func (u *UDPTransport) parseOptions() {
+	idle, exists := OptionParseInt(u.GetOption("IdleTimeoutInSecond"), 60)
+	u.idleTimeoutInSecond = idle
+	if exists {
+		u.logger.get().Info("option", "IdleTimeoutInSecond", u.idleTimeoutInSecond)
+	}
+
+	size, exists := OptionParseInt(u.GetOption("MaxQueueSize"), 64)
+	u.maxQueueSize = size
+	if exists {
+		u.logger.get().Info("option", "MaxQueueSize", u.maxQueueSize)
+	}
+
+	retry, exists := OptionParseInt(u.GetOption("MaxRetryCount"), 180)
+	u.maxRetryCount = retry
+	if exists {
+		u.logger.get().Info("option", "MaxRetryCount", u.maxRetryCount)
+	}
+
+	interval, exists := OptionParseInt(u.GetOption("RetryIntervalInSecond"), 1)
+	u.retryIntervalInSecond = interval
+	if exists {
+		u.logger.get().Info("option", "RetryIntervalInSecond", u.retryIntervalInSecond)
+	}
+}
+
+// doInit ...
+func (u *UDPTransport) doInit() {
+	u.connections = make(map[string]*UDPTransportConnection)
+	u.next = make(chan TransportConnection, 16)
+	u.quit = make(chan struct{})
+}
+
+// deliver passes the new connection to NextConnection, the connection
+// is closed if the transport is stopped in the meantime
+func (u *UDPTransport) deliver(tc TransportConnection) bool {
+	select {
+	case u.next <- tc:
+		return true
+	case <-u.quit:
+		tc.Close()
+		return false
+	}
+}
+
+// dropConnection forgets the closed virtual connection
+func (u *UDPTransport) dropConnection(c *UDPTransportConnection) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.connections[c.name] == c {
+		delete(u.connections, c.name)
+	}
+}
+
+// dropConnections ...
+func (u *UDPTransport) dropConnections() {
+	connections := make([]*UDPTransportConnection, 0, len(u.connections))
+	for _, c := range u.connections {
+		connections = append(connections, c)
+	}
+
+	// Close calls back dropConnection which needs the lock
+	u.Unlock()
+	for _, c := range connections {
+		c.Close()
+	}
+	u.Lock()
+}
+
+// findConnection returns the virtual connection of remote address, a new
+// one is created if not found
+func (u *UDPTransport) findConnection(listener *net.UDPConn, remote *net.UDPAddr) (*UDPTransportConnection, bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	c, ok := u.connections[remote.String()]
+	if ok {
+		return c, false
+	}
+
+	c = newUDPVirtualConnection(listener, remote, u.maxQueueSize, u.dropConnection)
+	c.logger = u.logger.get().With("connection", c.name)
+	u.connections[c.name] = c
+
+	return c, true
+}
+
+// expire closes the idle virtual connections
+func (u *UDPTransport) expire() {
+	timeout := time.Second * time.Duration(u.idleTimeoutInSecond)
+
+	for {
+		select {
+		case <-u.quit:
+			return
+		case <-time.After(time.Second):
+		}
+
+		u.Lock()
+		idles := make([]*UDPTransportConnection, 0)
+		for _, c := range u.connections {
+			if c.idle() > timeout {
+				idles = append(idles, c)
+			}
+		}
+		u.Unlock()
+
+		for _, c := range idles {
+			u.logger.get().Info("connection is idle, close it", "connection", c.GetName())
+			c.Close()
+		}
+	}
+}
+
+// accept ...
+func (u *UDPTransport) accept() {
+	addr, err := net.ResolveUDPAddr("udp", u.address)
+	if err != nil {
+		u.logger.get().Error("resolve address failed", "error", err)
+		u.Stop()
+		return
+	}
+
+	listener, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		u.logger.get().Error("listen failed", "error", err)
+		u.Stop()
+		return
+	}
+
+	u.Lock()
+	u.listener = listener
+	u.Unlock()
+
+	if u.idleTimeoutInSecond > 0 {
+		go u.expire()
+	}
+
+	u.logger.get().Info("wait client datagram", "address", u.GetAddress())
+
+	buffer := make([]byte, 65535)
+
+	for {
+		n, remote, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+
+		c, isNew := u.findConnection(listener, remote)
+
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+		c.received(datagram)
+
+		if isNew && !u.deliver(c) {
+			break
+		}
+	}
+
+	u.Stop()
+}
+
+// connect ...
+func (u *UDPTransport) connect() {
+	u.logger.get().Info("dial server", "address", u.GetAddress())
+
+	for i := 0; i < u.maxRetryCount; i++ {
+		addr, err := net.ResolveUDPAddr("udp", u.address)
+		if err == nil {
+			var connection *net.UDPConn
+			connection, err = net.DialUDP("udp", nil, addr)
+			if err == nil {
+				c := NewUDPTransportConnection(
+					connection.RemoteAddr().String(),
+					connection).(*UDPTransportConnection)
+				c.onClose = u.dropConnection
+				c.logger = u.logger.get().With("connection", c.name)
+
+				u.Lock()
+				u.connections[c.name] = c
+				u.Unlock()
+
+				u.deliver(c)
+				return
+			}
+		}
+
+		u.logger.get().Warn("dial failed", "error", err, "retry", i)
+
+		select {
+		case <-u.quit:
+			return
+		case <-time.After(time.Second * time.Duration(u.retryIntervalInSecond)):
+		}
+	}
+
+	u.logger.get().Error("timeout to connect server")
+
+	u.Stop()
+}
+
+// ForServer ...
+func (u *UDPTransport) ForServer(forServer bool) Transport {
+	u.forServer = forServer
+	return u
+}
+
+// GetName ...
+func (u *UDPTransport) GetName() string {
+	return u.name
+}
+
+// SetOption ...
+func (u *UDPTransport) SetOption(name string, value interface{}) Transport {
+	u.options[name] = value
+	return u
+}
+
+// GetOption ...
+func (u *UDPTransport) GetOption(name string) interface{} {
+	if value, ok := u.options[name]; ok {
+		return value
+	}
+	return nil
+}
+
+// SetAddress ...
+func (u *UDPTransport) SetAddress(address string) Transport {
+	u.address = address
+	return u
+}
+
+// GetAddress ...
+func (u *UDPTransport) GetAddress() string {
+	return u.address
+}
+
+// SetLogger ...
+func (u *UDPTransport) SetLogger(logger Logger) Transport {
+	u.logger.set(loggerOrSilent(logger).With("transport", u.name))
+	return u
+}
+
+// NextConnection returns the next new connection, or nil once the
+// transport is stopped
+func (u *UDPTransport) NextConnection() TransportConnection {
+	select {
+	case next := <-u.next:
+		return next
+	case <-u.quit:
+		return nil
+	}
+}
+
+// Run ...
+func (u *UDPTransport) Run() Transport {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.isRunning {
+		return u
+	}
+
+	u.isRunning = true
+
+	u.parseOptions()
+	u.doInit()
+
+	if u.forServer {
+		go u.accept()
+	} else {
+		go u.connect()
+	}
+	return u
+}
+
+// Stop ...
+func (u *UDPTransport) Stop() Transport {
+	u.Lock()
+	defer u.Unlock()
+
+	if !u.isRunning {
+		return u
+	}
+
+	close(u.quit)
+
+	u.dropConnections()
+
+	if u.listener != nil {
+		u.listener.Close()
+		u.listener = nil
+	}
+
+	u.isRunning = false
+
+	return u
+}
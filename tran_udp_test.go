@@ -0,0 +1,112 @@
+package ustack
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readDatagram reads c in background, the result is sent to results
+func readDatagram(c TransportConnection, size int, results chan string) {
+	go func() {
+		p := make([]byte, size)
+		n, err := c.Read(p)
+		if err != nil {
+			results <- err.Error()
+			return
+		}
+		results <- string(p[:n])
+	}()
+}
+
+func expectDatagram(t *testing.T, results chan string, expected string) {
+	select {
+	case result := <-results:
+		if result != expected {
+			t.Fatalf("expect %q, got %q", expected, result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expect %q", expected)
+	}
+}
+
+func TestUDPTransportOversizedDatagram(t *testing.T) {
+	const address = "127.0.0.1:23476"
+
+	log := &bytes.Buffer{}
+	server := NewUDPTransport("UDP").
+		SetAddress(address).
+		SetLogger(NewTextLogger(log, LogLevelError)).
+		Run()
+	defer server.Stop()
+
+	// wait for the server listening
+	listening := func() bool {
+		u := server.(*UDPTransport)
+		u.Lock()
+		defer u.Unlock()
+		return u.listener != nil
+	}
+	for i := 0; i < 100 && !listening(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	addr, _ := net.ResolveUDPAddr("udp", address)
+	client, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	large := strings.Repeat("x", 100)
+
+	t.Run("Server", func(t *testing.T) {
+		client.Write([]byte(large))
+		client.Write([]byte("small"))
+
+		c := server.NextConnection()
+		if c == nil {
+			t.Fatal("expect the connection of client")
+		}
+
+		results := make(chan string, 1)
+		readDatagram(c, 10, results)
+		expectDatagram(t, results, "small")
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewUDPTransportConnection("c", conn)
+		c.(*UDPTransportConnection).logger = NewTextLogger(log, LogLevelError)
+		defer c.Close()
+
+		remote := conn.LocalAddr().(*net.UDPAddr)
+		listener.WriteToUDP([]byte(large), remote)
+		listener.WriteToUDP([]byte("small"), remote)
+
+		results := make(chan string, 1)
+		readDatagram(c, 10, results)
+		expectDatagram(t, results, "small")
+
+		// exactly the size of buffer is not too large
+		listener.WriteToUDP([]byte("0123456789"), remote)
+		readDatagram(c, 10, results)
+		expectDatagram(t, results, "0123456789")
+	})
+
+	if n := strings.Count(log.String(), "datagram too large"); n != 2 {
+		t.Errorf("expect 2 datagrams reported, got %d:\n%s", n, log.String())
+	}
+}
@@ -6,12 +6,11 @@ package ustack
 
 import (
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,7 +18,12 @@ import (
 type UDSTransportConnection struct {
 	name   string
 	conn   net.Conn
-	closed bool
+	closed int32
+	done   chan struct{}
+	once   sync.Once
+	logger Logger
+	// for client, it is a redialed connection
+	reconnected bool
 }
 
 // NewUDSTransportConnection ...
@@ -27,7 +31,8 @@ func NewUDSTransportConnection(name string, conn net.Conn) TransportConnection {
 	return &UDSTransportConnection{
 		name:   name,
 		conn:   conn,
-		closed: false,
+		closed: 0,
+		done:   make(chan struct{}),
 	}
 }
 
@@ -38,15 +43,15 @@ func (c *UDSTransportConnection) GetName() string {
 
 // Read ...
 func (c *UDSTransportConnection) Read(p []byte) (n int, err error) {
-	if c.closed {
-		fmt.Println("read failed as connection", c.name, " is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("read on closed connection")
 		return 0, nil
 	}
 
 	n, err = c.conn.Read(p)
 	if err != nil {
 		if err != io.EOF {
-			fmt.Println("connection", c.name, "read failed:", err)
+			loggerOrSilent(c.logger).Warn("read failed", "error", err)
 		}
 	}
 
@@ -55,8 +60,8 @@ func (c *UDSTransportConnection) Read(p []byte) (n int, err error) {
 
 // Write ...
 func (c *UDSTransportConnection) Write(p []byte) (n int, err error) {
-	if c.closed {
-		fmt.Println("write failed as connection", c.name, " is closed")
+	if c.Closed() {
+		loggerOrSilent(c.logger).Warn("write on closed connection")
 		return 0, nil
 	}
 
@@ -80,13 +85,32 @@ func (c *UDSTransportConnection) SetReference(p interface{}) error {
 
 // Close ...
 func (c *UDSTransportConnection) Close() {
-	c.closed = true
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.done)
+	})
 	c.conn.Close()
 }
 
 // Closed ...
 func (c *UDSTransportConnection) Closed() bool {
-	return c.closed
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// IsReconnected returns true if the client redialed the server for this
+// connection
+func (c *UDSTransportConnection) IsReconnected() bool {
+	return c.reconnected
+}
+
+// setReconnected ...
+func (c *UDSTransportConnection) setReconnected() {
+	c.reconnected = true
+}
+
+// closing returns a channel which is closed when the connection is closed
+func (c *UDSTransportConnection) closing() <-chan struct{} {
+	return c.done
 }
 
 // UDSTransport ...
@@ -99,11 +123,12 @@ type UDSTransport struct {
 	forServer   bool
 	connections []TransportConnection
 	next        chan TransportConnection
+	quit        chan struct{}
+	logger      *loggerValue
 	// for server
 	listener net.Listener
 	// for client
-	maxRetryCount         int
-	retryIntervalInSecond int
+	reconnect ReconnectPolicy
 }
 
 // NewUDSTransport ...
@@ -114,28 +139,32 @@ func NewUDSTransport(name string) Transport {
 		isRunning: false,
 		forServer: true,
 		listener:  nil,
+		logger:    newLoggerValue(),
 	}
 }
 
 // parseOptions ...
 func (uds *UDSTransport) parseOptions() {
-	retry, exists := OptionParseInt(uds.GetOption("MaxRetryCount"), 180)
-	uds.maxRetryCount = retry
-	if exists {
-		fmt.Println("UDSTransport: option MaxRetryCount:", uds.maxRetryCount)
-	}
-
-	interval, exists := OptionParseInt(uds.GetOption("RetryIntervalInSecond"), 1)
-	uds.retryIntervalInSecond = interval
-	if exists {
-		fmt.Println("UDSTransport: option RetryIntervalInSecond:", uds.retryIntervalInSecond)
-	}
+	uds.reconnect = parseReconnectPolicy(uds, uds.logger.get())
 }
 
 // doInit ...
 func (uds *UDSTransport) doInit() {
 	uds.connections = make([]TransportConnection, 0)
 	uds.next = make(chan TransportConnection, 16)
+	uds.quit = make(chan struct{})
+}
+
+// deliver passes the new connection to NextConnection, the connection
+// is closed if the transport is stopped in the meantime
+func (uds *UDSTransport) deliver(tc TransportConnection) bool {
+	select {
+	case uds.next <- tc:
+		return true
+	case <-uds.quit:
+		tc.Close()
+		return false
+	}
 }
 
 // saveConnections ...
@@ -147,12 +176,17 @@ func (uds *UDSTransport) saveConnection(tc TransportConnection) {
 	uds.Lock()
 	defer uds.Unlock()
 
+	// forget the closed ones, a reconnecting client makes many
+	connections := uds.connections[:0]
 	for _, c := range uds.connections {
 		if c == tc {
 			return
 		}
+		if !c.Closed() {
+			connections = append(connections, c)
+		}
 	}
-	uds.connections = append(uds.connections, tc)
+	uds.connections = append(connections, tc)
 }
 
 // dropConnections ...
@@ -168,50 +202,57 @@ func (uds *UDSTransport) accept() {
 
 	listener, err := net.Listen("unix", uds.filename)
 	if err != nil {
-		log.Fatal(err)
+		uds.logger.get().Error("listen failed", "error", err)
+		uds.Stop()
+		return
 	}
 
 	defer os.Remove(uds.filename)
 
+	uds.Lock()
 	uds.listener = listener
+	uds.Unlock()
 
-	fmt.Println("Wait client connection ...")
+	uds.logger.get().Info("wait client connection", "address", uds.GetAddress())
 
 	for {
-		next, err := uds.listener.Accept()
+		next, err := listener.Accept()
 		if err != nil {
 			break
 		}
 
-		uds.next <- NewUDSTransportConnection(
-			next.RemoteAddr().String(),
-			next)
+		if !uds.deliver(uds.newConnection(next)) {
+			break
+		}
 	}
 
 	uds.Stop()
 }
 
-// connect ...
+// connect dials the server, and redials it after the connection is
+// closed if Reconnect is enabled
 func (uds *UDSTransport) connect() {
-	fmt.Println("Dial server ...")
+	uds.logger.get().Info("dial server", "address", uds.GetAddress())
 
-	for i := 0; i < uds.maxRetryCount; i++ {
+	dial := func() (reconnectableConnection, error) {
 		connection, err := net.DialTimeout("unix", uds.filename, time.Second)
-
-		if connection != nil && err == nil {
-			uds.next <- NewUDSTransportConnection(
-				connection.RemoteAddr().String(),
-				connection)
-			return
+		if err != nil {
+			return nil, err
 		}
 
-		fmt.Println(err, "retry", i+1)
+		return uds.newConnection(connection), nil
+	}
 
-		time.Sleep(time.Second * time.Duration(uds.retryIntervalInSecond))
+	if !uds.reconnect.keepConnected(uds.quit, dial, uds.deliver, uds.logger.get()) {
+		uds.Stop()
 	}
+}
 
-	fmt.Println("Timeout to connect server")
-	uds.Stop()
+// newConnection returns the connection logging with the transport logger
+func (uds *UDSTransport) newConnection(conn net.Conn) *UDSTransportConnection {
+	c := NewUDSTransportConnection(conn.RemoteAddr().String(), conn).(*UDSTransportConnection)
+	c.logger = uds.logger.get().With("connection", c.name)
+	return c
 }
 
 // ForServer ...
@@ -250,11 +291,22 @@ func (uds *UDSTransport) GetAddress() string {
 	return uds.filename
 }
 
-// NextConnection ...
+// SetLogger ...
+func (uds *UDSTransport) SetLogger(logger Logger) Transport {
+	uds.logger.set(loggerOrSilent(logger).With("transport", uds.name))
+	return uds
+}
+
+// NextConnection returns the next new connection, or nil once the
+// transport is stopped
 func (uds *UDSTransport) NextConnection() TransportConnection {
-	next := <-uds.next
-	uds.saveConnection(next)
-	return next
+	select {
+	case next := <-uds.next:
+		uds.saveConnection(next)
+		return next
+	case <-uds.quit:
+		return nil
+	}
 }
 
 // Run ...
@@ -293,7 +345,7 @@ func (uds *UDSTransport) Stop() Transport {
 		uds.listener = nil
 	}
 
-	close(uds.next)
+	close(uds.quit)
 
 	uds.dropConnections()
 
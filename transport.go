@@ -16,6 +16,12 @@ type TransportConnection interface {
 	Closed() bool
 }
 
+// Reconnectable is implemented by the connections of client transports
+// which can redial the server
+type Reconnectable interface {
+	IsReconnected() bool
+}
+
 // Transport ...
 type Transport interface {
 	GetName() string
@@ -24,6 +30,7 @@ type Transport interface {
 	ForServer(bool) Transport
 	SetAddress(address string) Transport
 	GetAddress() string
+	SetLogger(logger Logger) Transport
 	NextConnection() TransportConnection
 	Run() Transport
 	Stop() Transport
@@ -30,7 +30,6 @@ package ustack
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"sync/atomic"
@@ -184,7 +183,6 @@ func (ub *UBuf) resolveCopyOnWriteIfNeed() {
 		bytes:    make([]byte, ub.Capacity()),
 	}
 
-	fmt.Println("make COW")
 	copy(data.bytes[ub.readerIndex:ub.writerIndex], ub.data.bytes[ub.readerIndex:ub.writerIndex])
 
 	// update
@@ -4,6 +4,8 @@
 
 package ustack
 
+import "context"
+
 // Context ...
 type Context interface {
 	SetConnection(connection TransportConnection) Context
@@ -33,6 +35,11 @@ type UStack interface {
 	GetEndPoint() []EndPoint
 
 	AppendDataProcessor(dp DataProcessor) UStack
+	InsertDataProcessor(after string, dp DataProcessor) error
+	RemoveDataProcessor(name string) error
+	ReplaceDataProcessor(name string, dp DataProcessor) error
+	GetDataProcessor(name string) DataProcessor
+	GetDataProcessors() []DataProcessor
 
 	GetOverhead() int
 	GetMTU() int
@@ -40,9 +47,16 @@ type UStack interface {
 	AddTransport(tp Transport) UStack
 	DeleteTransport(tp Transport) UStack
 	GetTransport() []Transport
+	GetConnections() []TransportConnection
+
+	SetLogger(logger Logger) UStack
+	GetLogger() Logger
 
 	SetEventListener(listener func(Event)) UStack
 	PublishEvent(event Event) UStack
 
+	GetMetrics() *MetricsRegistry
+
 	Run() UStack
+	Stop(ctx context.Context) error
 }
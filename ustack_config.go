@@ -0,0 +1,258 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// UStackConfig describes a stack, it is usually loaded from JSON or YAML:
+//
+//	{
+//	  "name": "Server",
+//	  "mtu": 4096,
+//	  "processors": [
+//	    {"type": "BytesCodec"},
+//	    {"type": "StatCounter", "options": {"Collect.IntervalInSecond": 5}},
+//	    {"type": "Heartbeat", "enable": false},
+//	    {"type": "FrameDecoder"}
+//	  ],
+//	  "transports": [
+//	    {"type": "TCP", "name": "tcpServer", "address": "0.0.0.0:1234", "role": "server"}
+//	  ],
+//	  "endpoints": [
+//	    {"name": "EP-0", "session": 0}
+//	  ]
+//	}
+//
+// The processors are appended in order, the type names are looked up in
+// the registry, see RegisterDataProcessor.
+type UStackConfig struct {
+	Name       string                 `json:"name" yaml:"name"`
+	MTU        int                    `json:"mtu" yaml:"mtu"`
+	Options    map[string]interface{} `json:"options" yaml:"options"`
+	Processors []ProcessorConfig      `json:"processors" yaml:"processors"`
+	Transports []TransportConfig      `json:"transports" yaml:"transports"`
+	Features   []FeatureConfig        `json:"features" yaml:"features"`
+	EndPoints  []EndPointConfig       `json:"endpoints" yaml:"endpoints"`
+}
+
+// ProcessorConfig ...
+type ProcessorConfig struct {
+	Type string `json:"type" yaml:"type"`
+	// the default name of the type is used if empty
+	Name string `json:"name" yaml:"name"`
+	// true by default
+	Enable *bool `json:"enable" yaml:"enable"`
+	// "server" or "client", "server" by default
+	Role    string                 `json:"role" yaml:"role"`
+	Options map[string]interface{} `json:"options" yaml:"options"`
+}
+
+// TransportConfig ...
+type TransportConfig struct {
+	Type    string `json:"type" yaml:"type"`
+	Name    string `json:"name" yaml:"name"`
+	Address string `json:"address" yaml:"address"`
+	// "server" or "client", "server" by default
+	Role    string                 `json:"role" yaml:"role"`
+	Options map[string]interface{} `json:"options" yaml:"options"`
+}
+
+// FeatureConfig ...
+type FeatureConfig struct {
+	Type    string                 `json:"type" yaml:"type"`
+	Name    string                 `json:"name" yaml:"name"`
+	Options map[string]interface{} `json:"options" yaml:"options"`
+}
+
+// EndPointConfig ...
+type EndPointConfig struct {
+	Name    string `json:"name" yaml:"name"`
+	Session int    `json:"session" yaml:"session"`
+}
+
+// the roles in config
+const (
+	ConfigRoleServer string = "server"
+	ConfigRoleClient string = "client"
+)
+
+// UnmarshalFn decodes a config document, json.Unmarshal and the
+// Unmarshal of YAML packages fit
+type UnmarshalFn func(data []byte, v interface{}) error
+
+// LoadUStackConfig decodes the config document with unmarshal,
+// json.Unmarshal is used if unmarshal is nil
+func LoadUStackConfig(data []byte, unmarshal UnmarshalFn) (*UStackConfig, error) {
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+
+	config := &UStackConfig{}
+	if err := unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// NewUStackFromJSON builds a stack from a JSON document, the stack is
+// not run
+func NewUStackFromJSON(data []byte) (UStack, error) {
+	config, err := LoadUStackConfig(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewUStackFromConfig(config)
+}
+
+// parseRole returns true for server
+func parseRole(role string) (bool, error) {
+	switch role {
+	case "", ConfigRoleServer:
+		return true, nil
+	case ConfigRoleClient:
+		return false, nil
+	}
+	return false, errors.New("unknown role: " + role)
+}
+
+// the integers float64 holds exactly
+const configMaxExactInteger = 1 << 53
+
+// normalizeOption converts the numbers decoded from JSON, which are
+// always float64, to int if they are integral and int holds them, so the
+// options parse
+func normalizeOption(value interface{}) interface{} {
+	f, ok := value.(float64)
+	if !ok {
+		return value
+	}
+
+	if f != math.Trunc(f) || f < -configMaxExactInteger || f > configMaxExactInteger {
+		return f
+	}
+
+	// int may be 32 bits
+	if i := int64(f); int64(int(i)) == i {
+		return int(i)
+	}
+	return f
+}
+
+// newTransportFromConfig makes the transport described by tc
+func newTransportFromConfig(tc *TransportConfig) (Transport, error) {
+	factory, ok := lookupTransport(tc.Type)
+	if !ok {
+		return nil, errors.New("unknown transport type: " + tc.Type)
+	}
+
+	forServer, err := parseRole(tc.Role)
+	if err != nil {
+		return nil, errors.New("transport " + tc.Name + ": " + err.Error())
+	}
+
+	name := tc.Name
+	if name == "" {
+		name = tc.Type
+	}
+
+	tp := factory(name).
+		ForServer(forServer).
+		SetAddress(tc.Address)
+	for name, value := range tc.Options {
+		tp.SetOption(name, normalizeOption(value))
+	}
+
+	return tp, nil
+}
+
+// NewUStackFromConfig builds a stack from config, the stack is not run
+func NewUStackFromConfig(config *UStackConfig) (UStack, error) {
+	if config == nil {
+		return nil, errors.New("UStackConfig: nil config")
+	}
+
+	u := NewUStack()
+
+	if config.Name != "" {
+		u.SetName(config.Name)
+	}
+
+	for name, value := range config.Options {
+		u.SetOption(name, normalizeOption(value))
+	}
+
+	if config.MTU > 0 {
+		u.SetOption("MTU", config.MTU)
+	}
+
+	for _, fc := range config.Features {
+		factory, ok := lookupFeature(fc.Type)
+		if !ok {
+			return nil, errors.New("UStackConfig: unknown feature type: " + fc.Type)
+		}
+
+		ft := factory()
+		if fc.Name != "" {
+			ft.SetName(fc.Name)
+		}
+		for name, value := range fc.Options {
+			ft.SetOption(name, normalizeOption(value))
+		}
+
+		u.AddFeature(ft)
+	}
+
+	for _, ec := range config.EndPoints {
+		name := ec.Name
+		if name == "" {
+			name = "EP-" + strconv.Itoa(ec.Session)
+		}
+
+		u.AddEndPoint(NewEndPoint(name, ec.Session))
+	}
+
+	for _, pc := range config.Processors {
+		factory, ok := lookupDataProcessor(pc.Type)
+		if !ok {
+			return nil, errors.New("UStackConfig: unknown processor type: " + pc.Type)
+		}
+
+		forServer, err := parseRole(pc.Role)
+		if err != nil {
+			return nil, errors.New("UStackConfig: processor " + pc.Type + ": " + err.Error())
+		}
+
+		dp := factory().ForServer(forServer)
+		if pc.Name != "" {
+			dp.SetName(pc.Name)
+		}
+		if pc.Enable != nil {
+			dp.SetEnable(*pc.Enable)
+		}
+		for name, value := range pc.Options {
+			dp.SetOption(name, normalizeOption(value))
+		}
+
+		u.AppendDataProcessor(dp)
+	}
+
+	for _, tc := range config.Transports {
+		tp, err := newTransportFromConfig(&tc)
+		if err != nil {
+			return nil, errors.New("UStackConfig: " + err.Error())
+		}
+
+		u.AddTransport(tp)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,223 @@
+package ustack
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUStackFromJSON(t *testing.T) {
+	stack, err := NewUStackFromJSON([]byte(`{
+	  "name": "Config",
+	  "mtu": 2048,
+	  "options": {"Custom": "value"},
+	  "processors": [
+	    {"type": "StringCodec"},
+	    {"type": "Heartbeat", "name": "HB", "enable": false, "role": "client",
+	     "options": {"Interval": "2s", "TimeoutInSecond": 5}},
+	    {"type": "LoadBalancer", "options": {"Weight": 0.5}},
+	    {"type": "FrameDecoder", "options": {"MaxFrameSize": 1024}}
+	  ],
+	  "transports": [
+	    {"type": "TCP", "name": "tcpClient", "address": "127.0.0.1:1234", "role": "client",
+	     "options": {"Reconnect": true}}
+	  ],
+	  "features": [
+	    {"type": "Management", "name": "Admin", "options": {"Address": "127.0.0.1:0"}}
+	  ],
+	  "endpoints": [
+	    {"name": "EP-Config", "session": 1},
+	    {"session": 3}
+	  ]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stack.GetName() != "Config" || stack.GetOption("MTU") != 2048 || stack.GetOption("Custom") != "value" {
+		t.Errorf("unexpected stack %s, MTU %v, Custom %v", stack.GetName(), stack.GetOption("MTU"), stack.GetOption("Custom"))
+	}
+
+	// the processors are appended in order
+	var names []string
+	for _, dp := range stack.GetDataProcessors() {
+		names = append(names, dp.GetName())
+	}
+	if strings.Join(names, ",") != "StringCodec,HB,LoadBalancer,FrameDecoder" {
+		t.Errorf("unexpected processors %v", names)
+	}
+
+	hb := stack.GetDataProcessor("HB").(*Heartbeat)
+	if hb.IsEnabled() || hb.forServer {
+		t.Errorf("expect the heartbeat disabled for client")
+	}
+
+	// the integral numbers are int, the others are kept as float64
+	if hb.GetOption("Interval") != "2s" || hb.GetOption("TimeoutInSecond") != 5 {
+		t.Errorf("unexpected heartbeat options %v", hb.GetOptions())
+	}
+	if weight := stack.GetDataProcessor("LoadBalancer").GetOption("Weight"); weight != 0.5 {
+		t.Errorf("unexpected weight %v", weight)
+	}
+	if size := stack.GetDataProcessor("FrameDecoder").GetOption("MaxFrameSize"); size != 1024 {
+		t.Errorf("unexpected MaxFrameSize %#v", size)
+	}
+
+	transports := stack.GetTransport()
+	if len(transports) != 1 {
+		t.Fatalf("expect 1 transport, got %d", len(transports))
+	}
+	tcp := transports[0].(*TCPTransport)
+	if tcp.GetName() != "tcpClient" || tcp.GetAddress() != "127.0.0.1:1234" || tcp.forServer || tcp.GetOption("Reconnect") != true {
+		t.Errorf("unexpected transport %s at %s", tcp.GetName(), tcp.GetAddress())
+	}
+
+	if ft := stack.GetFeature("Admin"); ft == nil || ft.GetOption("Address") != "127.0.0.1:0" {
+		t.Errorf("expect the feature Admin")
+	}
+
+	endpoints := stack.GetEndPoint()
+	if len(endpoints) != 2 {
+		t.Fatalf("expect 2 endpoints, got %d", len(endpoints))
+	}
+	for i, expected := range []string{"EP-Config", "EP-3"} {
+		if endpoints[i].GetName() != expected {
+			t.Errorf("expect endpoint %s, got %s", expected, endpoints[i].GetName())
+		}
+	}
+}
+
+func TestUStackConfigNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		value   float64
+		integer bool
+	}{
+		{5, true},
+		{-3, true},
+		{1.5, false},
+		{1 << 53, strconv.IntSize == 64},
+		{-(1 << 53), strconv.IntSize == 64},
+		{1 << 54, false},
+		{1e300, false},
+	} {
+		got := normalizeOption(tc.value)
+		if i, ok := got.(int); ok != tc.integer || (ok && float64(i) != tc.value) {
+			t.Errorf("unexpected option %v(%T) of %v", got, got, tc.value)
+		}
+	}
+}
+
+func TestUStackConfigErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"BadDocument", `{"name": `, "unexpected end"},
+		{"Processor", `{"processors": [{"type": "NoSuchProcessor"}]}`, "unknown processor type: NoSuchProcessor"},
+		{"ProcessorRole", `{"processors": [{"type": "Heartbeat", "role": "peer"}]}`, "unknown role: peer"},
+		{"Transport", `{"transports": [{"type": "QUIC"}]}`, "unknown transport type: QUIC"},
+		{"TransportRole", `{"transports": [{"type": "TCP", "name": "t", "role": "peer"}]}`, "transport t: unknown role: peer"},
+		{"Feature", `{"features": [{"type": "NoSuchFeature"}]}`, "unknown feature type: NoSuchFeature"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stack, err := NewUStackFromJSON([]byte(tc.config))
+			if err == nil || stack != nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expect error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	if _, err := NewUStackFromConfig(nil); err == nil {
+		t.Errorf("expect error of nil config")
+	}
+}
+
+func TestUStackConfigUnmarshal(t *testing.T) {
+	document := []byte("name: YAML")
+
+	// a YAML decoder fills the config by the yaml tags, the numbers are
+	// int already
+	unmarshal := func(data []byte, v interface{}) error {
+		if string(data) != string(document) {
+			t.Fatalf("unexpected document %q", data)
+		}
+
+		config := v.(*UStackConfig)
+		config.Name = "YAML"
+		config.Processors = []ProcessorConfig{
+			{Type: "FrameDecoder", Options: map[string]interface{}{"MaxFrameSize": 1024}},
+		}
+		return nil
+	}
+
+	config, err := LoadUStackConfig(document, unmarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack, err := NewUStackFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stack.GetName() != "YAML" || stack.GetDataProcessor("FrameDecoder").GetOption("MaxFrameSize") != 1024 {
+		t.Errorf("unexpected stack %s", stack.GetName())
+	}
+}
+
+func TestUStackRegistry(t *testing.T) {
+	t.Cleanup(func() {
+		factories.Lock()
+		delete(factories.processors, "TestCodec")
+		factories.Unlock()
+	})
+
+	// the data processors need arguments are registered by the user
+	RegisterDataProcessor("TestCodec", func() DataProcessor {
+		return NewFilter(func(context Context, toUpper bool) bool { return true })
+	})
+
+	processors, transports, features := RegisteredTypes()
+	for _, list := range [][]string{processors, transports, features} {
+		for i := 1; i < len(list); i++ {
+			if list[i-1] >= list[i] {
+				t.Fatalf("expect sorted types %v", list)
+			}
+		}
+	}
+
+	found := false
+	for _, name := range processors {
+		found = found || name == "TestCodec"
+	}
+	if !found {
+		t.Fatalf("expect TestCodec registered in %v", processors)
+	}
+
+	config, _ := json.Marshal(&UStackConfig{
+		Processors: []ProcessorConfig{{Type: "TestCodec", Name: "Codec"}},
+	})
+
+	stack, err := NewUStackFromJSON(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stack.GetDataProcessor("Codec").(*Filter); !ok {
+		t.Errorf("expect the processor made by the registered factory")
+	}
+
+	// a registered type is replaced
+	RegisterDataProcessor("TestCodec", NewStatCounter)
+
+	stack, err = NewUStackFromJSON(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stack.GetDataProcessor("Codec").(*StatCounter); !ok {
+		t.Errorf("expect the processor made by the replaced factory")
+	}
+}
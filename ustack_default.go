@@ -4,7 +4,12 @@
 
 package ustack
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
 
 const (
 	defaultMTU int = 2048
@@ -75,6 +80,20 @@ func (c *DefaultUStackContext) GetMessage() interface{} {
 	return c.message
 }
 
+// cloneContext returns a new context having the same connection and
+// options as context, the buffer and message are not copied
+func cloneContext(context Context) Context {
+	clone := NewUStackContext().SetConnection(context.GetConnection())
+
+	if c, ok := context.(*DefaultUStackContext); ok {
+		for name, value := range c.options {
+			clone.SetOption(name, value)
+		}
+	}
+
+	return clone
+}
+
 // DefaultUStack ...
 type DefaultUStack struct {
 	name       string
@@ -85,9 +104,17 @@ type DefaultUStack struct {
 	transports []Transport
 	upperDeck  DataProcessor
 	processors []DataProcessor
-	overhead   int
+	overhead   int32
 	lowerDeck  DataProcessor
 	listeners  []func(Event)
+	logger     *loggerValue
+	metrics    *MetricsRegistry
+	sync.Mutex
+	isRunning bool
+	// protects processors while they are changed at runtime
+	pipeline sync.RWMutex
+	// protects endpoints and transports while they are changed at runtime
+	registry sync.RWMutex
 }
 
 // NewUStack ...
@@ -104,6 +131,8 @@ func NewUStack() UStack {
 		overhead:   0,
 		lowerDeck:  nil,
 		listeners:  nil,
+		logger:     newLoggerValue(),
+		metrics:    NewMetricsRegistry().SetConstLabels(Labels{"ustack": "UStack"}),
 	}
 }
 
@@ -112,7 +141,7 @@ func (u *DefaultUStack) parseOptions() {
 	mtu, exists := OptionParseInt(u.GetOption("MTU"), defaultMTU)
 	u.mtu = mtu
 	if exists {
-		fmt.Println("UStack: option MTU:", u.mtu)
+		u.GetLogger().Info("option", "MTU", u.mtu)
 	}
 }
 
@@ -141,13 +170,34 @@ func (u *DefaultUStack) build() {
 
 	for i := 0; i < count; i++ {
 		u.processors[i].SetUStack(u)
-		u.overhead += u.processors[i].GetOverhead()
 	}
+
+	u.updateOverhead()
+}
+
+// getProcessors returns a snapshot of the data processors
+func (u *DefaultUStack) getProcessors() []DataProcessor {
+	u.pipeline.RLock()
+	defer u.pipeline.RUnlock()
+
+	processors := make([]DataProcessor, len(u.processors))
+	copy(processors, u.processors)
+	return processors
+}
+
+// updateOverhead sums the overhead of all data processors
+func (u *DefaultUStack) updateOverhead() {
+	overhead := 0
+	for _, dp := range u.getProcessors() {
+		overhead += dp.GetOverhead()
+	}
+	atomic.StoreInt32(&u.overhead, int32(overhead))
 }
 
 // SetName ...
 func (u *DefaultUStack) SetName(name string) UStack {
 	u.name = name
+	u.metrics.SetConstLabels(Labels{"ustack": name})
 	return u
 }
 
@@ -172,6 +222,8 @@ func (u *DefaultUStack) GetOption(name string) interface{} {
 
 // AddFeature ...
 func (u *DefaultUStack) AddFeature(feature Feature) UStack {
+	feature.SetUStack(u)
+	feature.SetLogger(u.GetLogger())
 	u.features = append(u.features, feature)
 	return u
 }
@@ -193,12 +245,16 @@ func (u *DefaultUStack) GetFeatures() []Feature {
 
 // AddEndPoint ...
 func (u *DefaultUStack) AddEndPoint(ep EndPoint) UStack {
+	u.registry.Lock()
 	for _, endpoint := range u.endpoints {
 		if endpoint == ep {
 			// was added
+			u.registry.Unlock()
 			return u
 		}
 	}
+	u.endpoints = append(u.endpoints, ep)
+	u.registry.Unlock()
 
 	u.PublishEvent(Event{
 		Type:   UStackEventEndpointAdded,
@@ -206,46 +262,292 @@ func (u *DefaultUStack) AddEndPoint(ep EndPoint) UStack {
 		Data:   ep,
 	})
 
-	u.endpoints = append(u.endpoints, ep)
+	u.registerEndPointMetrics(ep)
 	return u
 }
 
 // DeleteEndPoint ...
 func (u *DefaultUStack) DeleteEndPoint(ep EndPoint) UStack {
+	u.registry.Lock()
+	found := false
 	for i, endpoint := range u.endpoints {
-		if endpoint != ep {
-			continue
+		if endpoint == ep {
+			// delete
+			u.endpoints = append(u.endpoints[:i], u.endpoints[i+1:]...)
+			found = true
+			break
 		}
+	}
+	u.registry.Unlock()
 
-		u.PublishEvent(Event{
-			Type:   UStackEventEndpointDeleted,
-			Source: u,
-			Data:   ep,
-		})
+	if !found {
+		return u
+	}
 
-		// delete
-		u.endpoints = append(u.endpoints[:i], u.endpoints[i+1:]...)
+	u.PublishEvent(Event{
+		Type:   UStackEventEndpointDeleted,
+		Source: u,
+		Data:   ep,
+	})
 
-		break
-	}
+	u.unregisterEndPointMetrics(ep)
 
+	if closer, ok := ep.(EndPointCloser); ok {
+		closer.Close()
+	}
 	return u
 }
 
-// GetEndPoint ...
+// GetEndPoint returns a snapshot of the endpoints
 func (u *DefaultUStack) GetEndPoint() []EndPoint {
-	return u.endpoints
+	u.registry.RLock()
+	defer u.registry.RUnlock()
+
+	endpoints := make([]EndPoint, len(u.endpoints))
+	copy(endpoints, u.endpoints)
+	return endpoints
 }
 
-// AppendDataProcessor ...
+// AppendDataProcessor appends the data processor at the bottom, it is
+// inserted right above LowerDeck if the stack is running
 func (u *DefaultUStack) AppendDataProcessor(dp DataProcessor) UStack {
-	u.processors = append(u.processors, dp)
+	u.Lock()
+	defer u.Unlock()
+
+	u.insertDataProcessor(len(u.getProcessors()), dp)
 	return u
 }
 
+// GetDataProcessors returns the data processors from top to bottom
+func (u *DefaultUStack) GetDataProcessors() []DataProcessor {
+	return u.getProcessors()
+}
+
+// GetDataProcessor returns the first data processor with name, nil if
+// not found
+func (u *DefaultUStack) GetDataProcessor(name string) DataProcessor {
+	_, dp := u.findDataProcessor(name)
+	return dp
+}
+
+// findDataProcessor ...
+func (u *DefaultUStack) findDataProcessor(name string) (int, DataProcessor) {
+	for i, dp := range u.getProcessors() {
+		if dp.GetName() == name {
+			return i, dp
+		}
+	}
+	return -1, nil
+}
+
+// InsertDataProcessor inserts the data processor right below the one
+// named after, or at the top if after is empty. If the stack is running,
+// the data processor is run, it gets the states and the
+// UStackEventNewConnection of the alive connections, then it is linked
+// into the chain while the data is flowing.
+//
+// The data processors changing the data format, e.g. codecs or the ones
+// adding a header, must be inserted at both sides before any data is
+// sent, a transparent one like StatCounter can be inserted at one side
+// at any time.
+func (u *DefaultUStack) InsertDataProcessor(after string, dp DataProcessor) error {
+	u.Lock()
+	defer u.Unlock()
+
+	index := 0
+	if after != "" {
+		i, found := u.findDataProcessor(after)
+		if found == nil {
+			return errors.New("InsertDataProcessor: not found data processor " + after)
+		}
+		index = i + 1
+	}
+
+	u.insertDataProcessor(index, dp)
+	return nil
+}
+
+// RemoveDataProcessor unlinks the data processor named name from the
+// chain and stops it if the stack is running
+func (u *DefaultUStack) RemoveDataProcessor(name string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	index, dp := u.findDataProcessor(name)
+	if dp == nil {
+		return errors.New("RemoveDataProcessor: not found data processor " + name)
+	}
+
+	u.pipeline.Lock()
+	u.processors = append(u.processors[:index:index], u.processors[index+1:]...)
+	u.pipeline.Unlock()
+
+	if !u.isRunning {
+		return nil
+	}
+
+	// the data in flight still passes the removed one to its neighbours
+	upper, lower := dp.GetUpper(), dp.GetLower()
+	upper.SetLower(lower)
+	lower.SetUpper(upper)
+
+	// shrink after the headers are not written any more
+	u.updateOverhead()
+
+	dp.Stop()
+	u.unregisterMetrics(dp)
+
+	return nil
+}
+
+// ReplaceDataProcessor puts dp in place of the data processor named name,
+// the old one is stopped if the stack is running
+func (u *DefaultUStack) ReplaceDataProcessor(name string, dp DataProcessor) error {
+	u.Lock()
+	defer u.Unlock()
+
+	index, old := u.findDataProcessor(name)
+	if old == nil {
+		return errors.New("ReplaceDataProcessor: not found data processor " + name)
+	}
+
+	dp.SetLogger(u.GetLogger())
+
+	if !u.isRunning {
+		u.pipeline.Lock()
+		u.processors[index] = dp
+		u.pipeline.Unlock()
+		return nil
+	}
+
+	upper, lower := old.GetUpper(), old.GetLower()
+
+	u.prepareDataProcessor(dp, upper, lower)
+
+	// both are counted until the old one is unlinked
+	atomic.AddInt32(&u.overhead, int32(dp.GetOverhead()))
+
+	u.pipeline.Lock()
+	u.processors[index] = dp
+	u.pipeline.Unlock()
+
+	lower.SetUpper(dp)
+	upper.SetLower(dp)
+
+	u.updateOverhead()
+
+	old.Stop()
+	u.unregisterMetrics(old)
+
+	u.releaseClosedStates(dp)
+
+	return nil
+}
+
+// RestartDataProcessor stops and runs the data processor named name
+// again if the stack is running, so its options are parsed again
+func (u *DefaultUStack) RestartDataProcessor(name string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	_, dp := u.findDataProcessor(name)
+	if dp == nil {
+		return errors.New("RestartDataProcessor: not found data processor " + name)
+	}
+
+	if !u.isRunning {
+		return nil
+	}
+
+	dp.Stop()
+	dp.Run()
+
+	u.updateOverhead()
+
+	return nil
+}
+
+// insertDataProcessor inserts dp at index of processors, the caller
+// holds the lock
+func (u *DefaultUStack) insertDataProcessor(index int, dp DataProcessor) {
+	dp.SetLogger(u.GetLogger())
+
+	if !u.isRunning {
+		u.pipeline.Lock()
+		u.processors = append(u.processors[:index:index],
+			append([]DataProcessor{dp}, u.processors[index:]...)...)
+		u.pipeline.Unlock()
+		return
+	}
+
+	processors := u.getProcessors()
+
+	upper := u.upperDeck
+	if index > 0 {
+		upper = processors[index-1]
+	}
+
+	lower := u.lowerDeck
+	if index < len(processors) {
+		lower = processors[index]
+	}
+
+	u.prepareDataProcessor(dp, upper, lower)
+
+	u.pipeline.Lock()
+	u.processors = append(u.processors[:index:index],
+		append([]DataProcessor{dp}, u.processors[index:]...)...)
+	u.pipeline.Unlock()
+
+	// grow before the new headers are written
+	u.updateOverhead()
+
+	lower.SetUpper(dp)
+	upper.SetLower(dp)
+
+	u.releaseClosedStates(dp)
+}
+
+// prepareDataProcessor runs dp and tells it the alive connections before
+// it is linked into the running chain
+func (u *DefaultUStack) prepareDataProcessor(dp DataProcessor, upper DataProcessor, lower DataProcessor) {
+	dp.SetUStack(u)
+	dp.SetUpper(upper)
+	dp.SetLower(lower)
+	dp.Run()
+	u.registerMetrics(dp)
+
+	ld, ok := u.lowerDeck.(*LowerDeck)
+	if !ok {
+		return
+	}
+
+	holder, isHolder := dp.(connectionStateHolder)
+
+	for _, connection := range ld.getConnections() {
+		if isHolder {
+			holder.allocState(connection)
+		}
+
+		dp.OnEvent(Event{
+			Type:   UStackEventNewConnection,
+			Source: ld,
+			Data:   connection,
+		})
+	}
+}
+
+// releaseClosedStates drops the states of the connections closed while dp
+// was being inserted, it missed their UStackEventConnectionClosed
+func (u *DefaultUStack) releaseClosedStates(dp DataProcessor) {
+	if holder, ok := dp.(connectionStateHolder); ok {
+		holder.releaseClosedStates()
+	}
+}
+
 // GetOverhead returns all data processors overhead
 func (u *DefaultUStack) GetOverhead() int {
-	return u.overhead
+	return int(atomic.LoadInt32(&u.overhead))
 }
 
 // GetMTU returns maximum transmission unit size
@@ -255,12 +557,19 @@ func (u *DefaultUStack) GetMTU() int {
 
 // AddTransport ...
 func (u *DefaultUStack) AddTransport(tp Transport) UStack {
+	u.registry.Lock()
 	for _, transport := range u.transports {
 		if transport == tp {
 			// was added
+			u.registry.Unlock()
 			return u
 		}
 	}
+	u.transports = append(u.transports, tp)
+	u.registry.Unlock()
+
+	tp.SetLogger(u.GetLogger())
+	u.registerMetrics(tp)
 
 	u.PublishEvent(Event{
 		Type:   UStackEventTransportAdded,
@@ -268,35 +577,138 @@ func (u *DefaultUStack) AddTransport(tp Transport) UStack {
 		Data:   tp,
 	})
 
-	u.transports = append(u.transports, tp)
 	return u
 }
 
 // DeleteTransport ...
 func (u *DefaultUStack) DeleteTransport(tp Transport) UStack {
+	u.registry.Lock()
+	found := false
 	for i, transport := range u.transports {
-		if transport != tp {
-			continue
+		if transport == tp {
+			// delete
+			u.transports = append(u.transports[:i], u.transports[i+1:]...)
+			found = true
+			break
 		}
+	}
+	u.registry.Unlock()
 
-		// delete
-		u.transports = append(u.transports[:i], u.transports[i+1:]...)
+	if !found {
+		return u
+	}
 
-		u.PublishEvent(Event{
-			Type:   UStackEventTransportDeleted,
-			Source: u,
-			Data:   tp,
-		})
+	u.PublishEvent(Event{
+		Type:   UStackEventTransportDeleted,
+		Source: u,
+		Data:   tp,
+	})
+
+	u.unregisterMetrics(tp)
+	return u
+}
 
-		break
+// GetTransport returns a snapshot of the transports
+func (u *DefaultUStack) GetTransport() []Transport {
+	u.registry.RLock()
+	defer u.registry.RUnlock()
+
+	transports := make([]Transport, len(u.transports))
+	copy(transports, u.transports)
+	return transports
+}
+
+// GetConnections returns the alive connections of all transports
+func (u *DefaultUStack) GetConnections() []TransportConnection {
+	if ld, ok := u.lowerDeck.(*LowerDeck); ok {
+		return ld.getConnections()
 	}
+	return nil
+}
+
+// SetLogger set the logger of the stack, it is passed to all the data
+// processors, transports and features, the silent logger is used if
+// logger is nil
+func (u *DefaultUStack) SetLogger(logger Logger) UStack {
+	u.logger.set(logger)
+	u.propagateLogger()
 
 	return u
 }
 
-// GetTransport ...
-func (u *DefaultUStack) GetTransport() []Transport {
-	return u.transports
+// propagateLogger passes the logger to all the components
+func (u *DefaultUStack) propagateLogger() {
+	logger := u.GetLogger()
+
+	for _, ft := range u.features {
+		ft.SetLogger(logger)
+	}
+	for _, tp := range u.GetTransport() {
+		tp.SetLogger(logger)
+	}
+	if u.upperDeck != nil {
+		u.upperDeck.SetLogger(logger)
+	}
+	for _, dp := range u.getProcessors() {
+		dp.SetLogger(logger)
+	}
+	if u.lowerDeck != nil {
+		u.lowerDeck.SetLogger(logger)
+	}
+}
+
+// GetLogger returns the logger of the stack with field stack
+func (u *DefaultUStack) GetLogger() Logger {
+	return u.logger.get().With("stack", u.name)
+}
+
+// GetMetrics returns the metrics registry of the stack, the samples are
+// labeled with "ustack" by the name of stack
+func (u *DefaultUStack) GetMetrics() *MetricsRegistry {
+	return u.metrics
+}
+
+// registerMetrics lets the component register its metrics if it is a
+// MetricsCollector
+func (u *DefaultUStack) registerMetrics(component interface{}) {
+	if collector, ok := component.(MetricsCollector); ok {
+		collector.RegisterMetrics(u.metrics)
+	}
+}
+
+// unregisterMetrics lets the component unregister its metrics if it is a
+// MetricsCollector, the processing errors of data processor are deleted
+// as well
+func (u *DefaultUStack) unregisterMetrics(component interface{}) {
+	if collector, ok := component.(MetricsCollector); ok {
+		collector.UnregisterMetrics(u.metrics)
+	}
+
+	if base, ok := component.(interface {
+		unregisterErrorMetrics(registry *MetricsRegistry)
+	}); ok {
+		base.unregisterErrorMetrics(u.metrics)
+	}
+}
+
+// registerEndPointMetrics registers the queue lengths of the endpoint
+func (u *DefaultUStack) registerEndPointMetrics(ep EndPoint) {
+	u.metrics.GaugeFunc("ustack_endpoint_queue_length", "The number of data in the endpoint queue.",
+		Labels{"endpoint": ep.GetName(), "queue": "rx"},
+		func() float64 { return float64(len(ep.GetRxChannel())) })
+	u.metrics.GaugeFunc("ustack_endpoint_queue_length", "The number of data in the endpoint queue.",
+		Labels{"endpoint": ep.GetName(), "queue": "tx"},
+		func() float64 { return float64(len(ep.GetTxChannel())) })
+
+	u.registerMetrics(ep)
+}
+
+// unregisterEndPointMetrics ...
+func (u *DefaultUStack) unregisterEndPointMetrics(ep EndPoint) {
+	u.metrics.Unregister("ustack_endpoint_queue_length", Labels{"endpoint": ep.GetName(), "queue": "rx"})
+	u.metrics.Unregister("ustack_endpoint_queue_length", Labels{"endpoint": ep.GetName(), "queue": "tx"})
+
+	u.unregisterMetrics(ep)
 }
 
 // SetEventListener ...
@@ -307,39 +719,139 @@ func (u *DefaultUStack) SetEventListener(listener func(Event)) UStack {
 
 // PublishEvent ...
 func (u *DefaultUStack) PublishEvent(event Event) UStack {
+	// states are ready before anyone knows the new connection
+	if event.Type == UStackEventNewConnection {
+		u.updateConnectionStates(event.Data, true)
+	}
+
 	for _, listener := range u.listeners {
 		listener(event)
 	}
-	for _, endpoint := range u.endpoints {
+	for _, endpoint := range u.GetEndPoint() {
 		endpoint.OnEvent(event)
 	}
 	if u.upperDeck != nil {
 		u.upperDeck.OnEvent(event)
 	}
-	for _, processor := range u.processors {
+	for _, processor := range u.getProcessors() {
 		processor.OnEvent(event)
 	}
 	if u.lowerDeck != nil {
 		u.lowerDeck.OnEvent(event)
 	}
+
+	// states are kept until everyone knows the connection closed
+	if event.Type == UStackEventConnectionClosed {
+		u.updateConnectionStates(event.Data, false)
+	}
+
 	return u
 }
 
+// updateConnectionStates allocates or releases the per-connection states
+// of data processors
+func (u *DefaultUStack) updateConnectionStates(data interface{}, alloc bool) {
+	connection, ok := data.(TransportConnection)
+	if !ok {
+		return
+	}
+
+	for _, processor := range u.getProcessors() {
+		holder, ok := processor.(connectionStateHolder)
+		if !ok {
+			continue
+		}
+
+		if alloc {
+			holder.allocState(connection)
+		} else {
+			holder.releaseState(connection)
+		}
+	}
+}
+
 // Run ...
 func (u *DefaultUStack) Run() UStack {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.isRunning {
+		return u
+	}
+
+	u.isRunning = true
+
 	u.build()
 
+	// the names may be changed after the logger was set
+	u.propagateLogger()
+
 	for _, ft := range u.features {
 		ft.Run()
+		u.registerMetrics(ft)
 	}
 
 	u.upperDeck.Run()
 
-	for _, dp := range u.processors {
+	for _, dp := range u.getProcessors() {
 		dp.Run()
+		u.registerMetrics(dp)
 	}
 
+	u.registerMetrics(u.lowerDeck)
 	u.lowerDeck.Run()
 
 	return u
 }
+
+// Stop shuts the stack down gracefully: new connections are refused,
+// the pending data of endpoints is flushed through the processors, all
+// the connections are closed and the close events are published, then
+// it waits for all the routines to exit and closes the endpoints which
+// are EndPointCloser.
+// If ctx expires first, Stop returns its error and the shutdown goes on
+// in background.
+func (u *DefaultUStack) Stop(ctx context.Context) error {
+	u.Lock()
+	if !u.isRunning {
+		u.Unlock()
+		return nil
+	}
+	u.isRunning = false
+	u.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if ld, ok := u.lowerDeck.(*LowerDeck); ok {
+			ld.stopAccepting()
+		}
+
+		u.upperDeck.Stop()
+
+		u.lowerDeck.Stop()
+
+		for _, dp := range u.getProcessors() {
+			dp.Stop()
+		}
+
+		for _, ft := range u.features {
+			ft.Stop()
+		}
+
+		for _, ep := range u.GetEndPoint() {
+			if closer, ok := ep.(EndPointCloser); ok {
+				closer.Close()
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,324 @@
+package ustack
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUStackStop(t *testing.T) {
+	const count = 100
+
+	baseline := runtime.NumGoroutine()
+
+	var received int32
+	server := NewUStack().
+		SetName("StopServer").
+		AddEndPoint(
+			NewEndPoint("StopServer:EP-0", 0).
+				SetDataListener(func(ep EndPoint, epd EndPointData) {
+					atomic.AddInt32(&received, 1)
+				})).
+		AddTransport(
+			NewReferenceTransport("StopServer:TP").
+				ForServer(true).
+				SetAddress("TestUStackStop")).
+		Run()
+
+	connected := make(chan TransportConnection, 1)
+	closed := make(chan TransportConnection, 1)
+	ep := NewEndPoint("StopClient:EP-0", 0)
+	client := NewUStack().
+		SetName("StopClient").
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventNewConnection {
+				connected <- event.Data.(TransportConnection)
+			} else if event.Type == UStackEventConnectionClosed {
+				closed <- event.Data.(TransportConnection)
+			}
+		}).
+		AddEndPoint(ep).
+		AddTransport(
+			NewReferenceTransport("StopClient:TP").
+				ForServer(false).
+				SetAddress("TestUStackStop")).
+		Run()
+
+	connection := <-connected
+
+	for i := 0; i < count; i++ {
+		ep.GetTxChannel() <- NewEndPointData().
+			SetConnection(connection).
+			SetData(i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Stop(ctx); err != nil {
+		t.Fatal("Unexpected client stop error:", err)
+	}
+
+	select {
+	case c := <-closed:
+		if c != connection {
+			t.Fatal("Unexpected closed connection")
+		}
+	default:
+		t.Fatal("Connection closed event was not published")
+	}
+
+	if !connection.Closed() {
+		t.Fatal("Connection was not closed")
+	}
+
+	for i := 0; i < 50 && atomic.LoadInt32(&received) < count; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&received); n != count {
+		t.Fatal("Pending data was not flushed, received:", n)
+	}
+
+	if err := server.Stop(ctx); err != nil {
+		t.Fatal("Unexpected server stop error:", err)
+	}
+
+	// the data listener routine of the endpoint is owned by the user
+	for i := 0; i < 50 && runtime.NumGoroutine() > baseline+1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > baseline+1 {
+		t.Fatal("Routines leaked, baseline:", baseline, "now:", n)
+	}
+}
+
+func TestUStackProcessingError(t *testing.T) {
+	failed := make(chan *ProcessingError, 1)
+	others := make(chan *ProcessingError, 1)
+
+	epd := NewEndPointData().SetData(make(chan int))
+	ep := NewEndPoint("ErrorClient:EP-0", 0).
+		SetEventListener(func(ep EndPoint, event Event) {
+			if event.Type == UStackEventProcessingError {
+				failed <- event.Data.(*ProcessingError)
+			}
+		})
+	other := NewEndPoint("ErrorClient:EP-1", 1).
+		SetEventListener(func(ep EndPoint, event Event) {
+			if event.Type == UStackEventProcessingError {
+				others <- event.Data.(*ProcessingError)
+			}
+		})
+
+	stack := NewUStack().
+		SetName("ErrorClient").
+		AddEndPoint(ep).
+		AddEndPoint(other).
+		AppendDataProcessor(NewJSONCodec(reflect.TypeOf(0))).
+		AppendDataProcessor(NewSessionResolver()).
+		Run()
+
+	ep.GetTxChannel() <- epd
+
+	select {
+	case perr := <-failed:
+		if perr.Processor != "JSONCodec" || perr.Direction != DataDirectionDown {
+			t.Fatal("Unexpected error source:", perr)
+		}
+		if perr.EndPointData != epd {
+			t.Fatal("Unexpected endpoint data")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Processing error was not published")
+	}
+
+	// the data without connection is dropped by LowerDeck
+	ep.GetTxChannel() <- NewEndPointData().SetData(1)
+
+	select {
+	case perr := <-failed:
+		if perr.Processor != "LowerDeck" || !errors.Is(perr, ErrNoConnection) {
+			t.Fatal("Unexpected error:", perr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Processing error was not published")
+	}
+
+	select {
+	case <-others:
+		t.Fatal("Error was published to the endpoint not sending the data")
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := stack.Stop(ctx); err != nil {
+		t.Fatal("Unexpected stop error:", err)
+	}
+}
+
+// countingProcessor counts the data passing through
+type countingProcessor struct {
+	ProcBase
+	down int32
+	up   int32
+}
+
+func newCountingProcessor(name string) DataProcessor {
+	cp := &countingProcessor{
+		ProcBase: NewProcBaseInstance(name),
+	}
+	return cp.ProcBase.SetWhere(cp)
+}
+
+func (cp *countingProcessor) OnUpperData(context Context) {
+	atomic.AddInt32(&cp.down, 1)
+	cp.GetLower().OnUpperData(context)
+}
+
+func (cp *countingProcessor) OnLowerData(context Context) {
+	atomic.AddInt32(&cp.up, 1)
+	cp.GetUpper().OnLowerData(context)
+}
+
+func TestUStackInsertRemoveDataProcessor(t *testing.T) {
+	const count = 10
+
+	var received int32
+	server := NewUStack().
+		SetName("InsertServer").
+		AddEndPoint(
+			NewEndPoint("InsertServer:EP-0", 0).
+				SetDataListener(func(ep EndPoint, epd EndPointData) {
+					atomic.AddInt32(&received, 1)
+				})).
+		AppendDataProcessor(newCountingProcessor("Top")).
+		AppendDataProcessor(newCountingProcessor("Bottom")).
+		AddTransport(
+			NewReferenceTransport("InsertServer:TP").
+				ForServer(true).
+				SetAddress("TestUStackInsertRemoveDataProcessor")).
+		Run()
+
+	connected := make(chan TransportConnection, 1)
+	ep := NewEndPoint("InsertClient:EP-0", 0)
+	client := NewUStack().
+		SetName("InsertClient").
+		SetEventListener(func(event Event) {
+			if event.Type == UStackEventNewConnection {
+				connected <- event.Data.(TransportConnection)
+			}
+		}).
+		AddEndPoint(ep).
+		AddTransport(
+			NewReferenceTransport("InsertClient:TP").
+				ForServer(false).
+				SetAddress("TestUStackInsertRemoveDataProcessor")).
+		Run()
+
+	connection := <-connected
+
+	send := func(expected int32) {
+		for i := 0; i < count; i++ {
+			ep.GetTxChannel() <- NewEndPointData().
+				SetConnection(connection).
+				SetData(i)
+		}
+		for i := 0; i < 100 && atomic.LoadInt32(&received) < expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&received); n != expected {
+			t.Fatal("Unexpected received:", n, "expected:", expected)
+		}
+	}
+
+	send(count)
+
+	capture := newCountingProcessor("Capture").(*countingProcessor)
+	if err := server.InsertDataProcessor("Top", capture); err != nil {
+		t.Fatal("Unexpected insert error:", err)
+	}
+	if err := server.InsertDataProcessor("NotExists", newCountingProcessor("X")); err == nil {
+		t.Fatal("Expected insert error")
+	}
+
+	names := []string{}
+	for _, dp := range server.GetDataProcessors() {
+		names = append(names, dp.GetName())
+	}
+	if !reflect.DeepEqual(names, []string{"Top", "Capture", "Bottom"}) {
+		t.Fatal("Unexpected data processors:", names)
+	}
+
+	send(2 * count)
+
+	if n := atomic.LoadInt32(&capture.up); n != count {
+		t.Fatal("Inserted data processor got:", n)
+	}
+
+	if err := server.RemoveDataProcessor("Capture"); err != nil {
+		t.Fatal("Unexpected remove error:", err)
+	}
+
+	send(3 * count)
+
+	if n := atomic.LoadInt32(&capture.up); n != count {
+		t.Fatal("Removed data processor got:", n)
+	}
+
+	top := server.GetDataProcessor("Top").(*countingProcessor)
+	if n := atomic.LoadInt32(&top.up); n != 3*count {
+		t.Fatal("Top data processor got:", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client.Stop(ctx)
+	server.Stop(ctx)
+}
+
+func TestUStackAddDeleteEndPointConcurrently(t *testing.T) {
+	stack := NewUStack().
+		SetName("Concurrent").
+		AddEndPoint(NewEndPoint("Concurrent:EP-0", 0)).
+		Run()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ep := NewEndPoint("Concurrent:EP-1", 1)
+			stack.AddEndPoint(ep)
+			tp := NewReferenceTransport("Concurrent:TP").SetAddress("TestUStackAddDeleteEndPointConcurrently")
+			stack.AddTransport(tp)
+			stack.DeleteTransport(tp)
+			stack.DeleteEndPoint(ep)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		// nobody handles the event, it ranges the endpoints only
+		stack.PublishEvent(Event{Type: -1, Source: stack})
+	}
+	<-done
+
+	if eps := stack.GetEndPoint(); len(eps) != 1 || eps[0].GetName() != "Concurrent:EP-0" {
+		t.Fatal("Unexpected endpoints:", eps)
+	}
+	if tps := stack.GetTransport(); len(tps) != 0 {
+		t.Fatal("Unexpected transports:", tps)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stack.Stop(ctx)
+}
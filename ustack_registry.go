@@ -0,0 +1,150 @@
+// Copyright 2021 The godevsig Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ustack
+
+import (
+	"sort"
+	"sync"
+)
+
+// DataProcessorFactory returns a new data processor
+type DataProcessorFactory func() DataProcessor
+
+// TransportFactory returns a new transport with name
+type TransportFactory func(name string) Transport
+
+// FeatureFactory returns a new feature
+type FeatureFactory func() Feature
+
+// registry keeps the factories by type name, the config loader uses it
+// to build the stack
+type registry struct {
+	sync.Mutex
+	processors map[string]DataProcessorFactory
+	transports map[string]TransportFactory
+	features   map[string]FeatureFactory
+}
+
+var factories = &registry{
+	processors: make(map[string]DataProcessorFactory),
+	transports: make(map[string]TransportFactory),
+	features:   make(map[string]FeatureFactory),
+}
+
+// RegisterDataProcessor registers the factory of data processor type,
+// a registered type is replaced. The data processors need arguments,
+// e.g. JSONCodec, are registered by the user, like
+//
+//	RegisterDataProcessor("MessageCodec", func() DataProcessor {
+//		return NewJSONCodec(reflect.TypeOf(Message{}))
+//	})
+func RegisterDataProcessor(typeName string, factory DataProcessorFactory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factories.processors[typeName] = factory
+}
+
+// RegisterTransport registers the factory of transport type
+func RegisterTransport(typeName string, factory TransportFactory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factories.transports[typeName] = factory
+}
+
+// RegisterFeature registers the factory of feature type
+func RegisterFeature(typeName string, factory FeatureFactory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factories.features[typeName] = factory
+}
+
+// lookupDataProcessor ...
+func lookupDataProcessor(typeName string) (DataProcessorFactory, bool) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factory, ok := factories.processors[typeName]
+	return factory, ok
+}
+
+// lookupTransport ...
+func lookupTransport(typeName string) (TransportFactory, bool) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factory, ok := factories.transports[typeName]
+	return factory, ok
+}
+
+// lookupFeature ...
+func lookupFeature(typeName string) (FeatureFactory, bool) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	factory, ok := factories.features[typeName]
+	return factory, ok
+}
+
+// RegisteredTypes returns the sorted type names of registered data
+// processors, transports and features
+func RegisteredTypes() (processors []string, transports []string, features []string) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	for name := range factories.processors {
+		processors = append(processors, name)
+	}
+	for name := range factories.transports {
+		transports = append(transports, name)
+	}
+	for name := range factories.features {
+		features = append(features, name)
+	}
+
+	sort.Strings(processors)
+	sort.Strings(transports)
+	sort.Strings(features)
+
+	return processors, transports, features
+}
+
+func init() {
+	RegisterDataProcessor("BytesCodec", NewBytesCodec)
+	RegisterDataProcessor("StringCodec", NewStringCodec)
+	RegisterDataProcessor("Broker", NewBroker)
+	RegisterDataProcessor("Compressor", NewCompressor)
+	RegisterDataProcessor("Correlator", NewCorrelator)
+	RegisterDataProcessor("Discarder", NewDiscarder)
+	RegisterDataProcessor("Encryptor", NewEncryptor)
+	RegisterDataProcessor("Echo", NewEcho)
+	RegisterDataProcessor("Loopback", NewLoopback)
+	RegisterDataProcessor("Filter", func() DataProcessor { return NewFilter() })
+	RegisterDataProcessor("Fragmenter", NewFragmenter)
+	RegisterDataProcessor("Forwarder", func() DataProcessor { return NewForwarder() })
+	RegisterDataProcessor("FlowController", NewFlowController)
+	RegisterDataProcessor("FrameDecoder", NewFrameDecoder)
+	RegisterDataProcessor("DelimiterFramer", NewDelimiterFramer)
+	RegisterDataProcessor("LengthFieldFramer", NewLengthFieldFramer)
+	RegisterDataProcessor("COBSFramer", NewCOBSFramer)
+	RegisterDataProcessor("SLIPFramer", NewSLIPFramer)
+	RegisterDataProcessor("Heartbeat", NewHeartbeat)
+	RegisterDataProcessor("LoadBalancer", NewLoadBalancer)
+	RegisterDataProcessor("Multiplexer", NewMultiplexer)
+	RegisterDataProcessor("Outbox", NewOutbox)
+	RegisterDataProcessor("PubSub", NewPubSub)
+	RegisterDataProcessor("SessionResolver", NewSessionResolver)
+	RegisterDataProcessor("StatCounter", NewStatCounter)
+
+	RegisterTransport("TCP", NewTCPTransport)
+	RegisterTransport("TLS", NewTLSTransport)
+	RegisterTransport("UDP", NewUDPTransport)
+	RegisterTransport("UDS", NewUDSTransport)
+	RegisterTransport("Reference", NewReferenceTransport)
+
+	RegisterFeature("Management", func() Feature { return NewManagement(nil) })
+}
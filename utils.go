@@ -4,6 +4,11 @@
 
 package ustack
 
+import (
+	"sync"
+	"time"
+)
+
 func OptionParseByte(option interface{}, defaultValue byte) (value byte, exits bool) {
 	if option != nil {
 		value, ok := option.(byte)
@@ -34,6 +39,44 @@ func OptionParseBool(option interface{}, defaultValue bool) (value bool, exits b
 	return defaultValue, false
 }
 
+func OptionParseString(option interface{}, defaultValue string) (value string, exits bool) {
+	if option != nil {
+		value, ok := option.(string)
+		if ok {
+			return value, true
+		}
+	}
+	return defaultValue, false
+}
+
+func OptionParseFloat(option interface{}, defaultValue float64) (value float64, exits bool) {
+	if option != nil {
+		switch value := option.(type) {
+		case float64:
+			return value, true
+		case int:
+			return float64(value), true
+		}
+	}
+	return defaultValue, false
+}
+
+// OptionParseDuration accepts time.Duration or string like "1.5s"
+func OptionParseDuration(option interface{}, defaultValue time.Duration) (value time.Duration, exits bool) {
+	if option != nil {
+		switch value := option.(type) {
+		case time.Duration:
+			return value, true
+		case string:
+			d, err := time.ParseDuration(value)
+			if err == nil {
+				return d, true
+			}
+		}
+	}
+	return defaultValue, false
+}
+
 func OptionParseByteSlice(option interface{}) (value []byte, ok bool) {
 	if option != nil {
 		value, ok := option.([]byte)
@@ -43,3 +86,92 @@ func OptionParseByteSlice(option interface{}) (value []byte, ok bool) {
 	}
 	return nil, false
 }
+
+// routineGroup keeps track of the goroutines owned by a component so
+// that they can be asked to quit and be waited for when it stops
+type routineGroup struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	quit    chan struct{}
+	stopped bool
+}
+
+// newRoutineGroup returns a new instance
+func newRoutineGroup() *routineGroup {
+	return &routineGroup{
+		quit: make(chan struct{}),
+	}
+}
+
+// spawn runs fn in a new goroutine, nothing is done once the group
+// has been stopped
+func (rg *routineGroup) spawn(fn func()) bool {
+	rg.Lock()
+	defer rg.Unlock()
+
+	if rg.stopped {
+		return false
+	}
+
+	rg.wg.Add(1)
+	go func() {
+		defer rg.wg.Done()
+		fn()
+	}()
+
+	return true
+}
+
+// restart lets the stopped group spawn again, it is called when the
+// component runs, the goroutines of last run have exited by stop and wait
+func (rg *routineGroup) restart() {
+	rg.Lock()
+	defer rg.Unlock()
+
+	if !rg.stopped {
+		return
+	}
+
+	rg.stopped = false
+	rg.quit = make(chan struct{})
+}
+
+// sleep waits for the duration, returns false if the group is stopped
+// in the meantime
+func (rg *routineGroup) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-rg.quitting():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// quitting returns a channel which is closed when the group is stopped
+func (rg *routineGroup) quitting() <-chan struct{} {
+	rg.Lock()
+	defer rg.Unlock()
+
+	return rg.quit
+}
+
+// stop asks all the goroutines to quit
+func (rg *routineGroup) stop() {
+	rg.Lock()
+	defer rg.Unlock()
+
+	if rg.stopped {
+		return
+	}
+
+	rg.stopped = true
+	close(rg.quit)
+}
+
+// wait blocks until all the goroutines exit
+func (rg *routineGroup) wait() {
+	rg.wg.Wait()
+}